@@ -0,0 +1,249 @@
+package main
+
+import (
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/operations"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func registerAPIRoutes(r *mux.Router) {
+	api := r.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/games/{game_type}", gameInfoHandler).Methods(http.MethodGet)
+	api.HandleFunc("/games/{game_type}/local", localGameInfoHandler).Methods(http.MethodGet)
+	api.HandleFunc("/tasks", listTasksHandler).Methods(http.MethodGet)
+	api.HandleFunc("/tasks/install", installHandler).Methods(http.MethodPost)
+	api.HandleFunc("/tasks/repair", repairHandler).Methods(http.MethodPost)
+	api.HandleFunc("/tasks/update", updateHandler).Methods(http.MethodPost)
+	api.HandleFunc("/tasks/{id}", getTaskHandler).Methods(http.MethodGet)
+	api.HandleFunc("/tasks/{id}", cancelTaskHandler).Methods(http.MethodDelete)
+	api.HandleFunc("/tasks/{id}/pause", pauseTaskHandler).Methods(http.MethodPost)
+	api.HandleFunc("/tasks/{id}/resume", resumeTaskHandler).Methods(http.MethodPost)
+	api.HandleFunc("/tasks/{id}/limits", taskLimitsHandler).Methods(http.MethodPatch)
+	api.HandleFunc("/tasks/{id}/mirrors", taskMirrorsHandler).Methods(http.MethodGet)
+	api.HandleFunc("/ratelimit", getRateLimitHandler).Methods(http.MethodGet)
+	api.HandleFunc("/ratelimit", setRateLimitHandler).Methods(http.MethodPatch)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Failed to encode response:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string, details ...string) {
+	writeJSON(w, status, models.ErrorResponse{Error: message, Details: details})
+}
+
+// decodeRequest decodes a JSON body into v and runs struct tag validation.
+// It writes the error response itself and reports whether the handler may continue.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body", err.Error())
+		return false
+	}
+	if errs := models.Validate(v); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation failed", errs...)
+		return false
+	}
+	return true
+}
+
+func writeTaskResponse(w http.ResponseWriter, resp models.TaskResponse) {
+	if resp.Status == "failed" {
+		writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+func installHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.InstallRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	writeTaskResponse(w, operations.RunTask("install", req))
+}
+
+func repairHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.RepairRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	writeTaskResponse(w, operations.RunTask("repair", req))
+}
+
+func updateHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.UpdateRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	writeTaskResponse(w, operations.RunTask("update", req))
+}
+
+// gameInfoHandler reports the online version of a game, e.g. GET /api/games/hk4e?reltype=os
+func gameInfoHandler(w http.ResponseWriter, r *http.Request) {
+	gameType := mux.Vars(r)["game_type"]
+	relType := r.URL.Query().Get("reltype")
+	if relType == "" {
+		relType = "os"
+	}
+	query := struct {
+		GameType string `json:"game_type" validate:"oneof=hk4e nap hkrpg"`
+		RelType  string `json:"reltype" validate:"oneof=os cn"`
+	}{gameType, relType}
+	if errs := models.Validate(query); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation failed", errs...)
+		return
+	}
+
+	info := operations.GetOnlineGameInfo(r.Context(), gameType, relType)
+	if info.Error != nil {
+		writeJSON(w, http.StatusBadGateway, info)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// localGameInfoHandler reports the installed version and the suggested action,
+// e.g. GET /api/games/hk4e/local?gamedir=/games/genshin&reltype=os
+func localGameInfoHandler(w http.ResponseWriter, r *http.Request) {
+	query := struct {
+		GameType string `json:"game_type" validate:"oneof=hk4e nap hkrpg bh3"`
+		RelType  string `json:"reltype" validate:"oneof=os cn"`
+		GameDir  string `json:"gamedir" validate:"required"`
+	}{mux.Vars(r)["game_type"], r.URL.Query().Get("reltype"), r.URL.Query().Get("gamedir")}
+	if query.RelType == "" {
+		query.RelType = "os"
+	}
+	if errs := models.Validate(query); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation failed", errs...)
+		return
+	}
+
+	info := operations.GetLocalGameInfo(r.Context(), query.GameDir, query.GameType, query.RelType)
+	if info.Error != nil {
+		writeJSON(w, http.StatusInternalServerError, info)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func listTasksHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, operations.ListTasks())
+}
+
+func getTaskHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	status, ok := operations.GetTaskStatus(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "task not found: "+id)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func cancelTaskHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	status, err := operations.CancelTask(id)
+	switch {
+	case errors.Is(err, operations.ErrTaskNotFound):
+		writeError(w, http.StatusNotFound, "task not found: "+id)
+	case errors.Is(err, operations.ErrTaskFinished):
+		writeError(w, http.StatusConflict, "task already finished with status "+status.Status)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+func pauseTaskHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	status, err := operations.PauseTask(id)
+	switch {
+	case errors.Is(err, operations.ErrTaskNotFound):
+		writeError(w, http.StatusNotFound, "task not found: "+id)
+	case errors.Is(err, operations.ErrTaskNotPausable):
+		writeError(w, http.StatusConflict, "task cannot be paused from status "+status.Status)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+func resumeTaskHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	status, err := operations.ResumeTask(id)
+	switch {
+	case errors.Is(err, operations.ErrTaskNotFound):
+		writeError(w, http.StatusNotFound, "task not found: "+id)
+	case errors.Is(err, operations.ErrTaskNotResumable):
+		writeError(w, http.StatusConflict, "task cannot be resumed from status "+status.Status)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusAccepted, status)
+	}
+}
+
+func taskLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req models.TaskLimits
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	limits, err := operations.SetTaskLimits(id, req)
+	switch {
+	case errors.Is(err, operations.ErrTaskNotFound):
+		writeError(w, http.StatusNotFound, "task not found: "+id)
+	case errors.Is(err, operations.ErrTaskNotResizable):
+		writeError(w, http.StatusConflict, "task has no running pipeline to resize")
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, limits)
+	}
+}
+
+func taskMirrorsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	mirrors, err := operations.GetTaskMirrors(id)
+	switch {
+	case errors.Is(err, operations.ErrTaskNotFound):
+		writeError(w, http.StatusNotFound, "task not found: "+id)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, mirrors)
+	}
+}
+
+func getRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, operations.GetRateLimit())
+}
+
+func setRateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.RateLimitRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	status, err := operations.SetRateLimit(req)
+	switch {
+	case errors.Is(err, operations.ErrInvalidRateLimit):
+		writeError(w, http.StatusBadRequest, "validation failed", err.Error())
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, status)
+	}
+}
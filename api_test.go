@@ -0,0 +1,120 @@
+package main
+
+import (
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/operations"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func startAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+	r := mux.NewRouter()
+	registerAPIRoutes(r)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// callAPI sends body to the API, decodes the JSON response into out and returns the status code.
+func callAPI(t *testing.T, srv *httptest.Server, method, path, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("%s %s: decoding response: %v", method, path, err)
+	}
+	return resp.StatusCode
+}
+
+// TestAPIRejectsInvalidRequests answers bodies that do not decode or validate with 400 and
+// details naming the offending field, without starting a task.
+func TestAPIRejectsInvalidRequests(t *testing.T) {
+	srv := startAPI(t)
+	cases := []struct {
+		name, path, body, field string
+	}{
+		{"unknown field", "/api/tasks/install", `{"gamedir": "/games/gi", "game_type": "hk4e", "install_reltype": "os", "reltype": "os"}`, "reltype"},
+		{"malformed", "/api/tasks/install", `{"gamedir": "/games/gi",`, ""},
+		{"wrong type", "/api/tasks/install", `{"gamedir": "/games/gi", "game_type": "hk4e", "install_reltype": "os", "downloads": "8"}`, "downloads"},
+		{"missing gamedir", "/api/tasks/install", `{"game_type": "hk4e", "install_reltype": "os"}`, "gamedir"},
+		{"unknown game", "/api/tasks/install", `{"gamedir": "/games/gi", "game_type": "wuwa", "install_reltype": "os"}`, "game_type"},
+		{"unknown release type", "/api/tasks/update", `{"gamedir": "/games/gi", "game_type": "hk4e", "update_reltype": "jp"}`, "update_reltype"},
+		{"unknown repair mode", "/api/tasks/repair", `{"gamedir": "/games/gi", "game_type": "hk4e", "repair_reltype": "os", "repair_mode": "fast"}`, "repair_mode"},
+		{"too many downloads", "/api/tasks/repair", `{"gamedir": "/games/gi", "game_type": "hk4e", "repair_reltype": "os", "repair_mode": "quick", "downloads": 1000}`, "downloads"},
+	}
+	tasks := len(operations.ListTasks())
+	for _, tc := range cases {
+		var resp models.ErrorResponse
+		if code := callAPI(t, srv, http.MethodPost, tc.path, tc.body, &resp); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", tc.name, code)
+			continue
+		}
+		if details := strings.Join(resp.Details, "; "); !strings.Contains(details, tc.field) {
+			t.Errorf("%s: error %q (%s) does not name %s", tc.name, resp.Error, details, tc.field)
+		}
+	}
+	if n := len(operations.ListTasks()); n != tasks {
+		t.Errorf("%d tasks started by invalid requests", n-tasks)
+	}
+}
+
+// TestAPITaskLifecycle starts an install through the API and looks it up, unknown task IDs are 404.
+func TestAPITaskLifecycle(t *testing.T) {
+	startFakeGame(t)
+	srv := startAPI(t)
+
+	var started models.TaskResponse
+	body := `{"gamedir": ` + jsonString(t, t.TempDir()) + `, "game_type": "hk4e", "install_reltype": "os"}`
+	if code := callAPI(t, srv, http.MethodPost, "/api/tasks/install", body, &started); code != http.StatusAccepted || started.TaskID == "" {
+		t.Fatalf("install: status %d, response %+v, want 202 with a task ID", code, started)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if _, err := operations.WaitTask(ctx, started.TaskID); err != nil {
+		t.Fatal(err)
+	}
+
+	var status models.TaskStatus
+	if code := callAPI(t, srv, http.MethodGet, "/api/tasks/"+started.TaskID, "", &status); code != http.StatusOK {
+		t.Fatalf("GET task: status %d", code)
+	}
+	if status.TaskID != started.TaskID || status.TaskType != "install" || status.Status != operations.StatusCompleted {
+		t.Errorf("GET task = %+v, want the completed install", status)
+	}
+	var finished models.ErrorResponse
+	if code := callAPI(t, srv, http.MethodDelete, "/api/tasks/"+started.TaskID, "", &finished); code != http.StatusConflict {
+		t.Errorf("DELETE of a finished task: status %d, want 409", code)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		var resp models.ErrorResponse
+		if code := callAPI(t, srv, method, "/api/tasks/no-such-task", "", &resp); code != http.StatusNotFound {
+			t.Errorf("%s of an unknown task: status %d, want 404", method, code)
+		}
+	}
+}
+
+// jsonString quotes s as a JSON string.
+func jsonString(t *testing.T, s string) string {
+	t.Helper()
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
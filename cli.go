@@ -0,0 +1,442 @@
+package main
+
+import (
+	"SophonClientv2/internal/config"
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/hypAPI"
+	"SophonClientv2/pkg/installer"
+	"SophonClientv2/pkg/operations"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Process exit codes
+const (
+	exitOK          = 0
+	exitFailed      = 1   // The operation failed
+	exitUsage       = 2   // Invalid command line
+	exitVerify      = 3   // verify found missing or broken files
+	exitInterrupted = 130 // Cancelled with SIGINT or SIGTERM
+)
+
+const progressRefresh = 500 * time.Millisecond
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"install", "download the latest version of a game", runInstall},
+	{"repair", "verify a game and download missing or broken files", runRepair},
+	{"update", "update an installed game to the latest version", runUpdate},
+	{"predownload", "download the patches of an upcoming version", runPredownload},
+	{"verify", "check a game against the latest manifest without changing it", runVerify},
+	{"info", "show the online version and the state of an installation", runInfo},
+	{"serve", "start the REST and WebSocket server", runServe},
+	{"config", "print the effective configuration", runConfig},
+}
+
+func runCLI(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return exitUsage
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		printUsage()
+		return exitOK
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+	printUsage()
+	return exitUsage
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: SophonClientv2 <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run 'SophonClientv2 <command> -h' for the flags of a command.")
+}
+
+// parseFlags parses args into fs. ok is false when the command should exit with code.
+func parseFlags(fs *flag.FlagSet, args []string) (code int, ok bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		fs.Usage()
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// loadConfig makes the config file, environment and flags the active configuration.
+// Settings read once at startup (logger, metadata cache) are updated as well.
+func loadConfig(flags *config.Flags) bool {
+	cfg, err := flags.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(os.Stderr, "  "+line)
+		}
+		return false
+	}
+	config.Config = cfg
+	previous := logging.GlobalLogger
+	logging.GlobalLogger = logging.NewLogger()
+	previous.Close()
+	hypAPI.Metadata.TTL = cfg.MetadataCacheTTL
+	hypAPI.Metadata.Dir = cfg.MetadataCacheDir
+	return true
+}
+
+// gameFlags are the flags shared by the commands operating on a game directory.
+type gameFlags struct {
+	gameType   string
+	relType    string
+	gameDir    string
+	stagingDir string
+	verbose    bool
+	config     *config.Flags
+}
+
+func newGameFlagSet(name string, g *gameFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	g.config = config.RegisterFlags(fs)
+	fs.StringVar(&g.gameType, "game", "hk4e", "game type (hk4e, nap, hkrpg)")
+	fs.StringVar(&g.relType, "rel", "os", "release type (os, cn)")
+	fs.StringVar(&g.gameDir, "dir", "", "game directory")
+	fs.StringVar(&g.stagingDir, "staging", "", "staging directory (default <dir>/.sophon_staging)")
+	fs.BoolVar(&g.verbose, "v", false, "print informational log messages (unless log-level is set)")
+	return fs
+}
+
+func (g *gameFlags) request() models.GameOperationRequest {
+	return models.GameOperationRequest{GameDir: g.gameDir, GameType: g.gameType, TempDir: g.stagingDir}
+}
+
+// setup loads the configuration and keeps the log quiet enough for the progress bar
+// unless a log level was configured.
+func (g *gameFlags) setup() bool {
+	if !loadConfig(g.config) {
+		return false
+	}
+	if config.Config.Source("log_level") != config.SourceDefault {
+		return true
+	}
+	if g.verbose {
+		config.Config.SophonLogLevel = config.Info
+	} else {
+		config.Config.SophonLogLevel = config.Warn
+	}
+	return true
+}
+
+// validate reports invalid fields of req and returns false if there were any.
+func validate(req any) bool {
+	errs := models.Validate(req)
+	for _, e := range errs {
+		fmt.Fprintln(os.Stderr, "Invalid flag:", e)
+	}
+	return len(errs) == 0
+}
+
+func runInstall(args []string) int {
+	var g gameFlags
+	fs := newGameFlagSet("install", &g)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	req := models.InstallRequest{GameOperationRequest: g.request(), InstallRelType: g.relType}
+	if !validate(req) || !g.setup() {
+		return exitUsage
+	}
+	return runTask("install", req)
+}
+
+func runRepair(args []string) int {
+	var g gameFlags
+	fs := newGameFlagSet("repair", &g)
+	mode := fs.String("mode", "reliable", "how existing files are checked: quick (size) or reliable (MD5)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	req := models.RepairRequest{GameOperationRequest: g.request(), RepairRelType: g.relType, RepairMode: *mode}
+	if !validate(req) || !g.setup() {
+		return exitUsage
+	}
+	return runTask("repair", req)
+}
+
+func runUpdate(args []string) int {
+	return runUpdateCommand("update", args, false)
+}
+
+func runPredownload(args []string) int {
+	return runUpdateCommand("predownload", args, true)
+}
+
+func runUpdateCommand(name string, args []string, predownload bool) int {
+	var g gameFlags
+	fs := newGameFlagSet(name, &g)
+	from := fs.String("from", "", "installed version (detected from the game directory by default)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	req := models.UpdateRequest{GameOperationRequest: g.request(), UpdateRelType: g.relType, FromVersion: *from, Predownload: predownload}
+	if !validate(req) || !g.setup() {
+		return exitUsage
+	}
+	return runTask("update", req)
+}
+
+// runTask runs a task in this process, drawing its progress until it finishes.
+// The first SIGINT or SIGTERM cancels the task, a second one exits immediately.
+func runTask(taskType string, req any) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	resp := operations.RunTask(taskType, req)
+	if resp.TaskID == "" {
+		fmt.Fprintln(os.Stderr, "Error:", resp.Message)
+		return exitFailed
+	}
+
+	finished := make(chan models.TaskStatus, 1)
+	go func() {
+		status, _ := operations.WaitTask(context.Background(), resp.TaskID)
+		finished <- status
+	}()
+
+	bar := newProgressBar(os.Stderr)
+	ticker := time.NewTicker(progressRefresh)
+	defer ticker.Stop()
+	interrupted := ctx.Done()
+	for {
+		select {
+		case <-ticker.C:
+			if progress, ok := operations.GetTaskProgress(resp.TaskID); ok {
+				bar.Render(progress)
+			}
+		case <-interrupted:
+			interrupted = nil
+			stop()
+			bar.Finish()
+			fmt.Fprintln(os.Stderr, "Interrupted, stopping "+taskType+" (press Ctrl+C again to exit immediately)")
+			operations.CancelTask(resp.TaskID)
+		case status := <-finished:
+			if progress, ok := operations.GetTaskProgress(resp.TaskID); ok {
+				bar.Render(progress)
+			}
+			bar.Finish()
+			switch status.Status {
+			case operations.StatusCompleted:
+				fmt.Fprintln(os.Stderr, taskType+" completed")
+				return exitOK
+			case operations.StatusCancelled:
+				fmt.Fprintln(os.Stderr, taskType+" cancelled")
+				return exitInterrupted
+			default:
+				msg := "unknown error"
+				if status.Error != nil {
+					msg = *status.Error
+				}
+				fmt.Fprintf(os.Stderr, "%s failed: %s\n", taskType, msg)
+				return exitFailed
+			}
+		}
+	}
+}
+
+func runVerify(args []string) int {
+	var g gameFlags
+	fs := newGameFlagSet("verify", &g)
+	quick := fs.Bool("quick", false, "compare file sizes only instead of MD5 hashes")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	mode := "reliable"
+	if *quick {
+		mode = "quick"
+	}
+	req := models.RepairRequest{GameOperationRequest: g.request(), RepairRelType: g.relType, RepairMode: mode}
+	if !validate(req) || !g.setup() {
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	bar := newProgressBar(os.Stderr)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	result, err := operations.VerifyGame(ctx, req, func(progress *installer.InstallProgress) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(progressRefresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					bar.Render(progress.Snapshot())
+					return
+				case <-ticker.C:
+					bar.Render(progress.Snapshot())
+				}
+			}
+		}()
+	})
+	close(done)
+	wg.Wait()
+	bar.Finish()
+	switch {
+	case ctx.Err() != nil:
+		fmt.Fprintln(os.Stderr, "verify cancelled")
+		return exitInterrupted
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "verify failed:", err)
+		return exitFailed
+	}
+
+	for _, file := range result.Missing {
+		fmt.Println("missing:", file)
+	}
+	for _, file := range result.Broken {
+		fmt.Println("broken: ", file)
+	}
+	fmt.Fprintf(os.Stderr, "Checked %d files, %d missing, %d broken\n", result.Checked, len(result.Missing), len(result.Broken))
+	if !result.OK() {
+		return exitVerify
+	}
+	return exitOK
+}
+
+func runInfo(args []string) int {
+	var g gameFlags
+	fs := newGameFlagSet("info", &g)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	query := struct {
+		GameType string `json:"game" validate:"oneof=hk4e nap hkrpg"`
+		RelType  string `json:"rel" validate:"oneof=os cn"`
+	}{g.gameType, g.relType}
+	if !validate(query) || !g.setup() {
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	online := operations.GetOnlineGameInfo(ctx, g.gameType, g.relType)
+	var local *models.LocalGameInfo
+	if g.gameDir != "" {
+		info := operations.GetLocalGameInfo(ctx, g.gameDir, g.gameType, g.relType)
+		local = &info
+	}
+	failed := online.Error != nil || (local != nil && local.Error != nil)
+
+	if *asJSON {
+		out := struct {
+			Online models.OnlineGameInfo `json:"online"`
+			Local  *models.LocalGameInfo `json:"local,omitempty"`
+		}{online, local}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return exitFailed
+		}
+	} else {
+		printOnlineInfo(online)
+		if local != nil {
+			fmt.Println()
+			printLocalInfo(*local)
+		}
+	}
+	if failed {
+		return exitFailed
+	}
+	return exitOK
+}
+
+func printOnlineInfo(info models.OnlineGameInfo) {
+	fmt.Printf("Game:           %s (%s)\n", info.GameType, info.ReleaseType)
+	if info.Error != nil {
+		fmt.Println("Error:         ", *info.Error)
+		return
+	}
+	fmt.Println("Latest version:", info.Version)
+	fmt.Println("Install size:  ", formatBytes(info.InstallSize))
+	fmt.Println("Download size: ", formatBytes(info.DownloadSize))
+	if len(info.UpdatableVersions) > 0 {
+		fmt.Println("Updatable from:", strings.Join(info.UpdatableVersions, ", "))
+	}
+	if info.PreDownloadVersion != nil {
+		fmt.Println("Predownload:   ", *info.PreDownloadVersion)
+	}
+}
+
+func printLocalInfo(info models.LocalGameInfo) {
+	fmt.Println("Game directory:", info.GameDir)
+	if info.Error != nil {
+		fmt.Println("Error:         ", *info.Error)
+		return
+	}
+	switch {
+	case !info.Installed:
+		fmt.Println("Installed:      no")
+	case info.InstalledVersion == "":
+		fmt.Println("Installed:      unknown version")
+	default:
+		fmt.Printf("Installed:      %s (from %s)\n", info.InstalledVersion, info.VersionSource)
+	}
+	fmt.Println("Action:        ", info.Action)
+	if info.PreDownloadVersion != nil {
+		fmt.Println("Predownload:   ", *info.PreDownloadVersion)
+	}
+}
+
+func runConfig(args []string) int {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	flags := config.RegisterFlags(fs)
+	format := fs.String("format", "toml", "output format: json, toml or yaml")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if !loadConfig(flags) {
+		return exitUsage
+	}
+	out, err := config.Config.Encode(*format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitUsage
+	}
+	os.Stdout.Write(out)
+	return exitOK
+}
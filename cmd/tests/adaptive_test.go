@@ -0,0 +1,103 @@
+package main
+
+import (
+	"SophonClientv2/pkg/downloader"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// capacityServer answers after delay, with 429 while more than capacity requests are in flight (0 is unlimited).
+func capacityServer(t *testing.T, delay time.Duration, capacity int64, throttled *atomic.Int64) *httptest.Server {
+	var inFlight atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer inFlight.Add(-1)
+		n := inFlight.Add(1)
+		time.Sleep(delay)
+		if capacity > 0 && n > capacity {
+			throttled.Add(1)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// watchWorkers records the lowest and highest worker count of d until stop is closed.
+func watchWorkers(d *downloader.Downloader, stop <-chan struct{}) (lowest, highest *atomic.Int64) {
+	lowest, highest = &atomic.Int64{}, &atomic.Int64{}
+	n := int64(d.WorkerCount())
+	lowest.Store(n)
+	highest.Store(n)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			n := int64(d.WorkerCount())
+			if n < lowest.Load() {
+				lowest.Store(n)
+			}
+			if n > highest.Load() {
+				highest.Store(n)
+			}
+		}
+	}()
+	return lowest, highest
+}
+
+func TestAdaptiveConcurrencyBacksOff(t *testing.T) {
+	var throttled atomic.Int64
+	srv := capacityServer(t, 5*time.Millisecond, 4, &throttled)
+	d := downloader.NewDownloader(downloader.Options{
+		Workers: 16, QueueSize: 512, MaxRetries: 100,
+		Adaptive: true, MinWorkers: 1, MaxWorkers: 32, AdaptInterval: 50 * time.Millisecond,
+	})
+	stop := make(chan struct{})
+	lowest, _ := watchWorkers(d, stop)
+	outputs := downloadAll(t, d, srv.URL, 400)
+	close(stop)
+
+	for _, out := range outputs {
+		if !out.Suceeded {
+			t.Fatalf("chunk %v failed", out.Payload)
+		}
+	}
+	if throttled.Load() == 0 {
+		t.Fatal("server never throttled, the test proves nothing")
+	}
+	if lowest.Load() > 8 {
+		t.Errorf("concurrency stayed at %d or more despite %d throttled requests", lowest.Load(), throttled.Load())
+	}
+}
+
+func TestAdaptiveConcurrencyGrows(t *testing.T) {
+	srv := capacityServer(t, 20*time.Millisecond, 0, nil)
+	d := downloader.NewDownloader(downloader.Options{
+		Workers: 2, QueueSize: 512,
+		Adaptive: true, MinWorkers: 1, MaxWorkers: 16, AdaptInterval: 50 * time.Millisecond,
+	})
+	stop := make(chan struct{})
+	_, highest := watchWorkers(d, stop)
+	downloadAll(t, d, srv.URL, 400)
+	close(stop)
+
+	if highest.Load() <= 4 {
+		t.Errorf("concurrency peaked at %d on an idle link with a backlog", highest.Load())
+	}
+	if stats := d.Concurrency(); !stats.Adaptive || stats.Min != 1 || stats.Max != 16 || stats.Workers > 16 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	d.SetWorkers(3)
+	if stats := d.Concurrency(); stats.Adaptive || stats.Workers != 3 {
+		t.Errorf("SetWorkers did not pin the worker count: %+v", stats)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"SophonClientv2/internal/fakesophon"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/installer"
+	"SophonClientv2/pkg/operations"
+	"SophonClientv2/pkg/utils"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedFS blocks every write to a game file until release is closed. entered is closed by the first write.
+type gatedFS struct {
+	utils.FS
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newGatedFS() *gatedFS {
+	return &gatedFS{FS: utils.OSFS{}, entered: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (fsys *gatedFS) OpenFile(name string, flag int, perm os.FileMode) (utils.File, error) {
+	f, err := fsys.FS.OpenFile(name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	return &gatedFile{File: f, fsys: fsys}, nil
+}
+
+type gatedFile struct {
+	utils.File
+	fsys *gatedFS
+}
+
+func (f *gatedFile) Write(p []byte) (int, error) {
+	f.fsys.once.Do(func() { close(f.fsys.entered) })
+	<-f.fsys.release
+	return f.File.Write(p)
+}
+
+// checkGoroutines returns a function failing the test unless the goroutine count falls back
+// to the current one within a few seconds. Idle connections to srv are closed on both ends.
+func checkGoroutines(t *testing.T, srv *fakesophon.Server) func() {
+	t.Helper()
+	// The schedule of the global rate limit is applied for the life of the process from the first download on
+	downloader.NewLimitedReader(context.Background(), strings.NewReader(""))
+	srv.Client.HTTPClient.CloseIdleConnections()
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		srv.Client.HTTPClient.CloseIdleConnections()
+		n := runtime.NumGoroutine()
+		for deadline := time.Now().Add(5 * time.Second); n > before && time.Now().Before(deadline); n = runtime.NumGoroutine() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n > before {
+			buf := make([]byte, 1<<20)
+			t.Errorf("%d goroutines left running, %d before:\n%s", n-before, before, buf[:runtime.Stack(buf, true)])
+		}
+	}
+}
+
+// TestInstallerCancelled cancels an install while chunks are downloading and while they are
+// written. Wait reports the cancellation and every goroutine of the pipeline exits.
+func TestInstallerCancelled(t *testing.T) {
+	srv := startFakeSophon(t)
+	srv.ChunkSize = 4096
+	if err := srv.SetGame("hk4e", "os", "5.0.0", syntheticGame(rand.New(rand.NewSource(31)))); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		opts    installer.Options
+		gate    bool
+		started func(inst *installer.Installer) bool
+	}{
+		{
+			name: "download",
+			opts: installer.Options{QueueSize: 64, Downloader: downloader.Options{Workers: 1, RateLimit: 64 << 10}},
+			started: func(inst *installer.Installer) bool {
+				return inst.Progress.Snapshot().DownloadedChunks >= 2
+			},
+		},
+		{
+			name: "assembly",
+			opts: installer.Options{QueueSize: 64},
+			gate: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+			defer cancel()
+			gameDir := t.TempDir()
+			leaks := checkGoroutines(t, srv)
+
+			inst := newGameInstaller(t, ctx, gameDir, tc.opts)
+			gate := newGatedFS()
+			if tc.gate {
+				inst.SetFS(gate)
+			} else {
+				close(gate.release)
+			}
+			runCtx, interrupt := context.WithCancel(ctx)
+			inst.Start(runCtx)
+			if tc.gate {
+				select {
+				case <-gate.entered:
+				case <-ctx.Done():
+					t.Fatal("no chunk was written")
+				}
+			} else {
+				for !tc.started(inst) {
+					if ctx.Err() != nil {
+						t.Fatal("timed out waiting for downloaded chunks")
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+			interrupt()
+			if tc.gate {
+				close(gate.release)
+			}
+
+			waited := make(chan error, 1)
+			go func() { waited <- inst.Wait() }()
+			select {
+			case err := <-waited:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("Wait = %v, want context.Canceled", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("pipeline did not stop after the cancellation")
+			}
+			inst.Stop()
+			leaks()
+		})
+	}
+}
+
+// TestCancelTask cancels an install task while it downloads. The task ends cancelled and leaves no goroutines behind.
+func TestCancelTask(t *testing.T) {
+	srv := startFakeSophon(t)
+	srv.ChunkSize = 4096
+	if err := srv.SetGame("hk4e", "os", "5.0.0", syntheticGame(rand.New(rand.NewSource(32)))); err != nil {
+		t.Fatal(err)
+	}
+	leaks := checkGoroutines(t, srv)
+
+	resp := operations.PerformInstall(models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: t.TempDir(), GameType: "hk4e", Downloads: 1, RateLimit: 64},
+		InstallRelType:       "os",
+	})
+	if resp.TaskID == "" {
+		t.Fatalf("task was not started: %+v", resp)
+	}
+	waitForProgress(t, resp.TaskID, func(p models.TaskProgress) bool { return p.DownloadedChunks >= 2 })
+	if status, err := operations.CancelTask(resp.TaskID); err != nil || status.Status != operations.StatusCancelled {
+		t.Fatalf("CancelTask = %s, %v, want cancelled", status.Status, err)
+	}
+	if status := waitForTask(t, resp); status.Status != operations.StatusCancelled {
+		t.Fatalf("cancelled task ended %s", status.Status)
+	}
+	if _, err := operations.CancelTask(resp.TaskID); !errors.Is(err, operations.ErrTaskFinished) {
+		t.Errorf("cancelling a cancelled task = %v, want ErrTaskFinished", err)
+	}
+	leaks()
+}
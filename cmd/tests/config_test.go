@@ -0,0 +1,130 @@
+package main
+
+import (
+	"SophonClientv2/internal/config"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFileFormats(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{"concurrent_downloads": 4, "log_level": "warn", "metadata_cache_ttl": "1h", "log_to_file": true, "log_file": "C:\\logs\\sophon.log"}`,
+		"config.toml": "# comment\nconcurrent_downloads = 4\nlog_level = \"warn\" # trailing\nmetadata_cache_ttl = '1h'\nlog_to_file = true\nlog_file = \"C:\\\\logs\\\\sophon.log\"\n",
+		"config.yaml": "---\nconcurrent_downloads: 4\nlog_level: warn\nmetadata_cache_ttl: 1h # trailing\nlog_to_file: true\nlog_file: 'C:\\logs\\sophon.log'\n",
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := config.Load(writeConfigFile(t, name, content), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.CocurrentDownloads != 4 || cfg.SophonLogLevel != config.Warn || cfg.MetadataCacheTTL != time.Hour ||
+				!cfg.SophonLogToFile || cfg.SophonLogFile != `C:\logs\sophon.log` {
+				t.Errorf("unexpected config %+v", cfg)
+			}
+			if cfg.Source("concurrent_downloads") != config.SourceFile || cfg.Source("max_api_retries") != config.SourceDefault {
+				t.Errorf("unexpected sources")
+			}
+		})
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := writeConfigFile(t, "config.toml", "concurrent_downloads = 4\nconcurrent_hashchecks = 2\nmax_api_retries = 7\n")
+	t.Setenv("SOPHON_CONCURRENT_DOWNLOADS", "6")
+	t.Setenv("SOPHON_CONCURRENT_HASHCHECKS", "3")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := config.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-config", file, "-concurrent-downloads", "8"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := flags.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		key    string
+		want   string
+		source config.Source
+	}{
+		{"concurrent_downloads", "8", config.SourceFlag},
+		{"concurrent_hashchecks", "3", config.SourceEnv},
+		{"max_api_retries", "7", config.SourceFile},
+		{"max_chunk_download_retries", "5", config.SourceDefault},
+	}
+	for _, c := range checks {
+		if got, _ := cfg.Get(c.key); got != c.want || cfg.Source(c.key) != c.source {
+			t.Errorf("%s = %s from %s, want %s from %s", c.key, got, cfg.Source(c.key), c.want, c.source)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	_, err := config.Load(writeConfigFile(t, "config.yaml", "concurrent_downloads: 0\ndownload_chan_size: 70000\nlog_to_file: true\n"), nil)
+	if err == nil {
+		t.Fatal("invalid config was accepted")
+	}
+	for _, want := range []string{"concurrent_downloads", "download_chan_size", "log_to_file requires log_file"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+
+	_, err = config.Load(writeConfigFile(t, "config.json", `{"concurrent_dowloads": 4}`), nil)
+	if !errors.Is(err, config.ErrUnknownKey) {
+		t.Errorf("typo in key: got %v, want ErrUnknownKey", err)
+	}
+	if _, err := config.Load(writeConfigFile(t, "config.toml", "log_level = \"loud\"\n"), nil); err == nil {
+		t.Error("invalid log level was accepted")
+	}
+	if _, err := config.Load(writeConfigFile(t, "config.toml", "download_rate_schedule = \"08:00-25:00=100\"\n"), nil); err == nil {
+		t.Error("invalid rate schedule was accepted")
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(&strings.Builder{})
+	config.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-concurrent-downloads", "many"}); err == nil {
+		t.Error("non-numeric flag value was accepted")
+	}
+}
+
+func TestConfigEncodeRoundTrip(t *testing.T) {
+	cfg := config.NewSophonClientConfig()
+	cfg.Set("concurrent_downloads", "12")
+	cfg.Set("log_level", "error")
+	cfg.Set("metadata_cache_dir", `D:\cache "quoted"`)
+	cfg.Set("metadata_cache_ttl", "90s")
+
+	for _, format := range []string{"json", "toml", "yaml"} {
+		out, err := cfg.Encode(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := config.Load(writeConfigFile(t, "config."+format, string(out)), nil)
+		if err != nil {
+			t.Fatalf("%s: reloading encoded config: %v\n%s", format, err, out)
+		}
+		for _, key := range config.Keys() {
+			want, _ := cfg.Get(key)
+			if got, _ := loaded.Get(key); got != want {
+				t.Errorf("%s: %s = %q after round trip, want %q", format, key, got, want)
+			}
+		}
+	}
+}
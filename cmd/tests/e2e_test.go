@@ -0,0 +1,336 @@
+package main
+
+import (
+	"SophonClientv2/internal/fakesophon"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/installer"
+	"SophonClientv2/pkg/localgame"
+	"SophonClientv2/pkg/operations"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syntheticGame returns game files covering multi-chunk files, chunks shared between files and nested dirs.
+func syntheticGame(r *rand.Rand) map[string][]byte {
+	random := func(n int) []byte {
+		data := make([]byte, n)
+		r.Read(data)
+		return data
+	}
+	shared := random(fakesophon.DefaultChunkSize)
+	return map[string][]byte{
+		"GenshinImpact.exe":                          random(3*fakesophon.DefaultChunkSize + 123),
+		"pkg_version":                                []byte(`{"remoteName": "GenshinImpact.exe"}` + "\n"),
+		"GenshinImpact_Data/data.unity3d":            random(2 * fakesophon.DefaultChunkSize),
+		"GenshinImpact_Data/StreamingAssets/a.blk":   append(append([]byte{}, shared...), random(1000)...),
+		"GenshinImpact_Data/StreamingAssets/b.blk":   append(append([]byte{}, shared...), random(2000)...),
+		"GenshinImpact_Data/StreamingAssets/old.blk": random(5000),
+	}
+}
+
+// prefixDiff returns a DiffFunc copying the common prefix of old and new from the old file.
+func prefixDiff(t *testing.T) func(oldData, newData []byte) []byte {
+	return func(oldData, newData []byte) []byte {
+		n := 0
+		for n < len(oldData) && n < len(newData) && oldData[n] == newData[n] {
+			n++
+		}
+		var covers []testCover
+		if n > 0 {
+			covers = append(covers, testCover{oldPos: 0, newPos: 0, length: n})
+		}
+		return encodeHDiff(t, oldData, newData, covers, true)
+	}
+}
+
+func startFakeSophon(t *testing.T) *fakesophon.Server {
+	t.Helper()
+	srv := fakesophon.NewServer()
+	restore := srv.UseAsDefault()
+	t.Cleanup(func() {
+		restore()
+		srv.Close()
+	})
+	return srv
+}
+
+func waitForTask(t *testing.T, resp models.TaskResponse) models.TaskStatus {
+	t.Helper()
+	if resp.TaskID == "" {
+		t.Fatalf("task was not started: %+v", resp)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	status, err := operations.WaitTask(ctx, resp.TaskID)
+	if err != nil {
+		t.Fatalf("waiting for task %s: %v", resp.TaskID, err)
+	}
+	return status
+}
+
+func requireCompleted(t *testing.T, status models.TaskStatus) {
+	t.Helper()
+	if status.Status != operations.StatusCompleted {
+		msg := ""
+		if status.Error != nil {
+			msg = *status.Error
+		}
+		t.Fatalf("task %s ended %s: %s", status.TaskID, status.Status, msg)
+	}
+}
+
+// assertGameDir checks that gameDir holds exactly the given files, ignoring config.ini and the staging dir.
+func assertGameDir(t *testing.T, gameDir string, files map[string][]byte) {
+	t.Helper()
+	found := make(map[string]bool)
+	err := filepath.WalkDir(gameDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(gameDir, path)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if strings.HasPrefix(rel, ".sophon_staging") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel == localgame.ConfigFileName {
+			return nil
+		}
+		want, ok := files[rel]
+		if !ok {
+			t.Errorf("unexpected file %s", rel)
+			return nil
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs: got %d bytes, want %d", rel, len(got), len(want))
+		}
+		found[rel] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		if !found[name] {
+			t.Errorf("missing file %s", name)
+		}
+	}
+}
+
+func installFakeGame(t *testing.T, gameDir string) {
+	t.Helper()
+	status := waitForTask(t, operations.PerformInstall(models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: gameDir, GameType: "hk4e"},
+		InstallRelType:       "os",
+	}))
+	requireCompleted(t, status)
+}
+
+func TestE2EInstall(t *testing.T) {
+	srv := startFakeSophon(t)
+	files := syntheticGame(rand.New(rand.NewSource(1)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+
+	gameDir := t.TempDir()
+	installFakeGame(t, gameDir)
+	assertGameDir(t, gameDir, files)
+
+	version, _, err := localgame.DetectVersion(gameDir, "hk4e")
+	if err != nil || version != "5.0.0" {
+		t.Fatalf("installed version = %q, %v; want 5.0.0", version, err)
+	}
+	info := operations.GetLocalGameInfo(context.Background(), gameDir, "hk4e", "os")
+	if info.Action != operations.ActionUpToDate {
+		t.Fatalf("local game action = %s, want %s", info.Action, operations.ActionUpToDate)
+	}
+}
+
+func TestE2ERepair(t *testing.T) {
+	srv := startFakeSophon(t)
+	files := syntheticGame(rand.New(rand.NewSource(2)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+	gameDir := t.TempDir()
+	installFakeGame(t, gameDir)
+
+	// Corrupt one file, truncate another and delete a third
+	exe := filepath.Join(gameDir, "GenshinImpact.exe")
+	data, _ := os.ReadFile(exe)
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(exe, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filepath.Join(gameDir, "GenshinImpact_Data/data.unity3d"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(gameDir, "pkg_version")); err != nil {
+		t.Fatal(err)
+	}
+
+	status := waitForTask(t, operations.PerformRepair(models.RepairRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: gameDir, GameType: "hk4e"},
+		RepairRelType:        "os",
+		RepairMode:           "reliable",
+	}))
+	requireCompleted(t, status)
+	assertGameDir(t, gameDir, files)
+}
+
+func TestE2EVerify(t *testing.T) {
+	srv := startFakeSophon(t)
+	files := syntheticGame(rand.New(rand.NewSource(5)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+	gameDir := t.TempDir()
+	installFakeGame(t, gameDir)
+
+	req := models.RepairRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: gameDir, GameType: "hk4e"},
+		RepairRelType:        "os",
+		RepairMode:           "reliable",
+	}
+	var progress *installer.InstallProgress
+	result, err := operations.VerifyGame(context.Background(), req, func(p *installer.InstallProgress) { progress = p })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK() || result.Checked != len(files) {
+		t.Fatalf("fresh install did not verify: %+v", result)
+	}
+	if snap := progress.Snapshot(); snap.VerifiedFiles != len(files) || snap.Percent != 100 {
+		t.Errorf("progress after verify = %+v", snap)
+	}
+
+	// Same-size corruption is only found by the MD5 check
+	exe := filepath.Join(gameDir, "GenshinImpact.exe")
+	data, _ := os.ReadFile(exe)
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(exe, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(gameDir, "pkg_version")); err != nil {
+		t.Fatal(err)
+	}
+	result, err = operations.VerifyGame(context.Background(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Missing, []string{"pkg_version"}) || !slices.Equal(result.Broken, []string{"GenshinImpact.exe"}) {
+		t.Errorf("reliable verify = %+v", result)
+	}
+
+	req.RepairMode = "quick"
+	result, err = operations.VerifyGame(context.Background(), req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Missing, []string{"pkg_version"}) || len(result.Broken) != 0 {
+		t.Errorf("quick verify = %+v", result)
+	}
+	// Verify must not touch the game directory
+	if after, _ := os.ReadFile(exe); !bytes.Equal(after, data) {
+		t.Error("verify modified a broken file")
+	}
+}
+
+func TestE2EUpdate(t *testing.T) {
+	for _, patched := range []bool{false, true} {
+		t.Run(fmt.Sprintf("hdiff=%v", patched), func(t *testing.T) {
+			srv := startFakeSophon(t)
+			if patched {
+				srv.DiffFunc = prefixDiff(t)
+			}
+			r := rand.New(rand.NewSource(3))
+			oldFiles := syntheticGame(r)
+			if err := srv.SetGame("hk4e", "os", "5.0.0", oldFiles); err != nil {
+				t.Fatal(err)
+			}
+			gameDir := t.TempDir()
+			installFakeGame(t, gameDir)
+
+			newFiles := make(map[string][]byte)
+			for name, data := range oldFiles {
+				newFiles[name] = data
+			}
+			newFiles["GenshinImpact.exe"] = append(append([]byte{}, oldFiles["GenshinImpact.exe"]...), "v5.1"...)
+			newFiles["GenshinImpact_Data/StreamingAssets/new.blk"] = []byte("added in 5.1")
+			delete(newFiles, "GenshinImpact_Data/StreamingAssets/old.blk")
+			if err := srv.SetGame("hk4e", "os", "5.1.0", newFiles); err != nil {
+				t.Fatal(err)
+			}
+			if err := srv.AddPatch("hk4e", "os", "5.0.0", oldFiles); err != nil {
+				t.Fatal(err)
+			}
+
+			if info := operations.GetLocalGameInfo(context.Background(), gameDir, "hk4e", "os"); info.Action != operations.ActionUpdate {
+				t.Fatalf("local game action = %s, want %s", info.Action, operations.ActionUpdate)
+			}
+			chunkRequests := srv.Requests("/chunks/")
+			status := waitForTask(t, operations.PerformUpdate(models.UpdateRequest{
+				GameOperationRequest: models.GameOperationRequest{GameDir: gameDir, GameType: "hk4e"},
+				UpdateRelType:        "os",
+			}))
+			requireCompleted(t, status)
+			assertGameDir(t, gameDir, newFiles)
+			if n := srv.Requests("/chunks/") - chunkRequests; n != 0 {
+				t.Errorf("update downloaded %d chunks, want everything patched", n)
+			}
+			if version, _, _ := localgame.DetectVersion(gameDir, "hk4e"); version != "5.1.0" {
+				t.Fatalf("version after update = %q, want 5.1.0", version)
+			}
+		})
+	}
+}
+
+func TestE2EUpdateFallsBackToDownload(t *testing.T) {
+	srv := startFakeSophon(t)
+	srv.DiffFunc = prefixDiff(t)
+	oldFiles := syntheticGame(rand.New(rand.NewSource(4)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", oldFiles); err != nil {
+		t.Fatal(err)
+	}
+	gameDir := t.TempDir()
+	installFakeGame(t, gameDir)
+
+	newFiles := make(map[string][]byte)
+	for name, data := range oldFiles {
+		newFiles[name] = data
+	}
+	newFiles["GenshinImpact_Data/data.unity3d"] = bytes.Repeat([]byte("5.1"), 1000)
+	if err := srv.SetGame("hk4e", "os", "5.1.0", newFiles); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AddPatch("hk4e", "os", "5.0.0", oldFiles); err != nil {
+		t.Fatal(err)
+	}
+
+	// The original no longer matches original_hash, so the file has to be downloaded
+	if err := os.WriteFile(filepath.Join(gameDir, "GenshinImpact_Data/data.unity3d"), []byte("modded"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	status := waitForTask(t, operations.PerformUpdate(models.UpdateRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: gameDir, GameType: "hk4e"},
+		UpdateRelType:        "os",
+	}))
+	requireCompleted(t, status)
+	assertGameDir(t, gameDir, newFiles)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/operations"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// TestEventSubscriptionOverflow closes a subscriber that cannot take a lifecycle event instead of
+// dropping the event silently, while subscribers that keep up get every event of the task.
+func TestEventSubscriptionOverflow(t *testing.T) {
+	srv := startFakeSophon(t)
+	if err := srv.SetGame("hk4e", "os", "5.0.0", syntheticGame(rand.New(rand.NewSource(4)))); err != nil {
+		t.Fatal(err)
+	}
+
+	slow := operations.SubscribeEvents(1) // Never read until the task finished
+	defer slow.Close()
+	fast := operations.SubscribeEvents(64)
+	defer fast.Close()
+
+	resp := operations.PerformInstall(models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: t.TempDir(), GameType: "hk4e"},
+		InstallRelType:       "os",
+	})
+	requireCompleted(t, waitForTask(t, resp))
+
+	received := 0
+	timeout := time.After(5 * time.Second)
+drain:
+	for {
+		select {
+		case ev, ok := <-slow.C:
+			if !ok {
+				break drain
+			}
+			if ev.TaskID == resp.TaskID {
+				received++
+			}
+		case <-timeout:
+			t.Fatalf("slow subscription was not closed after %d events", received)
+		}
+	}
+	if received != 1 || slow.Dropped() != 1 {
+		t.Errorf("slow subscriber got %d events and dropped %d, want 1 and its subscription closed", received, slow.Dropped())
+	}
+
+	var seen []string
+	for len(fast.C) > 0 {
+		if ev := <-fast.C; ev.TaskID == resp.TaskID {
+			seen = append(seen, ev.Event)
+		}
+	}
+	if fast.Dropped() != 0 || len(seen) < 3 || seen[0] != operations.EventCreated || seen[len(seen)-1] != operations.EventCompleted {
+		t.Errorf("fast subscriber got %v with %d dropped, want created ... completed", seen, fast.Dropped())
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"SophonClientv2/internal/faults"
+	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/installer"
+	"SophonClientv2/pkg/operations"
+	"SophonClientv2/pkg/retry"
+	"context"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// installWithFaults runs the installer against the fake server with inj wrapping its transport and file system.
+func installWithFaults(t *testing.T, gameDir string, inj *faults.Injector) {
+	t.Helper()
+	opts := installer.Options{QueueSize: 64, Downloader: downloader.Options{Retry: retry.Policy{BaseDelay: time.Millisecond}}}
+	if err := runInstall(t, gameDir, inj, opts); err != nil {
+		t.Fatalf("install with faults (%s): %v", &inj.Stats, err)
+	}
+	t.Logf("injected %s", &inj.Stats)
+}
+
+// runInstall installs the game of the fake server with opts and returns the result of Wait.
+func runInstall(t *testing.T, gameDir string, inj *faults.Injector, opts installer.Options) error {
+	t.Helper()
+	mani, info, err := operations.GetManifest(context.Background(), "hk4e", "os", "game", "main")
+	if err != nil {
+		t.Fatalf("GetManifest: %v", err)
+	}
+	inst := installer.NewInstaller(gameDir, filepath.Join(gameDir, ".sophon_staging"), opts)
+	if err := inst.ParseManifest(mani, info.ChunkDownload); err != nil {
+		t.Fatal(err)
+	}
+	inst.SetTransport(inj.Transport(nil))
+	inst.SetFS(inj.FS(nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if err := inst.Prepare(ctx); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	inst.Start(ctx)
+	err = inst.Wait()
+	inst.Stop()
+	return err
+}
+
+func TestInstallerConvergesUnderFaults(t *testing.T) {
+	cases := []struct {
+		name  string
+		rates faults.Rates
+		check func(s *faults.Stats) bool
+	}{
+		{
+			name:  "network",
+			rates: faults.Rates{Drop: 0.1, Status: 0.1, Truncate: 0.1, Corrupt: 0.1},
+			check: func(s *faults.Stats) bool {
+				return s.Drops.Load() > 0 && s.Statuses.Load() > 0 && s.Truncations.Load() > 0 && s.Corruptions.Load() > 0
+			},
+		},
+		{
+			name:  "filesystem",
+			rates: faults.Rates{WriteFail: 0.1, WriteCorrupt: 0.05, OpenFail: 0.1},
+			check: func(s *faults.Stats) bool {
+				return s.WriteFailures.Load() > 0 && s.WriteCorruptions.Load() > 0
+			},
+		},
+		{
+			name:  "combined",
+			rates: faults.Rates{Drop: 0.05, Status: 0.05, Truncate: 0.05, Corrupt: 0.05, WriteFail: 0.05, WriteCorrupt: 0.02, OpenFail: 0.05},
+			check: func(s *faults.Stats) bool { return true },
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := startFakeSophon(t)
+			srv.ChunkSize = 4096 // Many chunks, so every fault kind gets a chance
+			files := syntheticGame(rand.New(rand.NewSource(int64(10 + i))))
+			if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+				t.Fatal(err)
+			}
+
+			inj := faults.NewInjector(int64(i), tc.rates)
+			inj.PathPrefix = "/chunks/"
+			gameDir := t.TempDir()
+			installWithFaults(t, gameDir, inj)
+			assertGameDir(t, gameDir, files)
+			if !tc.check(&inj.Stats) {
+				t.Errorf("expected faults were not injected: %s", &inj.Stats)
+			}
+		})
+	}
+}
+
+// TestInstallerByteByByteFails cuts every chunk response after one byte. Resuming gets a little
+// further each time, but not enough to be free, so the chunk attempt budget still ends the task.
+func TestInstallerByteByByteFails(t *testing.T) {
+	srv := startFakeSophon(t)
+	files := syntheticGame(rand.New(rand.NewSource(12)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+	inj := faults.NewInjector(1, faults.Rates{Truncate: 1})
+	inj.PathPrefix = "/chunks/"
+	inj.TruncateAt = 1
+
+	const chunkAttempts, retries = 6, 3
+	opts := installer.Options{
+		QueueSize:     64,
+		ChunkAttempts: chunkAttempts,
+		Downloader:    downloader.Options{MaxRetries: retries, Retry: retry.Policy{BaseDelay: time.Millisecond}},
+	}
+	err := runInstall(t, t.TempDir(), inj, opts)
+	if !errors.Is(err, installer.ErrChunkAttemptsExhausted) {
+		t.Fatalf("install = %v, want ErrChunkAttemptsExhausted", err)
+	}
+
+	chunks := 0
+	for _, data := range files {
+		chunks += (len(data) + srv.ChunkSize - 1) / srv.ChunkSize
+	}
+	// A chunk gets at most one more round of retries after reaching its budget
+	if n, most := srv.Requests("/chunks/"), chunks*(chunkAttempts+retries); n > most {
+		t.Errorf("%d chunk requests for %d chunks, want at most %d", n, chunks, most)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"SophonClientv2/pkg/hpatch"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Minimal HDIFF13 and HDIFFSF20 encoders used to generate fixtures. Covers are given explicitly,
+// the bytes added to old data are derived from old and new like hdiffz does.
+
+type testCover struct {
+	oldPos, newPos, length int
+}
+
+func packUIntWithTag(out []byte, v uint64, tag byte, tagBits uint) []byte {
+	maxWithTag := uint64(1)<<(7-tagBits) - 1
+	var rest []byte
+	for v > maxWithTag {
+		rest = append(rest, byte(v&0x7f))
+		v >>= 7
+	}
+	first := byte(v) | tag<<(8-tagBits)
+	if len(rest) > 0 {
+		first |= 1 << (7 - tagBits)
+	}
+	out = append(out, first)
+	for i := len(rest) - 1; i >= 0; i-- {
+		b := rest[i]
+		if i > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func packUInt(out []byte, v uint64) []byte {
+	return packUIntWithTag(out, v, 0, 0)
+}
+
+// rleEncode splits the add data into zero, 0xff, single byte and literal runs.
+func rleEncode(data []byte) (ctrl, code []byte) {
+	for i := 0; i < len(data); {
+		j := i + 1
+		for j < len(data) && data[j] == data[i] {
+			j++
+		}
+		if j-i >= 3 || data[i] == 0 || data[i] == 0xff {
+			switch data[i] {
+			case 0:
+				ctrl = packUIntWithTag(ctrl, uint64(j-i-1), 0, 2)
+			case 0xff:
+				ctrl = packUIntWithTag(ctrl, uint64(j-i-1), 1, 2)
+			default:
+				ctrl = packUIntWithTag(ctrl, uint64(j-i-1), 2, 2)
+				code = append(code, data[i])
+			}
+			i = j
+			continue
+		}
+		// Literal run until the next repeat of 3 or a zero byte
+		j = i
+		for j < len(data) && data[j] != 0 && !(j+2 < len(data) && data[j] == data[j+1] && data[j] == data[j+2]) {
+			j++
+		}
+		ctrl = packUIntWithTag(ctrl, uint64(j-i-1), 3, 2)
+		code = append(code, data[i:j]...)
+		i = j
+	}
+	return ctrl, code
+}
+
+// rle0Encode writes the add data of single stream diffs as pairs of a zero run and literal bytes.
+func rle0Encode(data []byte) []byte {
+	var out []byte
+	for i := 0; i < len(data); {
+		zeros := i
+		for i < len(data) && data[i] == 0 {
+			i++
+		}
+		literal := i
+		for i < len(data) && data[i] != 0 {
+			i++
+		}
+		out = packUInt(out, uint64(literal-zeros))
+		out = packUInt(out, uint64(i-literal))
+		out = append(out, data[literal:i]...)
+	}
+	return out
+}
+
+// encodeCover appends a cover relative to the end of the previous one and returns its add data.
+func encodeCover(coverBuf []byte, oldData, newData []byte, c testCover, lastOldEnd, lastNewEnd int) ([]byte, []byte) {
+	if c.oldPos >= lastOldEnd {
+		coverBuf = packUIntWithTag(coverBuf, uint64(c.oldPos-lastOldEnd), 0, 1)
+	} else {
+		coverBuf = packUIntWithTag(coverBuf, uint64(lastOldEnd-c.oldPos), 1, 1)
+	}
+	coverBuf = packUInt(coverBuf, uint64(c.newPos-lastNewEnd))
+	coverBuf = packUInt(coverBuf, uint64(c.length))
+
+	addData := make([]byte, c.length)
+	for i := range addData {
+		addData[i] = newData[c.newPos+i] - oldData[c.oldPos+i]
+	}
+	return coverBuf, addData
+}
+
+func newEncoder(t *testing.T, compress bool) (string, *zstd.Encoder) {
+	if !compress {
+		return "", nil
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "zstd", enc
+}
+
+func encodeHDiff(t *testing.T, oldData, newData []byte, covers []testCover, compress bool) []byte {
+	var coverBuf, addData, newDiff []byte
+	lastOldEnd, lastNewEnd := 0, 0
+	for _, c := range covers {
+		var add []byte
+		coverBuf, add = encodeCover(coverBuf, oldData, newData, c, lastOldEnd, lastNewEnd)
+		addData = append(addData, add...)
+		newDiff = append(newDiff, newData[lastNewEnd:c.newPos]...)
+		lastOldEnd, lastNewEnd = c.oldPos+c.length, c.newPos+c.length
+	}
+	newDiff = append(newDiff, newData[lastNewEnd:]...)
+	rleCtrl, rleCode := rleEncode(addData)
+
+	compressType, enc := newEncoder(t, compress)
+
+	out := []byte("HDIFF13&" + compressType + "\x00")
+	out = packUInt(out, uint64(len(newData)))
+	out = packUInt(out, uint64(len(oldData)))
+	out = packUInt(out, uint64(len(covers)))
+	var body []byte
+	for _, section := range [][]byte{coverBuf, rleCtrl, rleCode, newDiff} {
+		out = packUInt(out, uint64(len(section)))
+		if enc != nil && len(section) > 0 {
+			compressed := enc.EncodeAll(section, nil)
+			out = packUInt(out, uint64(len(compressed)))
+			body = append(body, compressed...)
+		} else {
+			out = packUInt(out, 0)
+			body = append(body, section...)
+		}
+	}
+	return append(out, body...)
+}
+
+// encodeHDiffSingle writes an HDIFFSF20 diff with at most stepCovers covers per step.
+func encodeHDiffSingle(t *testing.T, oldData, newData []byte, covers []testCover, compress bool, stepCovers int) []byte {
+	coverCount := len(covers)
+	var stream []byte
+	var stepMem uint64
+	lastOldEnd, lastNewEnd := 0, 0
+	for len(covers) > 0 {
+		step := covers[:min(stepCovers, len(covers))]
+		covers = covers[len(step):]
+
+		var coverBuf, addData, newDiff []byte
+		stepOldEnd, stepNewEnd := lastOldEnd, lastNewEnd
+		for _, c := range step {
+			var add []byte
+			coverBuf, add = encodeCover(coverBuf, oldData, newData, c, stepOldEnd, stepNewEnd)
+			addData = append(addData, add...)
+			newDiff = append(newDiff, newData[stepNewEnd:c.newPos]...)
+			stepOldEnd, stepNewEnd = c.oldPos+c.length, c.newPos+c.length
+		}
+		rle := rle0Encode(addData)
+		stepMem = max(stepMem, uint64(len(coverBuf)+len(rle)))
+
+		stream = packUInt(stream, uint64(len(coverBuf)))
+		stream = packUInt(stream, uint64(len(rle)))
+		stream = append(stream, coverBuf...)
+		stream = append(stream, rle...)
+		stream = append(stream, newDiff...)
+		lastOldEnd, lastNewEnd = stepOldEnd, stepNewEnd
+	}
+	stream = append(stream, newData[lastNewEnd:]...)
+
+	compressType, enc := newEncoder(t, compress)
+	out := []byte("HDIFFSF20&" + compressType + "\x00")
+	out = packUInt(out, uint64(len(newData)))
+	out = packUInt(out, uint64(len(oldData)))
+	out = packUInt(out, uint64(coverCount))
+	out = packUInt(out, stepMem)
+	out = packUInt(out, uint64(len(stream)))
+	if enc != nil {
+		compressed := enc.EncodeAll(stream, nil)
+		out = packUInt(out, uint64(len(compressed)))
+		return append(out, compressed...)
+	}
+	out = packUInt(out, 0)
+	return append(out, stream...)
+}
+
+// makePatchFixture derives new data from old by copying (and lightly modifying) old ranges
+// in shuffled order, with fresh data in between.
+func makePatchFixture(r *rand.Rand, oldSize, pieces int) (oldData, newData []byte, covers []testCover) {
+	oldData = make([]byte, oldSize)
+	r.Read(oldData)
+
+	for i := 0; i < pieces; i++ {
+		fresh := make([]byte, r.Intn(300))
+		r.Read(fresh)
+		newData = append(newData, fresh...)
+
+		if oldSize == 0 {
+			continue
+		}
+		length := r.Intn(min(oldSize, 5000)) + 1
+		oldPos := r.Intn(oldSize - length + 1)
+		piece := append([]byte(nil), oldData[oldPos:oldPos+length]...)
+		for j := 0; j < len(piece)/50; j++ {
+			piece[r.Intn(len(piece))] += byte(r.Intn(255) + 1)
+		}
+		covers = append(covers, testCover{oldPos: oldPos, newPos: len(newData), length: length})
+		newData = append(newData, piece...)
+	}
+	return oldData, newData, covers
+}
+
+func applyPatch(t *testing.T, oldData, diff []byte) ([]byte, error) {
+	var out bytes.Buffer
+	err := hpatch.Patch(context.Background(), bytes.NewReader(oldData), int64(len(oldData)), bytes.NewReader(diff), int64(len(diff)), &out)
+	return out.Bytes(), err
+}
+
+func TestHPatchApply(t *testing.T) {
+	cases := []struct {
+		name     string
+		oldSize  int
+		pieces   int
+		compress bool
+	}{
+		{"raw", 20000, 20, false},
+		{"zstd", 20000, 20, true},
+		{"create from empty", 0, 5, true},
+		{"large", 4 << 20, 400, true},
+	}
+	for i, tc := range cases {
+		r := rand.New(rand.NewSource(int64(i + 1)))
+		oldData, newData, covers := makePatchFixture(r, tc.oldSize, tc.pieces)
+		formats := map[string][]byte{
+			"HDIFF13":   encodeHDiff(t, oldData, newData, covers, tc.compress),
+			"HDIFFSF20": encodeHDiffSingle(t, oldData, newData, covers, tc.compress, 7),
+		}
+		for format, diff := range formats {
+			t.Run(tc.name+"/"+format, func(t *testing.T) {
+				got, err := applyPatch(t, oldData, diff)
+				if err != nil {
+					t.Fatalf("patch failed: %v", err)
+				}
+				if !bytes.Equal(got, newData) {
+					t.Fatalf("patched data differs (got %d bytes, want %d)", len(got), len(newData))
+				}
+			})
+		}
+	}
+}
+
+func TestHPatchFile(t *testing.T) {
+	dir := t.TempDir()
+	r := rand.New(rand.NewSource(42))
+	oldData, newData, covers := makePatchFixture(r, 100000, 50)
+	diff := encodeHDiff(t, oldData, newData, covers, true)
+
+	oldPath := filepath.Join(dir, "old.bin")
+	diffPath := filepath.Join(dir, "patch.hdiff")
+	outPath := filepath.Join(dir, "new.bin")
+	if err := os.WriteFile(oldPath, oldData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(diffPath, diff, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hpatch.PatchFile(context.Background(), oldPath, diffPath, outPath); err != nil {
+		t.Fatalf("patch failed: %v", err)
+	}
+	got, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newData) {
+		t.Fatal("patched file differs")
+	}
+}
+
+func TestHPatchRejectsBadInput(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	oldData, newData, covers := makePatchFixture(r, 10000, 10)
+	diff := encodeHDiff(t, oldData, newData, covers, false)
+
+	if _, err := applyPatch(t, oldData, diff[:len(diff)-10]); err == nil {
+		t.Error("truncated diff was accepted")
+	}
+	if _, err := applyPatch(t, oldData[:len(oldData)-1], diff); err == nil {
+		t.Error("old data of wrong size was accepted")
+	}
+	single := encodeHDiffSingle(t, oldData, newData, covers, true, 3)
+	if _, err := applyPatch(t, oldData, single[:len(single)-10]); err == nil {
+		t.Error("truncated single stream diff was accepted")
+	}
+	if _, err := applyPatch(t, oldData, []byte("HDIFF14&\x00")); !errors.Is(err, hpatch.ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat for unknown version, got %v", err)
+	}
+	lzma := append([]byte("HDIFF13&lzma\x00"), diff[len("HDIFF13&\x00"):]...)
+	if _, err := applyPatch(t, oldData, lzma); !errors.Is(err, hpatch.ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat for lzma, got %v", err)
+	}
+}
+
+// TestHPatchRejectsOverflowingCover fails on covers whose positions only fit the new and old data
+// once their sums wrap around 64 bits, instead of writing wrong output.
+func TestHPatchRejectsOverflowingCover(t *testing.T) {
+	oldData := make([]byte, 100)
+	newTail := []byte("abcdef")
+	cover := func(incOldPos, copyLength, length uint64) []byte {
+		buf := packUIntWithTag(nil, incOldPos, 0, 1)
+		buf = packUInt(buf, copyLength)
+		return packUInt(buf, length)
+	}
+	cases := map[string][]byte{
+		"copy length":  cover(0, math.MaxUint64-5, 10),
+		"length":       cover(0, 0, math.MaxUint64-5),
+		"old position": cover(math.MaxUint64-5, 0, 10),
+	}
+	for name, coverBuf := range cases {
+		rleCtrl := packUIntWithTag(nil, 9, 0, 2) // 10 unchanged bytes
+		out := []byte("HDIFF13&\x00")
+		out = packUInt(out, 10)
+		out = packUInt(out, uint64(len(oldData)))
+		out = packUInt(out, 1)
+		var body []byte
+		for _, section := range [][]byte{coverBuf, rleCtrl, nil, newTail} {
+			out = packUInt(out, uint64(len(section)))
+			out = packUInt(out, 0)
+			body = append(body, section...)
+		}
+		if got, err := applyPatch(t, oldData, append(out, body...)); !errors.Is(err, hpatch.ErrCorruptDiff) {
+			t.Errorf("%s: expected ErrCorruptDiff, got %d bytes and %v", name, len(got), err)
+		}
+	}
+}
+
+// TestHPatchRejectsOversizedSteps fails on single stream diffs whose step sizes exceed the
+// StepMemSize of the header, or would wrap around when added, before allocating anything for them.
+func TestHPatchRejectsOversizedSteps(t *testing.T) {
+	oldData := make([]byte, 100)
+	newTail := []byte("abcdef")
+	singleDiff := func(stepMem uint64, stream []byte) []byte {
+		out := []byte("HDIFFSF20&\x00")
+		out = packUInt(out, 10)
+		out = packUInt(out, uint64(len(oldData)))
+		out = packUInt(out, 1)
+		out = packUInt(out, stepMem)
+		out = packUInt(out, uint64(len(stream)))
+		out = packUInt(out, 0)
+		return append(out, stream...)
+	}
+	step := func(coverSize, rleSize uint64, data ...[]byte) []byte {
+		stream := packUInt(packUInt(nil, coverSize), rleSize)
+		for _, d := range data {
+			stream = append(stream, d...)
+		}
+		return stream
+	}
+	coverBuf := packUInt(packUInt(packUIntWithTag(nil, 0, 0, 1), 0), 10)
+	overflowing := packUInt(packUInt(packUIntWithTag(nil, 0, 0, 1), math.MaxUint64-5), 10)
+	padding := make([]byte, 64)
+
+	cases := map[string][]byte{
+		"step memory larger than the diff": singleDiff(math.MaxUint64, step(uint64(len(coverBuf)), 0, coverBuf, newTail)),
+		"covers larger than step memory":   singleDiff(16, step(math.MaxUint64, 0, padding)),
+		"rle data larger than step memory": singleDiff(16, step(uint64(len(coverBuf)), 17, coverBuf, padding)),
+		"step sizes wrapping around":       singleDiff(16, step(4, math.MaxUint64-2, padding)),
+		"empty step":                       singleDiff(16, step(0, 0, padding)),
+		"overflowing cover":                singleDiff(16, step(uint64(len(overflowing)), 0, overflowing, newTail, padding)),
+	}
+	for name, diff := range cases {
+		if got, err := applyPatch(t, oldData, diff); !errors.Is(err, hpatch.ErrCorruptDiff) {
+			t.Errorf("%s: expected ErrCorruptDiff, got %d bytes and %v", name, len(got), err)
+		}
+	}
+}
+
+// TestHPatchHdiffzFixtures applies diffs made by hdiffz of HDiffPatch, the tool the game patches
+// come from, and compares the MD5 of the result with that of the new file. Skipped unless hdiffz
+// is in PATH, the encoders above only follow the format as this package reads it.
+func TestHPatchHdiffzFixtures(t *testing.T) {
+	hdiffz, err := exec.LookPath("hdiffz")
+	if err != nil {
+		t.Skip("hdiffz is not installed (https://github.com/sisong/HDiffPatch)")
+	}
+	dir := t.TempDir()
+	oldData, newData, _ := makePatchFixture(rand.New(rand.NewSource(11)), 300000, 80)
+	oldPath, newPath := filepath.Join(dir, "old.bin"), filepath.Join(dir, "new.bin")
+	if err := os.WriteFile(oldPath, oldData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(newPath, newData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wantMD5 := md5.Sum(newData)
+
+	cases := []struct {
+		name   string
+		args   []string
+		header string
+	}{
+		{"HDIFF13 zstd", []string{"-c-zstd"}, "HDIFF13&zstd\x00"},
+		{"HDIFF13", nil, "HDIFF13&\x00"},
+		{"HDIFFSF20", []string{"-SD"}, "HDIFFSF20&\x00"},
+		{"HDIFFSF20 zstd", []string{"-SD", "-c-zstd"}, "HDIFFSF20&zstd\x00"},
+	}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			diffPath := filepath.Join(dir, fmt.Sprintf("patch%d.hdiff", i))
+			cmd := exec.Command(hdiffz, append(tc.args, "-f", oldPath, newPath, diffPath)...)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("hdiffz %v: %v\n%s", tc.args, err, out)
+			}
+			diff, err := os.ReadFile(diffPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(diff, []byte(tc.header)) {
+				t.Fatalf("hdiffz %v wrote a %q diff, want %q", tc.args, diff[:min(len(diff), len(tc.header))], tc.header)
+			}
+			got, err := applyPatch(t, oldData, diff)
+			if err != nil {
+				t.Fatalf("patch failed: %v", err)
+			}
+			if md5.Sum(got) != wantMD5 {
+				t.Fatalf("patched data has MD5 %x, want %x", md5.Sum(got), wantMD5)
+			}
+		})
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"SophonClientv2/pkg/hypAPI"
 	"SophonClientv2/pkg/installer"
 	"SophonClientv2/pkg/operations"
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
+	"strings"
 	"testing"
 )
 
@@ -15,74 +18,79 @@ func StructPrettyPrint(data interface{}) {
 	fmt.Printf("%+v\n", data)
 }
 
-func TestHypAPIConfigs(t *testing.T) {
-	StructPrettyPrint(hypAPI.CNGameConfigs)
-	StructPrettyPrint(hypAPI.OSGameConfigs)
-	StructPrettyPrint(hypAPI.CNGameBranches)
-	StructPrettyPrint(hypAPI.OSGameBranches)
+// requireOnline skips tests that talk to the real HYP and Sophon services unless SOPHON_ONLINE_TESTS is set.
+// The e2e tests cover the same paths offline against internal/fakesophon.
+func requireOnline(t *testing.T) {
+	t.Helper()
+	if os.Getenv("SOPHON_ONLINE_TESTS") == "" {
+		t.Skip("set SOPHON_ONLINE_TESTS=1 to run tests against the live services")
+	}
 }
 
-func TestFetchCNGameBranches(t *testing.T) {
-	fmt.Println("Fetching CN Game Branches...")
-	for _, gameBranch := range hypAPI.CNGameBranches.Data.GameBranches {
-		mainBranch := gameBranch.Main
-		url := hypAPI.BuildSophonGetBuildURL("cn", mainBranch)
-		fmt.Println(url)
-		sophon := hypAPI.GetSophonBuild(url)
-		if sophon.Retcode != 0 {
-			t.Logf("Error fetching Sophon build for %s: %s\n", mainBranch.Branch, sophon.Message)
+func TestHypAPIConfigs(t *testing.T) {
+	requireOnline(t)
+	for _, relType := range []string{"cn", "os"} {
+		configs, err := hypAPI.Metadata.GameConfigs(context.Background(), relType)
+		if err != nil {
+			t.Fatalf("GameConfigs(%s): %v", relType, err)
+		}
+		StructPrettyPrint(configs)
+		branches, err := hypAPI.Metadata.GameBranches(context.Background(), relType)
+		if err != nil {
+			t.Fatalf("GameBranches(%s): %v", relType, err)
 		}
+		StructPrettyPrint(branches)
 	}
 }
 
+func TestFetchCNGameBranches(t *testing.T) {
+	requireOnline(t)
+	fetchGameBranches(t, "cn")
+}
+
 func TestFetchOSGameBranches(t *testing.T) {
-	fmt.Println("Fetching OS Game Branches...")
-	for _, gameBranch := range hypAPI.OSGameBranches.Data.GameBranches {
+	requireOnline(t)
+	fetchGameBranches(t, "os")
+}
+
+func fetchGameBranches(t *testing.T, relType string) {
+	fmt.Printf("Fetching %s Game Branches...\n", strings.ToUpper(relType))
+	branches, err := hypAPI.Metadata.GameBranches(context.Background(), relType)
+	if err != nil {
+		t.Fatalf("GameBranches(%s): %v", relType, err)
+	}
+	for _, gameBranch := range branches.Data.GameBranches {
 		mainBranch := gameBranch.Main
-		url := hypAPI.BuildSophonGetBuildURL("os", mainBranch)
+		url := hypAPI.BuildSophonGetBuildURL(relType, mainBranch)
 		fmt.Println(url)
-		sophon := hypAPI.GetSophonBuild(url)
-		if sophon.Retcode != 0 {
-			t.Logf("Error fetching Sophon build for %s: %s\n", mainBranch.Branch, sophon.Message)
+		if _, err := hypAPI.GetSophonBuild(context.Background(), url); err != nil {
+			t.Logf("Error fetching Sophon build for %s: %v\n", mainBranch.Branch, err)
 		}
 	}
 }
 
 func TestParseAllManifests(t *testing.T) {
-	mani, info := operations.GetManifest("hkrpg", "os", "game", "main")
-	inst := installer.NewInstaller(".", ".", 100)
-	_ = inst.ParseManifest(mani, info.ChunkDownload)
-
-	mani, info = operations.GetManifest("hkrpg", "cn", "game", "main")
-	inst = installer.NewInstaller(".", ".", 100)
-	_ = inst.ParseManifest(mani, info.ChunkDownload)
-
-	mani, info = operations.GetManifest("hk4e", "os", "game", "main")
-	inst = installer.NewInstaller(".", ".", 100)
-	_ = inst.ParseManifest(mani, info.ChunkDownload)
-
-	mani, info = operations.GetManifest("hk4e", "cn", "game", "main")
-	inst = installer.NewInstaller(".", ".", 100)
-	_ = inst.ParseManifest(mani, info.ChunkDownload)
-
-	mani, info = operations.GetManifest("bh3", "os", "game", "main")
-	inst = installer.NewInstaller(".", ".", 100)
-	_ = inst.ParseManifest(mani, info.ChunkDownload)
-
-	mani, info = operations.GetManifest("bh3", "cn", "game", "main")
-	inst = installer.NewInstaller(".", ".", 100)
-	_ = inst.ParseManifest(mani, info.ChunkDownload)
-
-	mani, info = operations.GetManifest("nap", "os", "game", "main")
-	inst = installer.NewInstaller(".", ".", 100)
-	_ = inst.ParseManifest(mani, info.ChunkDownload)
-
-	mani, info = operations.GetManifest("nap", "cn", "game", "main")
-	inst = installer.NewInstaller(".", ".", 100)
-	_ = inst.ParseManifest(mani, info.ChunkDownload)
+	requireOnline(t)
+	for _, gameType := range []string{"hkrpg", "hk4e", "bh3", "nap"} {
+		for _, relType := range []string{"os", "cn"} {
+			mani, info, err := operations.GetManifest(context.Background(), gameType, relType, "game", "main")
+			if err != nil {
+				t.Errorf("GetManifest(%s, %s): %v", gameType, relType, err)
+				continue
+			}
+			inst := installer.NewInstaller(".", ".", installer.Options{QueueSize: 100})
+			_ = inst.ParseManifest(mani, info.ChunkDownload)
+		}
+	}
 }
 
 func TestFullInstallation(t *testing.T) {
+	requireOnline(t)
+	gameDir := os.Getenv("SOPHON_TEST_GAME_DIR")
+	if gameDir == "" {
+		t.Skip("set SOPHON_TEST_GAME_DIR to the directory to install hk4e into")
+	}
+
 	f_c, err := os.Create("cpu.prof")
 	if err != nil {
 		t.Fatalf("Could not create CPU profile: %v", err)
@@ -99,12 +107,20 @@ func TestFullInstallation(t *testing.T) {
 	}
 	defer pprof.StopCPUProfile()
 
-	mani, info := operations.GetManifest("hk4e", "os", "game", "main")
-	inst := installer.NewInstaller("/Volumes/SSD/Games/Genshin Impact game1", "/Volumes/SSD/Games/Genshin Impact game1/.cache", 50)
+	mani, info, err := operations.GetManifest(context.Background(), "hk4e", "os", "game", "main")
+	if err != nil {
+		t.Fatalf("GetManifest failed: %v", err)
+	}
+	inst := installer.NewInstaller(gameDir, filepath.Join(gameDir, ".cache"), installer.Options{QueueSize: 50})
 	_ = inst.ParseManifest(mani, info.ChunkDownload)
-	_ = inst.Prepare()
-	inst.Start()
-	inst.Wait()
+	ctx := context.Background()
+	if err := inst.Prepare(ctx); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	inst.Start(ctx)
+	if err := inst.Wait(); err != nil {
+		t.Fatalf("Installation failed: %v", err)
+	}
 	inst.Stop()
 
 	if err := pprof.Lookup("heap").WriteTo(f_m, 0); err != nil {
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/hypAPI"
+	"SophonClientv2/pkg/manifest"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestClient(serverURL string) *hypAPI.Client {
+	client := hypAPI.NewClient()
+	client.UserAgent = "sophon-test"
+	client.Endpoints = map[string]hypAPI.Endpoints{
+		"os": {HYPAPIPrefix: serverURL + "/", LauncherID: "test", SophonAPIBase: serverURL + "/downloader/sophon_chunk/api/getBuild"},
+	}
+	return client
+}
+
+func TestClientUsesEndpointsAndUserAgent(t *testing.T) {
+	want := &models.Manifest{Files: []*models.FileInfo{{Filename: "a.txt", Size: 3}}}
+	manifestData, err := proto.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/downloader/sophon_chunk/api/getBuild", func(w http.ResponseWriter, r *http.Request) {
+		if ua := r.Header.Get("User-Agent"); ua != "sophon-test" {
+			t.Errorf("getBuild User-Agent = %q", ua)
+		}
+		if r.URL.Query().Get("branch") != "main" {
+			t.Errorf("getBuild branch = %q", r.URL.Query().Get("branch"))
+		}
+		_, _ = w.Write([]byte(`{"retcode":0,"message":"OK","data":{"tag":"1.0.0","manifests":[{"matching_field":"game",` +
+			`"manifest":{"id":"m1"},"manifest_download":{"url_prefix":"` + "http://" + r.Host + `/manifests"}}]}}`))
+	})
+	mux.HandleFunc("/manifests/m1", func(w http.ResponseWriter, r *http.Request) {
+		if ua := r.Header.Get("User-Agent"); ua != "sophon-test" {
+			t.Errorf("manifest User-Agent = %q", ua)
+		}
+		_, _ = w.Write(manifestData)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := newTestClient(server.URL)
+	build, err := client.GetSophonBuildByBranch(context.Background(), "os", models.HYPGameBranch{PackageId: "p", Branch: "main", Password: "x"})
+	if err != nil {
+		t.Fatalf("GetSophonBuildByBranch: %v", err)
+	}
+	if build.Data.Tag != "1.0.0" || len(build.Data.Manifests) != 1 {
+		t.Fatalf("unexpected build: %+v", build)
+	}
+
+	mani, err := manifest.GetManifest(context.Background(), client, build.Data.Manifests[0])
+	if err != nil {
+		t.Fatalf("GetManifest: %v", err)
+	}
+	if len(mani.GetFiles()) != 1 || mani.GetFiles()[0].GetFilename() != "a.txt" {
+		t.Fatalf("unexpected manifest: %v", mani)
+	}
+}
+
+func TestClientTypedErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "getGameBranches") {
+			http.Error(w, "gone", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"retcode":-502,"message":"invalid launcher"}`))
+	}))
+	defer server.Close()
+
+	client := newTestClient(server.URL)
+	_, err := client.GetGameBranches(context.Background(), "os")
+	var apiErr *hypAPI.APIError
+	if !errors.Is(err, hypAPI.ErrHTTPStatus) || !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("GetGameBranches error = %v, want HTTP 404", err)
+	}
+	_, err = client.GetGameConfigs(context.Background(), "os")
+	if !errors.Is(err, hypAPI.ErrRetcode) || !errors.As(err, &apiErr) || apiErr.Retcode != -502 {
+		t.Fatalf("GetGameConfigs error = %v, want retcode -502", err)
+	}
+}
+
+// TestClientCancelled stops waiting for a hanging response and between retries once ctx is cancelled.
+func TestClientCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "getGameBranches") {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	client := newTestClient(server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetGameBranches(ctx, "os"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("hanging request: error = %v, want context.DeadlineExceeded", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// The 503 that was being retried is reported
+	if _, err := client.GetGameConfigs(ctx, "os"); !errors.Is(err, hypAPI.ErrHTTPStatus) {
+		t.Errorf("retried request: error = %v, want the HTTP 503", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("retried request returned after %s, want right after the cancellation", elapsed)
+	}
+}
+
+func TestMetadataCacheRevalidatesWithETag(t *testing.T) {
+	var requests, notModified atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(`{"retcode":0,"message":"OK","data":{"game_branches":[{"game":{"biz":"hk4e_global"},"main":{"tag":"5.1.0"}}]}}`))
+	}))
+	defer server.Close()
+
+	cache := hypAPI.NewMetadataCache(time.Nanosecond, t.TempDir())
+	cache.Client = newTestClient(server.URL)
+	for i := 0; i < 2; i++ {
+		branches, err := cache.GameBranches(context.Background(), "os")
+		if err != nil {
+			t.Fatalf("GameBranches: %v", err)
+		}
+		if len(branches.Data.GameBranches) != 1 || branches.Data.GameBranches[0].Main.Tag != "5.1.0" {
+			t.Fatalf("unexpected branches: %+v", branches)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if requests.Load() != 2 || notModified.Load() != 1 {
+		t.Fatalf("requests = %d, not modified = %d, want 2 and 1", requests.Load(), notModified.Load())
+	}
+
+	// Offline: the on-disk copy is served
+	server.Close()
+	offline := hypAPI.NewMetadataCache(time.Hour, cache.Dir)
+	offline.Client = cache.Client
+	if _, err := offline.GameBranches(context.Background(), "os"); err != nil {
+		t.Fatalf("GameBranches from disk: %v", err)
+	}
+}
+
+// TestMetadataCacheConcurrentLookups shares one request between lookups of the same entry,
+// while a lookup of another entry does not wait for it.
+func TestMetadataCacheConcurrentLookups(t *testing.T) {
+	var configRequests atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "getGameConfigs") {
+			configRequests.Add(1)
+			<-release
+			_, _ = w.Write([]byte(`{"retcode":0,"message":"OK","data":{}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"retcode":0,"message":"OK","data":{"game_branches":[{"game":{"biz":"hk4e_global"},"main":{"tag":"5.1.0"}}]}}`))
+	}))
+	defer server.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	cache := hypAPI.NewMetadataCache(time.Hour, t.TempDir())
+	cache.Client = newTestClient(server.URL)
+
+	const lookups = 5
+	errs := make(chan error, lookups)
+	for range lookups {
+		go func() {
+			_, err := cache.GameConfigs(context.Background(), "os")
+			errs <- err
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); configRequests.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("configs were never requested")
+		}
+	}
+
+	branches := make(chan error, 1)
+	go func() {
+		_, err := cache.GameBranches(context.Background(), "os")
+		branches <- err
+	}()
+	select {
+	case err := <-branches:
+		if err != nil {
+			t.Fatalf("GameBranches: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GameBranches waited for the configs request")
+	}
+
+	close(release)
+	for range lookups {
+		if err := <-errs; err != nil {
+			t.Errorf("GameConfigs: %v", err)
+		}
+	}
+	if n := configRequests.Load(); n != 1 {
+		t.Errorf("%d configs requests for %d concurrent lookups, want 1", n, lookups)
+	}
+}
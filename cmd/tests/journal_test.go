@@ -0,0 +1,178 @@
+package main
+
+import (
+	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/installer"
+	"SophonClientv2/pkg/operations"
+	"bufio"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stagedChunk is one "A" record of the staging journal.
+type stagedChunk struct {
+	file    string
+	chunkID string
+	offset  int64
+}
+
+// readJournalRecords returns the chunk instances the journal in stagingDir still lists as assembled.
+func readJournalRecords(t *testing.T, stagingDir string) []stagedChunk {
+	t.Helper()
+	f, err := os.Open(filepath.Join(stagingDir, ".sophon_journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	records := make(map[string][]stagedChunk)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		switch {
+		case fields[0] == "A" && len(fields) == 3:
+			chunkID, offset, _ := strings.Cut(fields[2], ":")
+			n, err := strconv.ParseInt(offset, 10, 64)
+			if err != nil {
+				t.Fatalf("journal record %q", scanner.Text())
+			}
+			records[fields[1]] = append(records[fields[1]], stagedChunk{file: fields[1], chunkID: chunkID, offset: n})
+		case fields[0] == "R" && len(fields) == 2:
+			delete(records, fields[1])
+		}
+	}
+	var staged []stagedChunk
+	for _, chunks := range records {
+		staged = append(staged, chunks...)
+	}
+	return staged
+}
+
+// chunkIDOf names a chunk like the fake server does.
+func chunkIDOf(data []byte) string {
+	return fmt.Sprintf("%x_%d", md5.Sum(data), len(data))
+}
+
+// newGameInstaller prepares an installer for the game of the fake server.
+func newGameInstaller(t *testing.T, ctx context.Context, gameDir string, opts installer.Options) *installer.Installer {
+	t.Helper()
+	mani, info, err := operations.GetManifest(context.Background(), "hk4e", "os", "game", "main")
+	if err != nil {
+		t.Fatalf("GetManifest: %v", err)
+	}
+	inst := installer.NewInstaller(gameDir, filepath.Join(gameDir, ".sophon_staging"), opts)
+	if err := inst.ParseManifest(mani, info.ChunkDownload); err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Prepare(ctx); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	return inst
+}
+
+// TestInstallerResumesFromJournal interrupts an install after a few chunks were assembled and runs
+// it again on the same directory. Journaled chunks are taken from staging instead of downloaded
+// again, except one whose staged data was corrupted in between.
+func TestInstallerResumesFromJournal(t *testing.T) {
+	srv := startFakeSophon(t)
+	srv.ChunkSize = 4096
+	files := syntheticGame(rand.New(rand.NewSource(13)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+	gameDir := t.TempDir()
+	stagingDir := filepath.Join(gameDir, ".sophon_staging")
+
+	// A slow single download worker, so the install is still far from done when it is interrupted
+	slow := installer.Options{QueueSize: 64, Downloader: downloader.Options{Workers: 1, RateLimit: 64 << 10}}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	first := newGameInstaller(t, ctx, gameDir, slow)
+	runCtx, interrupt := context.WithCancel(ctx)
+	first.Start(runCtx)
+	for first.Progress.Snapshot().AssembledChunks < 8 {
+		if ctx.Err() != nil {
+			t.Fatal("timed out waiting for assembled chunks")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	interrupt()
+	if err := first.Wait(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted install = %v, want context.Canceled", err)
+	}
+	first.Stop()
+
+	staged := readJournalRecords(t, stagingDir)
+	if len(staged) < 2 {
+		t.Fatalf("%d chunks journaled, want a few", len(staged))
+	}
+	// Chunks used elsewhere as well are downloaded again for their other destinations
+	instances := make(map[string]int)
+	for _, data := range files {
+		for offset := 0; offset < len(data); offset += srv.ChunkSize {
+			instances[chunkIDOf(data[offset:min(offset+srv.ChunkSize, len(data))])]++
+		}
+	}
+	journaled := make(map[string]int)
+	for _, c := range staged {
+		journaled[c.chunkID]++
+	}
+	var reusable []stagedChunk
+	for _, c := range staged {
+		if journaled[c.chunkID] == instances[c.chunkID] {
+			reusable = append(reusable, c)
+		}
+	}
+	if len(reusable) < 2 {
+		t.Fatalf("%d chunks journaled for all their destinations, want a few", len(reusable))
+	}
+
+	corrupted := reusable[0]
+	f, err := os.OpenFile(filepath.Join(stagingDir, corrupted.file), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, corrupted.offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, corrupted.offset); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	before := make(map[string]int)
+	for _, c := range reusable {
+		before[c.chunkID] = srv.Requests("/chunks/" + c.chunkID)
+	}
+	second := newGameInstaller(t, ctx, gameDir, installer.Options{QueueSize: 64})
+	second.Start(ctx)
+	if err := second.Wait(); err != nil {
+		t.Fatalf("resumed install: %v", err)
+	}
+	second.Stop()
+	assertGameDir(t, gameDir, files)
+
+	if n := srv.Requests("/chunks/" + corrupted.chunkID); n == before[corrupted.chunkID] {
+		t.Errorf("corrupted staged chunk %s was not downloaded again", corrupted.chunkID)
+	}
+	for _, c := range reusable[1:] {
+		if c.chunkID == corrupted.chunkID {
+			continue
+		}
+		if n := srv.Requests("/chunks/" + c.chunkID); n != before[c.chunkID] {
+			t.Errorf("journaled chunk %s of %s was downloaded again", c.chunkID, c.file)
+		}
+	}
+	t.Logf("resumed with %d of %d journaled chunks", len(reusable)-1, len(staged))
+}
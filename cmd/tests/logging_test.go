@@ -0,0 +1,160 @@
+package main
+
+import (
+	"SophonClientv2/internal/config"
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/operations"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readJSONLines(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []map[string]any
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var rec map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestStructuredLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.NewWithHandler(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	logger.With(logging.KeyStage, "assembler", logging.KeyWorker, 2).Warn("Failed to write chunk", logging.KeyChunkID, "c1", logging.KeyFile, "a/b.pck")
+	logger.Debug("filtered")
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("expected one JSON record, got %q: %v", buf.String(), err)
+	}
+	if rec["msg"] != "Failed to write chunk" || rec["level"] != "WARN" || rec["stage"] != "assembler" ||
+		rec["worker"] != float64(2) || rec["chunk_id"] != "c1" || rec["file"] != "a/b.pck" {
+		t.Errorf("unexpected record %v", rec)
+	}
+}
+
+func TestTaskLogSinks(t *testing.T) {
+	logger := logging.NewWithHandler(slog.NewTextHandler(&bytes.Buffer{}, nil))
+	path := filepath.Join(t.TempDir(), "t1.log")
+	if err := logging.OpenTaskLog("t1", path); err != nil {
+		t.Fatal(err)
+	}
+	sub := logging.Subscribe("t1", 16)
+	defer sub.Close()
+
+	task := logger.With(logging.KeyTaskID, "t1")
+	task.With(logging.KeyStage, "verifier").Info("MD5 mismatch", "name", "chunk-a")
+	task.Slog().WithGroup("http").Info("Request failed", "status", 503)
+	logger.Info("Unrelated", logging.KeyTaskID, "t2")
+	logger.Info("No task")
+	if err := logging.CloseTaskLog("t1"); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readJSONLines(t, path)
+	if len(records) != 2 {
+		t.Fatalf("task log has %d records, want 2: %v", len(records), records)
+	}
+	if records[0]["task_id"] != "t1" || records[0]["stage"] != "verifier" || records[0]["name"] != "chunk-a" {
+		t.Errorf("unexpected first record %v", records[0])
+	}
+	if group, _ := records[1]["http"].(map[string]any); group["status"] != float64(503) {
+		t.Errorf("grouped attribute lost: %v", records[1])
+	}
+
+	select {
+	case entry := <-sub.C:
+		if entry.TaskID != "t1" || entry.Message != "MD5 mismatch" || entry.Attrs["stage"] != "verifier" {
+			t.Errorf("unexpected entry %+v", entry)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber received nothing")
+	}
+	if e := <-sub.C; e.Attrs["http.status"] != int64(503) {
+		t.Errorf("grouped attribute not flattened: %+v", e)
+	}
+	select {
+	case e := <-sub.C:
+		t.Errorf("subscriber for t1 received %+v", e)
+	default:
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sophon.log")
+	rf, err := logging.OpenRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(strings.Repeat("x", 29) + "\n")
+	for i := 0; i < 20; i++ {
+		if _, err := rf.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf.Close()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("missing %s: %v", filepath.Base(name), err)
+		}
+		if info.Size() > 100 {
+			t.Errorf("%s has %d bytes, limit is 100", filepath.Base(name), info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more backups than configured: %v", err)
+	}
+}
+
+func TestE2ETaskLogFile(t *testing.T) {
+	saved := config.Config
+	defer func() { config.Config = saved }()
+	config.Config.TaskLogDir = t.TempDir()
+
+	srv := startFakeSophon(t)
+	if err := srv.SetGame("hk4e", "os", "5.0.0", syntheticGame(rand.New(rand.NewSource(31)))); err != nil {
+		t.Fatal(err)
+	}
+	status := waitForTask(t, operations.PerformInstall(models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: t.TempDir(), GameType: "hk4e"},
+		InstallRelType:       "os",
+	}))
+	requireCompleted(t, status)
+
+	stages := make(map[any]bool)
+	records := readJSONLines(t, filepath.Join(config.Config.TaskLogDir, status.TaskID+".log"))
+	for _, rec := range records {
+		if rec["task_id"] != status.TaskID {
+			t.Fatalf("record of another task in the task log: %v", rec)
+		}
+		stages[rec["stage"]] = true
+	}
+	if last := records[len(records)-1]; last["msg"] != "Task completed" {
+		t.Errorf("last record = %v, want the completion", last)
+	}
+	for _, stage := range []string{"downloader", "decompressor", "verifier", "assembler"} {
+		if !stages[stage] {
+			t.Errorf("no records from the %s in the task log", stage)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"SophonClientv2/pkg/hypAPI"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCacheEntry(t *testing.T, dir, key string, body string, fetchedAt time.Time) {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{
+		"body":       json.RawMessage(body),
+		"fetched_at": fetchedAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, key+".json"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetadataCacheServesFreshDiskEntry(t *testing.T) {
+	dir := t.TempDir()
+	body := `{"retcode":0,"message":"OK","data":{"game_branches":[{"game":{"id":"1","biz":"hk4e_global"},"main":{"package_id":"p","branch":"main","password":"x","tag":"5.0.0"}}]}}`
+	writeCacheEntry(t, dir, "getGameBranches_os", body, time.Now())
+
+	cache := hypAPI.NewMetadataCache(time.Hour, dir)
+	branches, err := cache.GameBranches(context.Background(), "os")
+	if err != nil {
+		t.Fatalf("GameBranches: %v", err)
+	}
+	if len(branches.Data.GameBranches) != 1 || branches.Data.GameBranches[0].Main.Tag != "5.0.0" {
+		t.Fatalf("unexpected branches: %+v", branches)
+	}
+}
+
+func TestMetadataCacheRejectsCachedRetcode(t *testing.T) {
+	dir := t.TempDir()
+	writeCacheEntry(t, dir, "getGameConfigs_cn", `{"retcode":-1,"message":"bad"}`, time.Now())
+
+	cache := hypAPI.NewMetadataCache(time.Hour, dir)
+	if _, err := cache.GameConfigs(context.Background(), "cn"); err == nil {
+		t.Fatal("expected an error for a cached non-zero retcode")
+	}
+}
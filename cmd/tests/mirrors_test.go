@@ -0,0 +1,141 @@
+package main
+
+import (
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/operations"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirrorPrefixes(t *testing.T) {
+	got := downloader.MirrorPrefixes("https://cdn.example/client/chunks", []string{"http://mirror.example", " https://other.example/mirror/chunks ", "not a url", ""})
+	want := []string{"https://cdn.example/client/chunks", "http://mirror.example/client/chunks", "https://other.example/mirror/chunks"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("MirrorPrefixes = %q, want %q", got, want)
+	}
+}
+
+// mirrorServer serves the path as content after delay, or fails with status when it is set.
+func mirrorServer(t *testing.T, delay time.Duration, status int, hits *atomic.Int64) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(delay)
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		io.WriteString(w, strings.Repeat(r.URL.Path, 512))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// downloadAll enqueues n chunks below prefix, the queue size has to hold all of them.
+func downloadAll(t *testing.T, d *downloader.Downloader, prefix string, n int) []downloader.DownloaderOutput {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	d.Start(ctx)
+	go func() {
+		for i := 0; i < n; i++ {
+			d.EnqueueDownload(prefix+"/chunk"+strconv.Itoa(i), i)
+		}
+		d.Stop()
+	}()
+	var outputs []downloader.DownloaderOutput
+	for out := range d.GetOutputChannel() {
+		outputs = append(outputs, out)
+	}
+	return outputs
+}
+
+// TestMirrorFailover downloads from a primary that always fails; every chunk must come from the mirror,
+// and the primary must be taken out of rotation instead of being retried for every chunk.
+func TestMirrorFailover(t *testing.T) {
+	var badHits, goodHits atomic.Int64
+	bad := mirrorServer(t, 0, http.StatusServiceUnavailable, &badHits)
+	good := mirrorServer(t, 0, 0, &goodHits)
+
+	d := downloader.NewDownloader(downloader.Options{Workers: 1, QueueSize: 64, MaxRetries: 2})
+	d.SetMirrors(downloader.NewMirrors(bad.URL+"/chunks", good.URL+"/chunks"))
+	outputs := downloadAll(t, d, bad.URL+"/chunks", 30)
+	for _, out := range outputs {
+		want := strings.Repeat("/chunks/chunk"+strconv.Itoa(out.Payload.(int)), 512)
+		if !out.Suceeded || !strings.HasPrefix(out.Source, good.URL) {
+			t.Fatalf("chunk %v: succeeded=%v source=%s", out.Payload, out.Suceeded, out.Source)
+		}
+		if got, _ := io.ReadAll(out.Content); string(got) != want {
+			t.Fatalf("chunk %v has the wrong content", out.Payload)
+		}
+	}
+	if len(outputs) != 30 {
+		t.Fatalf("got %d outputs, want 30", len(outputs))
+	}
+	if badHits.Load() > 5 {
+		t.Errorf("failing primary was requested %d times for 30 chunks", badHits.Load())
+	}
+	stats := d.Mirrors().Stats()
+	if stats[0].Errors != badHits.Load() || stats[0].ErrorRate == 0 || stats[1].Requests != 30 || stats[1].Errors != 0 {
+		t.Errorf("unexpected mirror stats %+v", stats)
+	}
+}
+
+func TestMirrorPrefersFaster(t *testing.T) {
+	var slowHits, fastHits atomic.Int64
+	slow := mirrorServer(t, 30*time.Millisecond, 0, &slowHits)
+	fast := mirrorServer(t, 0, 0, &fastHits)
+
+	d := downloader.NewDownloader(downloader.Options{Workers: 1, QueueSize: 64})
+	d.SetMirrors(downloader.NewMirrors(slow.URL, fast.URL))
+	downloadAll(t, d, slow.URL, 40)
+	if fastHits.Load() < 30 {
+		t.Errorf("fast mirror served %d of 40 chunks, slow one %d", fastHits.Load(), slowHits.Load())
+	}
+}
+
+// TestE2EMirrorCorruption installs through a mirror that flips a byte of every chunk. Checksum
+// failures must be blamed on the mirror so the install finishes from the official server.
+func TestE2EMirrorCorruption(t *testing.T) {
+	srv := startFakeSophon(t)
+	srv.ChunkSize = 4096
+	files := syntheticGame(rand.New(rand.NewSource(41)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+	var mirrorHits atomic.Int64
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorHits.Add(1)
+		resp, err := http.Get(srv.URL + r.URL.Path)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		data[len(data)/2] ^= 0xff
+		w.Write(data)
+	}))
+	defer mirror.Close()
+
+	gameDir := t.TempDir()
+	status := waitForTask(t, operations.PerformInstall(models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: gameDir, GameType: "hk4e", Mirrors: []string{mirror.URL}},
+		InstallRelType:       "os",
+	}))
+	requireCompleted(t, status)
+	assertGameDir(t, gameDir, files)
+
+	chunks := srv.Requests("/chunks/")
+	if mirrorHits.Load() == 0 || mirrorHits.Load() > int64(chunks)/4 {
+		t.Errorf("corrupting mirror served %d requests next to %d from the official server", mirrorHits.Load(), chunks)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"SophonClientv2/internal/config"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/decompressor"
+	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/installer"
+	"SophonClientv2/pkg/operations"
+	"SophonClientv2/pkg/verifier"
+	"math/rand"
+	"testing"
+)
+
+func TestInstallerOptions(t *testing.T) {
+	background := installer.NewInstaller(t.TempDir(), t.TempDir(), installer.Options{
+		Downloader: downloader.Options{Workers: 2, MaxRetries: 1},
+		Verifier:   verifier.Options{Workers: 1},
+	})
+	foreground := installer.NewInstaller(t.TempDir(), t.TempDir(), installer.DefaultOptions())
+
+	if background.Downloader.ThreadCount != 2 || background.Downloader.Options.MaxRetries != 1 {
+		t.Errorf("background downloader = %d workers, %d retries", background.Downloader.ThreadCount, background.Downloader.Options.MaxRetries)
+	}
+	if background.Verifier.ThreadCount != 1 || background.Verifier2.ThreadCount != 1 {
+		t.Errorf("background verifiers = %d and %d workers", background.Verifier.ThreadCount, background.Verifier2.ThreadCount)
+	}
+	if !background.Verifier.ReturnContent || background.Verifier2.ReturnContent {
+		t.Error("chunk verifier must return content, file verifier must not")
+	}
+	// Unset fields come from the configuration
+	if got, want := background.Decompressor.ThreadCount, decompressor.DefaultOptions().Workers; got != want {
+		t.Errorf("background decompressor = %d workers, want configured %d", got, want)
+	}
+	if cap(background.InputQueue) != config.Config.DownloadChanSize {
+		t.Errorf("input queue = %d, want configured %d", cap(background.InputQueue), config.Config.DownloadChanSize)
+	}
+	if got := foreground.Downloader.ThreadCount; got != config.Config.CocurrentDownloads {
+		t.Errorf("foreground downloader = %d workers, want configured %d", got, config.Config.CocurrentDownloads)
+	}
+}
+
+func TestE2EInstallWithTaskLimits(t *testing.T) {
+	srv := startFakeSophon(t)
+	files := syntheticGame(rand.New(rand.NewSource(6)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: t.TempDir(), GameType: "hk4e", Downloads: 1000},
+		InstallRelType:       "os",
+	}
+	if errs := models.Validate(invalid); len(errs) != 1 {
+		t.Errorf("Validate(downloads=1000) = %v, want one error", errs)
+	}
+
+	gameDir := t.TempDir()
+	status := waitForTask(t, operations.PerformInstall(models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: gameDir, GameType: "hk4e", Downloads: 1, Decompressions: 1, Hashchecks: 1},
+		InstallRelType:       "os",
+	}))
+	requireCompleted(t, status)
+	assertGameDir(t, gameDir, files)
+}
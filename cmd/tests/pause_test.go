@@ -0,0 +1,156 @@
+package main
+
+import (
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/operations"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitForProgress polls the progress of a task until done returns true.
+func waitForProgress(t *testing.T, taskID string, done func(models.TaskProgress) bool) models.TaskProgress {
+	t.Helper()
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if progress, ok := operations.GetTaskProgress(taskID); ok && done(progress) {
+			return progress
+		}
+		if time.Now().After(deadline) {
+			status, _ := operations.GetTaskStatus(taskID)
+			t.Fatalf("task %s is %s, progress never reached the expected state", taskID, status.Status)
+		}
+	}
+}
+
+// TestPauseResumeTask pauses an install mid-download. Once the chunks already handed to the
+// downloader are done no further chunks are requested, and after resuming the install completes.
+func TestPauseResumeTask(t *testing.T) {
+	srv := startFakeSophon(t)
+	srv.ChunkSize = 4096
+	files := syntheticGame(rand.New(rand.NewSource(21)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+	gameDir := t.TempDir()
+
+	// A slow single download worker, so the install is still far from done when it is paused
+	resp := operations.PerformInstall(models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: gameDir, GameType: "hk4e", Downloads: 1, RateLimit: 128},
+		InstallRelType:       "os",
+	})
+	if resp.TaskID == "" {
+		t.Fatalf("task was not started: %+v", resp)
+	}
+	total := waitForProgress(t, resp.TaskID, func(p models.TaskProgress) bool { return p.DownloadedChunks >= 4 }).TotalChunks
+
+	status, err := operations.PauseTask(resp.TaskID)
+	if err != nil || status.Status != operations.StatusPaused {
+		t.Fatalf("PauseTask = %s, %v, want paused", status.Status, err)
+	}
+	if _, err := operations.PauseTask(resp.TaskID); !errors.Is(err, operations.ErrTaskNotPausable) {
+		t.Errorf("pausing a paused task = %v, want ErrTaskNotPausable", err)
+	}
+
+	// Chunks already dispatched finish, after that the chunk requests stop
+	requested := srv.Requests("/chunks/")
+	for stable := time.Now(); time.Since(stable) < time.Second; time.Sleep(50 * time.Millisecond) {
+		if n := srv.Requests("/chunks/"); n != requested {
+			requested, stable = n, time.Now()
+		}
+	}
+	progress, _ := operations.GetTaskProgress(resp.TaskID)
+	if !progress.Paused {
+		t.Error("progress of the paused task is not marked paused")
+	}
+	if progress.ETASeconds != nil {
+		t.Errorf("paused task has an ETA of %.1fs", *progress.ETASeconds)
+	}
+	if requested >= total {
+		t.Fatalf("%d chunks requested while paused, the whole game has %d", requested, total)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if n := srv.Requests("/chunks/"); n != requested {
+		t.Fatalf("%d chunks requested while paused", n-requested)
+	}
+	if status, _ := operations.GetTaskStatus(resp.TaskID); status.Status != operations.StatusPaused {
+		t.Fatalf("task is %s while paused", status.Status)
+	}
+
+	status, err = operations.ResumeTask(resp.TaskID)
+	if err != nil || status.Status != operations.StatusRunning {
+		t.Fatalf("ResumeTask = %s, %v, want running", status.Status, err)
+	}
+	requireCompleted(t, waitForTask(t, resp))
+	assertGameDir(t, gameDir, files)
+	t.Logf("paused after %d of %d chunk requests", requested, total)
+}
+
+// TestResumeFailedTask starts a failed install again from its stored request.
+func TestResumeFailedTask(t *testing.T) {
+	srv := startFakeSophon(t)
+	gameDir := t.TempDir()
+	resp := operations.PerformInstall(models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: gameDir, GameType: "hk4e"},
+		InstallRelType:       "os",
+	})
+	// Nothing is published yet
+	if status := waitForTask(t, resp); status.Status != operations.StatusFailed {
+		t.Fatalf("install of a missing game ended %s, want failed", status.Status)
+	}
+
+	files := syntheticGame(rand.New(rand.NewSource(22)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+	status, err := operations.ResumeTask(resp.TaskID)
+	if err != nil {
+		t.Fatalf("ResumeTask: %v", err)
+	}
+	if status.TaskID != resp.TaskID || status.Error != nil {
+		t.Errorf("resumed status %+v", status)
+	}
+	requireCompleted(t, waitForTask(t, resp))
+	assertGameDir(t, gameDir, files)
+
+	if _, err := operations.ResumeTask(resp.TaskID); !errors.Is(err, operations.ErrTaskNotResumable) {
+		t.Errorf("resuming a completed task = %v, want ErrTaskNotResumable", err)
+	}
+}
+
+// TestResumeInterruptedTask loads a task that was running when the previous process exited
+// and starts it again from its stored request.
+func TestResumeInterruptedTask(t *testing.T) {
+	srv := startFakeSophon(t)
+	files := syntheticGame(rand.New(rand.NewSource(23)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+	gameDir := t.TempDir()
+	request, err := json.Marshal(models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: gameDir, GameType: "hk4e"},
+		InstallRelType:       "os",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := filepath.Join(t.TempDir(), "tasks.json")
+	writeTaskStore(t, store, map[string]any{
+		"task_id": "interrupted-install", "task_type": "install", "status": operations.StatusRunning, "request": json.RawMessage(request),
+	})
+	if err := operations.InitTaskStore(store); err != nil {
+		t.Fatalf("InitTaskStore: %v", err)
+	}
+	t.Cleanup(func() { _ = operations.InitTaskStore("") })
+
+	if status, _ := operations.GetTaskStatus("interrupted-install"); status.Status != operations.StatusInterrupted {
+		t.Fatalf("loaded task is %s, want interrupted", status.Status)
+	}
+	if _, err := operations.ResumeTask("interrupted-install"); err != nil {
+		t.Fatalf("ResumeTask: %v", err)
+	}
+	requireCompleted(t, waitForTask(t, models.TaskResponse{TaskID: "interrupted-install"}))
+	assertGameDir(t, gameDir, files)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"SophonClientv2/internal/config"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/operations"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := downloader.NewRateLimiter(100 << 10)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, downloader.NewLimitedReader(context.Background(), bytes.NewReader(make([]byte, 50<<10)), l))
+	if err != nil || n != 50<<10 {
+		t.Fatalf("copied %d bytes: %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("50 KiB at 100 KiB/s took only %v", elapsed)
+	}
+
+	// A waiter is released once the limit is lifted
+	l.SetRate(1 << 10)
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, downloader.NewLimitedReader(context.Background(), bytes.NewReader(make([]byte, 32<<10)), l))
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l.SetRate(0)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second): // 32 KiB at 1 KiB/s would take 30s
+		t.Fatal("reader still throttled after the limit was removed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.SetRate(1)
+	if _, err := io.Copy(io.Discard, downloader.NewLimitedReader(ctx, bytes.NewReader(make([]byte, 1024)), l)); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled read returned %v", err)
+	}
+}
+
+func TestRateSchedule(t *testing.T) {
+	schedule, err := config.ParseRateSchedule("08:00-18:00=2048, 22:00-06:00=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(clock string) time.Time {
+		tm, _ := time.Parse("15:04", clock)
+		return tm
+	}
+	for _, tc := range []struct {
+		clock string
+		rate  int
+		ok    bool
+	}{
+		{"12:00", 2048, true},
+		{"18:00", 0, false},
+		{"23:30", 0, true},
+		{"05:59", 0, true},
+		{"07:00", 0, false},
+	} {
+		if rate, ok := schedule.RateAt(at(tc.clock)); rate != tc.rate || ok != tc.ok {
+			t.Errorf("at %s: got %d %v, want %d %v", tc.clock, rate, ok, tc.rate, tc.ok)
+		}
+	}
+	if s := schedule.String(); s != "08:00-18:00=2048,22:00-06:00=0" {
+		t.Errorf("String() = %q", s)
+	}
+	for _, bad := range []string{"08:00=10", "8-9=10", "08:00-09:00=-1", "08:00-09:00=fast"} {
+		if _, err := config.ParseRateSchedule(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+// TestDownloaderRateLimit checks the per-downloader and the global limit, and changing them at runtime.
+func TestDownloaderRateLimit(t *testing.T) {
+	blob := randomBlob(6, 64<<10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(blob)
+	}))
+	defer srv.Close()
+
+	download := func(opts downloader.Options) time.Duration {
+		d := downloader.NewDownloader(opts)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		d.Start(ctx)
+		start := time.Now()
+		d.EnqueueDownload(srv.URL, nil)
+		requireContent(t, <-d.GetOutputChannel(), blob)
+		d.Stop()
+		return time.Since(start)
+	}
+
+	if elapsed := download(downloader.Options{Workers: 1, RateLimit: 128 << 10}); elapsed < 350*time.Millisecond {
+		t.Errorf("64 KiB at 128 KiB/s took only %v", elapsed)
+	}
+
+	defer operations.SetRateLimit(models.RateLimitRequest{Limit: new(int), Schedule: new(string)})
+	limit := 128
+	status, err := operations.SetRateLimit(models.RateLimitRequest{Limit: &limit})
+	if err != nil || status.Limit != 128 || status.Effective != 128 {
+		t.Fatalf("SetRateLimit = %+v, %v", status, err)
+	}
+	throttled := download(downloader.Options{Workers: 1})
+	if throttled < 350*time.Millisecond {
+		t.Errorf("64 KiB at a global 128 KiB/s took only %v", throttled)
+	}
+
+	// A window covering the whole day overrides the limit
+	allDay := "00:00-00:00=0"
+	if status, _ = operations.SetRateLimit(models.RateLimitRequest{Schedule: &allDay}); status.Limit != 128 || status.Effective != 0 {
+		t.Errorf("schedule not applied: %+v", status)
+	}
+	// Relative to the throttled run, so a loaded machine slows both alike
+	if elapsed := download(downloader.Options{Workers: 1}); elapsed*3 > throttled {
+		t.Errorf("unlimited download took %v, throttled %v", elapsed, throttled)
+	}
+
+	bad := "soon"
+	if _, err := operations.SetRateLimit(models.RateLimitRequest{Schedule: &bad}); !errors.Is(err, operations.ErrInvalidRateLimit) {
+		t.Errorf("invalid schedule: got %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/retry"
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cuttingWriter sends at most limit body bytes and then drops the connection.
+type cuttingWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *cuttingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		w.ResponseWriter.Write(p[:w.limit])
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.limit -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// flakyServer serves blob and cuts every response after cutAfter bytes, except the last request
+// when cutRequests is positive. Without ranges it ignores Range headers.
+type flakyServer struct {
+	mu          sync.Mutex
+	blob        []byte
+	etag        string
+	ranges      bool
+	cutAfter    int
+	cutRequests int // Responses to cut, <0 cuts all
+	requests    []string
+	sent        int
+
+	next     []byte // Replaces blob after the first request, as if the chunk changed
+	nextETag string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Header.Get("Range"))
+	cut := s.cutRequests != 0
+	if s.cutRequests > 0 {
+		s.cutRequests--
+	}
+	blob, etag := s.blob, s.etag
+	if s.next != nil {
+		s.blob, s.etag, s.next = s.next, s.nextETag, nil
+	}
+	s.mu.Unlock()
+
+	counter := &countingWriter{ResponseWriter: w, s: s}
+	var out http.ResponseWriter = counter
+	if cut {
+		out = &cuttingWriter{ResponseWriter: counter, limit: s.cutAfter}
+	}
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if s.ranges {
+		http.ServeContent(out, r, "", time.Time{}, bytes.NewReader(blob))
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+	out.Write(blob)
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	s *flakyServer
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.s.mu.Lock()
+	w.s.sent += len(p)
+	w.s.mu.Unlock()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *countingWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func downloadOnce(t *testing.T, url string, retries int) downloader.DownloaderOutput {
+	t.Helper()
+	return downloadSized(t, url, 0, retries)
+}
+
+// downloadSized downloads url expecting at most size bytes, 0 for any length.
+func downloadSized(t *testing.T, url string, size int64, retries int) downloader.DownloaderOutput {
+	t.Helper()
+	d := downloader.NewDownloader(downloader.Options{Workers: 1, QueueSize: 1, MaxRetries: retries, Retry: retry.Policy{BaseDelay: time.Millisecond}})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	d.Start(ctx)
+	d.EnqueueSized(url, size, nil)
+	out := <-d.GetOutputChannel()
+	d.Stop()
+	return out
+}
+
+func requireContent(t *testing.T, out downloader.DownloaderOutput, want []byte) {
+	t.Helper()
+	if !out.Suceeded {
+		t.Fatal("download failed")
+	}
+	got, err := io.ReadAll(out.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes, want %d, contents differ", len(got), len(want))
+	}
+}
+
+func randomBlob(seed int64, n int) []byte {
+	blob := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(blob)
+	return blob
+}
+
+// TestDownloadResumesWithRange cuts every response after 16 KiB. The chunk must still arrive in full,
+// each request continuing where the previous one stopped, even with fewer retries than cuts.
+func TestDownloadResumesWithRange(t *testing.T) {
+	const size, cut = 100 << 10, 16 << 10
+	fs := &flakyServer{blob: randomBlob(1, size), etag: `"v1"`, ranges: true, cutAfter: cut, cutRequests: -1}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	requireContent(t, downloadOnce(t, srv.URL+"/chunk", 2), fs.blob)
+
+	wantRequests := (size + cut - 1) / cut
+	if len(fs.requests) != wantRequests {
+		t.Errorf("%d requests, want %d: %q", len(fs.requests), wantRequests, fs.requests)
+	}
+	for i, rng := range fs.requests {
+		want := ""
+		if i > 0 {
+			want = "bytes=" + strconv.Itoa(i*cut) + "-"
+		}
+		if rng != want {
+			t.Errorf("request %d has Range %q, want %q", i, rng, want)
+		}
+	}
+	if fs.sent != size {
+		t.Errorf("server sent %d bytes for a %d byte chunk", fs.sent, size)
+	}
+}
+
+// TestDownloadIgnoredRange falls back to full retries when the server answers Range with the whole body.
+func TestDownloadIgnoredRange(t *testing.T) {
+	fs := &flakyServer{blob: randomBlob(2, 64<<10), ranges: false, cutAfter: 10 << 10, cutRequests: 2}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	requireContent(t, downloadOnce(t, srv.URL+"/chunk", 3), fs.blob)
+	if len(fs.requests) != 3 {
+		t.Errorf("%d requests, want 3", len(fs.requests))
+	}
+}
+
+// TestDownloadChangedETag restarts from scratch when If-Range no longer matches.
+func TestDownloadChangedETag(t *testing.T) {
+	fs := &flakyServer{blob: randomBlob(3, 64<<10), etag: `"v1"`, ranges: true, cutAfter: 20 << 10, cutRequests: 1,
+		next: randomBlob(4, 48<<10), nextETag: `"v2"`}
+	newBlob := fs.next
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	requireContent(t, downloadOnce(t, srv.URL+"/chunk", 3), newBlob)
+	if len(fs.requests) != 2 || fs.requests[1] != "bytes=20480-" {
+		t.Errorf("requests with ranges %q, want one resume attempt", fs.requests)
+	}
+}
+
+// TestDownloadNoProgressFails gives up after MaxRetries when attempts keep failing without receiving anything.
+func TestDownloadNoProgressFails(t *testing.T) {
+	fs := &flakyServer{blob: randomBlob(5, 8<<10), ranges: true, cutAfter: 0, cutRequests: -1}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	if out := downloadOnce(t, srv.URL+"/chunk", 3); out.Suceeded {
+		t.Fatal("download succeeded although every response was cut before the body")
+	}
+	if len(fs.requests) != 3 {
+		t.Errorf("%d requests, want 3", len(fs.requests))
+	}
+}
+
+// TestDownloadTinyResumesUseRetries cuts every response after one byte. Such resumes use up
+// retries like any other failure instead of going on one byte at a time.
+func TestDownloadTinyResumesUseRetries(t *testing.T) {
+	fs := &flakyServer{blob: randomBlob(6, 8<<10), etag: `"v1"`, ranges: true, cutAfter: 1, cutRequests: -1}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	out := downloadOnce(t, srv.URL+"/chunk", 3)
+	if out.Suceeded {
+		t.Fatal("download succeeded although every response was cut after a byte")
+	}
+	if len(fs.requests) != 3 || out.Attempts != 3 {
+		t.Errorf("%d requests and %d attempts, want 3", len(fs.requests), out.Attempts)
+	}
+}
+
+// TestDownloadRejectsOversizedResponse fails right away, without buffering the body, when the
+// response is longer than the chunk it should be, whether or not it says so in Content-Length.
+func TestDownloadRejectsOversizedResponse(t *testing.T) {
+	blob := randomBlob(7, 64<<10)
+	for _, chunked := range []bool{false, true} {
+		var requests atomic.Int64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			if !chunked {
+				w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			}
+			w.Write(blob[:len(blob)/2])
+			w.(http.Flusher).Flush()
+			w.Write(blob[len(blob)/2:])
+		}))
+
+		out := downloadSized(t, srv.URL+"/chunk", 4096, 3)
+		srv.Close()
+		if out.Suceeded || retry.Classify(out.Err) != retry.Permanent {
+			t.Errorf("chunked %v: succeeded %v, err %v, want a permanent failure", chunked, out.Suceeded, out.Err)
+		}
+		if n := requests.Load(); n != 1 {
+			t.Errorf("chunked %v: %d requests, want 1", chunked, n)
+		}
+	}
+
+	exact := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(blob) }))
+	defer exact.Close()
+	requireContent(t, downloadSized(t, exact.URL+"/chunk", int64(len(blob)), 3), blob)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"SophonClientv2/internal/faults"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/installer"
+	"SophonClientv2/pkg/retry"
+	"SophonClientv2/pkg/updater"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryClassify(t *testing.T) {
+	cases := []struct {
+		err  error
+		want retry.Class
+	}{
+		{io.ErrUnexpectedEOF, retry.Retryable},
+		{&retry.StatusError{Code: http.StatusServiceUnavailable}, retry.Retryable},
+		{&retry.StatusError{Code: http.StatusTooManyRequests}, retry.Retryable},
+		{fmt.Errorf("wrapped: %w", &retry.StatusError{Code: http.StatusBadGateway}), retry.Retryable},
+		{&retry.StatusError{Code: http.StatusNotFound}, retry.Permanent},
+		{&retry.StatusError{Code: http.StatusForbidden}, retry.Permanent},
+		{&retry.StatusError{Code: http.StatusNotImplemented}, retry.Permanent},
+		{retry.MarkPermanent(io.ErrUnexpectedEOF), retry.Permanent},
+		{context.Canceled, retry.Permanent},
+	}
+	for _, tc := range cases {
+		if got := retry.Classify(tc.err); got != tc.want {
+			t.Errorf("Classify(%v) = %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := retry.Policy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 5: time.Second, 60: time.Second} {
+		if got := p.Delay(attempt, io.EOF); got != want {
+			t.Errorf("Delay(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	for range 100 {
+		if got := p.Delay(2, io.EOF); got < 100*time.Millisecond || got > 200*time.Millisecond {
+			t.Fatalf("jittered Delay(2) = %s, want 100ms to 200ms", got)
+		}
+	}
+
+	header := http.Header{}
+	header.Set("Retry-After", "3")
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: header}
+	if got := p.Delay(1, retry.NewStatusError(resp)); got != time.Second {
+		t.Errorf("Retry-After 3 = %s, want it capped at 1s", got)
+	}
+	p.MaxDelay = time.Minute
+	if got := p.Delay(1, retry.NewStatusError(resp)); got != 3*time.Second {
+		t.Errorf("Retry-After 3 = %s, want 3s", got)
+	}
+	header.Set("Retry-After", time.Now().Add(10*time.Second).UTC().Format(http.TimeFormat))
+	if got := p.Delay(1, retry.NewStatusError(resp)); got < 8*time.Second || got > 10*time.Second {
+		t.Errorf("Retry-After date = %s, want about 10s", got)
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	p := retry.Policy{MaxAttempts: 5, BaseDelay: time.Millisecond}
+
+	calls := 0
+	err := p.Do(context.Background(), func(attempt int) error {
+		calls++
+		if attempt < 3 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}, nil)
+	if err != nil || calls != 3 {
+		t.Errorf("transient failures: err %v after %d calls, want success after 3", err, calls)
+	}
+
+	calls = 0
+	notFound := &retry.StatusError{Code: http.StatusNotFound}
+	err = p.Do(context.Background(), func(int) error {
+		calls++
+		return notFound
+	}, nil)
+	if err != notFound || calls != 1 {
+		t.Errorf("permanent failure: err %v after %d calls, want 404 after 1", err, calls)
+	}
+
+	calls = 0
+	retries := 0
+	err = p.Do(context.Background(), func(int) error {
+		calls++
+		return io.ErrUnexpectedEOF
+	}, func(int, error, time.Duration) { retries++ })
+	if err != io.ErrUnexpectedEOF || calls != 5 || retries != 4 {
+		t.Errorf("exhausted: err %v after %d calls and %d retries, want 5 calls and 4 retries", err, calls, retries)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow := retry.Policy{MaxAttempts: 5, BaseDelay: time.Hour}
+	calls = 0
+	if err := slow.Do(ctx, func(int) error { calls++; return io.ErrUnexpectedEOF }, nil); err == nil || calls != 1 {
+		t.Errorf("cancelled: err %v after %d calls, want the failure after 1", err, calls)
+	}
+}
+
+// TestDownloadPermanentStatus gives up on a 404 right away instead of using up every retry.
+func TestDownloadPermanentStatus(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	out := downloadOnce(t, srv.URL, 5)
+	var se *retry.StatusError
+	if out.Suceeded || !errors.As(out.Err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("download: succeeded %v, err %v, want a 404 failure", out.Suceeded, out.Err)
+	}
+	if n := requests.Load(); n != 1 || out.Attempts != 1 {
+		t.Errorf("%d requests and %d attempts, want 1", n, out.Attempts)
+	}
+}
+
+// TestDownloadRetryAfter waits as long as the server asks before trying again.
+func TestDownloadRetryAfter(t *testing.T) {
+	blob := randomBlob(25, 4096)
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(blob)
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	out := downloadOnce(t, srv.URL, 3)
+	requireContent(t, out, blob)
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want the 1s of Retry-After", elapsed)
+	}
+	if out.Attempts != 2 {
+		t.Errorf("%d attempts, want 2", out.Attempts)
+	}
+}
+
+// TestInstallerChunkAttemptBudget fails the task once a chunk used up its attempts over several rounds.
+func TestInstallerChunkAttemptBudget(t *testing.T) {
+	srv := startFakeSophon(t)
+	files := syntheticGame(rand.New(rand.NewSource(3)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+	inj := faults.NewInjector(1, faults.Rates{Status: 1})
+	inj.PathPrefix = "/chunks/"
+
+	opts := installer.Options{
+		QueueSize:     64,
+		ChunkAttempts: 6,
+		Downloader:    downloader.Options{MaxRetries: 2, Retry: retry.Policy{BaseDelay: time.Millisecond}},
+	}
+	start := time.Now()
+	err := runInstall(t, t.TempDir(), inj, opts)
+	if !errors.Is(err, installer.ErrChunkAttemptsExhausted) {
+		t.Fatalf("install = %v, want ErrChunkAttemptsExhausted", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("gave up after %s", elapsed)
+	}
+	t.Logf("install failed with %v", err)
+}
+
+// predownloadPatch fetches one patch of size bytes from the start of the blob at url with an updater of 3 attempts.
+func predownloadPatch(t *testing.T, url string, size int) (string, error) {
+	return predownloadPatchAt(t, url, 0, size)
+}
+
+// predownloadPatchAt fetches the patch at offset of the blob at url with an updater of 3 attempts.
+func predownloadPatchAt(t *testing.T, url string, offset, size int) (string, error) {
+	t.Helper()
+	staging := t.TempDir()
+	u := updater.NewUpdater(t.TempDir(), staging, "5.0.0", updater.Options{MaxRetries: 3})
+	u.Patches = []*updater.PatchJob{{
+		FilePath: "data.bin",
+		Method:   updater.PatchCopyOver,
+		URL:      url,
+		Info:     &models.PatchInfo{PatchOffset: int64(offset), PatchLength: int64(size)},
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return filepath.Join(staging, updater.PatchDirName, "data.bin.hdiff"), u.Predownload(ctx)
+}
+
+// TestUpdaterPatchRetries gives up on a 404 patch blob right away and waits out Retry-After.
+func TestUpdaterPatchRetries(t *testing.T) {
+	var requests atomic.Int64
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer missing.Close()
+
+	_, err := predownloadPatch(t, missing.URL, 16)
+	var se *retry.StatusError
+	if !errors.As(err, &se) || se.Code != http.StatusNotFound {
+		t.Fatalf("predownload = %v, want a 404 error", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d requests for a missing patch, want 1", n)
+	}
+
+	blob := randomBlob(26, 4096)
+	requests.Store(0)
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(blob)
+	}))
+	defer busy.Close()
+
+	start := time.Now()
+	path, err := predownloadPatch(t, busy.URL, len(blob))
+	if err != nil {
+		t.Fatalf("predownload: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want the 1s of Retry-After", elapsed)
+	}
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, blob) {
+		t.Errorf("patch data differs (%d bytes, %v)", len(got), err)
+	}
+}
+
+// TestUpdaterPatchContentRange only keeps a partial response whose Content-Range is the requested
+// patch. A server ignoring the range is skipped to the patch like before.
+func TestUpdaterPatchContentRange(t *testing.T) {
+	blob := randomBlob(27, 8192)
+	const offset, length = 1000, 3000
+	partial := func(contentRange string, data []byte) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if contentRange != "" {
+				w.Header().Set("Content-Range", contentRange)
+			}
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data)
+		}
+	}
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		ok      bool
+	}{
+		{"range", func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		}, true},
+		{"range ignored", func(w http.ResponseWriter, r *http.Request) { w.Write(blob) }, true},
+		{"other start", partial("bytes 0-2999/8192", blob[:length]), false},
+		{"shorter range", partial("bytes 1000-1999/8192", blob[offset:2000]), false},
+		{"longer range", partial("bytes 1000-8191/8192", blob[offset:]), false},
+		{"no content range", partial("", blob[offset:offset+length]), false},
+		{"invalid content range", partial("bytes 1000/8192", blob[offset:offset+length]), false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(tc.handler)
+			defer srv.Close()
+			path, err := predownloadPatchAt(t, srv.URL, offset, length)
+			if !tc.ok {
+				if err == nil {
+					t.Fatal("predownload succeeded")
+				}
+				if _, serr := os.Stat(path); !os.IsNotExist(serr) {
+					t.Errorf("patch data was kept after %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("predownload: %v", err)
+			}
+			if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, blob[offset:offset+length]) {
+				t.Errorf("patch data differs (%d bytes, %v)", len(got), err)
+			}
+		})
+	}
+}
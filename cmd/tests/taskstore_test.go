@@ -0,0 +1,172 @@
+package main
+
+import (
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/operations"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTaskStore writes records in the format of the task registry file.
+func writeTaskStore(t *testing.T, path string, records ...map[string]any) {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"tasks": records})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useTaskStore loads the task registry from path for the rest of the test.
+func useTaskStore(t *testing.T, path string) error {
+	t.Helper()
+	t.Cleanup(func() { _ = operations.InitTaskStore("") })
+	return operations.InitTaskStore(path)
+}
+
+// storedTask is the part of a task registry record the tests look at.
+type storedTask struct {
+	models.TaskStatus
+	Request json.RawMessage `json:"request"`
+}
+
+func readTaskStore(t *testing.T, path string) map[string]storedTask {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var store struct {
+		Tasks []storedTask `json:"tasks"`
+	}
+	if err := json.Unmarshal(data, &store); err != nil {
+		t.Fatalf("task registry file: %v", err)
+	}
+	tasks := make(map[string]storedTask)
+	for _, task := range store.Tasks {
+		tasks[task.TaskID] = task
+	}
+	return tasks
+}
+
+// TestTaskStoreRoundTrip persists a finished task with its request and loads it back.
+func TestTaskStoreRoundTrip(t *testing.T) {
+	startFakeSophon(t)
+	path := filepath.Join(t.TempDir(), "registry", "tasks.json")
+	if err := useTaskStore(t, path); err != nil {
+		t.Fatalf("InitTaskStore on a missing file: %v", err)
+	}
+
+	req := models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: t.TempDir(), GameType: "hk4e", Downloads: 3},
+		InstallRelType:       "os",
+	}
+	// Nothing is published, so the task fails with an error to keep
+	status := waitForTask(t, operations.PerformInstall(req))
+	if status.Status != operations.StatusFailed || status.Error == nil {
+		t.Fatalf("install of a missing game ended %s", status.Status)
+	}
+
+	stored, ok := readTaskStore(t, path)[status.TaskID]
+	if !ok {
+		t.Fatalf("task %s was not persisted", status.TaskID)
+	}
+	if stored.TaskType != "install" || stored.Status != operations.StatusFailed || stored.Error == nil || *stored.Error != *status.Error {
+		t.Errorf("persisted task %+v, want the failed install", stored.TaskStatus)
+	}
+	var storedReq models.InstallRequest
+	if err := json.Unmarshal(stored.Request, &storedReq); err != nil || !reflect.DeepEqual(storedReq, req) {
+		t.Errorf("persisted request %s (%v), want %+v", stored.Request, err, req)
+	}
+
+	if err := operations.InitTaskStore(path); err != nil {
+		t.Fatalf("InitTaskStore: %v", err)
+	}
+	loaded, ok := operations.GetTaskStatus(status.TaskID)
+	if !ok || loaded.Status != operations.StatusFailed || loaded.Error == nil || *loaded.Error != *status.Error {
+		t.Errorf("loaded task %+v, want %+v", loaded, status)
+	}
+}
+
+// TestTaskStoreMarksUnfinishedInterrupted loads tasks left behind by a previous process.
+// Those that had not finished become interrupted, in memory and on disk.
+func TestTaskStoreMarksUnfinishedInterrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	want := map[string]string{
+		"store-pending":   operations.StatusInterrupted,
+		"store-running":   operations.StatusInterrupted,
+		"store-paused":    operations.StatusInterrupted,
+		"store-completed": operations.StatusCompleted,
+		"store-failed":    operations.StatusFailed,
+		"store-cancelled": operations.StatusCancelled,
+	}
+	var records []map[string]any
+	for id := range want {
+		records = append(records, map[string]any{
+			"task_id": id, "task_type": "install", "status": strings.TrimPrefix(id, "store-"), "request": map[string]any{},
+		})
+	}
+	writeTaskStore(t, path, records...)
+	if err := useTaskStore(t, path); err != nil {
+		t.Fatalf("InitTaskStore: %v", err)
+	}
+
+	stored := readTaskStore(t, path)
+	for id, status := range want {
+		if got, ok := operations.GetTaskStatus(id); !ok || got.Status != status {
+			t.Errorf("loaded %s is %q, want %s", id, got.Status, status)
+		}
+		if got := stored[id].Status; got != status {
+			t.Errorf("%s is stored as %q, want %s", id, got, status)
+		}
+	}
+}
+
+// TestTaskStoreCorrupt reports a registry file that cannot be decoded instead of starting over,
+// and leaves the file as it was. Empty records are skipped.
+func TestTaskStoreCorrupt(t *testing.T) {
+	cases := map[string]string{
+		"truncated":   `{"tasks": [{"task_id": "store-truncated", "task_type": "install", "sta`,
+		"garbage":     "\x00\x01 not json",
+		"wrong types": `{"tasks": {"task_id": 1}}`,
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tasks.json")
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := useTaskStore(t, path)
+			if err == nil || !strings.Contains(err.Error(), path) {
+				t.Fatalf("InitTaskStore = %v, want an error naming %s", err, path)
+			}
+			if data, _ := os.ReadFile(path); string(data) != content {
+				t.Errorf("corrupt registry was rewritten to %q", data)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "tasks.json")
+	if err := os.WriteFile(path, []byte(`{"tasks": [null, {}, {"task_id": "store-kept", "status": "completed"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := useTaskStore(t, path); err != nil {
+		t.Fatalf("InitTaskStore with empty records: %v", err)
+	}
+	if _, ok := operations.GetTaskStatus("store-kept"); !ok {
+		t.Error("task next to empty records was not loaded")
+	}
+	tasks := readTaskStore(t, path)
+	if _, ok := tasks["store-kept"]; !ok {
+		t.Error("store-kept was not stored again")
+	}
+	if _, ok := tasks[""]; ok {
+		t.Error("empty records were stored again")
+	}
+}
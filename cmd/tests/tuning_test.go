@@ -0,0 +1,192 @@
+package main
+
+import (
+	"SophonClientv2/internal/config"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/installer"
+	"SophonClientv2/pkg/operations"
+	"SophonClientv2/pkg/utils"
+	"SophonClientv2/pkg/verifier"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := utils.NewLimiter(2)
+	if !l.TryAcquire() || !l.TryAcquire() || l.TryAcquire() {
+		t.Fatal("limit of 2 not enforced")
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		acquired <- l.Acquire(ctx)
+	}()
+	l.SetLimit(3) // Raising the limit wakes the waiter
+	if !<-acquired {
+		t.Fatal("Acquire did not succeed after the limit was raised")
+	}
+
+	l.SetLimit(1)
+	l.Release()
+	l.Release()
+	if l.TryAcquire() {
+		t.Error("acquired above the lowered limit")
+	}
+	l.Release()
+	if !l.TryAcquire() {
+		t.Error("slot not available after releasing below the limit")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if l.Acquire(ctx) {
+		t.Error("Acquire succeeded on a cancelled context")
+	}
+}
+
+// TestVerifierResizeWhileRunning changes workers and queue size mid-stream; every item must still come out exactly once.
+func TestVerifierResizeWhileRunning(t *testing.T) {
+	v := verifier.NewVerifier(verifier.Options{Workers: 1, QueueSize: 4, MaxQueueSize: 16})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	v.Start(ctx)
+
+	const items = 500
+	go func() {
+		for i := 0; i < items; i++ {
+			data := []byte("chunk " + strconv.Itoa(i))
+			sum := md5.Sum(data)
+			v.EnqueueVerification(strconv.Itoa(i), io.NopCloser(bytes.NewReader(data)), hex.EncodeToString(sum[:]), i)
+			switch i {
+			case 100:
+				v.SetWorkers(8)
+				v.SetQueueSize(16)
+			case 300:
+				v.SetWorkers(2)
+				v.SetQueueSize(2)
+			}
+		}
+	}()
+
+	seen := make(map[int]bool)
+	for out := range v.GetOutputChannel() {
+		if !out.Suceeded {
+			t.Errorf("item %v failed verification", out.Payload)
+		}
+		seen[out.Payload.(int)] = true
+		if len(seen) == items {
+			v.Stop()
+		}
+	}
+	if len(seen) != items || v.Processed() != items {
+		t.Errorf("got %d distinct items, processed %d, want %d", len(seen), v.Processed(), items)
+	}
+	if got := v.WorkerCount(); got != 2 {
+		t.Errorf("WorkerCount = %d, want 2", got)
+	}
+	if got := v.SetQueueSize(1000); got != 16 {
+		t.Errorf("SetQueueSize above capacity = %d, want MaxQueueSize 16", got)
+	}
+}
+
+func TestStageDefaultsFromConfig(t *testing.T) {
+	saved := config.Config
+	defer func() { config.Config = saved }()
+
+	config.Config.CocurrentDownloads = 16
+	config.Config.CocurrentHashchecks = 3
+	if got := verifier.DefaultOptions().Workers; got != 3 {
+		t.Errorf("verifier workers = %d, want concurrent_hashchecks 3", got)
+	}
+	config.Config.CocurrentHashchecks = 0
+	if got := verifier.DefaultOptions().Workers; got != runtime.NumCPU() {
+		t.Errorf("automatic verifier workers = %d, want %d", got, runtime.NumCPU())
+	}
+}
+
+func TestInstallerSetLimitsWhileRunning(t *testing.T) {
+	srv := startFakeSophon(t)
+	srv.ChunkSize = 4096
+	files := syntheticGame(rand.New(rand.NewSource(21)))
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+	mani, info, err := operations.GetManifest(context.Background(), "hk4e", "os", "game", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gameDir := t.TempDir()
+	opts := installer.DefaultOptions()
+	opts.QueueSize = 8
+	opts.Autotune = true
+	inst := installer.NewInstaller(gameDir, filepath.Join(gameDir, ".sophon_staging"), opts)
+	if err := inst.ParseManifest(mani, info.ChunkDownload); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if err := inst.Prepare(ctx); err != nil {
+		t.Fatal(err)
+	}
+	inst.Start(ctx)
+
+	done := make(chan error, 1)
+	go func() { done <- inst.Wait() }()
+	sizes := []installer.Limits{
+		{Downloads: 1, Decompressions: 1, Hashchecks: 1, Writers: 1, QueueSize: 1, RateLimit: 4 << 20},
+		{Downloads: 12, Decompressions: 6, Hashchecks: 6, Writers: 4, QueueSize: 32, RateLimit: -1},
+		{Downloads: 3, Decompressions: 2, Hashchecks: 2, Writers: 2, QueueSize: 4, RateLimit: 16 << 20},
+	}
+	for i := 0; ; i++ {
+		l := sizes[i%len(sizes)]
+		if got := inst.SetLimits(l); got.Decompressions != l.Decompressions || got.Writers != l.Writers || got.RateLimit != max(0, l.RateLimit) {
+			t.Errorf("SetLimits(%+v) = %+v", l, got)
+		}
+		select {
+		case err = <-done:
+		case <-time.After(5 * time.Millisecond):
+			continue
+		}
+		break
+	}
+	inst.Stop()
+	if err != nil {
+		t.Fatalf("install while resizing: %v", err)
+	}
+	assertGameDir(t, gameDir, files)
+}
+
+func TestSetTaskLimitsErrors(t *testing.T) {
+	if _, err := operations.SetTaskLimits("no-such-task", models.TaskLimits{Downloads: 2}); !errors.Is(err, operations.ErrTaskNotFound) {
+		t.Errorf("unknown task: got %v, want ErrTaskNotFound", err)
+	}
+	if errs := models.Validate(models.TaskLimits{Writers: 100}); len(errs) != 1 {
+		t.Errorf("Validate(writers=100) = %v, want one error", errs)
+	}
+
+	srv := startFakeSophon(t)
+	if err := srv.SetGame("hk4e", "os", "5.0.0", syntheticGame(rand.New(rand.NewSource(22)))); err != nil {
+		t.Fatal(err)
+	}
+	status := waitForTask(t, operations.PerformInstall(models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: t.TempDir(), GameType: "hk4e"},
+		InstallRelType:       "os",
+	}))
+	requireCompleted(t, status)
+	if _, err := operations.SetTaskLimits(status.TaskID, models.TaskLimits{Downloads: 2}); !errors.Is(err, operations.ErrTaskNotResizable) {
+		t.Errorf("finished task: got %v, want ErrTaskNotResizable", err)
+	}
+}
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 type LogLevel int
@@ -15,64 +18,152 @@ const (
 	Fatal
 )
 
+var logLevelNames = []string{"debug", "info", "warn", "error", "fatal"}
+
+func (l LogLevel) String() string {
+	if l < Debug || l > Fatal {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+func (l LogLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *LogLevel) UnmarshalText(text []byte) error {
+	name := strings.ToLower(string(text))
+	if name == "warning" {
+		name = "warn"
+	}
+	for i, n := range logLevelNames {
+		if n == name {
+			*l = LogLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q", text)
+}
+
+// SophonClientConfig holds every tunable setting. The config tag is the key used in config files,
+// as environment variable (SOPHON_ + upper case key) and as command line flag (dashes instead of
+// underscores), see load.go. The range tag is checked by Validate.
 type SophonClientConfig struct {
-	MaxManifestDownloadRetries int
-	MaxChunkDownloadRetries    int
+	MaxManifestDownloadRetries int `config:"max_manifest_download_retries" range:"0,100"`
+	MaxChunkDownloadRetries    int `config:"max_chunk_download_retries" range:"0,100"`
+	MaxAPIRetries              int `config:"max_api_retries" range:"0,100"`
+	MaxChunkAttempts           int `config:"max_chunk_attempts" range:"0,100000"` // Download attempts per chunk over the whole task, 0 is unlimited
+
+	RetryBaseDelay time.Duration `config:"retry_base_delay" range:"0,"` // Doubled on every further attempt
+	RetryMaxDelay  time.Duration `config:"retry_max_delay" range:"0,"`  // Also caps Retry-After
+	RetryJitter    int           `config:"retry_jitter" range:"0,100"`  // Percent of each delay that is randomized
+
+	DownloadChanSize   int `config:"download_chan_size" range:"1,65536"`
+	VerifyChanSize     int `config:"verify_chan_size" range:"1,65536"`
+	DecompressChanSize int `config:"decompress_chan_size" range:"1,65536"`
+
+	CocurrentDownloads      int  `config:"concurrent_downloads" range:"1,256"` // Starting point when adaptive_downloads is set
+	AdaptiveDownloads       bool `config:"adaptive_downloads"`                 // Resize downloads by throughput, latency and throttling
+	DownloadConcurrencyMin  int  `config:"download_concurrency_min" range:"1,256"`
+	DownloadConcurrencyMax  int  `config:"download_concurrency_max" range:"1,256"`
+	CocurrentDecompressions int  `config:"concurrent_decompressions" range:"0,256"` // 0 is one per CPU
+	CocurrentHashchecks     int  `config:"concurrent_hashchecks" range:"0,256"`     // 0 is one per CPU
+	AssemblerWorkers        int  `config:"assembler_workers" range:"0,64"`          // 0 is one per two CPUs, at most 4
+	Autotune                bool `config:"autotune"`                                // Resize stages by their backlog while installing
 
-	DownloadChanSize   int
-	VerifyChanSize     int
-	DecompressChanSize int
+	DownloadRateLimit    int    `config:"download_rate_limit" range:"0,"` // KiB/s shared by every download, 0 is unlimited
+	DownloadRateSchedule string `config:"download_rate_schedule"`         // Windows overriding download_rate_limit, see ParseRateSchedule
+	DownloadMirrors      string `config:"download_mirrors"`               // Comma separated chunk URL prefixes or hosts tried besides the official CDN
 
-	CocurrentDownloads      int
-	CocurrentDecompressions int
-	CocurrentHashchecks     int
+	QueueLengthPrintInterval int `config:"queue_length_print_interval" range:"1,3600"` // Seconds
 
-	QueueLengthPrintInterval int
+	SophonLogLevel  LogLevel `config:"log_level"`
+	SophonLogFile   string   `config:"log_file"`
+	SophonLogToFile bool     `config:"log_to_file"`
+	LogFormat       string   `config:"log_format"`                     // console, text or json
+	LogMaxSizeMB    int      `config:"log_max_size" range:"0,65536"`   // 0 disables rotation
+	LogMaxBackups   int      `config:"log_max_backups" range:"0,1000"` // Rotated files kept next to log_file
+	TaskLogDir      string   `config:"task_log_dir"`                   // Empty disables per-task log files, serve defaults it next to the task registry
 
-	SophonLogLevel  LogLevel
-	SophonLogFile   string
-	SophonLogToFile bool
+	TaskRegistryFile string `config:"task_registry_file"`
+
+	MetadataCacheTTL time.Duration `config:"metadata_cache_ttl" range:"0,"`
+	MetadataCacheDir string        `config:"metadata_cache_dir"` // Empty disables the on-disk metadata cache
+
+	sources map[string]Source
 }
 
+// NewSophonClientConfig returns the built-in defaults.
 func NewSophonClientConfig() SophonClientConfig {
-	cfg := SophonClientConfig{
+	return SophonClientConfig{
 		MaxManifestDownloadRetries: 5,
 		MaxChunkDownloadRetries:    5,
+		MaxAPIRetries:              3,
+		MaxChunkAttempts:           50,
+
+		RetryBaseDelay: 500 * time.Millisecond,
+		RetryMaxDelay:  30 * time.Second,
+		RetryJitter:    50,
 
 		DownloadChanSize:   32,
 		VerifyChanSize:     32,
 		DecompressChanSize: 32,
 
 		CocurrentDownloads:      16,
-		CocurrentDecompressions: 4,
-		CocurrentHashchecks:     8,
+		AdaptiveDownloads:       true,
+		DownloadConcurrencyMin:  2,
+		DownloadConcurrencyMax:  64,
+		CocurrentDecompressions: 0,
+		CocurrentHashchecks:     0,
+		AssemblerWorkers:        0,
+		Autotune:                true,
+
+		DownloadRateLimit:    0,
+		DownloadRateSchedule: "",
+		DownloadMirrors:      "",
 
 		QueueLengthPrintInterval: 1,
 
 		SophonLogLevel:  Debug,
 		SophonLogFile:   "",
 		SophonLogToFile: false,
+		LogFormat:       "console",
+		LogMaxSizeMB:    10,
+		LogMaxBackups:   3,
+		TaskLogDir:      "",
+
+		TaskRegistryFile: defaultTaskRegistryFile(),
+
+		MetadataCacheTTL: 10 * time.Minute,
+		MetadataCacheDir: defaultMetadataCacheDir(),
 	}
+}
 
-	if file := os.Getenv("SOPHON_LOG"); file != "" {
-		cfg.SophonLogToFile = true
-		cfg.SophonLogFile = file
+func defaultTaskRegistryFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
 	}
-	if lvl := os.Getenv("SOPHON_LOG_LEVEL"); lvl != "" {
-		switch strings.ToLower(lvl) {
-		case "debug":
-			cfg.SophonLogLevel = Debug
-		case "info":
-			cfg.SophonLogLevel = Info
-		case "warn", "warning":
-			cfg.SophonLogLevel = Warn
-		case "error":
-			cfg.SophonLogLevel = Error
-		case "fatal":
-			cfg.SophonLogLevel = Fatal
-		}
+	return filepath.Join(dir, "SophonClientv2", "tasks.json")
+}
+
+func defaultMetadataCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "SophonClientv2", "metadata")
+}
+
+// loadStartup loads the config file and environment when the process starts. Command line flags
+// are applied later by the CLI, which also reports errors properly, so they only produce a warning here.
+func loadStartup() SophonClientConfig {
+	cfg, err := Load("", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration, using defaults:", err)
+		return NewSophonClientConfig()
 	}
 	return cfg
 }
 
-var Config SophonClientConfig = NewSophonClientConfig()
+var Config SophonClientConfig = loadStartup()
@@ -0,0 +1,511 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Source tells where the effective value of a setting came from. Later sources take precedence.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+var ErrUnknownKey = errors.New("unknown config key")
+
+// Override sets one key, e.g. from a command line flag.
+type Override struct {
+	Key   string
+	Value string
+}
+
+// Environment variables from before config files existed, applied before the SOPHON_<KEY> names
+var envAliases = []struct{ name, key string }{
+	{"SOPHON_TASKS_FILE", "task_registry_file"},
+	{"SOPHON_CACHE_DIR", "metadata_cache_dir"},
+}
+
+var keyHelp = map[string]string{
+	"max_manifest_download_retries": "attempts to download a manifest",
+	"max_chunk_download_retries":    "attempts to download a chunk before it is requeued",
+	"max_api_retries":               "retries of failed HYP/Sophon API requests",
+	"max_chunk_attempts":            "download attempts per chunk, requeues included, before the task fails; 0 is unlimited",
+	"retry_base_delay":              "wait before the first retry, doubled for every further one",
+	"retry_max_delay":               "longest wait between retries, also caps Retry-After",
+	"retry_jitter":                  "percent of each retry wait that is randomized",
+	"download_chan_size":            "queue length in front of the downloader",
+	"verify_chan_size":              "queue length in front of the verifiers",
+	"decompress_chan_size":          "queue length in front of the decompressor",
+	"concurrent_downloads":          "parallel chunk downloads, the starting point with adaptive_downloads",
+	"adaptive_downloads":            "grow downloads while throughput rises and back off on 429/5xx responses and rising latency",
+	"download_concurrency_min":      "fewest parallel downloads adaptive_downloads goes down to",
+	"download_concurrency_max":      "most parallel downloads adaptive_downloads goes up to",
+	"concurrent_decompressions":     "parallel chunk decompressions, 0 for one per CPU",
+	"concurrent_hashchecks":         "parallel MD5 checks, 0 for one per CPU",
+	"assembler_workers":             "parallel staging file writers, 0 to pick from the CPU count",
+	"autotune":                      "grow and shrink the decompressor, verifier and assembler workers by their backlog",
+	"download_rate_limit":           "KiB/s all downloads share, 0 is unlimited",
+	"download_rate_schedule":        "windows overriding download_rate_limit, e.g. 08:00-18:00=2048,22:00-06:00=0",
+	"download_mirrors":              "comma separated chunk URL prefixes, or hosts keeping the official path, to fail over to",
+	"queue_length_print_interval":   "seconds between queue length debug messages",
+	"log_level":                     "debug, info, warn, error or fatal",
+	"log_file":                      "file to log to when log_to_file is set",
+	"log_to_file":                   "log to log_file instead of stdout",
+	"log_format":                    "console, text or json",
+	"log_max_size":                  "megabytes after which log_file is rotated, 0 never rotates",
+	"log_max_backups":               "rotated log files to keep",
+	"task_log_dir":                  "directory for one JSON log file per task, empty disables them (serve uses logs/ next to the task registry)",
+	"task_registry_file":            "file the server persists tasks to",
+	"metadata_cache_ttl":            "how long fetched game metadata is used before revalidating",
+	"metadata_cache_dir":            "directory for cached game metadata, empty disables it",
+}
+
+type configField struct {
+	key   string
+	index int
+	rng   string
+}
+
+var configFields = func() []configField {
+	var fields []configField
+	rt := reflect.TypeOf(SophonClientConfig{})
+	for i := 0; i < rt.NumField(); i++ {
+		if key := rt.Field(i).Tag.Get("config"); key != "" {
+			fields = append(fields, configField{key: key, index: i, rng: rt.Field(i).Tag.Get("range")})
+		}
+	}
+	return fields
+}()
+
+func lookupField(key string) (configField, bool) {
+	for _, f := range configFields {
+		if f.key == key {
+			return f, true
+		}
+	}
+	return configField{}, false
+}
+
+// Keys returns every config key in declaration order.
+func Keys() []string {
+	keys := make([]string, len(configFields))
+	for i, f := range configFields {
+		keys[i] = f.key
+	}
+	return keys
+}
+
+// Set parses value into the setting named key.
+func (c *SophonClientConfig) Set(key, value string) error {
+	return c.set(key, value, SourceDefault)
+}
+
+func (c *SophonClientConfig) set(key, value string, source Source) error {
+	f, ok := lookupField(key)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKey, key)
+	}
+	fv := reflect.ValueOf(c).Elem().Field(f.index)
+	switch fv.Addr().Interface().(type) {
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		fv.SetInt(int64(d))
+	case *LogLevel:
+		var lvl LogLevel
+		if err := lvl.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		fv.SetInt(int64(lvl))
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer", key, value)
+		}
+		fv.SetInt(int64(n))
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a boolean", key, value)
+		}
+		fv.SetBool(b)
+	case *string:
+		fv.SetString(value)
+	default:
+		return fmt.Errorf("%s: unsupported type %s", key, fv.Type())
+	}
+	if source != SourceDefault {
+		if c.sources == nil {
+			c.sources = make(map[string]Source)
+		}
+		c.sources[key] = source
+	}
+	return nil
+}
+
+// Get returns the setting named key formatted the way Set accepts it.
+func (c SophonClientConfig) Get(key string) (string, bool) {
+	f, ok := lookupField(key)
+	if !ok {
+		return "", false
+	}
+	switch v := reflect.ValueOf(c).Field(f.index).Interface().(type) {
+	case fmt.Stringer:
+		return v.String(), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// Source returns where the effective value of key came from.
+func (c SophonClientConfig) Source(key string) Source {
+	if s, ok := c.sources[key]; ok {
+		return s
+	}
+	return SourceDefault
+}
+
+// Validate checks every setting against its allowed range and returns all problems at once.
+func (c SophonClientConfig) Validate() error {
+	var errs []error
+	rv := reflect.ValueOf(c)
+	for _, f := range configFields {
+		if f.rng == "" {
+			continue
+		}
+		minStr, maxStr, _ := strings.Cut(f.rng, ",")
+		v := rv.Field(f.index).Int()
+		lo, _ := strconv.ParseInt(minStr, 10, 64)
+		if maxStr == "" {
+			if v < lo {
+				errs = append(errs, fmt.Errorf("%s must be at least %d, got %d", f.key, lo, v))
+			}
+			continue
+		}
+		hi, _ := strconv.ParseInt(maxStr, 10, 64)
+		if v < lo || v > hi {
+			errs = append(errs, fmt.Errorf("%s must be between %d and %d, got %d", f.key, lo, hi, v))
+		}
+	}
+	if c.SophonLogLevel < Debug || c.SophonLogLevel > Fatal {
+		errs = append(errs, fmt.Errorf("log_level %d is out of range", c.SophonLogLevel))
+	}
+	if c.SophonLogToFile && c.SophonLogFile == "" {
+		errs = append(errs, errors.New("log_to_file requires log_file"))
+	}
+	switch c.LogFormat {
+	case "console", "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("log_format must be console, text or json, got %q", c.LogFormat))
+	}
+	if c.DownloadConcurrencyMin > c.DownloadConcurrencyMax {
+		errs = append(errs, fmt.Errorf("download_concurrency_min %d is above download_concurrency_max %d", c.DownloadConcurrencyMin, c.DownloadConcurrencyMax))
+	}
+	if _, err := ParseRateSchedule(c.DownloadRateSchedule); err != nil {
+		errs = append(errs, fmt.Errorf("download_rate_schedule: %w", err))
+	}
+	for _, m := range strings.Split(c.DownloadMirrors, ",") {
+		if m = strings.TrimSpace(m); m == "" {
+			continue
+		}
+		if u, err := url.Parse(m); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("download_mirrors: %q is not an http(s) URL", m))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DefaultConfigFiles are the paths searched for a config file when none is given.
+func DefaultConfigFiles() []string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, ext := range []string{".json", ".toml", ".yaml", ".yml"} {
+		files = append(files, filepath.Join(dir, "SophonClientv2", "config"+ext))
+	}
+	return files
+}
+
+// Load builds the configuration from the defaults, the config file, the environment and the
+// overrides, each taking precedence over the ones before, and validates the result.
+// An empty file means $SOPHON_CONFIG, or else the first of DefaultConfigFiles that exists.
+func Load(file string, overrides []Override) (SophonClientConfig, error) {
+	cfg := NewSophonClientConfig()
+
+	if file == "" {
+		file = os.Getenv("SOPHON_CONFIG")
+	}
+	if file == "" {
+		for _, candidate := range DefaultConfigFiles() {
+			if _, err := os.Stat(candidate); err == nil {
+				file = candidate
+				break
+			}
+		}
+	}
+	if file != "" {
+		values, err := ReadFile(file)
+		if err != nil {
+			return cfg, err
+		}
+		for _, o := range values {
+			if err := cfg.set(o.Key, o.Value, SourceFile); err != nil {
+				return cfg, fmt.Errorf("%s: %w", file, err)
+			}
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+
+	for _, o := range overrides {
+		if err := cfg.set(o.Key, o.Value, SourceFlag); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+func (c *SophonClientConfig) applyEnv() error {
+	for _, alias := range envAliases {
+		if value, ok := os.LookupEnv(alias.name); ok {
+			if err := c.set(alias.key, value, SourceEnv); err != nil {
+				return fmt.Errorf("%s: %w", alias.name, err)
+			}
+		}
+	}
+	// SOPHON_LOG=<file> predates log_to_file and implies it
+	if file := os.Getenv("SOPHON_LOG"); file != "" {
+		c.set("log_file", file, SourceEnv)
+		c.set("log_to_file", "true", SourceEnv)
+	}
+	for _, f := range configFields {
+		name := "SOPHON_" + strings.ToUpper(f.key)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := c.set(f.key, value, SourceEnv); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ReadFile reads the settings of a JSON, TOML or YAML config file, chosen by extension.
+// Only flat files with one key per line (or one level of JSON object) are supported.
+func ReadFile(path string) ([]Override, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	var values []Override
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		values, err = parseJSON(data)
+	case ".toml":
+		values, err = parseFlat(data, '=')
+	case ".yaml", ".yml":
+		values, err = parseFlat(data, ':')
+	default:
+		return nil, fmt.Errorf("config file %s: unsupported format %q (use .json, .toml or .yaml)", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return values, nil
+}
+
+func parseJSON(data []byte) ([]Override, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	values := make([]Override, 0, len(raw))
+	for _, key := range Keys() {
+		msg, ok := raw[key]
+		if !ok {
+			continue
+		}
+		delete(raw, key)
+		value := string(bytes.TrimSpace(msg))
+		switch {
+		case strings.HasPrefix(value, `"`):
+			if err := json.Unmarshal(msg, &value); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+		case value == "null" || strings.HasPrefix(value, "{") || strings.HasPrefix(value, "["):
+			return nil, fmt.Errorf("%s: expected a string, number or boolean", key)
+		}
+		values = append(values, Override{Key: key, Value: value})
+	}
+	for key := range raw {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, key)
+	}
+	return values, nil
+}
+
+// parseFlat reads "key = value" (TOML) or "key: value" (YAML) lines. Values may be quoted,
+// # starts a comment.
+func parseFlat(data []byte, sep byte) ([]Override, error) {
+	var values []Override
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || (sep == ':' && line == "---") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, string(sep))
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key %c value", lineNo, sep)
+		}
+		key = strings.TrimSpace(key)
+		value, err := parseFlatValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		values = append(values, Override{Key: key, Value: value})
+	}
+	return values, scanner.Err()
+}
+
+func parseFlatValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		quoted, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted value %s", value)
+		}
+		if rest := strings.TrimSpace(value[len(quoted):]); rest != "" && rest[0] != '#' {
+			return "", fmt.Errorf("unexpected %q after value", rest)
+		}
+		return strconv.Unquote(quoted)
+	case strings.HasPrefix(value, "'"):
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated value %s", value)
+		}
+		return value[1 : end+1], nil
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
+
+// Encode writes the configuration as json, toml or yaml. TOML and YAML note the source of every
+// setting that is not a default.
+func (c SophonClientConfig) Encode(format string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "json":
+		values := make(map[string]any, len(configFields))
+		rv := reflect.ValueOf(c)
+		for _, f := range configFields {
+			switch v := rv.Field(f.index).Interface().(type) {
+			case time.Duration, LogLevel:
+				values[f.key], _ = c.Get(f.key)
+			default:
+				values[f.key] = v
+			}
+		}
+		out, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(out)
+		buf.WriteByte('\n')
+	case "toml", "yaml":
+		sep := " = "
+		if format == "yaml" {
+			sep = ": "
+		}
+		rv := reflect.ValueOf(c)
+		for _, f := range configFields {
+			value, _ := c.Get(f.key)
+			switch rv.Field(f.index).Kind() {
+			case reflect.String, reflect.Int64:
+				// Strings, durations and the log level
+				value = strconv.Quote(value)
+			case reflect.Int:
+				if _, ok := rv.Field(f.index).Interface().(LogLevel); ok {
+					value = strconv.Quote(value)
+				}
+			}
+			buf.WriteString(f.key + sep + value)
+			if src := c.Source(f.key); src != SourceDefault {
+				buf.WriteString(" # " + string(src))
+			}
+			buf.WriteByte('\n')
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format %q (use json, toml or yaml)", format)
+	}
+	return buf.Bytes(), nil
+}
+
+// Flags collects settings given on the command line. Register them with RegisterFlags and call
+// Load after the flag set has been parsed.
+type Flags struct {
+	File      string
+	overrides []Override
+}
+
+type keyFlag struct {
+	flags  *Flags
+	key    string
+	isBool bool
+}
+
+func (f *keyFlag) String() string   { return "" }
+func (f *keyFlag) IsBoolFlag() bool { return f.isBool }
+
+func (f *keyFlag) Set(value string) error {
+	// Parse now so flag reports bad values together with the flag name
+	probe := NewSophonClientConfig()
+	if err := probe.Set(f.key, value); err != nil {
+		return err
+	}
+	f.flags.overrides = append(f.flags.overrides, Override{Key: f.key, Value: value})
+	return nil
+}
+
+// RegisterFlags adds -config and one flag per config key (underscores replaced by dashes) to fs.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	flags := &Flags{}
+	fs.StringVar(&flags.File, "config", "", "config file (.json, .toml or .yaml), default $SOPHON_CONFIG or "+filepath.Join("<user config dir>", "SophonClientv2", "config.*"))
+	defaults := NewSophonClientConfig()
+	for _, f := range configFields {
+		kind := reflect.ValueOf(defaults).Field(f.index).Kind()
+		def, _ := defaults.Get(f.key)
+		usage := keyHelp[f.key]
+		if def != "" {
+			usage += fmt.Sprintf(" (default %s)", def)
+		}
+		fs.Var(&keyFlag{flags: flags, key: f.key, isBool: kind == reflect.Bool}, strings.ReplaceAll(f.key, "_", "-"), usage)
+	}
+	return flags
+}
+
+// Load returns the configuration with the parsed flags applied on top of the file and environment.
+func (f *Flags) Load() (SophonClientConfig, error) {
+	return Load(f.File, f.overrides)
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateWindow limits downloads to Rate KiB/s (0 is unlimited) from Start until End, both in minutes
+// after local midnight. A window whose End is not after its Start wraps past midnight.
+type RateWindow struct {
+	Start, End int
+	Rate       int
+}
+
+// RateSchedule overrides download_rate_limit during its windows, the first matching window wins.
+type RateSchedule []RateWindow
+
+// ParseRateSchedule parses comma separated "HH:MM-HH:MM=KiB/s" windows, e.g. "08:00-18:00=2048,22:00-06:00=0".
+func ParseRateSchedule(s string) (RateSchedule, error) {
+	var schedule RateSchedule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		span, rate, ok := strings.Cut(part, "=")
+		from, to, ok2 := strings.Cut(span, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("rate window %q is not HH:MM-HH:MM=KiB/s", part)
+		}
+		var w RateWindow
+		var err error
+		if w.Start, err = parseClock(from); err != nil {
+			return nil, fmt.Errorf("rate window %q: %w", part, err)
+		}
+		if w.End, err = parseClock(to); err != nil {
+			return nil, fmt.Errorf("rate window %q: %w", part, err)
+		}
+		if w.Rate, err = strconv.Atoi(strings.TrimSpace(rate)); err != nil || w.Rate < 0 {
+			return nil, fmt.Errorf("rate window %q: rate must be a non-negative integer", part)
+		}
+		schedule = append(schedule, w)
+	}
+	return schedule, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// RateAt returns the rate of the window containing t, ok is false outside every window.
+func (s RateSchedule) RateAt(t time.Time) (rate int, ok bool) {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s {
+		inside := minute >= w.Start && minute < w.End
+		if w.End <= w.Start {
+			inside = minute >= w.Start || minute < w.End
+		}
+		if inside {
+			return w.Rate, true
+		}
+	}
+	return 0, false
+}
+
+func (s RateSchedule) String() string {
+	parts := make([]string, len(s))
+	for i, w := range s {
+		parts[i] = fmt.Sprintf("%02d:%02d-%02d:%02d=%d", w.Start/60, w.Start%60, w.End/60, w.End%60, w.Rate)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,426 @@
+// Package fakesophon serves synthetic games through stand-ins of the HYP API, the Sophon
+// getBuild / getPatchBuild endpoints and the manifest, chunk and patch CDNs, so the install,
+// repair and update pipelines can be tested offline.
+package fakesophon
+
+import (
+	"SophonClientv2/internal/models"
+	"SophonClientv2/internal/secrets"
+	"SophonClientv2/pkg/hypAPI"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+const DefaultChunkSize = 64 * 1024
+
+// Server is a running fake. Games are keyed by game type and release type, e.g. "hk4e" / "os".
+type Server struct {
+	URL string
+	// Client points at the server. Use UseAsDefault to route pkg/operations through it.
+	Client *hypAPI.Client
+	// ChunkSize is the size files are split into, changes apply to games set afterwards.
+	ChunkSize int
+	// DiffFunc produces an hdiff patch turning old into new. When nil, changed files are sent
+	// whole as copy-over patches.
+	DiffFunc func(oldData, newData []byte) []byte
+
+	server *httptest.Server
+
+	mu       sync.Mutex
+	games    map[string]*game
+	blobs    map[string][]byte // URL path -> content
+	requests map[string]int    // URL path -> count
+}
+
+type game struct {
+	gameType string
+	relType  string
+	version  string
+	files    map[string][]byte
+
+	manifest  models.SophonManifest
+	previous  map[string]map[string][]byte // fromVersion -> files
+	patch     *models.SophonPatchManifest
+	patchTags []string
+}
+
+func NewServer() *Server {
+	s := &Server{
+		ChunkSize: DefaultChunkSize,
+		games:     make(map[string]*game),
+		blobs:     make(map[string][]byte),
+		requests:  make(map[string]int),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+
+	s.Client = hypAPI.NewClient()
+	s.Client.HTTPClient = s.server.Client()
+	s.Client.Endpoints = map[string]hypAPI.Endpoints{}
+	for _, relType := range []string{"os", "cn"} {
+		s.Client.Endpoints[relType] = hypAPI.Endpoints{
+			HYPAPIPrefix:  s.URL + "/",
+			LauncherID:    relType,
+			SophonAPIBase: s.URL + "/sophon/" + relType + "/getBuild",
+		}
+	}
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// UseAsDefault makes hypAPI.DefaultClient and hypAPI.Metadata use the server until the
+// returned function is called.
+func (s *Server) UseAsDefault() (restore func()) {
+	client, metadata := hypAPI.DefaultClient, hypAPI.Metadata
+	hypAPI.DefaultClient = s.Client
+	hypAPI.Metadata = hypAPI.NewMetadataCache(0, "")
+	return func() {
+		hypAPI.DefaultClient, hypAPI.Metadata = client, metadata
+	}
+}
+
+// Requests returns how many requests were made for paths starting with prefix, e.g. "/chunks/".
+func (s *Server) Requests(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for path, count := range s.requests {
+		if strings.HasPrefix(path, prefix) {
+			n += count
+		}
+	}
+	return n
+}
+
+// SetGame publishes version of the game with the given files (slash separated paths). Patches
+// added for the previous version are dropped.
+func (s *Server) SetGame(gameType, relType, version string, files map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := &game{
+		gameType: gameType,
+		relType:  relType,
+		version:  version,
+		files:    files,
+		previous: make(map[string]map[string][]byte),
+	}
+	mani := &models.Manifest{}
+	var stats models.SophonManifestStats
+	seenChunks := make(map[string]bool)
+	for _, name := range sortedKeys(files) {
+		data := files[name]
+		fi := &models.FileInfo{Filename: name, Size: int32(len(data)), Md5: md5Hex(data)}
+		for offset := 0; offset < len(data); offset += s.ChunkSize {
+			part := data[offset:min(offset+s.ChunkSize, len(data))]
+			compressed := zstdCompress(part)
+			chunkID := md5Hex(part) + "_" + fmt.Sprint(len(part))
+			s.blobs["/chunks/"+chunkID] = compressed
+			fi.Chunks = append(fi.Chunks, &models.ChunkInfo{
+				ChunkId:          chunkID,
+				Md5:              md5Hex(part),
+				Offset:           uint64(offset),
+				CompressedSize:   uint32(len(compressed)),
+				UncompressedSize: uint32(len(part)),
+			})
+			if !seenChunks[chunkID] {
+				seenChunks[chunkID] = true
+				stats.ChunkCount++
+				stats.CompressedSize += int64(len(compressed))
+			}
+		}
+		stats.FileCount++
+		stats.UncompressedSize += int64(len(data))
+		mani.Files = append(mani.Files, fi)
+	}
+
+	info, err := s.publishManifest(mani)
+	if err != nil {
+		return err
+	}
+	g.manifest = models.SophonManifest{
+		CategoryID:       "1",
+		CategoryName:     "game",
+		Manifest:         info,
+		ChunkDownload:    models.SophonChunkDownloadInfo{Compression: 1, UrlPrefix: s.URL + "/chunks"},
+		ManifestDownload: models.SophonManifestDownloadInfo{Compression: 1, UrlPrefix: s.URL + "/manifests"},
+		MatchingField:    "game",
+		Stats:            stats,
+	}
+	s.games[gameKey(gameType, relType)] = g
+	return nil
+}
+
+// AddPatch publishes patches from fromVersion, whose files were oldFiles, to the current version
+// of the game. Changed files are patched with DiffFunc, new files are copied over and files
+// missing from the current version are deleted.
+func (s *Server) AddPatch(gameType, relType, fromVersion string, oldFiles map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.games[gameKey(gameType, relType)]
+	if g == nil {
+		return fmt.Errorf("no game %s/%s", gameType, relType)
+	}
+	g.previous[fromVersion] = oldFiles
+
+	diff := &models.DiffManifest{}
+	diffFiles := make(map[string]*models.DiffFileInfo)
+	stats := make(map[string]models.SophonManifestStats)
+	g.patchTags = g.patchTags[:0]
+	for _, from := range sortedKeys(g.previous) {
+		g.patchTags = append(g.patchTags, from)
+		old := g.previous[from]
+		patchID := "patch_" + from + "_" + g.version
+		var blob bytes.Buffer
+		for _, name := range sortedKeys(g.files) {
+			data := g.files[name]
+			oldData, existed := old[name]
+			if existed && bytes.Equal(oldData, data) {
+				continue
+			}
+			info := &models.PatchInfo{PatchId: patchID, Tag: g.version, BuildId: g.version, PatchOffset: int64(blob.Len())}
+			if existed && s.DiffFunc != nil {
+				blob.Write(s.DiffFunc(oldData, data))
+				info.OriginalName = name
+				info.OriginalSize = int64(len(oldData))
+				info.OriginalHash = md5Hex(oldData)
+			} else {
+				blob.Write(data)
+			}
+			info.PatchLength = int64(blob.Len()) - info.PatchOffset
+
+			fi := diffFiles[name]
+			if fi == nil {
+				fi = &models.DiffFileInfo{Filename: name, Size: int32(len(data)), Hash: md5Hex(data)}
+				diffFiles[name] = fi
+				diff.Files = append(diff.Files, fi)
+			}
+			fi.Patches = append(fi.Patches, &models.Patch{Key: from, Info: info})
+		}
+		s.blobs["/patches/"+patchID] = blob.Bytes()
+		for _, fi := range diff.Files {
+			for _, patch := range fi.Patches {
+				if patch.Key == from {
+					patch.Info.PatchSize = int64(blob.Len())
+				}
+			}
+		}
+
+		deletes := &models.DeleteFiles{}
+		for _, name := range sortedKeys(old) {
+			if _, ok := g.files[name]; !ok {
+				deletes.List = append(deletes.List, &models.DeleteFileInfo{Filename: name, Size: int64(len(old[name])), Hash: md5Hex(old[name])})
+			}
+		}
+		if len(deletes.List) > 0 {
+			diff.FilesDelete = append(diff.FilesDelete, &models.DeleteFile{Key: from, Info: deletes})
+		}
+		stats[from] = models.SophonManifestStats{CompressedSize: int64(blob.Len()), UncompressedSize: int64(blob.Len())}
+	}
+
+	info, err := s.publishManifest(diff)
+	if err != nil {
+		return err
+	}
+	g.patch = &models.SophonPatchManifest{
+		CategoryID:       "1",
+		CategoryName:     "game",
+		Manifest:         info,
+		DiffDownload:     models.SophonChunkDownloadInfo{UrlPrefix: s.URL + "/patches"},
+		ManifestDownload: models.SophonManifestDownloadInfo{Compression: 1, UrlPrefix: s.URL + "/manifests"},
+		MatchingField:    "game",
+		Stats:            stats,
+	}
+	return nil
+}
+
+// publishManifest stores the zstd compressed protobuf and returns its getBuild description.
+func (s *Server) publishManifest(msg proto.Message) (models.SophonManifestInfo, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return models.SophonManifestInfo{}, fmt.Errorf("encoding manifest: %w", err)
+	}
+	compressed := zstdCompress(data)
+	id := "manifest_" + md5Hex(compressed)
+	s.blobs["/manifests/"+id] = compressed
+	return models.SophonManifestInfo{
+		ID:               id,
+		Checksum:         md5Hex(data),
+		CompressedSize:   int64(len(compressed)),
+		UncompressedSize: int64(len(data)),
+	}, nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	blob, isBlob := s.blobs[r.URL.Path]
+	s.mu.Unlock()
+
+	switch {
+	case isBlob:
+		// ServeContent answers Range and If-Range requests like the real CDN
+		w.Header().Set("ETag", `"`+md5Hex(blob)+`"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	case r.URL.Path == "/"+secrets.GetGameBranchesAPIPath:
+		s.serveGameBranches(w, r)
+	case r.URL.Path == "/"+secrets.GetGameConfigsAPIPath:
+		s.serveGameConfigs(w, r)
+	case strings.HasPrefix(r.URL.Path, "/sophon/") && strings.HasSuffix(r.URL.Path, "/getBuild"):
+		s.serveBuild(w, r)
+	case strings.HasPrefix(r.URL.Path, "/sophon/") && strings.HasSuffix(r.URL.Path, "/getPatchBuild"):
+		s.servePatchBuild(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) gamesOf(relType string) []*game {
+	var games []*game
+	for _, key := range sortedKeys(s.games) {
+		if g := s.games[key]; g.relType == relType {
+			games = append(games, g)
+		}
+	}
+	return games
+}
+
+func (s *Server) serveGameBranches(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := models.HYPGetGameBranchesResponse{Message: "OK"}
+	for _, g := range s.gamesOf(r.URL.Query().Get("launcher_id")) {
+		resp.Data.GameBranches = append(resp.Data.GameBranches, models.HYPGame{
+			Game: models.HYPGameInfo{ID: g.gameType, Biz: biz(g.gameType, g.relType)},
+			Main: models.HYPGameBranch{
+				PackageId: biz(g.gameType, g.relType),
+				Branch:    "main",
+				Password:  "fake",
+				Tag:       g.version,
+				DiffTags:  append([]string{}, g.patchTags...),
+			},
+		})
+	}
+	writeJSON(w, resp)
+}
+
+func (s *Server) serveGameConfigs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := models.HYPGetGameConfigsResponse{Message: "OK"}
+	for _, g := range s.gamesOf(r.URL.Query().Get("launcher_id")) {
+		resp.Data.LaunchConfigs = append(resp.Data.LaunchConfigs, models.HYPLaunchConfig{
+			Game:        models.HYPGameInfo{ID: g.gameType, Biz: biz(g.gameType, g.relType)},
+			ExeFileName: g.gameType + ".exe",
+			EnableLdiff: true,
+		})
+	}
+	writeJSON(w, resp)
+}
+
+// lookupBuild finds the game a getBuild / getPatchBuild request is for, answering with a
+// non-zero retcode like the real API when there is none.
+func (s *Server) lookupBuild(w http.ResponseWriter, r *http.Request) *game {
+	for _, g := range s.games {
+		if biz(g.gameType, g.relType) == r.URL.Query().Get("package_id") && r.URL.Query().Get("branch") == "main" {
+			return g
+		}
+	}
+	writeJSON(w, map[string]any{"retcode": -1, "message": "build not found"})
+	return nil
+}
+
+func (s *Server) serveBuild(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.lookupBuild(w, r)
+	if g == nil {
+		return
+	}
+	writeJSON(w, models.SophonGetBuildAPIResponse{
+		Message: "OK",
+		Data: models.SophonGetBuildAPIData{
+			BuildID:   g.version,
+			Tag:       g.version,
+			Manifests: []models.SophonManifest{g.manifest},
+		},
+	})
+}
+
+func (s *Server) servePatchBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.lookupBuild(w, r)
+	if g == nil {
+		return
+	}
+	if g.patch == nil {
+		writeJSON(w, map[string]any{"retcode": -1, "message": "no patches for " + g.version})
+		return
+	}
+	writeJSON(w, models.SophonGetPatchBuildAPIResponse{
+		Message: "OK",
+		Data: models.SophonGetPatchBuildAPIData{
+			BuildID:   g.version,
+			PatchID:   "patch_" + g.version,
+			Tag:       g.version,
+			Manifests: []models.SophonPatchManifest{*g.patch},
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func gameKey(gameType, relType string) string {
+	return gameType + "/" + relType
+}
+
+func biz(gameType, relType string) string {
+	if relType == "cn" {
+		return gameType + "_cn"
+	}
+	return gameType + "_global"
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+var encoder, _ = zstd.NewWriter(nil)
+
+func zstdCompress(data []byte) []byte {
+	return encoder.EncodeAll(data, nil)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,216 @@
+// Package faults wraps an http.RoundTripper and a utils.FS to inject failures at configurable
+// rates, for testing that the pipeline retries its way to a correct result.
+package faults
+
+import (
+	"SophonClientv2/pkg/utils"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrInjectedDrop  = errors.New("injected connection drop")
+	ErrInjectedWrite = errors.New("injected write failure")
+	ErrInjectedOpen  = errors.New("injected open failure")
+)
+
+// Rates are probabilities between 0 and 1 that a request or file operation fails in the given way.
+type Rates struct {
+	Drop     float64 // Request fails before a response arrives
+	Status   float64 // Response is replaced by 503 or 429
+	Truncate float64 // Body ends early with io.ErrUnexpectedEOF
+	Corrupt  float64 // One byte of the body is flipped
+
+	WriteFail    float64 // File write returns an error
+	WriteCorrupt float64 // File write succeeds but stores a flipped byte
+	OpenFail     float64 // Opening an existing file for reading fails
+}
+
+// Stats counts the faults injected so far.
+type Stats struct {
+	Drops, Statuses, Truncations, Corruptions atomic.Int64
+	WriteFailures, WriteCorruptions           atomic.Int64
+	OpenFailures                              atomic.Int64
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("drops=%d statuses=%d truncations=%d corruptions=%d write_failures=%d write_corruptions=%d open_failures=%d",
+		s.Drops.Load(), s.Statuses.Load(), s.Truncations.Load(), s.Corruptions.Load(),
+		s.WriteFailures.Load(), s.WriteCorruptions.Load(), s.OpenFailures.Load())
+}
+
+// Injector decides which operations fail. It is safe for concurrent use.
+type Injector struct {
+	Rates Rates
+	Stats Stats
+	// Only requests whose URL path starts with PathPrefix are affected, empty affects all
+	PathPrefix string
+	// Body bytes a truncated response keeps, 0 picks a random length below 1 KiB
+	TruncateAt int64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func NewInjector(seed int64, rates Rates) *Injector {
+	return &Injector{Rates: rates, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (inj *Injector) hit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.rng.Float64() < rate
+}
+
+func (inj *Injector) intn(n int) int {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.rng.Intn(n)
+}
+
+// Transport returns a RoundTripper injecting network faults into requests made through base.
+func (inj *Injector) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{inj: inj, base: base}
+}
+
+type transport struct {
+	inj  *Injector
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	inj := t.inj
+	if !strings.HasPrefix(req.URL.Path, inj.PathPrefix) {
+		return t.base.RoundTrip(req)
+	}
+	if inj.hit(inj.Rates.Drop) {
+		inj.Stats.Drops.Add(1)
+		return nil, ErrInjectedDrop
+	}
+	if inj.hit(inj.Rates.Status) {
+		inj.Stats.Statuses.Add(1)
+		status := http.StatusServiceUnavailable
+		if inj.intn(2) == 0 {
+			status = http.StatusTooManyRequests
+		}
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			StatusCode: status,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode >= 300 {
+		return resp, err
+	}
+	switch {
+	case inj.hit(inj.Rates.Truncate):
+		inj.Stats.Truncations.Add(1)
+		truncateAt := inj.TruncateAt
+		if truncateAt <= 0 {
+			truncateAt = int64(inj.intn(1024))
+		}
+		resp.Body = &faultyBody{ReadCloser: resp.Body, truncateAt: truncateAt}
+	case inj.hit(inj.Rates.Corrupt):
+		inj.Stats.Corruptions.Add(1)
+		resp.Body = &faultyBody{ReadCloser: resp.Body, truncateAt: -1, corruptAt: int64(inj.intn(64))}
+	}
+	return resp, nil
+}
+
+// faultyBody cuts the body after truncateAt bytes (unless negative) or flips the byte at corruptAt.
+type faultyBody struct {
+	io.ReadCloser
+	truncateAt int64
+	corruptAt  int64
+	read       int64
+}
+
+func (b *faultyBody) Read(p []byte) (int, error) {
+	if b.truncateAt >= 0 {
+		remaining := b.truncateAt - b.read
+		if remaining <= 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.truncateAt < 0 && b.corruptAt >= b.read && b.corruptAt < b.read+int64(n) {
+		p[b.corruptAt-b.read] ^= 0xff
+	}
+	b.read += int64(n)
+	return n, err
+}
+
+// FS returns a file system injecting write and open faults into base.
+func (inj *Injector) FS(base utils.FS) utils.FS {
+	if base == nil {
+		base = utils.OSFS{}
+	}
+	return &faultFS{FS: base, inj: inj}
+}
+
+type faultFS struct {
+	utils.FS
+	inj *Injector
+}
+
+func (fsys *faultFS) Open(name string) (utils.File, error) {
+	if fsys.inj.hit(fsys.inj.Rates.OpenFail) {
+		fsys.inj.Stats.OpenFailures.Add(1)
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrInjectedOpen}
+	}
+	return fsys.FS.Open(name)
+}
+
+func (fsys *faultFS) OpenFile(name string, flag int, perm os.FileMode) (utils.File, error) {
+	f, err := fsys.FS.OpenFile(name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	return &faultFile{File: f, inj: fsys.inj, name: name}, nil
+}
+
+type faultFile struct {
+	utils.File
+	inj  *Injector
+	name string
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	inj := f.inj
+	if inj.hit(inj.Rates.WriteFail) {
+		inj.Stats.WriteFailures.Add(1)
+		// Part of the data may reach the disk before the failure, like a full disk
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, &os.PathError{Op: "write", Path: f.name, Err: ErrInjectedWrite}
+	}
+	if len(p) > 0 && inj.hit(inj.Rates.WriteCorrupt) {
+		inj.Stats.WriteCorruptions.Add(1)
+		corrupted := append([]byte{}, p...)
+		corrupted[inj.intn(len(corrupted))] ^= 0xff
+		return f.File.Write(corrupted)
+	}
+	return f.File.Write(p)
+}
@@ -0,0 +1,107 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// consoleHandler prints "[LEVEL] message key=value ..." lines, colored by level when writing to a terminal.
+type consoleHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	color  bool
+	level  slog.Leveler
+	attrs  string // Pre-formatted attributes from WithAttrs
+	prefix string // Group prefix for attribute keys, e.g. "request."
+}
+
+func newConsoleHandler(w io.Writer, color bool, level slog.Leveler) *consoleHandler {
+	return &consoleHandler{mu: &sync.Mutex{}, w: w, color: color, level: level}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	name, color := levelStyle(r.Level)
+	if h.color {
+		b.WriteString(color)
+	}
+	b.WriteString("[" + name + "] ")
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&b, h.prefix, a)
+		return true
+	})
+	if h.color {
+		b.WriteString("\033[0m")
+	}
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	for _, a := range attrs {
+		appendAttr(&b, h.prefix, a)
+	}
+	h2 := *h
+	h2.attrs += b.String()
+	return &h2
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+func levelStyle(level slog.Level) (name, color string) {
+	switch {
+	case level >= LevelFatal:
+		return "FATAL", "\033[35m"
+	case level >= slog.LevelError:
+		return "ERROR", "\033[31m"
+	case level >= slog.LevelWarn:
+		return "WARN", "\033[33m"
+	case level >= slog.LevelInfo:
+		return "INFO", "\033[32m"
+	default:
+		return "DEBUG", "\033[34m"
+	}
+}
+
+func appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(b, prefix, ga)
+		}
+		return
+	}
+	value := a.Value.String()
+	if value == "" || strings.ContainsAny(value, " =\"\n\t") {
+		value = strconv.Quote(value)
+	}
+	b.WriteString(" " + prefix + a.Key + "=" + value)
+}
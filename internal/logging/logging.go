@@ -2,123 +2,152 @@ package logging
 
 import (
 	"SophonClientv2/internal/config"
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// LevelFatal is the slog level of config.Fatal. It ranks above slog.LevelError.
+const LevelFatal = slog.Level(12)
+
+// Structured field keys shared by every package
+const (
+	KeyTaskID  = "task_id"
+	KeyStage   = "stage"
+	KeyWorker  = "worker"
+	KeyChunkID = "chunk_id"
+	KeyFile    = "file"
+)
+
+// Logger is a thin wrapper around slog.Logger keeping the level methods the code base uses.
+// Arguments after the message are slog key-value pairs, e.g. Info("Wrote chunk", KeyChunkID, id).
 type Logger struct {
-	LogToFile bool
-	LogFile   *os.File // Optional, used if LogToFile is true
+	slog   *slog.Logger
+	closer io.Closer // Log file owned by a logger from NewLogger, nil otherwise
+}
+
+func slogLevel(l config.LogLevel) slog.Level {
+	switch l {
+	case config.Debug:
+		return slog.LevelDebug
+	case config.Info:
+		return slog.LevelInfo
+	case config.Warn:
+		return slog.LevelWarn
+	case config.Error:
+		return slog.LevelError
+	default:
+		return LevelFatal
+	}
+}
+
+// configLevel reads the level from the global configuration on every call,
+// so the CLI can quieten the logger after it was created.
+type configLevel struct{}
+
+func (configLevel) Level() slog.Level {
+	return slogLevel(config.Config.SophonLogLevel)
 }
 
+// NewLogger builds the logger described by the global configuration: console, text or JSON
+// output to stdout or to a size-rotated log file. Records carrying a task ID are also passed
+// to the sinks of that task, see OpenTaskLog and Subscribe.
 func NewLogger() *Logger {
+	var w io.Writer = os.Stdout
+	var closer io.Closer
+	color := true
 	if config.Config.SophonLogToFile {
-		filePath := config.Config.SophonLogFile
-		dir := filepath.Dir(filePath)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			panic(err)
-		}
-
-		file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		file, err := OpenRotatingFile(config.Config.SophonLogFile, int64(config.Config.LogMaxSizeMB)<<20, config.Config.LogMaxBackups)
 		if err != nil {
-			panic(err)
-		}
-		return &Logger{
-			LogToFile: true,
-			LogFile:   file,
+			fmt.Fprintln(os.Stderr, "Failed to open log file, logging to stdout:", err)
+		} else {
+			w, closer, color = file, file, false
 		}
 	}
+	return &Logger{slog: slog.New(newTaskRouter(newHandler(w, config.Config.LogFormat, color, configLevel{}))), closer: closer}
+}
 
-	return &Logger{
-		LogToFile: false,
-		LogFile:   nil,
+// NewWithHandler wraps h, for tests and for embedding the client in other programs.
+func NewWithHandler(h slog.Handler) *Logger {
+	return &Logger{slog: slog.New(newTaskRouter(h))}
+}
+
+func newHandler(w io.Writer, format string, color bool, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceLevel}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.NewJSONHandler(w, opts)
+	case "text":
+		return slog.NewTextHandler(w, opts)
+	default:
+		return newConsoleHandler(w, color, level)
 	}
 }
 
-func (l *Logger) HandleMessage(message string) {
-	if l.LogToFile {
-		_, err := l.LogFile.WriteString(message + "\n")
-		if err != nil {
-			panic(err)
+// replaceLevel names LevelFatal instead of printing it as ERROR+4.
+func replaceLevel(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := a.Value.Any().(slog.Level); ok && level >= LevelFatal {
+			return slog.String(slog.LevelKey, "FATAL")
 		}
-	} else {
-		fmt.Println(message)
 	}
+	return a
+}
 
-	return
+func (l *Logger) log(level slog.Level, message string, args ...any) {
+	l.slog.Log(context.Background(), level, message, args...)
 }
 
-func (l *Logger) Debug(message string) {
-	if config.Config.SophonLogLevel > config.Debug {
-		return
-	}
-	debugPrefix := "[DEBUG] "
-	if l.LogToFile {
-		l.HandleMessage(debugPrefix + message)
-	} else {
-		debugColored := "\033[34m" + debugPrefix + message + "\033[0m"
-		l.HandleMessage(debugColored)
-	}
+func (l *Logger) Debug(message string, args ...any) {
+	l.log(slog.LevelDebug, message, args...)
 }
 
-func (l *Logger) Info(message string) {
-	if config.Config.SophonLogLevel > config.Info {
-		return
-	}
-	infoPrefix := "[INFO] "
-	if l.LogToFile {
-		l.HandleMessage(infoPrefix + message)
-	} else {
-		infoColored := "\033[32m" + infoPrefix + message + "\033[0m"
-		l.HandleMessage(infoColored)
-	}
+func (l *Logger) Info(message string, args ...any) {
+	l.log(slog.LevelInfo, message, args...)
 }
 
-func (l *Logger) Warn(message string) {
-	if config.Config.SophonLogLevel > config.Warn {
-		return
-	}
-	warnPrefix := "[WARN] "
-	if l.LogToFile {
-		l.HandleMessage(warnPrefix + message)
-	} else {
-		warnColored := "\033[33m" + warnPrefix + message + "\033[0m"
-		l.HandleMessage(warnColored)
-	}
+func (l *Logger) Warn(message string, args ...any) {
+	l.log(slog.LevelWarn, message, args...)
 }
 
-func (l *Logger) Error(message string) {
-	if config.Config.SophonLogLevel > config.Error {
-		return
-	}
-	errorPrefix := "[ERROR] "
-	if l.LogToFile {
-		l.HandleMessage(errorPrefix + message)
-	} else {
-		errorColored := "\033[31m" + errorPrefix + message + "\033[0m"
-		l.HandleMessage(errorColored)
-	}
+func (l *Logger) Error(message string, args ...any) {
+	l.log(slog.LevelError, message, args...)
 }
 
-func (l *Logger) Fatal(message string) {
-	fatalPrefix := "[FATAL] "
-	if l.LogToFile {
-		l.HandleMessage(fatalPrefix + message)
-	} else {
-		fatalColored := "\033[35m" + fatalPrefix + message + "\033[0m"
-		l.HandleMessage(fatalColored)
-	}
+// Fatal logs at LevelFatal. Unlike log.Fatal it does not exit, the caller still has to give up.
+func (l *Logger) Fatal(message string, args ...any) {
+	l.log(LevelFatal, message, args...)
+}
+
+// With returns a logger adding the key-value pairs to every record.
+// A KeyTaskID pair routes the records to that task's sinks as well.
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{slog: l.slog.With(args...)}
+}
 
-	err := l.LogFile.Sync()
-	if err != nil {
-		panic(err)
+// Slog returns the underlying slog.Logger.
+func (l *Logger) Slog() *slog.Logger {
+	return l.slog
+}
+
+// Close closes the log file of a logger created by NewLogger.
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
 	}
-	err = l.LogFile.Close()
-	if err != nil {
-		panic(err)
+	return l.closer.Close()
+}
+
+// DefaultTaskLogPath is where OpenTaskLog writes the log of a task, empty if task logs are disabled.
+func DefaultTaskLogPath(taskID string) string {
+	if config.Config.TaskLogDir == "" {
+		return ""
 	}
-	os.Exit(1) // Exit in fatal errors
+	return filepath.Join(config.Config.TaskLogDir, taskID+".log")
 }
 
 var GlobalLogger = NewLogger()
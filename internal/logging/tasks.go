@@ -0,0 +1,237 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is a log record as streamed to subscribers.
+type Entry struct {
+	Time    time.Time      `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"message"`
+	TaskID  string         `json:"task_id"`
+	Attrs   map[string]any `json:"attrs,omitempty"`
+}
+
+type Subscription struct {
+	C       chan Entry
+	taskID  string // Empty receives every task
+	dropped atomic.Int64
+}
+
+type taskFile struct {
+	file    *RotatingFile
+	handler slog.Handler
+}
+
+// taskSinks holds the per-task log files and the subscribers records with a task ID are copied to.
+type taskSinks struct {
+	mu     sync.RWMutex
+	files  map[string]*taskFile
+	subs   map[*Subscription]struct{}
+	active atomic.Bool // Any file or subscriber, so records are only copied when someone listens
+}
+
+var sinks = &taskSinks{files: make(map[string]*taskFile), subs: make(map[*Subscription]struct{})}
+
+func (s *taskSinks) updateActiveLocked() {
+	s.active.Store(len(s.files) > 0 || len(s.subs) > 0)
+}
+
+// OpenTaskLog writes every record of the task to path as JSON lines, in addition to the global log.
+// Reopening a task appends to its file. Records below the configured level are not written.
+func OpenTaskLog(taskID, path string) error {
+	file, err := OpenRotatingFile(path, 0, 0)
+	if err != nil {
+		return err
+	}
+	sinks.mu.Lock()
+	defer sinks.mu.Unlock()
+	if old, ok := sinks.files[taskID]; ok {
+		old.file.Close()
+	}
+	sinks.files[taskID] = &taskFile{file: file, handler: slog.NewJSONHandler(file, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: replaceLevel})}
+	sinks.updateActiveLocked()
+	return nil
+}
+
+func CloseTaskLog(taskID string) error {
+	sinks.mu.Lock()
+	defer sinks.mu.Unlock()
+	tf, ok := sinks.files[taskID]
+	if !ok {
+		return nil
+	}
+	delete(sinks.files, taskID)
+	sinks.updateActiveLocked()
+	return tf.file.Close()
+}
+
+// Subscribe streams the records of a task, or of every task if taskID is empty.
+// Publishing never blocks: entries are dropped while the buffer is full.
+func Subscribe(taskID string, buffSize int) *Subscription {
+	sub := &Subscription{C: make(chan Entry, buffSize), taskID: taskID}
+	sinks.mu.Lock()
+	sinks.subs[sub] = struct{}{}
+	sinks.updateActiveLocked()
+	sinks.mu.Unlock()
+	return sub
+}
+
+func (sub *Subscription) Close() {
+	sinks.mu.Lock()
+	defer sinks.mu.Unlock()
+	if _, ok := sinks.subs[sub]; !ok {
+		return
+	}
+	delete(sinks.subs, sub)
+	sinks.updateActiveLocked()
+	close(sub.C)
+}
+
+// Dropped returns how many entries could not be delivered because the subscriber was too slow.
+func (sub *Subscription) Dropped() int64 {
+	return sub.dropped.Load()
+}
+
+func (s *taskSinks) dispatch(ctx context.Context, taskID string, r slog.Record) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if tf, ok := s.files[taskID]; ok {
+		_ = tf.handler.Handle(ctx, r)
+	}
+	var entry *Entry
+	for sub := range s.subs {
+		if sub.taskID != "" && sub.taskID != taskID {
+			continue
+		}
+		if entry == nil {
+			entry = newEntry(taskID, r)
+		}
+		select {
+		case sub.C <- *entry:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+func newEntry(taskID string, r slog.Record) *Entry {
+	name, _ := levelStyle(r.Level)
+	entry := &Entry{Time: r.Time, Level: name, Message: r.Message, TaskID: taskID}
+	r.Attrs(func(a slog.Attr) bool {
+		if entry.Attrs == nil {
+			entry.Attrs = make(map[string]any, r.NumAttrs())
+		}
+		flattenAttr(entry.Attrs, "", a)
+		return true
+	})
+	return entry
+}
+
+func flattenAttr(m map[string]any, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			flattenAttr(m, prefix, ga)
+		}
+		return
+	}
+	if a.Key == KeyTaskID && prefix == "" {
+		return // Already in Entry.TaskID
+	}
+	m[prefix+a.Key] = a.Value.Any()
+}
+
+// taskRouter passes records to the global handler and, when they carry a task ID,
+// to the sinks of that task with every bound attribute included.
+type taskRouter struct {
+	base   slog.Handler
+	taskID string
+	attrs  []slog.Attr // Bound attributes, already nested into their groups
+	groups []string
+}
+
+func newTaskRouter(base slog.Handler) *taskRouter {
+	return &taskRouter{base: base}
+}
+
+func (h *taskRouter) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.base.Enabled(ctx, level)
+}
+
+func (h *taskRouter) Handle(ctx context.Context, r slog.Record) error {
+	err := h.base.Handle(ctx, r)
+	if !sinks.active.Load() {
+		return err
+	}
+	taskID := h.taskID
+	if taskID == "" && len(h.groups) == 0 {
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == KeyTaskID {
+				taskID = a.Value.String()
+				return false
+			}
+			return true
+		})
+	}
+	if taskID == "" {
+		return err
+	}
+
+	full := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	full.AddAttrs(h.attrs...)
+	var own []slog.Attr
+	r.Attrs(func(a slog.Attr) bool {
+		own = append(own, a)
+		return true
+	})
+	full.AddAttrs(nestInGroups(h.groups, own)...)
+	sinks.dispatch(ctx, taskID, full)
+	return err
+}
+
+func (h *taskRouter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.base = h.base.WithAttrs(attrs)
+	h2.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], nestInGroups(h.groups, attrs)...)
+	if len(h.groups) == 0 {
+		for _, a := range attrs {
+			if a.Key == KeyTaskID {
+				h2.taskID = a.Value.String()
+			}
+		}
+	}
+	return &h2
+}
+
+func (h *taskRouter) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.base = h.base.WithGroup(name)
+	h2.groups = append(h.groups[:len(h.groups):len(h.groups)], name)
+	return &h2
+}
+
+func nestInGroups(groups []string, attrs []slog.Attr) []slog.Attr {
+	if len(attrs) == 0 {
+		return nil
+	}
+	for i := len(groups) - 1; i >= 0; i-- {
+		args := make([]any, len(attrs))
+		for j, a := range attrs {
+			args[j] = a
+		}
+		attrs = []slog.Attr{slog.Group(groups[i], args...)}
+	}
+	return attrs
+}
@@ -59,3 +59,28 @@ type SophonGetBuildAPIResponse struct {
 	Message string                `json:"message"`
 	Data    SophonGetBuildAPIData `json:"data"`
 }
+
+// getPatchBuild shares most fields with getBuild, manifests additionally carry the patch blob location.
+// Stats are keyed by the version the patch applies to.
+type SophonPatchManifest struct {
+	CategoryID       string                         `json:"category_id"`
+	CategoryName     string                         `json:"category_name"`
+	Manifest         SophonManifestInfo             `json:"manifest"`
+	DiffDownload     SophonChunkDownloadInfo        `json:"diff_download"`
+	ManifestDownload SophonManifestDownloadInfo     `json:"manifest_download"`
+	MatchingField    string                         `json:"matching_field"`
+	Stats            map[string]SophonManifestStats `json:"stats"`
+}
+
+type SophonGetPatchBuildAPIData struct {
+	BuildID   string                `json:"build_id"`
+	PatchID   string                `json:"patch_id"`
+	Tag       string                `json:"tag"`
+	Manifests []SophonPatchManifest `json:"manifests"`
+}
+
+type SophonGetPatchBuildAPIResponse struct {
+	Retcode int                        `json:"retcode"`
+	Message string                     `json:"message"`
+	Data    SophonGetPatchBuildAPIData `json:"data"`
+}
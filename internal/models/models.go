@@ -1,9 +1,19 @@
 package models
 
+import "time"
+
 type GameOperationRequest struct {
 	GameDir  string `json:"gamedir" validate:"required"`
 	GameType string `json:"game_type" validate:"oneof=hk4e nap hkrpg"` // hkrpg not implemented in python
 	TempDir  string `json:"tempdir,omitempty"`
+
+	// Per-task limits overriding the configuration, zero keeps the configured value.
+	// E.g. a background predownload with few downloads next to a full speed repair.
+	Downloads      int      `json:"downloads,omitempty" validate:"min=0,max=256"`
+	Decompressions int      `json:"decompressions,omitempty" validate:"min=0,max=256"`
+	Hashchecks     int      `json:"hashchecks,omitempty" validate:"min=0,max=256"`
+	RateLimit      int      `json:"rate_limit,omitempty" validate:"min=0"` // KiB/s, within the global limit
+	Mirrors        []string `json:"mirrors,omitempty"`                     // Chunk URL prefixes or hosts in addition to download_mirrors
 }
 
 type InstallRequest struct {
@@ -13,12 +23,53 @@ type InstallRequest struct {
 
 type UpdateRequest struct {
 	GameOperationRequest
-	Predownload bool `json:"predownload"`
+	UpdateRelType string `json:"update_reltype" validate:"oneof=os cn"`
+	FromVersion   string `json:"from_version,omitempty"` // Installed game version, e.g. "5.5.0". Detected from GameDir when empty
+	Predownload   bool   `json:"predownload"`
 }
 
 type RepairRequest struct {
 	GameOperationRequest
-	RepairMode string `json:"repair_mode" validate:"oneof=quick reliable"`
+	RepairRelType string `json:"repair_reltype" validate:"oneof=os cn"`
+	RepairMode    string `json:"repair_mode" validate:"oneof=quick reliable"`
+}
+
+// TaskLimits resizes the pipeline of a running task, zero fields are left unchanged.
+// Stages set this way are no longer autotuned. A RateLimit of -1 removes the task's bandwidth limit,
+// in responses 0 means unlimited.
+type TaskLimits struct {
+	Downloads      int `json:"downloads,omitempty" validate:"min=0,max=256"`
+	Decompressions int `json:"decompressions,omitempty" validate:"min=0,max=256"`
+	Hashchecks     int `json:"hashchecks,omitempty" validate:"min=0,max=256"`
+	Writers        int `json:"writers,omitempty" validate:"min=0,max=64"`
+	QueueSize      int `json:"queue_size,omitempty" validate:"min=0,max=65536"`
+	RateLimit      int `json:"rate_limit,omitempty" validate:"min=-1"` // KiB/s
+}
+
+// RateLimitRequest changes the bandwidth limit all tasks share, omitted fields are left unchanged.
+// Rates are KiB/s with 0 for unlimited. The schedule overrides the limit during its windows,
+// e.g. "08:00-18:00=2048,22:00-06:00=0", an empty schedule removes them.
+type RateLimitRequest struct {
+	Limit    *int    `json:"limit,omitempty"`
+	Schedule *string `json:"schedule,omitempty"`
+}
+
+// MirrorStatus describes one chunk mirror of a running task.
+type MirrorStatus struct {
+	Prefix           string  `json:"prefix"`
+	SpeedBytesPerSec float64 `json:"speed_bytes_per_sec"`
+	LatencyMs        float64 `json:"latency_ms"`
+	ErrorRate        float64 `json:"error_rate"`
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	Bytes            int64   `json:"bytes"`
+	Down             bool    `json:"down"` // Skipped for a while after repeated failures
+}
+
+type RateLimitStatus struct {
+	Limit     int    `json:"limit"`
+	Schedule  string `json:"schedule"`
+	Effective int    `json:"effective"` // Limit in effect right now
 }
 
 type TaskResponse struct {
@@ -29,7 +80,8 @@ type TaskResponse struct {
 
 type TaskStatus struct {
 	TaskID   string   `json:"task_id"`
-	Status   string   `json:"status" validate:"oneof=running completed failed cancelled pending"`
+	TaskType string   `json:"task_type"`
+	Status   string   `json:"status" validate:"oneof=running paused completed failed cancelled pending interrupted"`
 	Progress *float64 `json:"progress,omitempty"`
 	Error    *string  `json:"error,omitempty"`
 }
@@ -37,10 +89,58 @@ type TaskStatus struct {
 type OnlineGameInfo struct {
 	GameType           string   `json:"game_type" validate:"oneof=hk4e nap hkrpg''"`
 	Version            string   `json:"version"`
-	InstallSize        int64    `json:"install_size"`
+	InstallSize        int64    `json:"install_size"`  // Bytes on disk after installing
+	DownloadSize       int64    `json:"download_size"` // Bytes to download for a fresh install
 	UpdatableVersions  []string `json:"updatable_versions"`
 	ReleaseType        string   `json:"release_type"`
 	PreDownload        bool     `json:"pre_download"`
 	PreDownloadVersion *string  `json:"pre_download_version,omitempty"`
 	Error              *string  `json:"error,omitempty"`
 }
+
+type LocalGameInfo struct {
+	GameType           string  `json:"game_type"`
+	GameDir            string  `json:"gamedir"`
+	ReleaseType        string  `json:"release_type"`
+	Installed          bool    `json:"installed"`
+	InstalledVersion   string  `json:"installed_version,omitempty"`
+	VersionSource      string  `json:"version_source,omitempty"` // File the version was read from
+	LatestVersion      string  `json:"latest_version"`
+	Action             string  `json:"action" validate:"oneof=up_to_date update reinstall install"`
+	PreDownload        bool    `json:"pre_download"` // A predownload for the installed version is available
+	PreDownloadVersion *string `json:"pre_download_version,omitempty"`
+	Error              *string `json:"error,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error   string   `json:"error"`
+	Details []string `json:"details,omitempty"`
+}
+
+type TaskProgress struct {
+	TotalChunks        int      `json:"total_chunks"`
+	TotalFiles         int      `json:"total_files"`
+	DownloadedChunks   int      `json:"downloaded_chunks"`
+	DecompressedChunks int      `json:"decompressed_chunks"`
+	VerifiedChunks     int      `json:"verified_chunks"`
+	AssembledChunks    int      `json:"assembled_chunks"`
+	VerifiedFiles      int      `json:"verified_files"`
+	TotalBytes         int64    `json:"total_bytes"`
+	DownloadedBytes    int64    `json:"downloaded_bytes"`
+	Percent            float64  `json:"percent"`
+	SpeedBytesPerSec   float64  `json:"speed_bytes_per_sec"`
+	ElapsedSeconds     float64  `json:"elapsed_seconds"`
+	ETASeconds         *float64 `json:"eta_seconds,omitempty"`
+	Paused             bool     `json:"paused"`
+
+	DownloadConcurrency int `json:"download_concurrency,omitempty"` // Parallel downloads right now, adaptive_downloads changes it
+}
+
+type TaskEvent struct {
+	TaskID  string    `json:"task_id"`
+	Event   string    `json:"event"`
+	Status  string    `json:"status"`
+	Message string    `json:"message,omitempty"`
+	Error   *string   `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
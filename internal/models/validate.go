@@ -0,0 +1,122 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Validate checks the `validate` struct tags of v (required, oneof, min, max, omitempty)
+// and returns one message per failed field. Embedded structs are walked as well.
+func Validate(v any) []string {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return []string{"request body is empty"}
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	return validateStruct(rv)
+}
+
+func validateStruct(rv reflect.Value) []string {
+	var errs []string
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		value := rv.Field(i)
+
+		if field.Anonymous && value.Kind() == reflect.Struct {
+			errs = append(errs, validateStruct(value)...)
+			continue
+		}
+
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		name := jsonFieldName(field)
+
+		omitEmpty := false
+		for _, rule := range strings.Split(tag, ",") {
+			switch {
+			case rule == "omitempty":
+				omitEmpty = true
+			case rule == "required":
+				if value.IsZero() {
+					errs = append(errs, fmt.Sprintf("%s is required", name))
+				}
+			case strings.HasPrefix(rule, "oneof="):
+				if omitEmpty && value.IsZero() {
+					continue
+				}
+				allowed := parseOneOf(strings.TrimPrefix(rule, "oneof="))
+				got := fmt.Sprint(value.Interface())
+				if !containsString(allowed, got) {
+					errs = append(errs, fmt.Sprintf("%s must be one of [%s], got %q", name, strings.Join(quoteAll(allowed), " "), got))
+				}
+			case strings.HasPrefix(rule, "min="), strings.HasPrefix(rule, "max="):
+				if !value.CanInt() {
+					continue
+				}
+				limit, err := strconv.ParseInt(rule[len("min="):], 10, 64)
+				if err != nil {
+					continue
+				}
+				if rule[:3] == "min" && value.Int() < limit {
+					errs = append(errs, fmt.Sprintf("%s must be at least %d, got %d", name, limit, value.Int()))
+				}
+				if rule[:3] == "max" && value.Int() > limit {
+					errs = append(errs, fmt.Sprintf("%s must be at most %d, got %d", name, limit, value.Int()))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// parseOneOf splits a oneof rule on spaces. A value suffixed with two single quotes also allows the empty string.
+func parseOneOf(rule string) []string {
+	var allowed []string
+	for _, v := range strings.Fields(rule) {
+		if strings.HasSuffix(v, "''") {
+			allowed = append(allowed, "")
+			v = strings.TrimSuffix(v, "''")
+			if v == "" {
+				continue
+			}
+		}
+		allowed = append(allowed, v)
+	}
+	return allowed
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	if tag := field.Tag.Get("json"); tag != "" {
+		if name := strings.Split(tag, ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteAll(list []string) []string {
+	out := make([]string, len(list))
+	for i, v := range list {
+		out[i] = fmt.Sprintf("%q", v)
+	}
+	return out
+}
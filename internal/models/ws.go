@@ -0,0 +1,65 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WebSocket progress protocol, see WebSocket.md for the full description.
+const WSProtocolVersion = 1
+
+// Client -> server message types
+const (
+	WSSubscribe   = "subscribe"
+	WSUnsubscribe = "unsubscribe"
+	WSPing        = "ping"
+	WSPause       = "pause"
+	WSResume      = "resume"
+
+	WSSubscribeLogs   = "subscribe_logs"
+	WSUnsubscribeLogs = "unsubscribe_logs"
+)
+
+// Server -> client message types
+const (
+	WSHello        = "hello"
+	WSSubscribed   = "subscribed"
+	WSUnsubscribed = "unsubscribed"
+	WSProgress     = "progress"
+	WSEvent        = "event"
+	WSError        = "error"
+	WSPong         = "pong"
+
+	WSLogsSubscribed   = "logs_subscribed"
+	WSLogsUnsubscribed = "logs_unsubscribed"
+	WSLog              = "log"
+)
+
+// Subscribing to this task ID subscribes to every task, including ones created later.
+const WSAllTasks = "*"
+
+type WSClientMessage struct {
+	Type    string   `json:"type"`
+	TaskIDs []string `json:"task_ids,omitempty"`
+}
+
+type WSServerMessage struct {
+	Version int             `json:"version"`
+	Type    string          `json:"type"`
+	TaskID  string          `json:"task_id,omitempty"`
+	Time    time.Time       `json:"time"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type WSHelloData struct {
+	ProtocolVersion    int   `json:"protocol_version"`
+	SnapshotIntervalMs int64 `json:"snapshot_interval_ms"`
+}
+
+type WSSubscriptionData struct {
+	TaskIDs []string `json:"task_ids"`
+}
+
+type WSErrorData struct {
+	Error string `json:"error"`
+}
@@ -1,50 +1,72 @@
 package main
 
 import (
+	"SophonClientv2/internal/config"
+	"SophonClientv2/pkg/operations"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
 }
 
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
+// runServe starts the REST and WebSocket server and shuts it down gracefully on SIGINT or SIGTERM.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	configFlags := config.RegisterFlags(fs)
+	addr := fs.String("addr", ":8080", "address to listen on")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
 	}
-	defer conn.Close()
-	for {
-		messageType, message, err := conn.ReadMessage()
-		if err != nil {
-			log.Println(err)
-			break
-		}
-		log.Printf("Received: %s", message)
-		err = conn.WriteMessage(messageType, message)
-		if err != nil {
-			log.Println(err)
-			break
-		}
+	if !loadConfig(configFlags) {
+		return exitUsage
 	}
-}
 
-func apiHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Hello from REST API!")
-}
+	if config.Config.TaskLogDir == "" && config.Config.Source("task_log_dir") == config.SourceDefault {
+		config.Config.TaskLogDir = filepath.Join(filepath.Dir(config.Config.TaskRegistryFile), "logs")
+	}
+	if err := operations.InitTaskStore(config.Config.TaskRegistryFile); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
 
-func main() {
 	r := mux.NewRouter()
-	r.HandleFunc("/api", apiHandler)
+	registerAPIRoutes(r)
 	r.HandleFunc("/ws", wsHandler)
-	log.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+	srv := &http.Server{Addr: *addr, Handler: r}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errCh := make(chan error, 1)
+	go func() {
+		log.Println("Server starting on " + *addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	case <-ctx.Done():
+	}
+	log.Println("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	return exitOK
 }
@@ -4,103 +4,257 @@ import (
 	"SophonClientv2/internal/config"
 	"SophonClientv2/internal/logging"
 	"SophonClientv2/pkg/utils"
-	"fmt"
+	"context"
 	"io"
 	"os"
 	"path/filepath"
-	"strconv"
-	"sync"
+	"runtime"
 	"time"
 )
 
-func NewAssembler(stagingDir string, buffSize int) *Assembler {
-	inputQueue := make(chan AssemblerInput, buffSize)
-	outputQueue := make(chan AssemblerOutput, buffSize)
-	wg := &sync.WaitGroup{}
-
-	asm := &Assembler{
-		StagingDir:  stagingDir,
-		InputQueue:  inputQueue,
-		OutputQueue: outputQueue,
-		wg:          wg,
+// DefaultOptions returns the assembler settings of the global configuration.
+// A worker count of 0 means one writer per two CPUs, at most 4, as writes are mostly disk bound.
+func DefaultOptions() Options {
+	workers := config.Config.AssemblerWorkers
+	if workers <= 0 {
+		workers = min(4, max(1, runtime.NumCPU()/2))
 	}
+	return Options{
+		Workers:        workers,
+		QueueSize:      config.Config.DownloadChanSize,
+		StatusInterval: config.Config.QueueLengthPrintInterval,
+		FS:             utils.OSFS{},
+	}
+}
 
-	asm.Start() // Not multi threaded
-	asm.StartPrintChannelStatus(config.Config.QueueLengthPrintInterval)
+func (o Options) withDefaults() Options {
+	def := DefaultOptions()
+	if o.Workers <= 0 {
+		o.Workers = def.Workers
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = def.QueueSize
+	}
+	if o.MaxQueueSize < o.QueueSize {
+		o.MaxQueueSize = 4 * o.QueueSize // Room for SetQueueSize, unused capacity costs next to nothing
+	}
+	if o.StatusInterval <= 0 {
+		o.StatusInterval = def.StatusInterval
+	}
+	if o.FS == nil {
+		o.FS = def.FS
+	}
+	if o.Logger == nil {
+		o.Logger = logging.GlobalLogger
+	}
+	return o
+}
 
-	return asm
+func NewAssembler(stagingDir string, opts Options) *Assembler {
+	opts = opts.withDefaults()
+	a := &Assembler{
+		Options:     opts,
+		StagingDir:  stagingDir,
+		FS:          opts.FS,
+		InputQueue:  make(chan AssemblerInput, max(opts.QueueSize, opts.MaxQueueSize)),
+		OutputQueue: make(chan AssemblerOutput, opts.QueueSize),
+		log:         opts.Logger.With(logging.KeyStage, "assembler"),
+		group:       utils.NewWorkerGroup(),
+		slots:       utils.NewLimiter(opts.QueueSize),
+		ctx:         context.Background(),
+		done:        make(chan struct{}),
+	}
+	a.SetWorkers(opts.Workers)
+	return a
 }
 
-func (a *Assembler) StartPrintChannelStatus(intervalSeconds int) {
+func (a *Assembler) StartPrintChannelStatus(ctx context.Context, intervalSeconds int) {
 	go func() {
+		ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
+		defer ticker.Stop()
 		for {
-			if a.wg == nil {
+			a.PrintChannelStatus()
+			select {
+			case <-ctx.Done():
 				return
+			case <-a.done:
+				return
+			case <-ticker.C:
 			}
-			a.PrintChannelStatus()
-			<-time.After(time.Duration(intervalSeconds) * time.Second)
 		}
 	}()
 }
 
 func (a *Assembler) PrintChannelStatus() {
-	logging.GlobalLogger.Debug("Assembler Input Queue Length: " + strconv.Itoa(len(a.InputQueue)) + "/" + strconv.Itoa(cap(a.InputQueue)))
-	logging.GlobalLogger.Debug("Assembler Output Queue Length: " + strconv.Itoa(len(a.OutputQueue)) + "/" + strconv.Itoa(cap(a.OutputQueue)))
+	a.log.Debug("Queue lengths", "input", len(a.InputQueue), "input_size", a.QueueSize(), "output", len(a.OutputQueue), "output_size", cap(a.OutputQueue))
 }
 
-func (a *Assembler) Start() {
-	a.wg.Add(1)
+// Start launches the writer goroutines. Cancelling ctx aborts the chunks being written
+// and closes their staging files, OutputQueue is closed once every writer has exited.
+func (a *Assembler) Start(ctx context.Context) {
+	a.mu.Lock()
+	a.ctx = ctx
+	a.started = true
+	for _, w := range a.writers {
+		a.startWriter(ctx, w)
+	}
+	a.mu.Unlock()
 	go func() {
-		defer a.wg.Done()
-		for input := range a.InputQueue {
-			fullPath := filepath.Join(a.StagingDir, input.FilePath)
-
-			dir := filepath.Dir(fullPath)
-			if err := os.MkdirAll(dir, 0o755); err != nil {
-				logging.GlobalLogger.Error(fmt.Sprintf("Failed to create directory %s: %v", dir, err))
-				utils.CloseStreamSafe(input.Content)
-				a.OutputQueue <- AssemblerOutput{FilePath: input.FilePath, ChunkID: input.ChunkID, Succeeded: false, Payload: input.Payload}
-				continue
-			}
+		<-a.group.Done()
+		close(a.OutputQueue)
+		close(a.done)
+	}()
+	a.StartPrintChannelStatus(ctx, a.Options.StatusInterval)
+}
 
-			file, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY, 0o644)
-			if err != nil {
-				logging.GlobalLogger.Error(fmt.Sprintf("Failed to open file %s: %v", fullPath, err))
-				utils.CloseStreamSafe(input.Content)
-				a.OutputQueue <- AssemblerOutput{FilePath: input.FilePath, ChunkID: input.ChunkID, Succeeded: false, Payload: input.Payload}
-				continue
-			}
+func (a *Assembler) startWriter(ctx context.Context, w *writer) bool {
+	if !a.group.Add() {
+		return false
+	}
+	w.log.Debug("Started assembler writer")
 
-			if _, err := file.Seek(int64(input.Offset), io.SeekStart); err != nil {
-				logging.GlobalLogger.Error(fmt.Sprintf("Failed to seek to offset %d: %v", input.Offset, err))
-				utils.CloseStreamSafe(file)
-				utils.CloseStreamSafe(input.Content)
-				a.OutputQueue <- AssemblerOutput{FilePath: input.FilePath, ChunkID: input.ChunkID, Succeeded: false, Payload: input.Payload}
-				continue
+	go func() {
+		defer a.group.Exit()
+		for {
+			var input AssemblerInput
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.quit:
+				w.log.Debug("Removed assembler writer")
+				return
+			case input, ok = <-a.InputQueue:
+				if !ok {
+					return
+				}
 			}
+			a.slots.Release()
+			a.processed.Add(1)
 
-			written, err := io.Copy(file, input.Content)
-			utils.CloseStreamSafe(file)
-			utils.CloseStreamSafe(input.Content)
-
-			if err != nil {
-				logging.GlobalLogger.Error(fmt.Sprintf("Failed to write chunk %s: %v", input.ChunkID, err))
-				a.OutputQueue <- AssemblerOutput{FilePath: input.FilePath, ChunkID: input.ChunkID, Succeeded: false, Payload: input.Payload}
-				continue
+			succeeded := a.write(ctx, w.log, input)
+			if !utils.SendContext(ctx, a.OutputQueue, AssemblerOutput{FilePath: input.FilePath, Offset: input.Offset, ChunkID: input.ChunkID, Succeeded: succeeded, Payload: input.Payload}) {
+				return
 			}
-
-			logging.GlobalLogger.Debug(fmt.Sprintf("Wrote chunk %s to %s at offset %d (%d bytes)", input.ChunkID, input.FilePath, input.Offset, written))
-			a.OutputQueue <- AssemblerOutput{FilePath: input.FilePath, ChunkID: input.ChunkID, Succeeded: true, Payload: input.Payload}
 		}
 	}()
+	return true
 }
 
+// SetWorkers changes the number of writers, also while running. Removed writers finish their
+// current chunk first. Returns the new writer count.
+func (a *Assembler) SetWorkers(n int) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for len(a.writers) < max(1, n) {
+		w := &writer{id: a.nextID, log: a.log.With(logging.KeyWorker, a.nextID), quit: make(chan struct{})}
+		a.nextID++
+		if a.started && !a.startWriter(a.ctx, w) {
+			break
+		}
+		a.writers = append(a.writers, w)
+	}
+	for len(a.writers) > max(1, n) {
+		close(a.writers[len(a.writers)-1].quit)
+		a.writers = a.writers[:len(a.writers)-1]
+	}
+	return len(a.writers)
+}
+
+func (a *Assembler) WorkerCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.writers)
+}
+
+// SetQueueSize changes how many chunks may wait in the input queue, at most MaxQueueSize.
+// Returns the new queue size.
+func (a *Assembler) SetQueueSize(n int) int {
+	n = min(max(1, n), cap(a.InputQueue))
+	a.slots.SetLimit(n)
+	return n
+}
+
+func (a *Assembler) QueueSize() int {
+	return a.slots.Limit()
+}
+
+func (a *Assembler) QueueLength() int {
+	return len(a.InputQueue)
+}
+
+// Processed returns how many chunks the writers have taken from the input queue so far.
+func (a *Assembler) Processed() int64 {
+	return a.processed.Load()
+}
+
+func (a *Assembler) write(ctx context.Context, log *logging.Logger, input AssemblerInput) bool {
+	log = log.With(logging.KeyChunkID, input.ChunkID, logging.KeyFile, input.FilePath)
+	fullPath := filepath.Join(a.StagingDir, input.FilePath)
+
+	dir := filepath.Dir(fullPath)
+	if err := a.FS.MkdirAll(dir, 0o755); err != nil {
+		log.Error("Failed to create directory", "dir", dir, "error", err)
+		input.Discard()
+		return false
+	}
+
+	file, err := a.FS.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Error("Failed to open file", "path", fullPath, "error", err)
+		input.Discard()
+		return false
+	}
+
+	if _, err := file.Seek(int64(input.Offset), io.SeekStart); err != nil {
+		log.Error("Failed to seek", "offset", input.Offset, "error", err)
+		file.Close()
+		input.Discard()
+		return false
+	}
+
+	// Not synced here, once per chunk is far too slow on spinning disks. The installer syncs each
+	// file once it is complete, and checks journaled chunks against their MD5 before trusting them.
+	written, err := io.Copy(file, utils.NewContextReader(ctx, input.Content))
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	input.Discard()
+
+	if err != nil {
+		log.Error("Failed to write chunk", "offset", input.Offset, "error", err)
+		return false
+	}
+
+	log.Debug("Wrote chunk", "offset", input.Offset, "bytes", written)
+	return true
+}
+
+// Stop closes the input for a graceful shutdown and waits until the writers have drained it.
+// After cancellation the input is left open since abandoned enqueues may still reference it.
 func (a *Assembler) Stop() {
-	close(a.InputQueue)
-	a.wg.Wait()
-	a.wg = nil
-	close(a.OutputQueue)
-	logging.GlobalLogger.Info("Assembler stopped")
+	a.stopOnce.Do(func() {
+		if a.ctx.Err() == nil {
+			close(a.InputQueue)
+		}
+		if !a.started {
+			close(a.OutputQueue)
+			close(a.done)
+		}
+	})
+	a.Wait()
+	a.log.Info("Assembler stopped")
+}
+
+// Wait blocks until all writers have exited and OutputQueue is closed.
+func (a *Assembler) Wait() {
+	<-a.done
+}
+
+// Discard releases everything still buffered in the queues of a cancelled assembler.
+func (a *Assembler) Discard() {
+	utils.DrainDiscard(a.InputQueue)
+	utils.DrainDiscard(a.OutputQueue)
 }
 
 func (a *Assembler) EnqueueWrite(filePath string, offset uint64, chunkID string, content io.ReadCloser, payload any) {
@@ -112,7 +266,7 @@ func (a *Assembler) EnqueueWrite(filePath string, offset uint64, chunkID string,
 		Payload:  payload,
 	}
 
-	utils.NonBlockingEnqueue(a.InputQueue, input)
+	utils.EnqueueLimited(a.ctx, a.InputQueue, a.slots, input)
 }
 
 func (a *Assembler) GetOutputChannel() chan AssemblerOutput {
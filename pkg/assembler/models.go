@@ -1,8 +1,12 @@
 package assembler
 
 import (
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/pkg/utils"
+	"context"
 	"io"
 	"sync"
+	"sync/atomic"
 )
 
 type AssemblerInput struct {
@@ -13,16 +17,53 @@ type AssemblerInput struct {
 	Payload  any
 }
 
+func (i AssemblerInput) Discard() {
+	if i.Content != nil {
+		i.Content.Close()
+	}
+}
+
 type AssemblerOutput struct {
 	FilePath  string
+	Offset    uint64
 	ChunkID   string
 	Succeeded bool
 	Payload   any
 }
 
+// Options configures an Assembler. Zero fields are taken from DefaultOptions.
+type Options struct {
+	Workers        int // Writer goroutines, chunks never overlap so they can write in parallel
+	QueueSize      int
+	MaxQueueSize   int             // Capacity of the input queue, the most SetQueueSize allows. At least QueueSize
+	StatusInterval int             // Seconds between queue length debug messages
+	FS             utils.FS        // File system staging files are written through
+	Logger         *logging.Logger // Records are tagged with the stage, writer, chunk and file
+}
+
+type writer struct {
+	id   int
+	log  *logging.Logger
+	quit chan struct{} // Closed to remove the writer after its current chunk
+}
+
 type Assembler struct {
+	Options     Options
 	StagingDir  string
+	FS          utils.FS
 	InputQueue  chan AssemblerInput
 	OutputQueue chan AssemblerOutput
-	wg          *sync.WaitGroup
+
+	log       *logging.Logger
+	mu        sync.Mutex // Guards writers once started
+	writers   []*writer
+	nextID    int
+	group     *utils.WorkerGroup
+	slots     *utils.Limiter
+	processed atomic.Int64
+
+	ctx      context.Context
+	started  bool
+	done     chan struct{} // Closed together with OutputQueue
+	stopOnce sync.Once
 }
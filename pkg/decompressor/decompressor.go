@@ -4,9 +4,9 @@ import (
 	"SophonClientv2/internal/config"
 	"SophonClientv2/internal/logging"
 	"SophonClientv2/pkg/utils"
+	"context"
 	"io"
-	"strconv"
-	"sync"
+	"runtime"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
@@ -17,88 +17,233 @@ func (z *zstdReadCloser) Close() error {
 	return z.source.Close()
 }
 
-func NewWorker(id int, inputQueue chan DecompressorInput, outputQueue chan DecompressorOutput, wg *sync.WaitGroup) *DecompressorWorker {
+func (d *Decompressor) newWorker() *DecompressorWorker {
+	d.nextID++
 	return &DecompressorWorker{
-		Id:          id,
-		InputQueue:  inputQueue,
-		OutputQueue: outputQueue,
-		wg:          wg,
+		Id:          d.nextID - 1,
+		InputQueue:  d.InputQueue,
+		OutputQueue: d.OutputQueue,
+		log:         d.log.With(logging.KeyWorker, d.nextID-1),
+		group:       d.group,
+		slots:       d.slots,
+		processed:   &d.processed,
+		quit:        make(chan struct{}),
 	}
 }
 
-func (worker *DecompressorWorker) Start() {
-	logging.GlobalLogger.Debug("Started decompressor worker " + strconv.Itoa(worker.Id))
+// Start runs the worker until the input is closed, ctx is done or the worker is removed.
+// It returns false if the decompressor has already finished.
+func (worker *DecompressorWorker) Start(ctx context.Context) bool {
+	if !worker.group.Add() {
+		return false
+	}
+	worker.log.Debug("Started decompressor worker")
 
-	worker.wg.Add(1)
 	go func() {
-		defer worker.wg.Done()
-		for input := range worker.InputQueue {
-			dec, err := zstd.NewReader(input.Content)
+		defer worker.group.Exit()
+		for {
+			var input DecompressorInput
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case <-worker.quit:
+				worker.log.Debug("Removed decompressor worker")
+				return
+			case input, ok = <-worker.InputQueue:
+				if !ok {
+					return
+				}
+			}
+			worker.slots.Release()
+			worker.processed.Add(1)
+
+			dec, err := zstd.NewReader(utils.NewContextReader(ctx, input.Content))
 			if err != nil {
 				input.Content.Close()
-				logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Failed to create zstd reader: " + err.Error())
-				worker.OutputQueue <- DecompressorOutput{Content: nil, Suceeded: false, Payload: input.Payload}
+				worker.log.Error("Failed to create zstd reader", "error", err)
+				if !utils.SendContext(ctx, worker.OutputQueue, DecompressorOutput{Content: nil, Suceeded: false, Payload: input.Payload}) {
+					return
+				}
 				continue
 			}
 
-			logging.GlobalLogger.Debug("Worker " + strconv.Itoa(worker.Id) + ": Successfully decompressed content")
-			worker.OutputQueue <- DecompressorOutput{Content: &zstdReadCloser{Decoder: dec, source: input.Content}, Suceeded: true, Payload: input.Payload}
+			worker.log.Debug("Successfully decompressed content")
+			if !utils.SendContext(ctx, worker.OutputQueue, DecompressorOutput{Content: &zstdReadCloser{Decoder: dec, source: input.Content}, Suceeded: true, Payload: input.Payload}) {
+				return
+			}
 		}
 	}()
+	return true
+}
+
+// DefaultOptions returns the decompressor settings of the global configuration.
+// A worker count of 0 means one worker per CPU.
+func DefaultOptions() Options {
+	workers := config.Config.CocurrentDecompressions
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return Options{
+		Workers:        workers,
+		QueueSize:      config.Config.DecompressChanSize,
+		StatusInterval: config.Config.QueueLengthPrintInterval,
+	}
 }
 
-func NewDecompressor(buffSize int) *Decompressor {
-	logging.GlobalLogger.Info("Initializing Decompressor with " + strconv.Itoa(config.Config.CocurrentDecompressions) + " workers")
+func (o Options) withDefaults() Options {
+	def := DefaultOptions()
+	if o.Workers <= 0 {
+		o.Workers = def.Workers
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = def.QueueSize
+	}
+	if o.MaxQueueSize < o.QueueSize {
+		o.MaxQueueSize = 4 * o.QueueSize // Room for SetQueueSize, unused capacity costs next to nothing
+	}
+	if o.StatusInterval <= 0 {
+		o.StatusInterval = def.StatusInterval
+	}
+	if o.Logger == nil {
+		o.Logger = logging.GlobalLogger
+	}
+	return o
+}
 
-	threadCount := config.Config.CocurrentDecompressions
-	inputQueue := make(chan DecompressorInput, buffSize)
-	outputQueue := make(chan DecompressorOutput, buffSize)
-	workers := make([]*DecompressorWorker, threadCount)
-	wg := &sync.WaitGroup{}
+func NewDecompressor(opts Options) *Decompressor {
+	opts = opts.withDefaults()
+	opts.Logger.Info("Initializing Decompressor", "workers", opts.Workers)
+
+	d := &Decompressor{
+		Options:     opts,
+		InputQueue:  make(chan DecompressorInput, max(opts.QueueSize, opts.MaxQueueSize)),
+		OutputQueue: make(chan DecompressorOutput, opts.QueueSize),
+		log:         opts.Logger.With(logging.KeyStage, "decompressor"),
+		group:       utils.NewWorkerGroup(),
+		slots:       utils.NewLimiter(opts.QueueSize),
+		ctx:         context.Background(),
+		done:        make(chan struct{}),
+	}
+	d.SetWorkers(opts.Workers)
+	return d
+}
 
-	for i := 0; i < threadCount; i++ {
-		workers[i] = NewWorker(i, inputQueue, outputQueue, wg)
-		workers[i].Start()
+// Start launches the workers. OutputQueue is closed once every worker has exited,
+// either because the input was closed or because ctx was cancelled.
+func (d *Decompressor) Start(ctx context.Context) {
+	d.mu.Lock()
+	d.ctx = ctx
+	d.started = true
+	for _, worker := range d.Workers {
+		worker.Start(ctx)
 	}
+	d.mu.Unlock()
+	go func() {
+		<-d.group.Done()
+		close(d.OutputQueue)
+		close(d.done)
+	}()
+	d.StartPrintChannelStatus(ctx, d.Options.StatusInterval)
+}
 
-	decompressor := &Decompressor{
-		ThreadCount: threadCount,
-		InputQueue:  inputQueue,
-		OutputQueue: outputQueue,
-		Workers:     workers,
-		wg:          wg,
+// SetWorkers changes the number of workers, also while running. Removed workers finish their
+// current item first. Returns the new worker count.
+func (d *Decompressor) SetWorkers(n int) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.Workers) < max(1, n) {
+		worker := d.newWorker()
+		if d.started && !worker.Start(d.ctx) {
+			break
+		}
+		d.Workers = append(d.Workers, worker)
+	}
+	for len(d.Workers) > max(1, n) {
+		close(d.Workers[len(d.Workers)-1].quit)
+		d.Workers = d.Workers[:len(d.Workers)-1]
 	}
-	decompressor.StartPrintChannelStatus(config.Config.QueueLengthPrintInterval)
-	return decompressor
+	d.ThreadCount = len(d.Workers)
+	return d.ThreadCount
+}
+
+func (d *Decompressor) WorkerCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ThreadCount
+}
+
+// SetQueueSize changes how many items may wait in the input queue, at most MaxQueueSize.
+// Returns the new queue size.
+func (d *Decompressor) SetQueueSize(n int) int {
+	n = min(max(1, n), cap(d.InputQueue))
+	d.slots.SetLimit(n)
+	return n
+}
+
+func (d *Decompressor) QueueSize() int {
+	return d.slots.Limit()
+}
+
+func (d *Decompressor) QueueLength() int {
+	return len(d.InputQueue)
 }
 
-func (d *Decompressor) StartPrintChannelStatus(intervalSeconds int) {
+// Processed returns how many items the workers have taken from the input queue so far.
+func (d *Decompressor) Processed() int64 {
+	return d.processed.Load()
+}
+
+func (d *Decompressor) StartPrintChannelStatus(ctx context.Context, intervalSeconds int) {
 	go func() {
+		ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
+		defer ticker.Stop()
 		for {
-			if d.wg == nil {
+			d.PrintChannelStatus()
+			select {
+			case <-ctx.Done():
 				return
+			case <-d.done:
+				return
+			case <-ticker.C:
 			}
-			d.PrintChannelStatus()
-			<-time.After(time.Duration(intervalSeconds) * time.Second)
 		}
 	}()
 }
 
 func (d *Decompressor) PrintChannelStatus() {
-	logging.GlobalLogger.Debug("Decompressor Input Queue Length: " + strconv.Itoa(len(d.InputQueue)) + "/" + strconv.Itoa(cap(d.InputQueue)))
-	logging.GlobalLogger.Debug("Decompressor Output Queue Length: " + strconv.Itoa(len(d.OutputQueue)) + "/" + strconv.Itoa(cap(d.OutputQueue)))
+	d.log.Debug("Queue lengths", "input", len(d.InputQueue), "input_size", d.QueueSize(), "output", len(d.OutputQueue), "output_size", cap(d.OutputQueue))
 }
 
+// Stop closes the input for a graceful shutdown and waits until the workers have drained it.
+// After cancellation the input is left open since abandoned enqueues may still reference it.
 func (d *Decompressor) Stop() {
-	close(d.InputQueue)
-	d.wg.Wait()
-	d.wg = nil
-	close(d.OutputQueue)
-	logging.GlobalLogger.Info("Decompressor stopped")
+	d.stopOnce.Do(func() {
+		if d.ctx.Err() == nil {
+			close(d.InputQueue)
+		}
+		if !d.started {
+			close(d.OutputQueue)
+			close(d.done)
+		}
+	})
+	d.Wait()
+	d.log.Info("Decompressor stopped")
+}
+
+// Wait blocks until all workers have exited and OutputQueue is closed.
+func (d *Decompressor) Wait() {
+	<-d.done
+}
+
+// Discard releases everything still buffered in the queues of a cancelled decompressor.
+func (d *Decompressor) Discard() {
+	utils.DrainDiscard(d.InputQueue)
+	utils.DrainDiscard(d.OutputQueue)
 }
 
 func (d *Decompressor) EnqueueDecompression(content io.ReadCloser, payload any) {
-	utils.NonBlockingEnqueue(d.InputQueue, DecompressorInput{Content: content, Payload: payload})
+	utils.EnqueueLimited(d.ctx, d.InputQueue, d.slots, DecompressorInput{Content: content, Payload: payload})
 }
 
 func (d *Decompressor) GetOutputChannel() chan DecompressorOutput {
@@ -1,8 +1,12 @@
 package decompressor
 
 import (
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/pkg/utils"
+	"context"
 	"io"
 	"sync"
+	"sync/atomic"
 
 	"github.com/klauspost/compress/zstd"
 )
@@ -12,25 +16,63 @@ type DecompressorInput struct {
 	Payload any
 }
 
+func (i DecompressorInput) Discard() {
+	if i.Content != nil {
+		i.Content.Close()
+	}
+}
+
 type DecompressorOutput struct {
 	Content  io.ReadCloser
 	Suceeded bool
 	Payload  any
 }
 
+func (o DecompressorOutput) Discard() {
+	if o.Content != nil {
+		o.Content.Close()
+	}
+}
+
+// Options configures a Decompressor. Zero fields are taken from DefaultOptions.
+type Options struct {
+	Workers        int
+	QueueSize      int
+	MaxQueueSize   int             // Capacity of the input queue, the most SetQueueSize allows. At least QueueSize
+	StatusInterval int             // Seconds between queue length debug messages
+	Logger         *logging.Logger // Records are tagged with the stage and worker
+}
+
 type DecompressorWorker struct {
 	Id          int
 	InputQueue  chan DecompressorInput
 	OutputQueue chan DecompressorOutput
-	wg          *sync.WaitGroup
+
+	log       *logging.Logger
+	group     *utils.WorkerGroup
+	slots     *utils.Limiter
+	processed *atomic.Int64
+	quit      chan struct{} // Closed to remove the worker after its current item
 }
 
 type Decompressor struct {
+	Options     Options
 	ThreadCount int
 	InputQueue  chan DecompressorInput
 	OutputQueue chan DecompressorOutput
 	Workers     []*DecompressorWorker
-	wg          *sync.WaitGroup
+
+	log       *logging.Logger
+	mu        sync.Mutex // Guards Workers and ThreadCount once started
+	nextID    int
+	group     *utils.WorkerGroup
+	slots     *utils.Limiter
+	processed atomic.Int64
+
+	ctx      context.Context
+	started  bool
+	done     chan struct{} // Closed together with OutputQueue
+	stopOnce sync.Once
 }
 
 type zstdReadCloser struct {
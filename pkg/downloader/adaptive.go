@@ -0,0 +1,155 @@
+package downloader
+
+import (
+	"SophonClientv2/pkg/retry"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConcurrencyStats describes the adaptive worker count of a downloader over the last interval.
+type ConcurrencyStats struct {
+	Workers    int
+	Min, Max   int
+	Adaptive   bool    // False once the worker count was set by hand
+	Throughput float64 // Bytes per second
+	Latency    time.Duration
+	Throttled  int // 429 and 503 responses
+	Failures   int // Other 5xx responses and network errors
+}
+
+// concurrency grows the worker count by one while the input queue has work, throughput keeps
+// rising and latency stays near its baseline (additive increase), and halves it on throttling or
+// frequent errors (multiplicative decrease). Rising latency alone shrinks it by a quarter.
+type concurrency struct {
+	mu       sync.Mutex
+	enabled  bool
+	min, max int
+
+	// Counters of the current interval
+	bytes        int64
+	latencySum   time.Duration
+	latencyCount int
+	requests     int
+	throttled    int
+	failures     int
+
+	baseline time.Duration // Lowest average latency seen, drifts up slowly so one lucky interval does not stick
+	prevRate float64
+	grown    bool
+	hold     int // Intervals to wait before growing again
+	last     ConcurrencyStats
+}
+
+// record counts one attempt that transferred n bytes.
+func (c *concurrency) record(n int64, latency time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests++
+	c.bytes += n
+	if latency > 0 {
+		c.latencySum += latency
+		c.latencyCount++
+	}
+	var se *retry.StatusError
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+	case errors.As(err, &se) && (se.Code == http.StatusTooManyRequests || se.Code == http.StatusServiceUnavailable):
+		c.throttled++
+	case errors.As(err, &se) && se.Code < 500:
+		// Missing chunks and the like say nothing about capacity
+	default:
+		c.failures++
+	}
+}
+
+// tick decides the worker count for the next interval from the one that just ended.
+func (c *concurrency) tick(workers int, backlog bool, interval time.Duration) (int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rate := float64(c.bytes) / interval.Seconds()
+	var latency time.Duration
+	if c.latencyCount > 0 {
+		latency = c.latencySum / time.Duration(c.latencyCount)
+	}
+	requests, throttled, failures := c.requests, c.throttled, c.failures
+	c.bytes, c.latencySum, c.latencyCount, c.requests, c.throttled, c.failures = 0, 0, 0, 0, 0, 0
+	c.last = ConcurrencyStats{Workers: workers, Min: c.min, Max: c.max, Adaptive: c.enabled, Throughput: rate, Latency: latency, Throttled: throttled, Failures: failures}
+	if !c.enabled || requests == 0 {
+		return workers, ""
+	}
+
+	if latency > 0 {
+		if c.baseline == 0 || latency < c.baseline {
+			c.baseline = latency
+		} else {
+			c.baseline += c.baseline / 100
+		}
+	}
+	if c.hold > 0 {
+		c.hold--
+	}
+	n, reason := workers, ""
+	switch {
+	case throttled > 0 || failures*10 > requests:
+		n, reason = workers/2, "throttled"
+		c.hold = 3
+	case c.grown && rate*100 < c.prevRate*105:
+		n, reason = workers-1, "no gain"
+		c.hold = 3
+	case latency > 3*c.baseline:
+		n, reason = workers*3/4, "latency"
+		c.hold = 2
+	case backlog && c.hold == 0 && latency <= 2*c.baseline:
+		n, reason = workers+1, "backlog"
+	}
+	n = min(c.max, max(c.min, n))
+	c.grown = n > workers
+	c.prevRate = rate
+	return n, reason
+}
+
+func (c *concurrency) setEnabled(enabled bool) {
+	c.mu.Lock()
+	c.enabled = enabled
+	c.grown = false
+	c.mu.Unlock()
+}
+
+// adapt resizes the workers every AdaptInterval until the downloader is done.
+func (d *Downloader) adapt(ctx context.Context) {
+	ticker := time.NewTicker(d.Options.AdaptInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+		workers := d.WorkerCount()
+		n, reason := d.concurrency.tick(workers, d.QueueLength() > 0, d.Options.AdaptInterval)
+		if n != workers {
+			d.resize(n)
+			d.log.Debug("Adjusted download concurrency", "from", workers, "to", n, "reason", reason)
+		}
+	}
+}
+
+// SetAdaptive turns the adaptive worker count on or off. SetWorkers turns it off.
+func (d *Downloader) SetAdaptive(enabled bool) {
+	d.concurrency.setEnabled(enabled)
+}
+
+// Concurrency returns the worker count with the measurements of the last interval.
+func (d *Downloader) Concurrency() ConcurrencyStats {
+	d.concurrency.mu.Lock()
+	stats := d.concurrency.last
+	stats.Min, stats.Max, stats.Adaptive = d.concurrency.min, d.concurrency.max, d.concurrency.enabled
+	d.concurrency.mu.Unlock()
+	stats.Workers = d.WorkerCount()
+	return stats
+}
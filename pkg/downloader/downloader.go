@@ -3,85 +3,224 @@ package downloader
 import (
 	"SophonClientv2/internal/config"
 	"SophonClientv2/internal/logging"
+	"SophonClientv2/pkg/retry"
 	"SophonClientv2/pkg/utils"
 	"bytes"
+	"context"
 	"io"
 	"net/http"
-	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
-func NewWorker(id int, httpClient *http.Client, inputQueue chan DownloaderInput, outputQueue chan DownloaderOutput, wg *sync.WaitGroup) *DownloaderWorker {
+func (d *Downloader) newWorker() *DownloaderWorker {
+	d.nextID++
 	return &DownloaderWorker{
-		Id:          id,
-		HttpClient:  httpClient,
-		InputQueue:  inputQueue,
-		OutputQueue: outputQueue,
-		wg:          wg,
+		Id:          d.nextID - 1,
+		MaxRetries:  max(1, d.Options.MaxRetries),
+		retry:       d.Options.Retry,
+		HttpClient:  d.HttpClient,
+		InputQueue:  d.InputQueue,
+		OutputQueue: d.OutputQueue,
+		log:         d.log.With(logging.KeyWorker, d.nextID-1),
+		group:       d.group,
+		slots:       d.slots,
+		processed:   &d.processed,
+		mirrors:     &d.mirrors,
+		concurrency: d.concurrency,
+		rate:        d.rate,
+		quit:        make(chan struct{}),
 	}
 }
 
-func (worker *DownloaderWorker) Start() {
-	logging.GlobalLogger.Debug("Started downloader worker " + strconv.Itoa(worker.Id))
+// Start runs the worker until the input is closed, ctx is done or the worker is removed.
+// It returns false if the downloader has already finished.
+func (worker *DownloaderWorker) Start(ctx context.Context) bool {
+	if !worker.group.Add() {
+		return false
+	}
+	worker.log.Debug("Started downloader worker")
 
-	worker.wg.Add(1)
 	go func() {
-		defer worker.wg.Done()
-		maxRetries := config.Config.MaxChunkDownloadRetries
-		for input := range worker.InputQueue {
-			var resp *http.Response
-			var err error
-			for attempt := 1; attempt <= maxRetries; attempt++ {
-				resp, err = worker.HttpClient.Get(input.Url)
-				if err == nil && resp.StatusCode == http.StatusOK {
-					logging.GlobalLogger.Debug("Worker " + strconv.Itoa(worker.Id) + ": Successfully downloaded chunk from " + input.Url)
-					var contentBytes []byte
-					contentBytes, err = io.ReadAll(resp.Body)
-					utils.CloseStreamSafe(resp.Body)
-					if err != nil {
-						logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Error reading response body from " + input.Url + ": " + err.Error())
-						contentBytes = nil
-						continue
-					}
-
-					worker.OutputQueue <- DownloaderOutput{Content: io.NopCloser(bytes.NewReader(contentBytes)), Suceeded: true, Payload: input.Payload}
-					break
-				}
-				if attempt < maxRetries {
-					logging.GlobalLogger.Warn("Worker " + strconv.Itoa(worker.Id) + ": Failed to download chunk, retrying... (attempt " + strconv.Itoa(attempt) + ")")
-					continue
+		defer worker.group.Exit()
+		for {
+			var input DownloaderInput
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case <-worker.quit:
+				worker.log.Debug("Removed downloader worker")
+				return
+			case input, ok = <-worker.InputQueue:
+				if !ok {
+					return
 				}
+			}
+			worker.slots.Release()
+			worker.processed.Add(1)
 
-				// Cleanup on final failure
-				if resp != nil && resp.Body != nil {
-					utils.CloseStreamSafe(resp.Body)
-				}
-				if err != nil {
-					logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Failed to download chunk from " + input.Url + ": " + err.Error())
-				} else {
-					logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Failed to download chunk from " + input.Url)
-				}
-				worker.OutputQueue <- DownloaderOutput{Content: nil, Suceeded: false, Payload: input.Payload}
+			output := worker.download(ctx, input)
+			if !utils.SendContext(ctx, worker.OutputQueue, output) {
+				return
 			}
 		}
 	}()
+	return true
 }
 
-func NewDownloader(buffSize int) *Downloader {
-	logging.GlobalLogger.Info("Initializing Downloader with " + strconv.Itoa(config.Config.CocurrentDownloads) + " concurrent downloads")
+// Attempts that received at least 1/resumeShare of the chunk before they were cut off do not use up
+// a retry, up to maxFreeResumes times per chunk.
+const (
+	resumeShare    = 16
+	maxFreeResumes = 32
+)
 
-	threadCount := config.Config.CocurrentDownloads
-	inputQueue := make(chan DownloaderInput, buffSize)
-	outputQueue := make(chan DownloaderOutput, buffSize)
-	workers := make([]*DownloaderWorker, threadCount)
+// download fetches a chunk with up to MaxRetries attempts, waiting between them as the retry policy
+// says. A body cut off midway is kept and the rest requested with a Range request; attempts that got
+// a good deal further this way do not use up a retry. With mirrors every other attempt goes to the
+// best mirror besides the one that just failed, right away and even after a permanent error.
+func (worker *DownloaderWorker) download(ctx context.Context, input DownloaderInput) DownloaderOutput {
+	policy := worker.retry
+	mirrors := worker.mirrors.Load()
+	var mirror *Mirror
+	path := ""
+	if mirrors != nil {
+		if mirror, path = mirrors.resolve(input.Url); mirror != nil {
+			mirror = mirrors.pick(nil)
+		}
+	}
+
+	p := partialBody{size: -1}
+	var lastErr error
+	attempt, resumes := 1, 0
+	for ; ; attempt++ {
+		if ctx.Err() != nil {
+			return DownloaderOutput{Content: nil, Suceeded: false, Payload: input.Payload, Attempts: attempt - 1, Err: ctx.Err()}
+		}
+
+		url := input.Url
+		if mirror != nil {
+			url = mirror.Prefix + path
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			worker.log.Error("Failed to create request", "url", url, "error", err)
+			lastErr = retry.MarkPermanent(err)
+			break
+		}
+
+		start := time.Now()
+		n, latency, err := worker.fetch(req, &p, input.Size)
+		worker.concurrency.record(n, latency, err)
+		if err == nil {
+			worker.log.Debug("Successfully downloaded chunk", "url", url)
+			if mirror != nil {
+				mirrors.succeeded(mirror, n, latency, time.Since(start))
+			}
+			return DownloaderOutput{Content: io.NopCloser(bytes.NewReader(p.buf)), Suceeded: true, Payload: input.Payload, Source: url, Attempts: attempt}
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			attempt--
+			continue
+		}
+		if mirror != nil {
+			mirrors.failed(mirror)
+		}
+		if n > 0 && p.resumable() && n*resumeShare >= p.size && resumes < maxFreeResumes {
+			resumes++
+			delay := policy.Delay(1, err)
+			worker.log.Debug("Chunk download interrupted, resuming", "url", url, "received", len(p.buf), "size", p.size, "delay", delay, "error", err)
+			attempt--
+			retry.Sleep(ctx, delay)
+			continue
+		}
+
+		next := mirror
+		if mirror != nil {
+			next = mirrors.pick(mirror)
+		}
+		if !policy.Retry(attempt, err) && (next == mirror || attempt >= policy.MaxAttempts) {
+			worker.log.Error("Failed to download chunk", "url", url, "attempt", attempt, "class", retry.Classify(err), "error", err)
+			break
+		}
+		delay := policy.Delay(attempt, err)
+		if next != mirror {
+			// Another server, neither the backoff nor Retry-After of this one apply.
+			// ETags are not comparable across CDNs, the Content-Range check still applies.
+			delay, mirror, p.etag = 0, next, ""
+		}
+		worker.log.Warn("Failed to download chunk, retrying...", "url", url, "attempt", attempt, "delay", delay, "error", err)
+		if retry.Sleep(ctx, delay) != nil {
+			continue
+		}
+	}
+	return DownloaderOutput{Content: nil, Suceeded: false, Payload: input.Payload, Attempts: attempt, Err: lastErr}
+}
+
+// DefaultOptions returns the downloader settings of the global configuration.
+func DefaultOptions() Options {
+	return Options{
+		Workers:        config.Config.CocurrentDownloads,
+		QueueSize:      config.Config.DownloadChanSize,
+		MaxRetries:     config.Config.MaxChunkDownloadRetries,
+		Retry:          retry.FromConfig(config.Config.MaxChunkDownloadRetries),
+		Mirrors:        strings.Split(config.Config.DownloadMirrors, ","),
+		Adaptive:       config.Config.AdaptiveDownloads,
+		MinWorkers:     config.Config.DownloadConcurrencyMin,
+		MaxWorkers:     config.Config.DownloadConcurrencyMax,
+		AdaptInterval:  2 * time.Second,
+		StatusInterval: config.Config.QueueLengthPrintInterval,
+	}
+}
+
+func (o Options) withDefaults() Options {
+	def := DefaultOptions()
+	if o.Workers <= 0 {
+		o.Workers = def.Workers
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = def.QueueSize
+	}
+	if o.MaxQueueSize < o.QueueSize {
+		o.MaxQueueSize = 4 * o.QueueSize // Room for SetQueueSize, unused capacity costs next to nothing
+	}
+	if o.MaxRetries <= 0 {
+		o.MaxRetries = def.MaxRetries
+	}
+	if o.Retry.BaseDelay == 0 && o.Retry.MaxDelay == 0 && o.Retry.Jitter == 0 {
+		o.Retry.BaseDelay, o.Retry.MaxDelay, o.Retry.Jitter = def.Retry.BaseDelay, def.Retry.MaxDelay, def.Retry.Jitter
+	}
+	o.Retry.MaxAttempts = max(1, o.MaxRetries)
+	if o.StatusInterval <= 0 {
+		o.StatusInterval = def.StatusInterval
+	}
+	if o.MinWorkers <= 0 {
+		o.MinWorkers = min(def.MinWorkers, o.Workers)
+	}
+	if o.MaxWorkers < o.MinWorkers {
+		o.MaxWorkers = max(def.MaxWorkers, o.Workers)
+	}
+	if o.AdaptInterval <= 0 {
+		o.AdaptInterval = def.AdaptInterval
+	}
+	if o.Logger == nil {
+		o.Logger = logging.GlobalLogger
+	}
+	return o
+}
+
+func NewDownloader(opts Options) *Downloader {
+	opts = opts.withDefaults()
+	opts.Logger.Info("Initializing Downloader", "workers", opts.Workers, "adaptive", opts.Adaptive, "rate_limit", opts.RateLimit)
 
 	transport := &http.Transport{
-		MaxIdleConns:        100,              // Maximum idle connections across all hosts
-		MaxIdleConnsPerHost: threadCount * 2,  // Maximum idle connections per host
-		MaxConnsPerHost:     threadCount * 2,  // Maximum connections per host
-		IdleConnTimeout:     90 * time.Second, // How long idle connections stay open
-		DisableKeepAlives:   false,            // Enable keep-alive (connection reuse)
+		MaxIdleConns:        100,                 // Maximum idle connections across all hosts
+		MaxIdleConnsPerHost: opts.MaxWorkers * 2, // Maximum idle connections per host
+		IdleConnTimeout:     90 * time.Second,    // How long idle connections stay open
+		DisableKeepAlives:   false,               // Enable keep-alive (connection reuse)
+		// No MaxConnsPerHost, the worker count (which SetWorkers may raise) already bounds it
 	}
 
 	httpClient := &http.Client{
@@ -89,52 +228,176 @@ func NewDownloader(buffSize int) *Downloader {
 		Timeout:   5 * time.Minute,
 	}
 
-	wg := &sync.WaitGroup{}
+	d := &Downloader{
+		Options:     opts,
+		HttpClient:  httpClient,
+		InputQueue:  make(chan DownloaderInput, max(opts.QueueSize, opts.MaxQueueSize)),
+		OutputQueue: make(chan DownloaderOutput, opts.QueueSize),
+		log:         opts.Logger.With(logging.KeyStage, "downloader"),
+		group:       utils.NewWorkerGroup(),
+		slots:       utils.NewLimiter(opts.QueueSize),
+		rate:        NewRateLimiter(opts.RateLimit),
+		concurrency: &concurrency{enabled: opts.Adaptive, min: opts.MinWorkers, max: opts.MaxWorkers},
+		ctx:         context.Background(),
+		done:        make(chan struct{}),
+	}
+	d.resize(opts.Workers)
+	return d
+}
 
-	for i := 0; i < threadCount; i++ {
-		workers[i] = NewWorker(i, httpClient, inputQueue, outputQueue, wg)
-		workers[i].Start()
+// Start launches the workers. Cancelling ctx aborts in-flight requests and stops the workers,
+// OutputQueue is closed once every worker has exited either way.
+func (d *Downloader) Start(ctx context.Context) {
+	d.mu.Lock()
+	d.ctx = ctx
+	d.started = true
+	for _, worker := range d.Workers {
+		worker.Start(ctx)
 	}
+	d.mu.Unlock()
+	go func() {
+		<-d.group.Done()
+		// The transport belongs to this downloader, nothing reuses its connections after the workers
+		d.HttpClient.CloseIdleConnections()
+		close(d.OutputQueue)
+		close(d.done)
+	}()
+	d.StartPrintChannelStatus(ctx, d.Options.StatusInterval)
+	go d.adapt(ctx)
+}
 
-	downloader := &Downloader{
-		ThreadCount: threadCount,
-		HttpClient:  httpClient,
-		InputQueue:  inputQueue,
-		OutputQueue: outputQueue,
-		Workers:     workers,
-		wg:          wg,
+// SetWorkers changes the number of workers, also while running, and stops adapting it.
+// Removed workers finish their current chunk first. Returns the new worker count.
+func (d *Downloader) SetWorkers(n int) int {
+	d.SetAdaptive(false)
+	return d.resize(n)
+}
+
+func (d *Downloader) resize(n int) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.Workers) < max(1, n) {
+		worker := d.newWorker()
+		if d.started && !worker.Start(d.ctx) {
+			break
+		}
+		d.Workers = append(d.Workers, worker)
+	}
+	for len(d.Workers) > max(1, n) {
+		close(d.Workers[len(d.Workers)-1].quit)
+		d.Workers = d.Workers[:len(d.Workers)-1]
 	}
-	downloader.StartPrintChannelStatus(config.Config.QueueLengthPrintInterval)
-	return downloader
+	d.ThreadCount = len(d.Workers)
+	return d.ThreadCount
+}
+
+func (d *Downloader) WorkerCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ThreadCount
+}
+
+// SetQueueSize changes how many chunks may wait in the input queue, at most MaxQueueSize.
+// Returns the new queue size.
+func (d *Downloader) SetQueueSize(n int) int {
+	n = min(max(1, n), cap(d.InputQueue))
+	d.slots.SetLimit(n)
+	return n
+}
+
+func (d *Downloader) QueueSize() int {
+	return d.slots.Limit()
+}
+
+func (d *Downloader) QueueLength() int {
+	return len(d.InputQueue)
+}
+
+// SetMirrors makes chunk URLs starting with one of the mirror prefixes download from whichever
+// mirror is doing best. Nil downloads every URL as given.
+func (d *Downloader) SetMirrors(ms *Mirrors) {
+	d.mirrors.Store(ms)
+}
+
+func (d *Downloader) Mirrors() *Mirrors {
+	return d.mirrors.Load()
 }
 
-func (d *Downloader) StartPrintChannelStatus(intervalSeconds int) {
+// SetRateLimit changes the bytes per second of this downloader, 0 is unlimited.
+func (d *Downloader) SetRateLimit(bytesPerSec int64) {
+	d.rate.SetRate(bytesPerSec)
+}
+
+func (d *Downloader) RateLimit() int64 {
+	return d.rate.Rate()
+}
+
+// Processed returns how many chunks the workers have taken from the input queue so far.
+func (d *Downloader) Processed() int64 {
+	return d.processed.Load()
+}
+
+func (d *Downloader) StartPrintChannelStatus(ctx context.Context, intervalSeconds int) {
 	go func() {
+		ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
+		defer ticker.Stop()
 		for {
-			if d.wg == nil {
+			d.PrintChannelStatus()
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.done:
 				return
+			case <-ticker.C:
 			}
-			d.PrintChannelStatus()
-			<-time.After(time.Duration(intervalSeconds) * time.Second)
 		}
 	}()
 }
 
 func (d *Downloader) PrintChannelStatus() {
-	logging.GlobalLogger.Debug("Downloader InputQueue: " + strconv.Itoa(len(d.InputQueue)) + "/" + strconv.Itoa(cap(d.InputQueue)))
-	logging.GlobalLogger.Debug("Downloader OutputQueue: " + strconv.Itoa(len(d.OutputQueue)) + "/" + strconv.Itoa(cap(d.OutputQueue)))
+	d.log.Debug("Queue lengths", "input", len(d.InputQueue), "input_size", d.QueueSize(), "output", len(d.OutputQueue), "output_size", cap(d.OutputQueue))
 }
 
+// Stop closes the input for a graceful shutdown and waits until the workers have drained it.
+// After cancellation the input is left open since abandoned enqueues may still reference it.
 func (d *Downloader) Stop() {
-	close(d.InputQueue)
-	d.wg.Wait()
-	d.wg = nil
-	close(d.OutputQueue)
-	logging.GlobalLogger.Info("Downloader stopped")
+	d.stopOnce.Do(func() {
+		if d.ctx.Err() == nil {
+			close(d.InputQueue)
+		}
+		if !d.started {
+			close(d.OutputQueue)
+			close(d.done)
+		}
+	})
+	d.Wait()
+	d.log.Info("Downloader stopped")
+}
+
+// Wait blocks until all workers have exited and OutputQueue is closed.
+func (d *Downloader) Wait() {
+	<-d.done
+}
+
+// Discard releases everything still buffered in the queues of a cancelled downloader.
+func (d *Downloader) Discard() {
+	utils.DrainDiscard(d.InputQueue)
+	utils.DrainDiscard(d.OutputQueue)
 }
 
 func (d *Downloader) EnqueueDownload(url string, payload any) {
-	utils.NonBlockingEnqueue(d.InputQueue, DownloaderInput{Url: url, Payload: payload})
+	d.EnqueueSized(url, 0, payload)
+}
+
+// EnqueueSized queues a download whose content is expected to be size bytes long.
+func (d *Downloader) EnqueueSized(url string, size int64, payload any) {
+	utils.EnqueueLimited(d.ctx, d.InputQueue, d.slots, DownloaderInput{Url: url, Size: size, Payload: payload})
+}
+
+// SubmitSized queues a download like EnqueueSized, but waits for room in the queue instead of
+// queueing in the background. It returns false if the downloader was cancelled first.
+func (d *Downloader) SubmitSized(url string, size int64, payload any) bool {
+	return utils.SendLimited(d.ctx, d.InputQueue, d.slots, DownloaderInput{Url: url, Size: size, Payload: payload})
 }
 
 func (d *Downloader) GetOutputChannel() chan DownloaderOutput {
@@ -0,0 +1,221 @@
+package downloader
+
+import (
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorSmoothing  = 0.3             // Weight of a new sample in the moving averages
+	mirrorExplore    = 20              // One pick in this many goes to a random mirror to keep its stats fresh
+	mirrorDownAfter  = 3               // Consecutive failures before a mirror is skipped for a while
+	mirrorMinBackoff = 5 * time.Second // First time a mirror is skipped, doubled on every further failure
+	mirrorMaxBackoff = 5 * time.Minute
+)
+
+// Mirror is one URL prefix chunks can be downloaded from. Its fields are guarded by Mirrors.
+type Mirror struct {
+	Prefix string
+
+	throughput float64       // Smoothed bytes per second of successful downloads
+	latency    time.Duration // Smoothed time until the response headers
+	errorRate  float64       // Smoothed share of failed attempts
+	failures   int           // Consecutive failures
+	downUntil  time.Time
+	picked     int64 // Attempts started, so concurrent workers try an unknown mirror only once
+	requests   int64
+	errors     int64
+	bytes      int64
+}
+
+// MirrorStats is a snapshot of one mirror.
+type MirrorStats struct {
+	Prefix     string
+	Throughput float64
+	Latency    time.Duration
+	ErrorRate  float64
+	Requests   int64
+	Errors     int64
+	Bytes      int64
+	Down       bool // Skipped after repeated failures
+}
+
+// Mirrors picks the prefix each download attempt uses: mirrors that were never tried first, then
+// the one with the best throughput after discounting its error rate. Mirrors failing repeatedly
+// are skipped with a growing backoff. It is safe for concurrent use.
+type Mirrors struct {
+	mu      sync.Mutex
+	mirrors []*Mirror
+	rng     *rand.Rand
+}
+
+// NewMirrors returns a mirror set of the given URL prefixes, duplicates and empty ones are dropped.
+func NewMirrors(prefixes ...string) *Mirrors {
+	ms := &Mirrors{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	seen := make(map[string]bool)
+	for _, p := range prefixes {
+		p = strings.TrimRight(p, "/")
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		ms.mirrors = append(ms.mirrors, &Mirror{Prefix: p})
+	}
+	return ms
+}
+
+// MirrorPrefixes returns primary followed by the mirrors. A mirror given as scheme and host only
+// keeps the path of primary, so one list of hosts works for every game. Invalid entries are skipped.
+func MirrorPrefixes(primary string, mirrors []string) []string {
+	prefixes := []string{primary}
+	base, err := url.Parse(primary)
+	if err != nil {
+		return prefixes
+	}
+	for _, m := range mirrors {
+		u, err := url.Parse(strings.TrimSpace(m))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			continue
+		}
+		if strings.Trim(u.Path, "/") == "" {
+			u.Path, u.RawPath = base.Path, base.RawPath
+		}
+		prefixes = append(prefixes, u.String())
+	}
+	return prefixes
+}
+
+// resolve returns the mirror whose prefix url starts with and the rest of url after it.
+func (ms *Mirrors) resolve(rawURL string) (*Mirror, string) {
+	for _, m := range ms.mirrors {
+		if rest, ok := strings.CutPrefix(rawURL, m.Prefix); ok && (rest == "" || rest[0] == '/' || rest[0] == '?') {
+			return m, rest
+		}
+	}
+	return nil, ""
+}
+
+// pick chooses the mirror for the next attempt, avoiding avoid if any other is usable.
+func (ms *Mirrors) pick(avoid *Mirror) *Mirror {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	var up, others []*Mirror
+	for _, m := range ms.mirrors {
+		if m == avoid {
+			continue
+		}
+		others = append(others, m)
+		if !now.Before(m.downUntil) {
+			up = append(up, m)
+		}
+	}
+	candidates := up
+	if len(candidates) == 0 {
+		candidates = others
+	}
+	if len(candidates) == 0 {
+		return avoid
+	}
+
+	best := candidates[0]
+	for _, m := range candidates {
+		if m.picked == 0 {
+			best = m
+			break
+		}
+		if m.score() > best.score() {
+			best = m
+		}
+	}
+	if best.picked > 0 && len(candidates) > 1 && ms.rng.Intn(mirrorExplore) == 0 {
+		best = candidates[ms.rng.Intn(len(candidates))]
+	}
+	best.picked++
+	return best
+}
+
+func (m *Mirror) score() float64 {
+	return m.throughput * (1 - m.errorRate)
+}
+
+func smooth(avg, sample float64) float64 {
+	return avg + mirrorSmoothing*(sample-avg)
+}
+
+// succeeded records a completed download of n bytes that took elapsed, latency of it before the headers.
+func (ms *Mirrors) succeeded(m *Mirror, n int64, latency, elapsed time.Duration) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m.requests++
+	m.bytes += n
+	m.failures = 0
+	m.downUntil = time.Time{}
+	m.errorRate = smooth(m.errorRate, 0)
+	if m.latency == 0 {
+		m.latency = latency
+	} else {
+		m.latency = time.Duration(smooth(float64(m.latency), float64(latency)))
+	}
+	if elapsed > 0 {
+		rate := float64(n) / elapsed.Seconds()
+		if m.throughput == 0 {
+			m.throughput = rate
+		} else {
+			m.throughput = smooth(m.throughput, rate)
+		}
+	}
+}
+
+func (ms *Mirrors) failed(m *Mirror) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m.requests++
+	ms.failedLocked(m)
+}
+
+func (ms *Mirrors) failedLocked(m *Mirror) {
+	m.errors++
+	m.failures++
+	m.errorRate = smooth(m.errorRate, 1)
+	if m.failures >= mirrorDownAfter {
+		backoff := min(mirrorMaxBackoff, mirrorMinBackoff<<min(m.failures-mirrorDownAfter, 10))
+		m.downUntil = time.Now().Add(backoff)
+	}
+}
+
+// Corrupt counts a chunk downloaded from rawURL that failed decompression or its checksum against
+// the mirror it came from. Broken data is worse than a failed request, the mirror is skipped right away.
+func (ms *Mirrors) Corrupt(rawURL string) {
+	m, _ := ms.resolve(rawURL)
+	if m == nil {
+		return
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m.failures = max(m.failures, mirrorDownAfter-1)
+	ms.failedLocked(m)
+}
+
+func (ms *Mirrors) Stats() []MirrorStats {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	now := time.Now()
+	stats := make([]MirrorStats, len(ms.mirrors))
+	for i, m := range ms.mirrors {
+		stats[i] = MirrorStats{
+			Prefix:     m.Prefix,
+			Throughput: m.throughput,
+			Latency:    m.latency,
+			ErrorRate:  m.errorRate,
+			Requests:   m.requests,
+			Errors:     m.errors,
+			Bytes:      m.bytes,
+			Down:       now.Before(m.downUntil),
+		}
+	}
+	return stats
+}
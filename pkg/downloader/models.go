@@ -1,13 +1,20 @@
 package downloader
 
 import (
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/pkg/retry"
+	"SophonClientv2/pkg/utils"
+	"context"
 	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type DownloaderInput struct {
 	Url     string
+	Size    int64 // Expected length of the content, a longer response fails permanently. 0 if unknown
 	Payload any
 }
 
@@ -15,21 +22,72 @@ type DownloaderOutput struct {
 	Content  io.ReadCloser
 	Suceeded bool
 	Payload  any
+	Source   string // URL the content was downloaded from, which may be a mirror of the requested one
+	Attempts int    // Requests made, not counting resumed ones that got a good deal further
+	Err      error  // Why the download failed, classify it with retry.Classify
+}
+
+func (o DownloaderOutput) Discard() {
+	if o.Content != nil {
+		o.Content.Close()
+	}
+}
+
+// Options configures a Downloader. Zero fields are taken from DefaultOptions.
+type Options struct {
+	Workers        int
+	QueueSize      int
+	MaxQueueSize   int          // Capacity of the input queue, the most SetQueueSize allows. At least QueueSize
+	MaxRetries     int          // Attempts per chunk before it is reported as failed
+	Retry          retry.Policy // Waits between attempts, zero delays are taken from the configuration. MaxAttempts is MaxRetries
+	RateLimit      int64        // Bytes per second for this downloader, within GlobalRateLimiter. 0 is unlimited
+	Mirrors        []string     // Extra URL prefixes or hosts for the chunks, see MirrorPrefixes
+	Adaptive       bool         // Resize the workers between MinWorkers and MaxWorkers, starting at Workers
+	MinWorkers     int
+	MaxWorkers     int
+	AdaptInterval  time.Duration   // How often the adaptive worker count is reconsidered
+	StatusInterval int             // Seconds between queue length debug messages
+	Logger         *logging.Logger // Records are tagged with the stage and worker
 }
 
 type DownloaderWorker struct {
 	Id          int
+	MaxRetries  int
+	retry       retry.Policy
 	HttpClient  *http.Client
 	InputQueue  chan DownloaderInput
 	OutputQueue chan DownloaderOutput
-	wg          *sync.WaitGroup
+
+	log         *logging.Logger
+	group       *utils.WorkerGroup
+	slots       *utils.Limiter
+	processed   *atomic.Int64
+	rate        *RateLimiter
+	mirrors     *atomic.Pointer[Mirrors]
+	concurrency *concurrency
+	quit        chan struct{} // Closed to remove the worker after its current chunk
 }
 
 type Downloader struct {
+	Options     Options
 	ThreadCount int
 	HttpClient  *http.Client
 	InputQueue  chan DownloaderInput
 	OutputQueue chan DownloaderOutput
 	Workers     []*DownloaderWorker
-	wg          *sync.WaitGroup
+
+	log         *logging.Logger
+	mu          sync.Mutex // Guards Workers and ThreadCount once started
+	nextID      int
+	group       *utils.WorkerGroup
+	slots       *utils.Limiter
+	processed   atomic.Int64
+	rate        *RateLimiter // Limit of this downloader, GlobalRateLimiter applies as well
+	mirrors     atomic.Pointer[Mirrors]
+	concurrency *concurrency
+
+	ctx      context.Context
+	started  bool
+	done     chan struct{} // Closed together with OutputQueue
+	stopOnce sync.Once
 }
@@ -0,0 +1,177 @@
+package downloader
+
+import (
+	"SophonClientv2/internal/config"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxThrottledRead bounds each read of a limited reader so one read cannot run far ahead of the rate.
+const maxThrottledRead = 32 << 10
+
+// RateLimiter is a token bucket of bytes per second. A rate of 0 is unlimited.
+// Waiters reserve their bytes up front, so concurrent readers share the rate fairly.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    int64
+	tokens  float64 // Negative while reserved bytes are outstanding
+	last    time.Time
+	changed chan struct{} // Closed by SetRate to wake the waiters
+}
+
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return &RateLimiter{rate: max(0, bytesPerSec), last: time.Now(), changed: make(chan struct{})}
+}
+
+// burst is how many bytes may pile up while idle, a quarter of a second.
+func (l *RateLimiter) burst() float64 {
+	return float64(l.rate) / 4
+}
+
+func (l *RateLimiter) refillLocked(now time.Time) {
+	if l.rate > 0 {
+		l.tokens = min(l.burst(), l.tokens+now.Sub(l.last).Seconds()*float64(l.rate))
+	}
+	l.last = now
+}
+
+// SetRate changes the rate, also while readers are waiting.
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refillLocked(time.Now())
+	l.rate = max(0, bytesPerSec)
+	if l.rate == 0 {
+		l.tokens = 0
+	}
+	l.tokens = min(l.tokens, l.burst())
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// WaitN blocks until n bytes may pass. Waiting ends early when the rate changes,
+// the outstanding reservation then carries over to the new rate.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refillLocked(time.Now())
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	changed := l.changed
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-changed:
+	case <-timer.C:
+	}
+	return nil
+}
+
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+// NewLimitedReader reads from r no faster than every one of limiters allows. Nil limiters are ignored.
+func NewLimitedReader(ctx context.Context, r io.Reader, limiters ...*RateLimiter) io.Reader {
+	startGlobalRate()
+	lr := &limitedReader{ctx: ctx, r: r}
+	for _, l := range limiters {
+		if l != nil {
+			lr.limiters = append(lr.limiters, l)
+		}
+	}
+	return lr
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxThrottledRead {
+		p = p[:maxThrottledRead]
+	}
+	n, err := lr.r.Read(p)
+	for _, l := range lr.limiters {
+		if werr := l.WaitN(lr.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// GlobalRateLimiter is shared by every download on top of the limit of its task. It follows
+// download_rate_limit and download_rate_schedule, or the values set through SetGlobalRate.
+var GlobalRateLimiter = NewRateLimiter(0)
+
+var globalRate struct {
+	mu       sync.Mutex
+	once     sync.Once
+	limit    int // KiB/s outside the schedule
+	schedule config.RateSchedule
+}
+
+// rateScheduleInterval is how often the schedule is checked for a new window.
+var rateScheduleInterval = 15 * time.Second
+
+// startGlobalRate loads the configured limit once something is downloaded and keeps applying
+// the schedule for the life of the process.
+func startGlobalRate() {
+	globalRate.once.Do(func() {
+		schedule, _ := config.ParseRateSchedule(config.Config.DownloadRateSchedule) // Validated with the config
+		globalRate.mu.Lock()
+		globalRate.limit, globalRate.schedule = config.Config.DownloadRateLimit, schedule
+		globalRate.mu.Unlock()
+		applyGlobalRate(time.Now())
+		go func() {
+			for range time.Tick(rateScheduleInterval) {
+				applyGlobalRate(time.Now())
+			}
+		}()
+	})
+}
+
+func applyGlobalRate(now time.Time) {
+	globalRate.mu.Lock()
+	defer globalRate.mu.Unlock()
+	rate := globalRate.limit
+	if r, ok := globalRate.schedule.RateAt(now); ok {
+		rate = r
+	}
+	if int64(rate)<<10 != GlobalRateLimiter.Rate() {
+		GlobalRateLimiter.SetRate(int64(rate) << 10)
+	}
+}
+
+// SetGlobalRate replaces the configured limit and schedule (KiB/s, 0 is unlimited) at runtime.
+func SetGlobalRate(limit int, schedule config.RateSchedule) {
+	startGlobalRate()
+	globalRate.mu.Lock()
+	globalRate.limit, globalRate.schedule = max(0, limit), schedule
+	globalRate.mu.Unlock()
+	applyGlobalRate(time.Now())
+}
+
+// GlobalRate returns the limit and schedule in KiB/s and the rate in effect in bytes per second.
+func GlobalRate() (limit int, schedule config.RateSchedule, effective int64) {
+	startGlobalRate()
+	globalRate.mu.Lock()
+	defer globalRate.mu.Unlock()
+	return globalRate.limit, globalRate.schedule, GlobalRateLimiter.Rate()
+}
@@ -0,0 +1,159 @@
+package downloader
+
+import (
+	"SophonClientv2/pkg/retry"
+	"SophonClientv2/pkg/utils"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// partialBody keeps what was received of a chunk across attempts, so an interrupted body
+// can be resumed with a Range request instead of starting over.
+type partialBody struct {
+	buf  []byte
+	etag string // Strong ETag of the response the bytes came from, sent as If-Range
+	size int64  // Full length of the chunk, -1 if unknown
+}
+
+// resumable reports whether the next request can ask for the rest only. Without the full length
+// neither the Content-Range nor the end of the body can be checked.
+func (p *partialBody) resumable() bool {
+	return len(p.buf) > 0 && p.size > 0
+}
+
+func (p *partialBody) reset() {
+	p.buf, p.etag, p.size = p.buf[:0], "", -1
+}
+
+// fetch performs one attempt, appending the received bytes to p. It returns how many bytes the
+// attempt added and how long the response headers took; on error p still holds whatever can be resumed from.
+// A response longer than limit, unless it is 0, fails with a permanent error before it is buffered.
+func (worker *DownloaderWorker) fetch(req *http.Request, p *partialBody, limit int64) (int64, time.Duration, error) {
+	resuming := p.resumable()
+	if resuming {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(p.buf)))
+		if p.etag != "" {
+			req.Header.Set("If-Range", p.etag)
+		}
+	}
+	start := time.Now()
+	resp, err := worker.HttpClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	latency := time.Since(start)
+	defer utils.CloseStreamSafe(resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && resuming:
+		start, _, size, err := ParseContentRange(resp.Header.Get("Content-Range"))
+		if err == nil && (start != int64(len(p.buf)) || size != p.size) {
+			err = fmt.Errorf("content range %q does not continue %d of %d bytes", resp.Header.Get("Content-Range"), len(p.buf), p.size)
+		}
+		if etag := strongETag(resp.Header.Get("ETag")); err == nil && p.etag != "" && etag != p.etag {
+			err = fmt.Errorf("ETag changed from %s to %s", p.etag, etag)
+		}
+		if err != nil {
+			p.reset()
+			return 0, latency, err
+		}
+	case resp.StatusCode == http.StatusOK:
+		// Also the answer when the server ignores Range or the chunk changed since the last attempt
+		if resuming {
+			worker.log.Debug("Server sent the whole chunk, restarting", "url", req.URL.String(), "received", len(p.buf))
+		}
+		p.reset()
+		if !resp.Uncompressed {
+			p.size = resp.ContentLength
+			p.etag = strongETag(resp.Header.Get("ETag"))
+		}
+		if limit > 0 && p.size > limit {
+			err := fmt.Errorf("response of %d bytes is longer than the expected %d", p.size, limit)
+			p.reset()
+			return 0, latency, retry.MarkPermanent(err)
+		}
+		if p.size > 0 && int64(cap(p.buf)) < p.size {
+			p.buf = make([]byte, 0, p.size)
+		}
+	default:
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			p.reset()
+		}
+		return 0, latency, retry.NewStatusError(resp)
+	}
+
+	before := len(p.buf)
+	var body io.Reader = NewLimitedReader(req.Context(), resp.Body, GlobalRateLimiter, worker.rate)
+	if limit > 0 {
+		// One byte past the limit is enough to tell a body without Content-Length is too long
+		body = io.LimitReader(body, limit-int64(before)+1)
+	}
+	p.buf, err = readAppend(p.buf, body)
+	n := int64(len(p.buf) - before)
+	if limit > 0 && int64(len(p.buf)) > limit {
+		p.reset()
+		return n, latency, retry.MarkPermanent(fmt.Errorf("response is longer than the expected %d bytes", limit))
+	}
+	if err == nil && p.size >= 0 && int64(len(p.buf)) != p.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && !p.resumable() {
+		p.reset()
+	}
+	return n, latency, err
+}
+
+// readAppend reads r until EOF into buf, keeping what was read when an error cuts it short.
+func readAppend(buf []byte, r io.Reader) ([]byte, error) {
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if errors.Is(err, io.EOF) {
+			return buf, nil
+		}
+		if err != nil {
+			return buf, err
+		}
+	}
+}
+
+// parseContentRange parses "bytes start-end/size" and returns start and size.
+// ParseContentRange parses a "bytes start-end/size" Content-Range header. A size of "*" is returned as -1.
+func ParseContentRange(header string) (start, end, size int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	rng, total, ok2 := strings.Cut(spec, "/")
+	first, last, ok3 := strings.Cut(rng, "-")
+	if !ok || !ok2 || !ok3 {
+		return 0, 0, 0, fmt.Errorf("invalid content range %q", header)
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err == nil {
+		end, err = strconv.ParseInt(last, 10, 64)
+	}
+	if err != nil || start < 0 || end < start {
+		return 0, 0, 0, fmt.Errorf("invalid content range %q", header)
+	}
+	if total == "*" {
+		return start, end, -1, nil
+	}
+	if size, err = strconv.ParseInt(total, 10, 64); err != nil || size <= end {
+		return 0, 0, 0, fmt.Errorf("invalid content range %q", header)
+	}
+	return start, end, size, nil
+}
+
+// strongETag returns the ETag if it may be used with If-Range, weak ones may not.
+func strongETag(etag string) string {
+	if strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return etag
+}
@@ -0,0 +1,161 @@
+package hpatch
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+var errUintOverflow = errors.New("packed integer overflows 64 bits")
+
+// readUintWithTag decodes an HDiffPatch packed integer. The first byte carries tagBits
+// tag bits (ignored here), a continuation bit and the highest value bits; every following
+// byte carries a continuation bit and 7 more value bits, most significant first.
+func readUintWithTag(r io.ByteReader, tagBits uint) (uint64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	value := uint64(c & (1<<(7-tagBits) - 1))
+	more := c&(1<<(7-tagBits)) != 0
+	for more {
+		if value>>(64-7) != 0 {
+			return 0, errUintOverflow
+		}
+		c, err = r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		value = value<<7 | uint64(c&0x7f)
+		more = c&0x80 != 0
+	}
+	return value, nil
+}
+
+func readUint(r io.ByteReader) (uint64, error) {
+	return readUintWithTag(r, 0)
+}
+
+// Byte run types of the rle control stream
+const (
+	rleZero  = 0 // Run of 0x00, no code bytes
+	rle255   = 1 // Run of 0xff, no code bytes
+	rleByte  = 2 // Run of one code byte
+	rleBytes = 3 // Literal code bytes
+)
+
+// rleReader decodes the bytes that are added to old data inside covers.
+type rleReader struct {
+	ctrl io.ByteScanner
+	code interface {
+		io.ByteReader
+		io.Reader
+	}
+	lit []byte
+
+	kind      byte
+	value     byte
+	remaining uint64
+}
+
+// add adds the next len(dst) decoded bytes to dst (modulo 256).
+func (r *rleReader) add(dst []byte) error {
+	for len(dst) > 0 {
+		if r.remaining == 0 {
+			c, err := r.ctrl.ReadByte()
+			if err != nil {
+				return err
+			}
+			if err := r.ctrl.UnreadByte(); err != nil {
+				return err
+			}
+			length, err := readUintWithTag(r.ctrl, 2)
+			if err != nil {
+				return err
+			}
+			r.kind = c >> 6
+			r.remaining = length + 1
+			switch r.kind {
+			case rleZero:
+				r.value = 0
+			case rle255:
+				r.value = 0xff
+			case rleByte:
+				if r.value, err = r.code.ReadByte(); err != nil {
+					return err
+				}
+			}
+		}
+
+		n := min(uint64(len(dst)), r.remaining)
+		switch r.kind {
+		case rleZero:
+		case rleBytes:
+			if uint64(cap(r.lit)) < n {
+				r.lit = make([]byte, n)
+			}
+			lit := r.lit[:n]
+			if _, err := io.ReadFull(r.code, lit); err != nil {
+				return err
+			}
+			for i := range lit {
+				dst[i] += lit[i]
+			}
+		default:
+			for i := uint64(0); i < n; i++ {
+				dst[i] += r.value
+			}
+		}
+		dst = dst[n:]
+		r.remaining -= n
+	}
+	return nil
+}
+
+// rle0Reader decodes the bytes added to old data in single stream diffs: pairs of a zero run length
+// and a literal length followed by that many code bytes.
+type rle0Reader struct {
+	code bytes.Reader // Rle data of the current step
+
+	zeros   uint64
+	literal uint64
+}
+
+// add adds the next len(dst) decoded bytes to dst (modulo 256).
+func (r *rle0Reader) add(dst []byte) error {
+	for len(dst) > 0 {
+		if r.zeros == 0 && r.literal == 0 {
+			var err error
+			if r.zeros, err = readUint(&r.code); err != nil {
+				return err
+			}
+			if r.literal, err = readUint(&r.code); err != nil {
+				return err
+			}
+			if r.zeros == 0 && r.literal == 0 {
+				return errors.New("empty rle run")
+			}
+		}
+
+		if r.zeros > 0 {
+			n := min(uint64(len(dst)), r.zeros)
+			dst = dst[n:]
+			r.zeros -= n
+			continue
+		}
+		n := min(uint64(len(dst)), r.literal)
+		for i := range dst[:n] {
+			c, err := r.code.ReadByte()
+			if err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			dst[i] += c
+		}
+		dst = dst[n:]
+		r.literal -= n
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+// Package hpatch applies HDiffPatch diffs, both the compressed format ("HDIFF13" as produced by
+// hdiffz -c / sophon ldiff) and the single compressed stream format ("HDIFFSF20", hdiffz -SD).
+//
+// An HDIFF13 diff consists of a header followed by four sections, each stored raw or compressed:
+//
+//	covers       ranges of new data that are derived from old data
+//	rle ctrl     run-length control codes of the bytes added to old data inside covers
+//	rle code     literal bytes referenced by the control codes
+//	new data     bytes of new data outside of any cover, in order
+//
+// An HDIFFSF20 diff is a header followed by one stream, stored raw or compressed, of steps. Each step
+// holds a batch of covers and the bytes added to old data inside them, and is followed by the new data
+// in front of each of its covers. The new data after the last cover ends the stream.
+//
+// The new file is produced front to back, so only the old file needs random access.
+package hpatch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	versionTag       = "HDIFF13"
+	singleVersionTag = "HDIFFSF20"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported diff format")
+	ErrCorruptDiff       = errors.New("corrupt diff")
+)
+
+type section struct {
+	offset         int64
+	size           uint64 // Size after decompression
+	compressedSize uint64 // Zero if stored raw
+}
+
+func (s section) storedSize() uint64 {
+	if s.compressedSize != 0 {
+		return s.compressedSize
+	}
+	return s.size
+}
+
+type Header struct {
+	Single       bool // HDIFFSF20, one stream of steps instead of four sections
+	CompressType string
+	NewSize      uint64
+	OldSize      uint64
+	CoverCount   uint64
+	StepMemSize  uint64 // Largest step of a single stream diff, covers plus rle data
+
+	covers  section
+	rleCtrl section
+	rleCode section
+	newData section
+	stream  section // The steps of a single stream diff
+}
+
+// byteReader reads the header straight from the diff without buffering past it.
+type byteReader struct {
+	r   io.ReaderAt
+	pos int64
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	var buf [1]byte
+	if _, err := b.r.ReadAt(buf[:], b.pos); err != nil {
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	b.pos++
+	return buf[0], nil
+}
+
+// ReadHeader parses the diff header and checks that every section fits into diffSize.
+func ReadHeader(diff io.ReaderAt, diffSize int64) (*Header, error) {
+	br := &byteReader{r: diff}
+
+	var tag []byte
+	for len(tag) < 16 {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading diff type: %w", err)
+		}
+		if c == '&' || c == 0 {
+			break
+		}
+		tag = append(tag, c)
+	}
+	if string(tag) != versionTag && string(tag) != singleVersionTag {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, tag)
+	}
+
+	var compressType []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading compress type: %w", err)
+		}
+		if c == 0 {
+			break
+		}
+		if len(compressType) >= 64 {
+			return nil, fmt.Errorf("%w: compress type too long", ErrCorruptDiff)
+		}
+		compressType = append(compressType, c)
+	}
+
+	h := &Header{Single: string(tag) == singleVersionTag, CompressType: string(compressType)}
+	fields := []*uint64{
+		&h.NewSize, &h.OldSize, &h.CoverCount,
+		&h.covers.size, &h.covers.compressedSize,
+		&h.rleCtrl.size, &h.rleCtrl.compressedSize,
+		&h.rleCode.size, &h.rleCode.compressedSize,
+		&h.newData.size, &h.newData.compressedSize,
+	}
+	sections := []*section{&h.covers, &h.rleCtrl, &h.rleCode, &h.newData}
+	if h.Single {
+		fields = []*uint64{&h.NewSize, &h.OldSize, &h.CoverCount, &h.StepMemSize, &h.stream.size, &h.stream.compressedSize}
+		sections = []*section{&h.stream}
+	}
+	for _, field := range fields {
+		v, err := readUint(br)
+		if err != nil {
+			return nil, fmt.Errorf("reading diff header: %w", err)
+		}
+		*field = v
+	}
+	if h.NewSize > math.MaxInt64 || h.OldSize > math.MaxInt64 {
+		return nil, fmt.Errorf("%w: data size out of range", ErrCorruptDiff)
+	}
+	if h.Single && h.StepMemSize > h.stream.size {
+		return nil, fmt.Errorf("%w: step larger than the diff", ErrCorruptDiff)
+	}
+
+	pos := br.pos
+	for _, s := range sections {
+		if s.compressedSize != 0 && h.CompressType == "" {
+			return nil, fmt.Errorf("%w: compressed section without compress type", ErrCorruptDiff)
+		}
+		s.offset = pos
+		if s.storedSize() > uint64(diffSize-pos) {
+			return nil, fmt.Errorf("%w: section exceeds diff size", ErrCorruptDiff)
+		}
+		pos += int64(s.storedSize())
+	}
+	switch h.CompressType {
+	case "", "zstd":
+	default:
+		return nil, fmt.Errorf("%w: compression %q", ErrUnsupportedFormat, h.CompressType)
+	}
+	return h, nil
+}
+
+// openSection returns a reader yielding exactly s.size decompressed bytes.
+func (h *Header) openSection(diff io.ReaderAt, s section) (io.Reader, func(), error) {
+	raw := io.NewSectionReader(diff, s.offset, int64(s.storedSize()))
+	if s.compressedSize == 0 {
+		return raw, func() {}, nil
+	}
+	dec, err := zstd.NewReader(raw, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating zstd reader: %w", err)
+	}
+	return &exactReader{r: dec, remaining: s.size}, dec.Close, nil
+}
+
+// exactReader fails instead of returning short data when a section decompresses to fewer bytes than declared.
+type exactReader struct {
+	r         io.Reader
+	remaining uint64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.remaining == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= uint64(n)
+	if err == io.EOF && e.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// diffStreams yields the covers, the bytes added to old data inside them and the new data outside of them.
+type diffStreams interface {
+	// nextCover returns the next cover relative to the end of the previous one: its old data position,
+	// the length of new data in front of it and its length
+	nextCover(oldPosBack uint64) (oldPos, copyLength, length uint64, err error)
+	newData() io.Reader
+	add(dst []byte) error
+}
+
+// readCover decodes a cover: the old data position as a signed offset from oldPosBack,
+// the new data length in front of the cover and the cover length.
+func readCover(r io.ByteScanner, oldPosBack, oldSize uint64) (oldPos, copyLength, length uint64, err error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	r.UnreadByte()
+	incOldPos, err := readUintWithTag(r, 1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if c>>7 == 0 {
+		if incOldPos > oldSize-oldPosBack {
+			return 0, 0, 0, errors.New("cover past end of old data")
+		}
+		oldPos = oldPosBack + incOldPos
+	} else {
+		if incOldPos > oldPosBack {
+			return 0, 0, 0, errors.New("cover before start of old data")
+		}
+		oldPos = oldPosBack - incOldPos
+	}
+	if copyLength, err = readUint(r); err != nil {
+		return 0, 0, 0, err
+	}
+	if length, err = readUint(r); err != nil {
+		return 0, 0, 0, err
+	}
+	return oldPos, copyLength, length, nil
+}
+
+// sectionStreams reads an HDIFF13 diff from its four sections.
+type sectionStreams struct {
+	covers  *bufio.Reader
+	rle     *rleReader
+	data    *bufio.Reader
+	oldSize uint64
+}
+
+func (s *sectionStreams) nextCover(oldPosBack uint64) (uint64, uint64, uint64, error) {
+	return readCover(s.covers, oldPosBack, s.oldSize)
+}
+
+func (s *sectionStreams) newData() io.Reader { return s.data }
+
+func (s *sectionStreams) add(dst []byte) error { return s.rle.add(dst) }
+
+// singleStreams reads an HDIFFSF20 diff, loading one step of covers and rle data at a time.
+type singleStreams struct {
+	stream  *bufio.Reader
+	covers  bytes.Reader
+	rle     rle0Reader
+	stepMem uint64
+	oldSize uint64
+}
+
+func (s *singleStreams) nextCover(oldPosBack uint64) (uint64, uint64, uint64, error) {
+	if s.covers.Len() == 0 {
+		if err := s.nextStep(); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return readCover(&s.covers, oldPosBack, s.oldSize)
+}
+
+func (s *singleStreams) nextStep() error {
+	coverSize, err := readUint(s.stream)
+	if err != nil {
+		return err
+	}
+	rleSize, err := readUint(s.stream)
+	if err != nil {
+		return err
+	}
+	if coverSize == 0 || coverSize > s.stepMem || rleSize > s.stepMem-coverSize {
+		return errors.New("step size out of range")
+	}
+	step := make([]byte, coverSize+rleSize)
+	if _, err := io.ReadFull(s.stream, step); err != nil {
+		return err
+	}
+	s.covers.Reset(step[:coverSize])
+	s.rle.code.Reset(step[coverSize:])
+	return nil
+}
+
+func (s *singleStreams) newData() io.Reader { return s.stream }
+
+func (s *singleStreams) add(dst []byte) error { return s.rle.add(dst) }
+
+// Patch applies diff to old and writes the new data to out.
+func Patch(ctx context.Context, old io.ReaderAt, oldSize int64, diff io.ReaderAt, diffSize int64, out io.Writer) error {
+	h, err := ReadHeader(diff, diffSize)
+	if err != nil {
+		return err
+	}
+	if uint64(oldSize) != h.OldSize {
+		return fmt.Errorf("old data size %d does not match diff (%d)", oldSize, h.OldSize)
+	}
+
+	var streams diffStreams
+	if h.Single {
+		r, closeFn, err := h.openSection(diff, h.stream)
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+		streams = &singleStreams{stream: bufio.NewReaderSize(r, 64*1024), stepMem: h.StepMemSize, oldSize: h.OldSize}
+	} else {
+		sections := make([]*bufio.Reader, 4)
+		for i, s := range []section{h.covers, h.rleCtrl, h.rleCode, h.newData} {
+			r, closeFn, err := h.openSection(diff, s)
+			if err != nil {
+				return err
+			}
+			defer closeFn()
+			sections[i] = bufio.NewReaderSize(r, 64*1024)
+		}
+		streams = &sectionStreams{
+			covers:  sections[0],
+			rle:     &rleReader{ctrl: sections[1], code: sections[2]},
+			data:    sections[3],
+			oldSize: h.OldSize,
+		}
+	}
+	return h.apply(ctx, old, streams, out)
+}
+
+func (h *Header) apply(ctx context.Context, old io.ReaderAt, streams diffStreams, out io.Writer) error {
+	newData := streams.newData()
+	w := bufio.NewWriterSize(out, 256*1024)
+	var oldPosBack, newPosBack uint64
+	buf := make([]byte, 64*1024)
+	for i := uint64(0); i < h.CoverCount; i++ {
+		if i%64 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		oldPos, copyLength, length, err := streams.nextCover(oldPosBack)
+		if err != nil {
+			return fmt.Errorf("%w: reading cover %d: %v", ErrCorruptDiff, i, err)
+		}
+		// Compared against what is left, sums of crafted values could wrap around
+		if copyLength > h.NewSize-newPosBack {
+			return fmt.Errorf("%w: cover %d out of range", ErrCorruptDiff, i)
+		}
+		newPos := newPosBack + copyLength
+		if length > h.NewSize-newPos || length > h.OldSize-oldPos {
+			return fmt.Errorf("%w: cover %d out of range", ErrCorruptDiff, i)
+		}
+
+		// Literal new data before the cover
+		if _, err := io.CopyN(w, newData, int64(copyLength)); err != nil {
+			return fmt.Errorf("%w: copying new data: %v", ErrCorruptDiff, err)
+		}
+
+		// Old data plus the run-length encoded difference
+		for done := uint64(0); done < length; {
+			n := min(uint64(len(buf)), length-done)
+			chunk := buf[:n]
+			if _, err := old.ReadAt(chunk, int64(oldPos+done)); err != nil {
+				return fmt.Errorf("reading old data at %d: %w", oldPos+done, err)
+			}
+			if err := streams.add(chunk); err != nil {
+				return fmt.Errorf("%w: decoding rle data: %v", ErrCorruptDiff, err)
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			done += n
+		}
+
+		oldPosBack = oldPos + length
+		newPosBack = newPos + length
+	}
+
+	if _, err := io.CopyN(w, newData, int64(h.NewSize-newPosBack)); err != nil {
+		return fmt.Errorf("%w: copying new data: %v", ErrCorruptDiff, err)
+	}
+	return w.Flush()
+}
+
+// PatchFile applies the diff at diffPath to oldPath and writes the result to outPath.
+// An empty oldPath means the diff creates the file from nothing.
+func PatchFile(ctx context.Context, oldPath, diffPath, outPath string) (err error) {
+	var old io.ReaderAt = emptyReaderAt{}
+	var oldSize int64
+	if oldPath != "" {
+		oldFile, err := os.Open(oldPath)
+		if err != nil {
+			return err
+		}
+		defer oldFile.Close()
+		info, err := oldFile.Stat()
+		if err != nil {
+			return err
+		}
+		old, oldSize = oldFile, info.Size()
+	}
+
+	diffFile, err := os.Open(diffPath)
+	if err != nil {
+		return err
+	}
+	defer diffFile.Close()
+	info, err := diffFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(outPath)
+		}
+	}()
+	return Patch(ctx, old, oldSize, diffFile, info.Size(), out)
+}
+
+type emptyReaderAt struct{}
+
+func (emptyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return 0, io.EOF
+}
@@ -0,0 +1,242 @@
+package hypAPI
+
+import (
+	"SophonClientv2/internal/config"
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetadataCache holds the getGameBranches and getGameConfigs responses per release type.
+// Entries are fetched on first use and revalidated with ETag / If-Modified-Since once older
+// than TTL. With Dir set they are mirrored to disk, so the client can start offline and keeps
+// serving the last good response (with a warning) while the API is unreachable.
+// Concurrent lookups of a stale entry share one request, lookups of other entries never wait for it.
+type MetadataCache struct {
+	TTL    time.Duration
+	Dir    string
+	Client *Client // nil uses DefaultClient
+
+	mu       sync.Mutex // Guards entries and inflight only, never held across I/O
+	entries  map[string]*cacheEntry
+	inflight map[string]*cacheFetch
+}
+
+// cacheFetch is a load or revalidation in progress, entry and err are set before done is closed.
+type cacheFetch struct {
+	done  chan struct{}
+	entry *cacheEntry
+	err   error
+}
+
+type cacheEntry struct {
+	Body         json.RawMessage `json:"body"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	FetchedAt    time.Time       `json:"fetched_at"`
+}
+
+func NewMetadataCache(ttl time.Duration, dir string) *MetadataCache {
+	return &MetadataCache{
+		TTL:      ttl,
+		Dir:      dir,
+		entries:  make(map[string]*cacheEntry),
+		inflight: make(map[string]*cacheFetch),
+	}
+}
+
+// Metadata is the process wide cache used by pkg/operations.
+var Metadata = NewMetadataCache(config.Config.MetadataCacheTTL, config.Config.MetadataCacheDir)
+
+func (c *MetadataCache) client() *Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return DefaultClient
+}
+
+func (c *MetadataCache) GameBranches(ctx context.Context, relType string) (models.HYPGetGameBranchesResponse, error) {
+	var branches models.HYPGetGameBranchesResponse
+	err := c.get(ctx, "getGameBranches", relType, c.client().gameBranchesURL(relType), &branches, false)
+	return branches, err
+}
+
+func (c *MetadataCache) GameConfigs(ctx context.Context, relType string) (models.HYPGetGameConfigsResponse, error) {
+	var configs models.HYPGetGameConfigsResponse
+	err := c.get(ctx, "getGameConfigs", relType, c.client().gameConfigsURL(relType), &configs, false)
+	return configs, err
+}
+
+// Refresh revalidates both responses of the release type regardless of their age.
+func (c *MetadataCache) Refresh(ctx context.Context, relType string) error {
+	var branches models.HYPGetGameBranchesResponse
+	if err := c.get(ctx, "getGameBranches", relType, c.client().gameBranchesURL(relType), &branches, true); err != nil {
+		return err
+	}
+	var configs models.HYPGetGameConfigsResponse
+	return c.get(ctx, "getGameConfigs", relType, c.client().gameConfigsURL(relType), &configs, true)
+}
+
+// Clear drops the in-memory entries, the next lookup reloads them from disk or the API.
+func (c *MetadataCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*cacheEntry)
+}
+
+// get serves the entry or fetches it. A lookup waiting for another one's request stops waiting
+// when its own ctx is done, and takes over when the other lookup was cancelled.
+func (c *MetadataCache) get(ctx context.Context, op, relType, url string, out any, force bool) error {
+	key := op + "_" + strings.ToLower(relType)
+
+	for {
+		c.mu.Lock()
+		entry := c.entries[key]
+		if entry != nil && !force && time.Since(entry.FetchedAt) < c.TTL {
+			c.mu.Unlock()
+			return decodeAPI(op, url, entry.Body, out)
+		}
+		f, ok := c.inflight[key]
+		if !ok {
+			f = &cacheFetch{done: make(chan struct{})}
+			c.inflight[key] = f
+		}
+		c.mu.Unlock()
+
+		if ok {
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if f.err != nil && ctx.Err() == nil && (errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded)) {
+				continue
+			}
+		} else {
+			f.entry, f.err = c.fetch(ctx, op, key, url, entry, force)
+			c.mu.Lock()
+			delete(c.inflight, key)
+			c.mu.Unlock()
+			close(f.done)
+		}
+		if f.err != nil {
+			return f.err
+		}
+		return decodeAPI(op, url, f.entry.Body, out)
+	}
+}
+
+// fetch loads the entry from disk or revalidates it with the API. It returns the entry to serve,
+// which is the cached one (with a warning) when the API fails.
+func (c *MetadataCache) fetch(ctx context.Context, op, key, url string, entry *cacheEntry, force bool) (*cacheEntry, error) {
+	if entry == nil {
+		if entry = c.load(key); entry != nil {
+			c.store(key, entry)
+			if !force && time.Since(entry.FetchedAt) < c.TTL {
+				return entry, nil
+			}
+		}
+	}
+
+	header := http.Header{}
+	if entry != nil {
+		if entry.ETag != "" {
+			header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+	resp, err := c.client().requestAPI(ctx, op, http.MethodGet, url, header)
+	if err == nil && resp.Body == nil {
+		if entry == nil {
+			return nil, &APIError{Op: op, URL: url, Kind: ErrHTTPStatus, StatusCode: http.StatusNotModified}
+		}
+		// Other lookups may be reading the old entry
+		revalidated := *entry
+		revalidated.FetchedAt = time.Now()
+		c.store(key, &revalidated)
+		c.save(key, &revalidated)
+		return &revalidated, nil
+	}
+	if err == nil {
+		// Check the response before replacing a good entry with it
+		var envelope apiEnvelope
+		if err = decodeAPI(op, url, resp.Body, &envelope); err == nil {
+			entry = &cacheEntry{
+				Body:         resp.Body,
+				ETag:         resp.ETag,
+				LastModified: resp.LastModified,
+				FetchedAt:    time.Now(),
+			}
+			c.store(key, entry)
+			c.save(key, entry)
+			return entry, nil
+		}
+	}
+
+	if entry == nil {
+		return nil, err
+	}
+	logging.GlobalLogger.Warn(fmt.Sprintf("%v, serving cached %s from %s", err, key, entry.FetchedAt.Format(time.RFC3339)))
+	return entry, nil
+}
+
+func (c *MetadataCache) store(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+}
+
+func (c *MetadataCache) path(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+func (c *MetadataCache) load(key string) *cacheEntry {
+	if c.Dir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.GlobalLogger.Warn("Failed to read metadata cache: " + err.Error())
+		}
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		logging.GlobalLogger.Warn(fmt.Sprintf("Ignoring corrupt metadata cache %s: %v", c.path(key), err))
+		return nil
+	}
+	return &entry
+}
+
+// save writes the entry atomically, failures only cost the offline fallback so they are logged.
+func (c *MetadataCache) save(key string, entry *cacheEntry) {
+	if c.Dir == "" {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = os.MkdirAll(c.Dir, 0o755)
+	}
+	tmpPath := c.path(key) + ".tmp"
+	if err == nil {
+		err = os.WriteFile(tmpPath, data, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, c.path(key))
+	}
+	if err != nil {
+		logging.GlobalLogger.Warn("Failed to write metadata cache: " + err.Error())
+	}
+}
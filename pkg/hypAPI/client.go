@@ -0,0 +1,67 @@
+package hypAPI
+
+import (
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/internal/secrets"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultUserAgent = "SophonClientv2"
+
+// Endpoints are the API locations of one release type.
+type Endpoints struct {
+	HYPAPIPrefix  string // Base of the hyp-connect API, ending in "/"
+	LauncherID    string
+	SophonAPIBase string // getBuild endpoint, getPatchBuild lives next to it
+}
+
+// Client talks to the HYP and Sophon APIs. Point Endpoints at a mirror or a local stand-in and
+// set HTTPClient to route through a proxy. The zero value is not usable, use NewClient.
+type Client struct {
+	HTTPClient *http.Client
+	UserAgent  string
+	Endpoints  map[string]Endpoints // Keyed by release type, "os" and "cn"
+}
+
+// NewClient returns a client for the official endpoints.
+func NewClient() *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		UserAgent:  DefaultUserAgent,
+		Endpoints: map[string]Endpoints{
+			"os": {HYPAPIPrefix: secrets.OSHYPAPIPrefix, LauncherID: secrets.OSLauncherID, SophonAPIBase: secrets.OSSophonAPIBaseURL},
+			"cn": {HYPAPIPrefix: secrets.CNHYPAPIPrefix, LauncherID: secrets.CNLauncherID, SophonAPIBase: secrets.CNSophonAPIBaseURL},
+		},
+	}
+}
+
+// DefaultClient is used by the package level functions and by Metadata.
+var DefaultClient = NewClient()
+
+// Do sends the request with the client's user agent.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if c.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+func (c *Client) endpoints(relType string) Endpoints {
+	relType = strings.ToLower(relType)
+	if ep, ok := c.Endpoints[relType]; ok {
+		return ep
+	}
+	logging.GlobalLogger.Warn("Unknown release type " + relType + ", defaulting to OS")
+	return c.Endpoints["os"]
+}
+
+func (c *Client) hypAPIURL(relType, apiPath string) string {
+	ep := c.endpoints(relType)
+	return ep.HYPAPIPrefix + apiPath + "?launcher_id=" + ep.LauncherID
+}
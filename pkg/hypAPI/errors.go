@@ -0,0 +1,58 @@
+package hypAPI
+
+import (
+	"SophonClientv2/pkg/retry"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error kinds, match them with errors.Is
+var (
+	ErrNetwork    = errors.New("network error")
+	ErrHTTPStatus = errors.New("unexpected HTTP status")
+	ErrRetcode    = errors.New("API returned an error")
+	ErrDecode     = errors.New("invalid response")
+)
+
+// APIError describes a failed HYP / Sophon API call.
+type APIError struct {
+	Op         string // e.g. "getGameBranches"
+	URL        string
+	Kind       error // One of the Err* kinds above
+	StatusCode int   // Set for ErrHTTPStatus, Err is then a *retry.StatusError
+	Retcode    int   // Set for ErrRetcode
+	Message    string
+	Err        error // Underlying error, if any
+}
+
+func (e *APIError) Error() string {
+	switch e.Kind {
+	case ErrHTTPStatus:
+		return fmt.Sprintf("%s: %v: %d %s", e.Op, e.Kind, e.StatusCode, http.StatusText(e.StatusCode))
+	case ErrRetcode:
+		return fmt.Sprintf("%s: %v: retcode %d: %s", e.Op, e.Kind, e.Retcode, e.Message)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v: %v", e.Op, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Op, e.Kind)
+}
+
+func (e *APIError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// Temporary reports whether retrying the call may succeed.
+func (e *APIError) Temporary() bool {
+	switch e.Kind {
+	case ErrNetwork:
+		return true
+	case ErrHTTPStatus:
+		return retry.ClassifyStatus(e.StatusCode) == retry.Retryable
+	}
+	return false
+}
@@ -4,72 +4,43 @@ import (
 	"SophonClientv2/internal/logging"
 	"SophonClientv2/internal/models"
 	"SophonClientv2/internal/secrets"
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
-	"strings"
 )
 
-func GetGameBranches(relType string) models.HYPGetGameBranchesResponse {
-	var url string
-	switch strings.ToLower(relType) {
-	case "cn":
-		url = secrets.GetGameBranchCNUrl
-	case "os":
-		url = secrets.GetGameBranchOSUrl
-	default:
-		logging.GlobalLogger.Warn("Unknown release type in function GetGameBranches, defaulting to OS")
-		url = secrets.GetGameBranchOSUrl
-	}
-	resp, err := http.Get(url)
-	if err != nil {
-		fmt.Printf("Error fetching game branches: %v\n", err)
-		logging.GlobalLogger.Fatal("Failed to fetch game branches: " + err.Error())
-	}
-	defer resp.Body.Close()
-	logging.GlobalLogger.Info("Fetched game branches successfully with status: " + resp.Status)
+func (c *Client) gameBranchesURL(relType string) string {
+	return c.hypAPIURL(relType, secrets.GetGameBranchesAPIPath)
+}
 
+func (c *Client) gameConfigsURL(relType string) string {
+	return c.hypAPIURL(relType, secrets.GetGameConfigsAPIPath)
+}
+
+// GetGameBranches always asks the API, use Metadata.GameBranches for the cached response.
+func (c *Client) GetGameBranches(ctx context.Context, relType string) (models.HYPGetGameBranchesResponse, error) {
 	var branches models.HYPGetGameBranchesResponse
-	err = json.NewDecoder(resp.Body).Decode(&branches)
-	if err != nil {
-		logging.GlobalLogger.Fatal("Failed to decode game branches response: " + err.Error())
+	if err := c.callAPI(ctx, "getGameBranches", http.MethodGet, c.gameBranchesURL(relType), &branches); err != nil {
+		return branches, err
 	}
-	logging.GlobalLogger.Info("Decoded game branches response successfully")
 	logging.GlobalLogger.Info(fmt.Sprintf("Number of game branches fetched: %d", len(branches.Data.GameBranches)))
-
-	return branches
+	return branches, nil
 }
 
-func GetGameConfigs(relType string) models.HYPGetGameConfigsResponse {
-	var url string
-	switch strings.ToLower(relType) {
-	case "cn":
-		url = secrets.GetGameConfigsCNUrl
-	case "os":
-		url = secrets.GetGameConfigsOSUrl
-	default:
-		logging.GlobalLogger.Warn("Unknown release type in function GetGameConfigs, defaulting to OS")
-		url = secrets.GetGameConfigsOSUrl
-	}
-	resp, err := http.Get(url)
-	if err != nil {
-		logging.GlobalLogger.Fatal("Failed to fetch game configs: " + err.Error())
-	}
-	defer resp.Body.Close()
-	logging.GlobalLogger.Info("Fetched game configs successfully with status: " + resp.Status)
-
+// GetGameConfigs always asks the API, use Metadata.GameConfigs for the cached response.
+func (c *Client) GetGameConfigs(ctx context.Context, relType string) (models.HYPGetGameConfigsResponse, error) {
 	var configs models.HYPGetGameConfigsResponse
-	err = json.NewDecoder(resp.Body).Decode(&configs)
-	if err != nil {
-		logging.GlobalLogger.Fatal("Failed to decode game configs response: " + err.Error())
+	if err := c.callAPI(ctx, "getGameConfigs", http.MethodGet, c.gameConfigsURL(relType), &configs); err != nil {
+		return configs, err
 	}
-	logging.GlobalLogger.Info("Decoded game configs response successfully")
 	logging.GlobalLogger.Info(fmt.Sprintf("Number of game configs fetched: %d", len(configs.Data.LaunchConfigs)))
+	return configs, nil
+}
 
-	return configs
+func GetGameBranches(ctx context.Context, relType string) (models.HYPGetGameBranchesResponse, error) {
+	return DefaultClient.GetGameBranches(ctx, relType)
 }
 
-var OSGameBranches = GetGameBranches("os")
-var CNGameBranches = GetGameBranches("cn")
-var OSGameConfigs = GetGameConfigs("os")
-var CNGameConfigs = GetGameConfigs("cn")
+func GetGameConfigs(ctx context.Context, relType string) (models.HYPGetGameConfigsResponse, error) {
+	return DefaultClient.GetGameConfigs(ctx, relType)
+}
@@ -3,51 +3,77 @@ package hypAPI
 import (
 	"SophonClientv2/internal/logging"
 	"SophonClientv2/internal/models"
-	"SophonClientv2/internal/secrets"
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
 )
 
-func BuildSophonGetBuildURL(relType string, branch models.HYPGameBranch) string {
-	var baseURL string
-	switch strings.ToLower(relType) {
-	case "cn":
-		baseURL = secrets.CNSophonAPIBaseURL
-	case "os":
-		baseURL = secrets.OSSophonAPIBaseURL
-	default:
-		logging.GlobalLogger.Warn("Unknown release type in function BuildSophonGetBuildURL, defaulting to OS")
-		baseURL = secrets.OSSophonAPIBaseURL
-	}
+func (c *Client) BuildSophonGetBuildURL(relType string, branch models.HYPGameBranch) string {
 	return fmt.Sprintf(
 		"%s?package_id=%s&branch=%s&password=%s",
-		baseURL,
+		c.endpoints(relType).SophonAPIBase,
 		branch.PackageId,
 		branch.Branch,
 		branch.Password,
 	)
 }
 
-func GetSophonBuild(url string) models.SophonGetBuildAPIResponse {
-	resp, err := http.Get(url)
-	if err != nil {
-		logging.GlobalLogger.Fatal("Failed to fetch Sophon build: " + err.Error())
+func (c *Client) GetSophonBuild(ctx context.Context, url string) (models.SophonGetBuildAPIResponse, error) {
+	var buildResponse models.SophonGetBuildAPIResponse
+	if err := c.callAPI(ctx, "getBuild", http.MethodGet, url, &buildResponse); err != nil {
+		return buildResponse, err
 	}
-	defer resp.Body.Close()
-	logging.GlobalLogger.Info("Fetched Sophon build successfully with status: " + resp.Status)
+	logging.GlobalLogger.Info("Fetched Sophon build " + buildResponse.Data.Tag)
+	return buildResponse, nil
+}
 
-	var buildResponse models.SophonGetBuildAPIResponse
-	err = json.NewDecoder(resp.Body).Decode(&buildResponse)
-	if err != nil {
-		logging.GlobalLogger.Fatal("Failed to decode Sophon build response: " + err.Error())
+func (c *Client) GetSophonBuildByBranch(ctx context.Context, relType string, branch models.HYPGameBranch) (models.SophonGetBuildAPIResponse, error) {
+	url := c.BuildSophonGetBuildURL(relType, branch)
+	return c.GetSophonBuild(ctx, url)
+}
+
+// BuildSophonGetPatchBuildURL returns the getPatchBuild endpoint, which lives next to getBuild.
+func (c *Client) BuildSophonGetPatchBuildURL(relType string, branch models.HYPGameBranch) string {
+	getBuildURL := c.BuildSophonGetBuildURL(relType, branch)
+	return strings.Replace(getBuildURL, "/getBuild?", "/getPatchBuild?", 1)
+}
+
+// GetSophonPatchBuild fetches the patch build. Unlike getBuild the endpoint only accepts POST.
+func (c *Client) GetSophonPatchBuild(ctx context.Context, url string) (models.SophonGetPatchBuildAPIResponse, error) {
+	var buildResponse models.SophonGetPatchBuildAPIResponse
+	if err := c.callAPI(ctx, "getPatchBuild", http.MethodPost, url, &buildResponse); err != nil {
+		return buildResponse, err
 	}
-	logging.GlobalLogger.Info("Decoded Sophon build response successfully")
-	return buildResponse
+	logging.GlobalLogger.Info("Fetched Sophon patch build " + buildResponse.Data.Tag)
+	return buildResponse, nil
+}
+
+func (c *Client) GetSophonPatchBuildByBranch(ctx context.Context, relType string, branch models.HYPGameBranch) (models.SophonGetPatchBuildAPIResponse, error) {
+	url := c.BuildSophonGetPatchBuildURL(relType, branch)
+	return c.GetSophonPatchBuild(ctx, url)
+}
+
+func BuildSophonGetBuildURL(relType string, branch models.HYPGameBranch) string {
+	return DefaultClient.BuildSophonGetBuildURL(relType, branch)
+}
+
+func GetSophonBuild(ctx context.Context, url string) (models.SophonGetBuildAPIResponse, error) {
+	return DefaultClient.GetSophonBuild(ctx, url)
+}
+
+func GetSophonBuildByBranch(ctx context.Context, relType string, branch models.HYPGameBranch) (models.SophonGetBuildAPIResponse, error) {
+	return DefaultClient.GetSophonBuildByBranch(ctx, relType, branch)
+}
+
+func BuildSophonGetPatchBuildURL(relType string, branch models.HYPGameBranch) string {
+	return DefaultClient.BuildSophonGetPatchBuildURL(relType, branch)
+}
+
+func GetSophonPatchBuild(ctx context.Context, url string) (models.SophonGetPatchBuildAPIResponse, error) {
+	return DefaultClient.GetSophonPatchBuild(ctx, url)
 }
 
-func GetSophonBuildByBranch(relType string, branch models.HYPGameBranch) models.SophonGetBuildAPIResponse {
-	url := BuildSophonGetBuildURL(relType, branch)
-	return GetSophonBuild(url)
+func GetSophonPatchBuildByBranch(ctx context.Context, relType string, branch models.HYPGameBranch) (models.SophonGetPatchBuildAPIResponse, error) {
+	return DefaultClient.GetSophonPatchBuildByBranch(ctx, relType, branch)
 }
@@ -0,0 +1,109 @@
+package hypAPI
+
+import (
+	"SophonClientv2/internal/config"
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/pkg/retry"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// apiEnvelope holds the fields every HYP / Sophon API response shares.
+type apiEnvelope struct {
+	Retcode int    `json:"retcode"`
+	Message string `json:"message"`
+}
+
+// apiResponse is a successful HTTP exchange. Body is nil when the server answered 304 Not Modified.
+type apiResponse struct {
+	Body         []byte
+	ETag         string
+	LastModified string
+}
+
+// callAPI performs the request, retrying temporary failures with exponential backoff, and decodes
+// the JSON body into out. A non-zero retcode is returned as ErrRetcode and not retried.
+func (c *Client) callAPI(ctx context.Context, op, method, url string, out any) error {
+	resp, err := c.requestAPI(ctx, op, method, url, nil)
+	if err != nil {
+		return err
+	}
+	return decodeAPI(op, url, resp.Body, out)
+}
+
+// classify retries the API errors that are Temporary, retcodes and undecodable responses are not.
+func classify(err error) retry.Class {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && !apiErr.Temporary() {
+		return retry.Permanent
+	}
+	return retry.Classify(err)
+}
+
+// requestAPI performs the request with the extra headers, retrying temporary failures until ctx is done.
+func (c *Client) requestAPI(ctx context.Context, op, method, url string, header http.Header) (*apiResponse, error) {
+	policy := retry.FromConfig(config.Config.MaxAPIRetries + 1)
+	policy.Classify = classify
+	var resp *apiResponse
+	err := policy.Do(ctx, func(int) error {
+		var err error
+		resp, err = c.requestAPIOnce(ctx, op, method, url, header)
+		return err
+	}, func(attempt int, err error, delay time.Duration) {
+		logging.GlobalLogger.Warn("API request failed, retrying", "op", op, "attempt", attempt, "max_attempts", policy.MaxAttempts, "delay", delay.Round(time.Millisecond), "error", err)
+	})
+	return resp, err
+}
+
+func (c *Client) requestAPIOnce(ctx context.Context, op, method, url string, header http.Header) (*apiResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, &APIError{Op: op, URL: url, Kind: ErrNetwork, Err: err}
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, &APIError{Op: op, URL: url, Kind: ErrNetwork, Err: err}
+	}
+	defer resp.Body.Close()
+
+	result := &apiResponse{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	if resp.StatusCode == http.StatusNotModified {
+		logging.GlobalLogger.Debug("API response not modified", "op", op)
+		return result, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, &APIError{Op: op, URL: url, Kind: ErrHTTPStatus, StatusCode: resp.StatusCode, Err: retry.NewStatusError(resp)}
+	}
+	result.Body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &APIError{Op: op, URL: url, Kind: ErrNetwork, Err: err}
+	}
+	logging.GlobalLogger.Debug("API request succeeded", "op", op, "status", resp.Status)
+	return result, nil
+}
+
+// decodeAPI checks the response envelope and decodes body into out.
+func decodeAPI(op, url string, body []byte, out any) error {
+	var envelope apiEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return &APIError{Op: op, URL: url, Kind: ErrDecode, Err: err}
+	}
+	if envelope.Retcode != 0 {
+		return &APIError{Op: op, URL: url, Kind: ErrRetcode, Retcode: envelope.Retcode, Message: envelope.Message}
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return &APIError{Op: op, URL: url, Kind: ErrDecode, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package installer
+
+import (
+	"SophonClientv2/internal/logging"
+	"context"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var autotuneInterval = 2 * time.Second
+
+// tunable is the part of a pipeline stage the tuner resizes.
+type tunable interface {
+	WorkerCount() int
+	SetWorkers(n int) int
+	QueueLength() int
+	QueueSize() int
+	Processed() int64
+}
+
+type tunedStage struct {
+	name   string
+	stage  tunable
+	log    *logging.Logger
+	base   int  // Configured worker count, the tuner never goes below it
+	limit  int  // The tuner never goes above it
+	pinned bool // Set through SetLimits, left alone from then on
+
+	last  int64 // Processed at the previous tick
+	rate  int64 // Items taken during the previous interval
+	grown bool  // A worker was added at the previous tick
+	hold  int   // Ticks to wait before growing again after a revert
+	idle  int   // Consecutive ticks with an empty queue
+}
+
+// tuner grows a stage while its input queue stays at least half full and throughput keeps rising,
+// and shrinks it back to the configured count once the queue has been empty for a while.
+// Downloads are not tuned, their bottleneck is the network rather than the CPU.
+type tuner struct {
+	mu     sync.Mutex
+	stages []*tunedStage
+}
+
+func newTuner(inst *Installer) *tuner {
+	limit := 2 * runtime.NumCPU()
+	t := &tuner{}
+	for _, s := range []struct {
+		name  string
+		stage tunable
+	}{
+		{"decompressor", inst.Decompressor},
+		{"verifier", inst.Verifier},
+		{"assembler", inst.Assembler},
+		{"file verifier", inst.Verifier2},
+	} {
+		base := s.stage.WorkerCount()
+		t.stages = append(t.stages, &tunedStage{name: s.name, stage: s.stage, log: inst.log, base: base, limit: max(base, limit)})
+	}
+	return t
+}
+
+func (t *tuner) run(ctx context.Context) {
+	ticker := time.NewTicker(autotuneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t.mu.Lock()
+		for _, s := range t.stages {
+			if !s.pinned {
+				s.tick()
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// pin stops tuning the stage, e.g. because its worker count was set by hand.
+func (t *tuner) pin(stage tunable) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.stages {
+		if s.stage == stage {
+			s.pinned = true
+		}
+	}
+}
+
+func (s *tunedStage) tick() {
+	processed := s.stage.Processed()
+	rate := processed - s.last
+	s.last = processed
+	workers := s.stage.WorkerCount()
+	queued := s.stage.QueueLength()
+	backlog := queued*2 >= s.stage.QueueSize()
+
+	if s.hold > 0 {
+		s.hold--
+	}
+	if queued == 0 {
+		s.idle++
+	} else {
+		s.idle = 0
+	}
+
+	switch {
+	case s.grown && rate*100 < s.rate*105:
+		// The extra worker did not help, the bottleneck is elsewhere
+		s.resize(workers, workers-1)
+		s.grown = false
+		s.hold = 3
+	case backlog && workers < s.limit && s.hold == 0:
+		s.resize(workers, workers+1)
+		s.grown = true
+	case s.idle >= 3 && workers > s.base:
+		s.resize(workers, workers-1)
+		s.grown = false
+		s.idle = 0
+	default:
+		s.grown = false
+	}
+	s.rate = rate
+}
+
+func (s *tunedStage) resize(from, to int) {
+	to = s.stage.SetWorkers(to)
+	s.log.Debug("Autotune resized stage", logging.KeyStage, s.name, "from", from, "to", to)
+}
+
+// Limits resizes the stages of a running installer, zero fields are left unchanged.
+type Limits struct {
+	Downloads      int
+	Decompressions int
+	Hashchecks     int // Chunk and file verifiers
+	Writers        int
+	QueueSize      int   // Input queue length of every stage
+	RateLimit      int64 // Download bytes per second, -1 removes the limit. 0 is unlimited in the result
+}
+
+// SetLimits applies l and returns the resulting limits. Stages set this way are no longer autotuned.
+func (inst *Installer) SetLimits(l Limits) Limits {
+	if l.Downloads > 0 {
+		inst.Downloader.SetWorkers(l.Downloads)
+	}
+	if l.RateLimit != 0 {
+		inst.Downloader.SetRateLimit(max(0, l.RateLimit))
+	}
+	if l.Decompressions > 0 {
+		inst.Decompressor.SetWorkers(l.Decompressions)
+		inst.tuner.pin(inst.Decompressor)
+	}
+	if l.Hashchecks > 0 {
+		inst.Verifier.SetWorkers(l.Hashchecks)
+		inst.Verifier2.SetWorkers(l.Hashchecks)
+		inst.tuner.pin(inst.Verifier)
+		inst.tuner.pin(inst.Verifier2)
+	}
+	if l.Writers > 0 {
+		inst.Assembler.SetWorkers(l.Writers)
+		inst.tuner.pin(inst.Assembler)
+	}
+	if l.QueueSize > 0 {
+		inst.Downloader.SetQueueSize(l.QueueSize)
+		inst.Decompressor.SetQueueSize(l.QueueSize)
+		inst.Verifier.SetQueueSize(l.QueueSize)
+		inst.Assembler.SetQueueSize(l.QueueSize)
+		inst.Verifier2.SetQueueSize(l.QueueSize)
+	}
+	return inst.Limits()
+}
+
+// Limits returns the current worker counts and queue size.
+func (inst *Installer) Limits() Limits {
+	return Limits{
+		Downloads:      inst.Downloader.WorkerCount(),
+		Decompressions: inst.Decompressor.WorkerCount(),
+		Hashchecks:     inst.Verifier.WorkerCount(),
+		Writers:        inst.Assembler.WorkerCount(),
+		QueueSize:      inst.Downloader.QueueSize(),
+		RateLimit:      inst.Downloader.RateLimit(),
+	}
+}
@@ -0,0 +1,119 @@
+package installer
+
+import (
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/pkg/verifier"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Files opened for hashing at the same time during Check
+const checkWindow = 64
+
+// CheckResult lists the manifest files that are missing from GameDir or do not match the manifest.
+type CheckResult struct {
+	Checked int
+	Missing []string
+	Broken  []string
+}
+
+func (r CheckResult) OK() bool {
+	return len(r.Missing) == 0 && len(r.Broken) == 0
+}
+
+// Check verifies GameDir against the parsed manifest without changing anything on disk.
+// Progress is reported through VerifiedFiles.
+func (inst *Installer) Check(ctx context.Context) (CheckResult, error) {
+	var result CheckResult
+	inst.Progress.mu.Lock()
+	// Nothing is downloaded, so progress is counted in files
+	inst.Progress.TotalChunks = 0
+	inst.Progress.TotalBytes = 0
+	inst.Progress.TotalFiles = len(inst.FileMap)
+	inst.Progress.mu.Unlock()
+	inst.Progress.MarkStarted()
+
+	verOpts := inst.Options.Verifier
+	verOpts.QueueSize = checkWindow
+	verOpts.ReturnContent = false
+	ver := verifier.NewVerifier(verOpts)
+	verCtx, cancelVer := context.WithCancel(ctx)
+	defer cancelVer()
+	ver.Start(verCtx)
+	defer func() {
+		cancelVer()
+		ver.Wait()
+		ver.Discard()
+	}()
+
+	inflight := 0
+	collect := func() error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out := <-ver.GetOutputChannel():
+			inflight--
+			fm := out.Payload.(*FileMetaData)
+			if !out.Suceeded {
+				inst.log.Warn("File failed verification", logging.KeyFile, fm.FilePath)
+				result.Broken = append(result.Broken, fm.FilePath)
+			}
+			inst.Progress.IncrementVerifiedFiles()
+			return nil
+		}
+	}
+
+	for filePath, fm := range inst.FileMap {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		result.Checked++
+		absPath := filepath.Join(inst.GameDir, filePath)
+		info, err := inst.FS.Stat(absPath)
+		switch {
+		case os.IsNotExist(err):
+			result.Missing = append(result.Missing, filePath)
+			inst.Progress.IncrementVerifiedFiles()
+			continue
+		case err != nil:
+			return result, fmt.Errorf("stat %s: %w", absPath, err)
+		case fm.IsFolder:
+			if !info.IsDir() {
+				result.Broken = append(result.Broken, filePath)
+			}
+			inst.Progress.IncrementVerifiedFiles()
+			continue
+		case info.IsDir() || info.Size() != int64(fm.Size):
+			result.Broken = append(result.Broken, filePath)
+			inst.Progress.IncrementVerifiedFiles()
+			continue
+		case inst.QuickVerify:
+			inst.Progress.IncrementVerifiedFiles()
+			continue
+		}
+
+		f, err := inst.FS.Open(absPath)
+		if err != nil {
+			return result, fmt.Errorf("opening %s: %w", absPath, err)
+		}
+		ver.EnqueueVerification(absPath, f, fm.MD5, fm)
+		inflight++
+		if inflight >= checkWindow {
+			if err := collect(); err != nil {
+				return result, err
+			}
+		}
+	}
+	for inflight > 0 {
+		if err := collect(); err != nil {
+			return result, err
+		}
+	}
+
+	sort.Strings(result.Missing)
+	sort.Strings(result.Broken)
+	return result, nil
+}
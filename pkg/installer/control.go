@@ -1,9 +1,32 @@
 package installer
 
-import "SophonClientv2/internal/logging"
+import (
+	"SophonClientv2/pkg/utils"
+	"context"
+	"errors"
+	"fmt"
+)
 
-func (inst *Installer) Start() {
-	logging.GlobalLogger.Info("Starting installation pipeline")
+var ErrInstallerStopped = errors.New("installer stopped")
+
+// ErrChunkAttemptsExhausted fails a task whose chunk could not be downloaded intact within Options.ChunkAttempts.
+var ErrChunkAttemptsExhausted = errors.New("chunk download attempts exhausted")
+
+// Start launches every stage and the goroutines connecting them.
+// Cancelling ctx (or calling Stop) aborts the pipeline, Wait then returns the cancellation cause.
+func (inst *Installer) Start(ctx context.Context) {
+	inst.log.Info("Starting installation pipeline")
+	inst.ctx, inst.cancel = context.WithCancelCause(ctx)
+	inst.Progress.MarkStarted()
+
+	inst.Downloader.Start(inst.ctx)
+	inst.Decompressor.Start(inst.ctx)
+	inst.Verifier.Start(inst.ctx)
+	inst.Assembler.Start(inst.ctx)
+	inst.Verifier2.Start(inst.ctx)
+	if inst.Options.Autotune {
+		go inst.tuner.run(inst.ctx)
+	}
 
 	inst.EnqueueChunks()
 	inst.DownloadChunks()
@@ -13,29 +36,126 @@ func (inst *Installer) Start() {
 	inst.VerifyFiles()
 	inst.MoveFiles()
 
-	logging.GlobalLogger.Info("All pipeline stages started")
+	inst.log.Info("All pipeline stages started")
 }
 
+// Stop cancels a running pipeline and waits for every goroutine to exit. It is safe to call
+// after Wait has returned or on an installer that was never started.
 func (inst *Installer) Stop() {
-	logging.GlobalLogger.Info("Stopping installation pipeline")
-	defer func() {
-		if r := recover(); r != nil {
-		}
-	}()
-	close(inst.InputQueue)
+	if inst.cancel == nil {
+		return
+	}
+	inst.log.Info("Stopping installation pipeline")
+	inst.cancel(ErrInstallerStopped)
+	_ = inst.Wait()
+	inst.log.Info("Installation pipeline stopped")
+}
 
-	inst.Downloader.Stop()
-	inst.Decompressor.Stop()
-	inst.Verifier.Stop()
-	inst.Assembler.Stop()
-	inst.Verifier2.Stop()
+// fail aborts the pipeline with err as the cause reported by Wait.
+func (inst *Installer) fail(err error) {
+	inst.log.Error("Installation failed", "error", err)
+	inst.cancel(err)
+}
 
-	inst.wg.Wait()
-	logging.GlobalLogger.Info("Installation pipeline stopped")
+// Wait blocks until the pipeline has finished. It returns nil when every file was installed,
+// or the cancellation cause when the pipeline was aborted.
+func (inst *Installer) Wait() error {
+	inst.waitOnce.Do(func() {
+		inst.waitErr = inst.wait()
+	})
+	return inst.waitErr
 }
 
-func (inst *Installer) Wait() {
-	logging.GlobalLogger.Info("Waiting for installation to complete")
+func (inst *Installer) wait() error {
+	inst.log.Info("Waiting for installation to complete")
 	inst.wg.Wait()
-	logging.GlobalLogger.Info("Installation completed successfully")
+	inst.Downloader.Wait()
+	inst.Decompressor.Wait()
+	inst.Verifier.Wait()
+	inst.Assembler.Wait()
+	inst.Verifier2.Wait()
+
+	if inst.ctx.Err() != nil {
+		if err := inst.journal.Close(); err != nil {
+			inst.log.Warn("Failed to close journal", "error", err)
+		}
+		// Release buffered chunks and close files still sitting in the queues
+		utils.DrainDiscard(inst.InputQueue)
+		inst.Downloader.Discard()
+		inst.Decompressor.Discard()
+		inst.Verifier.Discard()
+		inst.Assembler.Discard()
+		inst.Verifier2.Discard()
+		return fmt.Errorf("installation aborted: %w", context.Cause(inst.ctx))
+	}
+
+	// Everything was moved to GameDir, nothing left to resume from
+	if err := inst.journal.Remove(); err != nil {
+		inst.log.Warn("Failed to remove journal", "error", err)
+	}
+	inst.cancel(nil) // Release context resources
+	inst.log.Info("Installation completed successfully")
+	return nil
+}
+
+// finishInput tells the dispatcher that no more chunks will be needed. InputQueue itself is never
+// closed because retries may still hold pending sends to it.
+func (inst *Installer) finishInput() {
+	inst.finishInputOnce.Do(func() {
+		close(inst.inputDone)
+	})
+}
+
+// Pause stops dispatching new chunks from InputQueue. Chunks already handed to the downloader
+// run through the remaining stages, so nothing that was assembled needs to be fetched again.
+// It returns false if the installer was already paused.
+func (inst *Installer) Pause() bool {
+	inst.pauseMu.Lock()
+	defer inst.pauseMu.Unlock()
+	if inst.resumeCh != nil {
+		return false
+	}
+	inst.resumeCh = make(chan struct{})
+	inst.Progress.setPaused(true)
+	inst.log.Info("Installation paused")
+	return true
+}
+
+// Resume continues dispatching chunks. It returns false if the installer was not paused.
+func (inst *Installer) Resume() bool {
+	inst.pauseMu.Lock()
+	defer inst.pauseMu.Unlock()
+	if inst.resumeCh == nil {
+		return false
+	}
+	close(inst.resumeCh)
+	inst.resumeCh = nil
+	inst.Progress.setPaused(false)
+	inst.log.Info("Installation resumed")
+	return true
+}
+
+func (inst *Installer) IsPaused() bool {
+	inst.pauseMu.Lock()
+	defer inst.pauseMu.Unlock()
+	return inst.resumeCh != nil
+}
+
+// waitWhilePaused blocks the dispatcher while paused. It returns false if the pipeline
+// was cancelled or finished in the meantime.
+func (inst *Installer) waitWhilePaused() bool {
+	inst.pauseMu.Lock()
+	resumeCh := inst.resumeCh
+	inst.pauseMu.Unlock()
+	if resumeCh == nil {
+		return true
+	}
+	select {
+	case <-resumeCh:
+		return true
+	case <-inst.ctx.Done():
+		return false
+	case <-inst.inputDone:
+		return false
+	}
 }
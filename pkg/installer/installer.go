@@ -2,27 +2,88 @@ package installer
 
 import (
 	"SophonClientv2/internal/config"
+	"SophonClientv2/internal/logging"
 	"SophonClientv2/pkg/assembler"
 	"SophonClientv2/pkg/decompressor"
 	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/utils"
 	"SophonClientv2/pkg/verifier"
+	"net/http"
 )
 
-func NewInstaller(gameDir, stagingDir string, queueSize int) *Installer {
-	return &Installer{
+// DefaultOptions returns the installer settings of the global configuration.
+func DefaultOptions() Options {
+	return Options{
+		QueueSize:     config.Config.DownloadChanSize,
+		Downloader:    downloader.DefaultOptions(),
+		Decompressor:  decompressor.DefaultOptions(),
+		Verifier:      verifier.DefaultOptions(),
+		Assembler:     assembler.DefaultOptions(),
+		Autotune:      config.Config.Autotune,
+		ChunkAttempts: config.Config.MaxChunkAttempts,
+	}
+}
+
+func NewInstaller(gameDir, stagingDir string, opts Options) *Installer {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = config.Config.DownloadChanSize
+	}
+	if opts.ChunkAttempts == 0 {
+		opts.ChunkAttempts = config.Config.MaxChunkAttempts
+	}
+	if opts.Assembler.QueueSize <= 0 {
+		opts.Assembler.QueueSize = opts.QueueSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = logging.GlobalLogger
+	}
+	for _, l := range []**logging.Logger{&opts.Downloader.Logger, &opts.Decompressor.Logger, &opts.Verifier.Logger, &opts.Assembler.Logger} {
+		if *l == nil {
+			*l = opts.Logger
+		}
+	}
+	chunkVerifier, fileVerifier := opts.Verifier, opts.Verifier
+	chunkVerifier.ReturnContent = true
+	fileVerifier.ReturnContent = false
+	fsys := opts.Assembler.FS
+	if fsys == nil {
+		fsys = utils.OSFS{}
+	}
+
+	inst := &Installer{
 		GameDir:    gameDir,
 		StagingDir: stagingDir,
+		Options:    opts,
+		FS:         fsys,
+		log:        opts.Logger,
 
 		ChunkMap: make(map[string]*ChunkMetaData),
 		FileMap:  make(map[string]*FileMetaData),
-		Progress: InstallProgress{},
 
-		InputQueue: make(chan ChunksInput, queueSize),
+		allChunks: make(map[string]*ChunkMetaData),
+		assembled: make(map[string]map[string]bool),
+		Progress:  InstallProgress{},
 
-		Downloader:   downloader.NewDownloader(config.Config.DownloadChanSize),
-		Decompressor: decompressor.NewDecompressor(config.Config.DecompressChanSize),
-		Verifier:     verifier.NewVerifier(config.Config.VerifyChanSize, true),
-		Assembler:    assembler.NewAssembler(stagingDir, queueSize),
-		Verifier2:    verifier.NewVerifier(config.Config.VerifyChanSize, false),
+		InputQueue: make(chan ChunksInput, opts.QueueSize),
+		inputDone:  make(chan struct{}),
+
+		Downloader:   downloader.NewDownloader(opts.Downloader),
+		Decompressor: decompressor.NewDecompressor(opts.Decompressor),
+		Verifier:     verifier.NewVerifier(chunkVerifier),
+		Assembler:    assembler.NewAssembler(stagingDir, opts.Assembler),
+		Verifier2:    verifier.NewVerifier(fileVerifier),
 	}
+	inst.tuner = newTuner(inst)
+	return inst
+}
+
+// SetFS replaces the file system used by the assembler and the file move step. Call before Start.
+func (inst *Installer) SetFS(fsys utils.FS) {
+	inst.FS = fsys
+	inst.Assembler.FS = fsys
+}
+
+// SetTransport replaces the transport of the chunk downloader. Call before Start.
+func (inst *Installer) SetTransport(rt http.RoundTripper) {
+	inst.Downloader.HttpClient.Transport = rt
 }
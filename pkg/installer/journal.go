@@ -0,0 +1,189 @@
+package installer
+
+import (
+	"SophonClientv2/internal/logging"
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The journal lives in the staging directory and records every chunk instance that was
+// written to a staging file, so an interrupted install can continue where it stopped.
+//
+// It is a plain append-only text file, one record per line:
+//
+//	A <tab> file path <tab> chunkID:offset   chunk instance assembled
+//	R <tab> file path                        staging file removed or moved, forget its chunks
+//
+// Staging files are only synced once complete, so after a crash a journaled chunk may not have
+// reached the disk; Prepare checks every journaled chunk against its MD5 before trusting it.
+// A torn last line after a crash is simply ignored.
+const (
+	journalFileName = ".sophon_journal"
+	journalHeader   = "# sophon chunk journal v1"
+)
+
+type chunkJournal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func chunkInstanceKey(chunkID string, offset uint64) string {
+	return fmt.Sprintf("%s:%d", chunkID, offset)
+}
+
+func journalPath(stagingDir string) string {
+	return filepath.Join(stagingDir, journalFileName)
+}
+
+// readJournal replays the journal into file path -> set of assembled chunk instance keys.
+// A missing journal yields an empty state.
+func readJournal(path string) (map[string]map[string]bool, error) {
+	state := make(map[string]map[string]bool)
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("opening journal %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	malformed := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		switch {
+		case fields[0] == "A" && len(fields) == 3 && fields[1] != "" && strings.Contains(fields[2], ":"):
+			if state[fields[1]] == nil {
+				state[fields[1]] = make(map[string]bool)
+			}
+			state[fields[1]][fields[2]] = true
+		case fields[0] == "R" && len(fields) == 2:
+			delete(state, fields[1])
+		default:
+			malformed++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading journal %s: %w", path, err)
+	}
+	if malformed > 0 {
+		logging.GlobalLogger.Warn("Ignored malformed journal records", "path", path, "records", malformed)
+	}
+	return state, nil
+}
+
+// openJournal atomically rewrites the journal to contain exactly state and opens it for appending.
+func openJournal(path string, state map[string]map[string]bool) (*chunkJournal, error) {
+	files := make([]string, 0, len(state))
+	for filePath := range state {
+		files = append(files, filePath)
+	}
+	sort.Strings(files)
+
+	var sb strings.Builder
+	sb.WriteString(journalHeader + "\n")
+	for _, filePath := range files {
+		keys := make([]string, 0, len(state[filePath]))
+		for key := range state[filePath] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			sb.WriteString("A\t" + filePath + "\t" + key + "\n")
+		}
+	}
+
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("creating journal: %w", err)
+	}
+	if _, err := tmp.WriteString(sb.String()); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("writing journal: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("syncing journal: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("closing journal: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, fmt.Errorf("replacing journal: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal for append: %w", err)
+	}
+	return &chunkJournal{path: path, f: f}, nil
+}
+
+func (j *chunkJournal) append(line string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return
+	}
+	// Losing a record only costs a redownload, so failures are not fatal
+	if _, err := j.f.WriteString(line); err != nil {
+		logging.GlobalLogger.Warn("Failed to write journal record", "path", j.path, "error", err)
+	}
+}
+
+// recordChunk must only be called once the chunk data has been written to the staging file.
+func (j *chunkJournal) recordChunk(filePath, key string) {
+	j.append("A\t" + filePath + "\t" + key + "\n")
+}
+
+func (j *chunkJournal) resetFile(filePath string) {
+	j.append("R\t" + filePath + "\n")
+}
+
+func (j *chunkJournal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Sync()
+	if cerr := j.f.Close(); err == nil {
+		err = cerr
+	}
+	j.f = nil
+	return err
+}
+
+// Remove closes and deletes the journal once nothing is left in staging.
+func (j *chunkJournal) Remove() error {
+	if j == nil {
+		return nil
+	}
+	if err := j.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
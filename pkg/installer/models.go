@@ -1,11 +1,15 @@
 package installer
 
 import (
+	"SophonClientv2/internal/logging"
 	"SophonClientv2/pkg/assembler"
 	"SophonClientv2/pkg/decompressor"
 	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/utils"
 	"SophonClientv2/pkg/verifier"
+	"context"
 	"sync"
+	"time"
 )
 
 type ChunkDestination struct {
@@ -21,6 +25,9 @@ type ChunkMetaData struct {
 	UncompressedSize uint32
 	Destinations     []ChunkDestination
 	IsCompressed     bool
+
+	source   string // URL of the last download, a mirror is blamed if the content turns out broken
+	attempts int    // Download requests made for the chunk so far, see Options.ChunkAttempts
 }
 
 type FileMetaData struct {
@@ -28,9 +35,15 @@ type FileMetaData struct {
 	Size     int32
 	MD5      string
 	Chunks   []string
+	Offsets  []uint64 // Offset of Chunks[i] within the file
 	IsFolder bool
 }
 
+type chunkInstance struct {
+	ChunkID string
+	Offset  uint64
+}
+
 type InstallProgress struct {
 	TotalChunks int
 	TotalFiles  int
@@ -43,7 +56,28 @@ type InstallProgress struct {
 
 	TotalBytes      int64
 	DownloadedBytes int64
-	mu              sync.RWMutex
+
+	paused      bool
+	startedAt   time.Time
+	sampleAt    time.Time
+	sampleBytes int64
+	speed       float64 // Smoothed bytes per second
+	mu          sync.RWMutex
+}
+
+// Options are the settings of one installer, so concurrent tasks can run with different limits.
+// Zero fields of the stage options are taken from the global configuration.
+type Options struct {
+	QueueSize    int // Length of the chunk input queue
+	Downloader   downloader.Options
+	Decompressor decompressor.Options
+	Verifier     verifier.Options // Chunk, file and existing file hash checks
+	Assembler    assembler.Options
+	Autotune     bool // Resize the decompressor, verifier and assembler by their backlog while running
+	// Download attempts per chunk over the whole task, counting re-enqueued and corrupt downloads.
+	// The task fails once a chunk reaches it. Negative is unlimited
+	ChunkAttempts int
+	Logger        *logging.Logger // Passed on to the stages unless they set their own
 }
 
 type ChunksInput struct {
@@ -57,11 +91,24 @@ type FileOutput struct {
 type Installer struct {
 	GameDir    string
 	StagingDir string
+	Options    Options
+
+	// Compare sizes instead of MD5 hashes when checking existing files in Prepare
+	QuickVerify bool
+	// File system the pipeline stages write and move files through, set with SetFS
+	FS utils.FS
 
 	ChunkMap map[string]*ChunkMetaData
 	FileMap  map[string]*FileMetaData
 	Progress InstallProgress
 
+	// Every chunk of the manifest, including ones removed from ChunkMap by Prepare.
+	// Needed to re-download whole files that were partially recovered from staging.
+	allChunks map[string]*ChunkMetaData
+	// Assembled chunk instance keys per staging file, seeded from the journal by Prepare
+	assembled map[string]map[string]bool
+	journal   *chunkJournal
+
 	InputQueue chan ChunksInput
 
 	Downloader   *downloader.Downloader
@@ -69,6 +116,16 @@ type Installer struct {
 	Verifier     *verifier.Verifier // For chunk verification
 	Assembler    *assembler.Assembler
 	Verifier2    *verifier.Verifier // For file verification
+	tuner        *tuner
+	log          *logging.Logger
 
-	wg sync.WaitGroup
+	ctx             context.Context
+	cancel          context.CancelCauseFunc
+	inputDone       chan struct{}
+	pauseMu         sync.Mutex
+	resumeCh        chan struct{} // Non-nil while paused, closed on resume
+	finishInputOnce sync.Once
+	waitOnce        sync.Once
+	waitErr         error
+	wg              sync.WaitGroup
 }
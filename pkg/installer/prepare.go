@@ -3,46 +3,85 @@ package installer
 import (
 	"SophonClientv2/internal/logging"
 	"SophonClientv2/pkg/verifier"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
-func (inst *Installer) Prepare() error {
-	// Clear staging directory (remove previous probably failed downloads)
-	logging.GlobalLogger.Info("Clearing staging directory")
-	os.RemoveAll(inst.StagingDir) // Ignore error (Somehow fails on my machine)
-
+// Prepare removes files that are already valid in GameDir from the plan and recovers chunks
+// that a previous, interrupted run already assembled in the staging directory (see journal.go).
+func (inst *Installer) Prepare(ctx context.Context) error {
 	if err := os.MkdirAll(inst.StagingDir, 0o755); err != nil {
-		logging.GlobalLogger.Error(fmt.Sprintf("Error creating staging dir: %v", err))
+		inst.log.Error("Error creating staging dir", "path", inst.StagingDir, "error", err)
 		return fmt.Errorf("creating staging dir: %w", err)
 	}
 
+	journaled, err := readJournal(journalPath(inst.StagingDir))
+	if err != nil {
+		// Without a readable journal nothing in staging can be trusted
+		inst.log.Warn("Discarding staging directory", "path", inst.StagingDir, "error", err)
+		journaled = make(map[string]map[string]bool)
+	}
+
 	// Set up verifier and enqueue existing files
 	// Queue size should be enough to hold all files (No subscriber for output yet)
-	ver := verifier.NewVerifier(len(inst.FileMap)+10, false)
+	verOpts := inst.Options.Verifier
+	verOpts.QueueSize = len(inst.FileMap) + 10
+	verOpts.ReturnContent = false
+	ver := verifier.NewVerifier(verOpts)
+	verCtx, cancelVer := context.WithCancel(ctx)
+	defer cancelVer()
+	ver.Start(verCtx)
+	abort := func(err error) error {
+		cancelVer()
+		ver.Wait()
+		ver.Discard()
+		return err
+	}
+
 	jobs := 0
 	for filePath, fm := range inst.FileMap {
 		absPath := filepath.Join(inst.GameDir, filePath)
 		info, err := os.Stat(absPath)
 		if err != nil {
 			if os.IsNotExist(err) {
-				logging.GlobalLogger.Debug(fmt.Sprintf("File not present, will download: %s", absPath))
+				inst.log.Debug("File not present, will download", logging.KeyFile, absPath)
 				continue
 			}
-			logging.GlobalLogger.Fatal(fmt.Sprintf("Error stating file %s: %v", absPath, err))
-			return fmt.Errorf("stat existing file %s: %w", absPath, err)
+			inst.log.Error("Error stating file", logging.KeyFile, absPath, "error", err)
+			return abort(fmt.Errorf("stat existing file %s: %w", absPath, err))
 		}
 		if info.IsDir() {
-			logging.GlobalLogger.Debug(fmt.Sprintf("Skipping directory entry: %s", absPath))
+			inst.log.Debug("Skipping directory entry", logging.KeyFile, absPath)
+			continue
+		}
+
+		if inst.QuickVerify {
+			if info.Size() == int64(fm.Size) {
+				inst.log.Debug("Existing file size matches, skipping download", logging.KeyFile, absPath)
+				inst.skipExistingFile(fm)
+				delete(journaled, fm.FilePath)
+				continue
+			}
+			inst.log.Warn("File size mismatch, deleting", logging.KeyFile, absPath, "size", info.Size(), "expected_size", fm.Size)
+			if err := os.Remove(absPath); err != nil {
+				inst.log.Error("Error deleting file", logging.KeyFile, absPath, "error", err)
+				return abort(fmt.Errorf("deleting invalid file %s: %w", absPath, err))
+			}
 			continue
 		}
 
 		// MD5 hashcheck (submits to verifier)
 		f, err := os.Open(absPath)
 		if err != nil {
-			logging.GlobalLogger.Fatal(fmt.Sprintf("Error opening existing file %s: %v", absPath, err))
-			return fmt.Errorf("opening existing file %s: %w", absPath, err)
+			inst.log.Error("Error opening existing file", logging.KeyFile, absPath, "error", err)
+			return abort(fmt.Errorf("opening existing file %s: %w", absPath, err))
 		}
 		ver.EnqueueVerification(f.Name(), f, fm.MD5, fm)
 		jobs++
@@ -50,43 +89,236 @@ func (inst *Installer) Prepare() error {
 
 	// Collect verifier results
 	for i := 0; i < jobs; i++ {
-		out := <-ver.GetOutputChannel()
+		var out verifier.VerifierOutput
+		select {
+		case <-ctx.Done():
+			inst.log.Info("Prepare cancelled while verifying existing files")
+			return abort(ctx.Err())
+		case out = <-ver.GetOutputChannel():
+		}
 		fmOut := out.Payload.(*FileMetaData)
 		absPath := filepath.Join(inst.GameDir, fmOut.FilePath)
 
 		if out.Suceeded {
-			logging.GlobalLogger.Debug(fmt.Sprintf("Existing file verified, skipping download: %s", absPath))
-
-			for _, chunkID := range fmOut.Chunks {
-				if cm, ok := inst.ChunkMap[chunkID]; ok {
-					newD := make([]ChunkDestination, 0, len(cm.Destinations))
-					for _, dest := range cm.Destinations {
-						if dest.File != fmOut {
-							newD = append(newD, dest)
-						}
-					}
-					if len(newD) == 0 {
-						delete(inst.ChunkMap, chunkID)
-					} else {
-						cm.Destinations = newD
-					}
-				}
-			}
-			delete(inst.FileMap, fmOut.FilePath)
+			inst.log.Debug("Existing file verified, skipping download", logging.KeyFile, absPath)
+			inst.skipExistingFile(fmOut)
+			delete(journaled, fmOut.FilePath)
 		} else {
-			logging.GlobalLogger.Warn(fmt.Sprintf("File failed verification, deleting: %s", absPath))
+			inst.log.Warn("File failed verification, deleting", logging.KeyFile, absPath)
 			if err := os.Remove(absPath); err != nil {
-				logging.GlobalLogger.Fatal(fmt.Sprintf("Error deleting file %s: %v", absPath, err))
-				return fmt.Errorf("deleting invalid file %s: %w", absPath, err)
+				inst.log.Error("Error deleting file", logging.KeyFile, absPath, "error", err)
+				return abort(fmt.Errorf("deleting invalid file %s: %w", absPath, err))
 			}
 		}
 	}
 	ver.Stop()
+
+	if err := inst.reconcileStaging(ctx, journaled); err != nil {
+		return err
+	}
+	journal, err := openJournal(journalPath(inst.StagingDir), journaled)
+	if err != nil {
+		return fmt.Errorf("opening journal: %w", err)
+	}
+	inst.journal = journal
+
 	inst.Progress.mu.Lock()
 	inst.Progress.TotalChunks = len(inst.ChunkMap)
 	inst.Progress.TotalFiles = len(inst.FileMap)
 	inst.Progress.mu.Unlock()
 	inst.ComputeTotalBytes()
-	logging.GlobalLogger.Info(fmt.Sprintf("Prepare complete, %d chunks, %d files, total %d bytes remaining", inst.Progress.TotalChunks, len(inst.FileMap), inst.Progress.TotalBytes))
+	inst.log.Info("Prepare complete", "chunks", inst.Progress.TotalChunks, "files", len(inst.FileMap), "remaining_bytes", inst.Progress.TotalBytes)
 	return nil
 }
+
+// skipExistingFile removes a file that is already valid in GameDir from the download plan.
+func (inst *Installer) skipExistingFile(fm *FileMetaData) {
+	for _, chunkID := range fm.Chunks {
+		if cm, ok := inst.ChunkMap[chunkID]; ok {
+			newD := make([]ChunkDestination, 0, len(cm.Destinations))
+			for _, dest := range cm.Destinations {
+				if dest.File != fm {
+					newD = append(newD, dest)
+				}
+			}
+			if len(newD) == 0 {
+				delete(inst.ChunkMap, chunkID)
+			} else {
+				cm.Destinations = newD
+			}
+		}
+	}
+	delete(inst.FileMap, fm.FilePath)
+}
+
+// reconcileStaging checks the journaled chunks against the staging files and updates journaled to
+// what is actually usable. Files with every chunk present are moved to GameDir right away, chunks of
+// partial files are dropped from the plan. Other files in staging not covered by the journal are deleted.
+func (inst *Installer) reconcileStaging(ctx context.Context, journaled map[string]map[string]bool) error {
+	err := filepath.WalkDir(inst.StagingDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// Top level dot-directories belong to other tools (e.g. patch data of the updater)
+			if filepath.Dir(path) == filepath.Clean(inst.StagingDir) && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(inst.StagingDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == journalFileName || rel == journalFileName+".tmp" {
+			return nil
+		}
+		if _, ok := inst.FileMap[rel]; ok && len(journaled[rel]) > 0 {
+			return nil
+		}
+		inst.log.Debug("Removing untracked staging file", logging.KeyFile, rel)
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("removing stale staging file %s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cleaning staging dir: %w", err)
+	}
+
+	keptChunks, recoveredFiles := 0, 0
+	for filePath, keys := range journaled {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fm, ok := inst.FileMap[filePath]
+		if !ok {
+			delete(journaled, filePath)
+			continue
+		}
+
+		valid, err := inst.verifyStagedChunks(fm, keys)
+		if err != nil {
+			inst.log.Warn("Discarding staged file", logging.KeyFile, filePath, "error", err)
+			valid = nil
+		}
+		stagingPath := filepath.Join(inst.StagingDir, filePath)
+		if len(valid) == 0 {
+			delete(journaled, filePath)
+			if err := os.Remove(stagingPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("removing staging file %s: %w", stagingPath, err)
+			}
+			continue
+		}
+
+		if len(valid) == len(fm.chunkInstances()) {
+			delete(journaled, filePath)
+			if err := inst.recoverStagedFile(fm); err != nil {
+				return err
+			}
+			recoveredFiles++
+			continue
+		}
+
+		journaled[filePath] = valid
+		inst.assembled[filePath] = make(map[string]bool, len(valid))
+		for key := range valid {
+			inst.assembled[filePath][key] = true
+		}
+		inst.dropAssembledInstances(fm, valid)
+		keptChunks += len(valid)
+	}
+
+	if keptChunks > 0 || recoveredFiles > 0 {
+		inst.log.Info("Recovered from staging directory", "files", recoveredFiles, "chunks", keptChunks)
+	}
+	return nil
+}
+
+// verifyStagedChunks returns the journaled chunk instances whose data in the staging file matches the chunk MD5.
+func (inst *Installer) verifyStagedChunks(fm *FileMetaData, keys map[string]bool) (map[string]bool, error) {
+	f, err := os.Open(filepath.Join(inst.StagingDir, fm.FilePath))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	instances := fm.chunkInstances()
+	valid := make(map[string]bool, len(keys))
+	for key := range keys {
+		ci, ok := instances[key]
+		if !ok {
+			continue // Manifest changed since the chunk was written
+		}
+		cm := inst.allChunks[ci.ChunkID]
+		h := md5.New()
+		n, err := io.Copy(h, io.NewSectionReader(f, int64(ci.Offset), int64(cm.UncompressedSize)))
+		if err != nil {
+			return nil, err
+		}
+		if n == int64(cm.UncompressedSize) && strings.EqualFold(hex.EncodeToString(h.Sum(nil)), cm.MD5) {
+			valid[key] = true
+		} else {
+			inst.log.Debug("Staged chunk is corrupt, will download again", logging.KeyFile, fm.FilePath, logging.KeyChunkID, ci.ChunkID, "offset", ci.Offset)
+		}
+	}
+	return valid, nil
+}
+
+// recoverStagedFile moves a fully assembled staging file to GameDir if it passes verification.
+// Otherwise it is deleted and stays in the plan.
+func (inst *Installer) recoverStagedFile(fm *FileMetaData) error {
+	stagingPath := filepath.Join(inst.StagingDir, fm.FilePath)
+	finalPath := filepath.Join(inst.GameDir, fm.FilePath)
+
+	f, err := os.Open(stagingPath)
+	if err != nil {
+		return fmt.Errorf("opening staging file %s: %w", stagingPath, err)
+	}
+	h := md5.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("hashing staging file %s: %w", stagingPath, err)
+	}
+
+	if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), fm.MD5) {
+		inst.log.Warn("Staged file failed verification, deleting", logging.KeyFile, fm.FilePath)
+		if err := os.Remove(stagingPath); err != nil {
+			return fmt.Errorf("removing staging file %s: %w", stagingPath, err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(finalPath), 0o755); err != nil {
+		return fmt.Errorf("creating directory for %s: %w", finalPath, err)
+	}
+	if err := os.Rename(stagingPath, finalPath); err != nil {
+		return fmt.Errorf("moving recovered file %s -> %s: %w", stagingPath, finalPath, err)
+	}
+	inst.log.Debug("Recovered complete file from staging", logging.KeyFile, fm.FilePath)
+	inst.skipExistingFile(fm)
+	return nil
+}
+
+// dropAssembledInstances removes chunk destinations that are already in the staging file from the plan.
+func (inst *Installer) dropAssembledInstances(fm *FileMetaData, assembled map[string]bool) {
+	for _, chunkID := range fm.Chunks {
+		cm, ok := inst.ChunkMap[chunkID]
+		if !ok {
+			continue
+		}
+		newD := make([]ChunkDestination, 0, len(cm.Destinations))
+		for _, dest := range cm.Destinations {
+			if dest.File != fm || !assembled[chunkInstanceKey(chunkID, dest.Offset)] {
+				newD = append(newD, dest)
+			}
+		}
+		if len(newD) == 0 {
+			delete(inst.ChunkMap, chunkID)
+		} else {
+			cm.Destinations = newD
+		}
+	}
+}
@@ -2,26 +2,54 @@ package installer
 
 import (
 	"SophonClientv2/internal/logging"
+	"SophonClientv2/pkg/retry"
 	"SophonClientv2/pkg/utils"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 )
 
+func (inst *Installer) requeue(cm *ChunkMetaData) {
+	utils.EnqueueContext(inst.ctx, inst.InputQueue, ChunksInput{Metadata: cm})
+}
+
+// retryChunk re-enqueues cm after its download failed with err, or fails the task when the error is
+// permanent or the chunk has used up its attempt budget. It reports whether cm was re-enqueued.
+func (inst *Installer) retryChunk(cm *ChunkMetaData, err error) bool {
+	if retry.Classify(err) == retry.Permanent {
+		inst.fail(fmt.Errorf("chunk %s: %w", cm.ChunkID, err))
+		return false
+	}
+	if budget := inst.Options.ChunkAttempts; budget > 0 && cm.attempts >= budget {
+		inst.fail(fmt.Errorf("chunk %s: %w after %d attempts, last error: %v", cm.ChunkID, ErrChunkAttemptsExhausted, cm.attempts, err))
+		return false
+	}
+	inst.requeue(cm)
+	return true
+}
+
+// reportCorrupt counts a chunk that failed decompression or verification against its mirror.
+func (inst *Installer) reportCorrupt(cm *ChunkMetaData) {
+	if ms := inst.Downloader.Mirrors(); ms != nil && cm.source != "" {
+		ms.Corrupt(cm.source)
+	}
+}
+
 func (inst *Installer) EnqueueChunks() {
 	// Subscribe to Input channel and enqueue chunks for processing
 
 	orderedChunks := inst.EnumerateChunksWithFileOrder()
 	if len(orderedChunks) != len(inst.ChunkMap) {
-		logging.GlobalLogger.Fatal("Assertion Failed. Chunk enumeration mismatch. Something is wrong with the code.")
+		inst.fail(errors.New("assertion failed: chunk enumeration mismatch"))
 		return
 	}
 
 	if len(orderedChunks) == 0 {
-		logging.GlobalLogger.Info("No chunks to download, nothing to enqueue")
-		close(inst.InputQueue)
+		inst.log.Info("No chunks to download, nothing to enqueue")
+		inst.finishInput()
 		return
 	}
 
@@ -29,42 +57,65 @@ func (inst *Installer) EnqueueChunks() {
 	go func() {
 		defer inst.wg.Done()
 		for _, cm := range orderedChunks {
-			utils.NonBlockingEnqueue(inst.InputQueue, ChunksInput{Metadata: cm})
+			inst.requeue(cm)
 		}
-		logging.GlobalLogger.Info("All initial chunks enqueued")
+		inst.log.Info("All initial chunks enqueued")
 	}()
 }
 
 func (inst *Installer) DownloadChunks() {
-	logging.GlobalLogger.Info("Starting chunk download")
+	inst.log.Info("Starting chunk download")
 
 	inst.wg.Add(1)
 	go func() {
 		defer inst.wg.Done()
-		for input := range inst.InputQueue {
-			inst.Downloader.EnqueueDownload(input.Metadata.URL, input.Metadata)
+	loop:
+		for {
+			if !inst.waitWhilePaused() {
+				break loop
+			}
+			select {
+			case <-inst.ctx.Done():
+				inst.log.Info("Pipeline cancelled, stopping chunk dispatch")
+				break loop
+			case <-inst.inputDone:
+				inst.log.Info("All chunks processed, stopping Downloader")
+				break loop
+			case input := <-inst.InputQueue:
+				// Waiting for room in the download queue keeps the remaining chunks here, where Pause holds them
+				if !inst.Downloader.SubmitSized(input.Metadata.URL, int64(input.Metadata.CompressedSize), input.Metadata) {
+					inst.log.Info("Pipeline cancelled, stopping chunk dispatch")
+					break loop
+				}
+			}
 		}
-		logging.GlobalLogger.Info("InputQueue closed, stopping Downloader")
 		inst.Downloader.Stop()
 	}()
 }
 
 func (inst *Installer) DecompressChunks() {
-	logging.GlobalLogger.Info("Starting chunk decompression")
+	inst.log.Info("Starting chunk decompression")
 
 	inst.wg.Add(1)
 	go func() {
 		defer inst.wg.Done()
 		for downloadOutput := range inst.Downloader.GetOutputChannel() {
+			if inst.ctx.Err() != nil {
+				downloadOutput.Discard()
+				continue
+			}
 			cm := downloadOutput.Payload.(*ChunkMetaData)
 
+			cm.attempts += downloadOutput.Attempts
 			if !downloadOutput.Suceeded {
-				logging.GlobalLogger.Warn(fmt.Sprintf("Download failed for chunk %s, re-enqueueing", cm.ChunkID))
 				utils.CloseStreamSafe(downloadOutput.Content)
-				utils.NonBlockingEnqueue(inst.InputQueue, ChunksInput{Metadata: cm})
+				if inst.retryChunk(cm, downloadOutput.Err) {
+					inst.log.Warn("Download failed, re-enqueueing", logging.KeyChunkID, cm.ChunkID, "attempts", cm.attempts, "error", downloadOutput.Err)
+				}
 				continue
 			}
 
+			cm.source = downloadOutput.Source
 			if cm.IsCompressed {
 				inst.Decompressor.EnqueueDecompression(downloadOutput.Content, cm)
 
@@ -72,28 +123,35 @@ func (inst *Installer) DecompressChunks() {
 				inst.Progress.IncrementDownloadedBytes(int64(cm.CompressedSize))
 			} else {
 				// TODO: Handle uncompressed chunk (passthrough)
-				logging.GlobalLogger.Fatal("Uncompressed chunks are not yet supported")
-				return
+				downloadOutput.Discard()
+				inst.fail(errors.New("uncompressed chunks are not yet supported"))
 			}
 		}
-		logging.GlobalLogger.Info("Downloader output closed, stopping Decompressor")
+		inst.log.Info("Downloader output closed, stopping Decompressor")
 		inst.Decompressor.Stop()
 	}()
 }
 
 func (inst *Installer) VerifyChunks() {
-	logging.GlobalLogger.Info("Starting chunk verification")
+	inst.log.Info("Starting chunk verification")
 
 	inst.wg.Add(1)
 	go func() {
 		defer inst.wg.Done()
 		for decompressOutput := range inst.Decompressor.GetOutputChannel() {
+			if inst.ctx.Err() != nil {
+				decompressOutput.Discard()
+				continue
+			}
 			cm := decompressOutput.Payload.(*ChunkMetaData)
 
 			if !decompressOutput.Suceeded {
-				logging.GlobalLogger.Warn(fmt.Sprintf("Decompression failed for chunk %s, re-enqueueing", cm.ChunkID))
+				inst.log.Warn("Decompression failed, re-enqueueing", logging.KeyChunkID, cm.ChunkID, "url", cm.source)
 				utils.CloseStreamSafe(decompressOutput.Content)
-				utils.NonBlockingEnqueue(inst.InputQueue, ChunksInput{Metadata: cm})
+				inst.reportCorrupt(cm)
+				if !inst.retryChunk(cm, errors.New("decompression failed")) {
+					continue
+				}
 
 				// Adjust downloaded bytes since we are re-enqueueing
 				inst.Progress.IncrementTotalBytes(int64(cm.CompressedSize))
@@ -103,24 +161,31 @@ func (inst *Installer) VerifyChunks() {
 			inst.Verifier.EnqueueVerification(cm.ChunkID, decompressOutput.Content, cm.MD5, cm)
 			inst.Progress.IncrementDecompressedChunks()
 		}
-		logging.GlobalLogger.Info("Decompressor output closed, stopping Verifier")
+		inst.log.Info("Decompressor output closed, stopping Verifier")
 		inst.Verifier.Stop()
 	}()
 }
 
 func (inst *Installer) AssembleChunks() {
-	logging.GlobalLogger.Info("Starting chunk assembly")
+	inst.log.Info("Starting chunk assembly")
 
 	inst.wg.Add(1)
 	go func() {
 		defer inst.wg.Done()
 		for verifyOutput := range inst.Verifier.GetOutputChannel() {
+			if inst.ctx.Err() != nil {
+				verifyOutput.Discard()
+				continue
+			}
 			cm := verifyOutput.Payload.(*ChunkMetaData)
 
 			if !verifyOutput.Suceeded {
-				logging.GlobalLogger.Warn(fmt.Sprintf("Verification failed for chunk %s, re-enqueueing", cm.ChunkID))
+				inst.log.Warn("Verification failed, re-enqueueing", logging.KeyChunkID, cm.ChunkID, "url", cm.source)
 				utils.CloseStreamSafe(verifyOutput.Content)
-				utils.NonBlockingEnqueue(inst.InputQueue, ChunksInput{Metadata: cm})
+				inst.reportCorrupt(cm)
+				if !inst.retryChunk(cm, errors.New("checksum mismatch")) {
+					continue
+				}
 
 				// Adjust downloaded bytes since we are re-enqueueing
 				inst.Progress.IncrementTotalBytes(int64(cm.CompressedSize))
@@ -135,9 +200,9 @@ func (inst *Installer) AssembleChunks() {
 			utils.CloseStreamSafe(verifyOutput.Content)
 
 			if err != nil {
-				logging.GlobalLogger.Error(fmt.Sprintf("Failed to read verified content for chunk %s: %v, re-enqueueing", cm.ChunkID, err))
+				inst.log.Error("Failed to read verified content, re-enqueueing", logging.KeyChunkID, cm.ChunkID, "error", err)
 				contentBytes = nil // Content is already closed by readAll or closeStreamSafe
-				utils.NonBlockingEnqueue(inst.InputQueue, ChunksInput{Metadata: cm})
+				inst.requeue(cm)
 
 				inst.Progress.IncrementTotalBytes(int64(cm.CompressedSize))
 				continue
@@ -148,30 +213,90 @@ func (inst *Installer) AssembleChunks() {
 				inst.Assembler.EnqueueWrite(dest.File.FilePath, dest.Offset, cm.ChunkID, io.NopCloser(bytes.NewReader(contentBytes)), cm)
 			}
 		}
-		logging.GlobalLogger.Info("Verifier output closed, stopping Assembler")
+		inst.log.Info("Verifier output closed, stopping Assembler")
 		inst.Assembler.Stop()
 	}()
 }
 
+// syncFile flushes a complete staging file to disk.
+func (inst *Installer) syncFile(path string) error {
+	f, err := inst.FS.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// requeueFile re-enqueues every chunk of a single file with its destinations limited to that file.
+// The staging file must already be removed, its journal records are dropped here.
+func (inst *Installer) requeueFile(fm *FileMetaData) error {
+	inst.journal.resetFile(fm.FilePath)
+
+	byChunk := make(map[string]*ChunkMetaData)
+	for i, chunkID := range fm.Chunks {
+		if newCm, ok := byChunk[chunkID]; ok {
+			// Same chunk used at several offsets of this file
+			newCm.Destinations = append(newCm.Destinations, ChunkDestination{File: fm, Offset: fm.Offsets[i]})
+			continue
+		}
+
+		cm, ok := inst.allChunks[chunkID]
+		if !ok {
+			return fmt.Errorf("chunk %s of file %s not found in manifest", chunkID, fm.FilePath)
+		}
+		byChunk[chunkID] = &ChunkMetaData{
+			ChunkID:          cm.ChunkID,
+			URL:              cm.URL,
+			MD5:              cm.MD5,
+			CompressedSize:   cm.CompressedSize,
+			UncompressedSize: cm.UncompressedSize,
+			IsCompressed:     cm.IsCompressed,
+			Destinations: []ChunkDestination{
+				{File: fm, Offset: fm.Offsets[i]},
+			},
+		}
+	}
+
+	for _, newCm := range byChunk {
+		inst.requeue(newCm)
+
+		inst.Progress.IncrementTotalBytes(int64(newCm.CompressedSize))
+	}
+	return nil
+}
+
 func (inst *Installer) VerifyFiles() {
-	logging.GlobalLogger.Info("Starting file verification")
+	inst.log.Info("Starting file verification")
 
 	inst.wg.Add(1)
 	go func() {
 		defer inst.wg.Done()
-		// Track which chunk instances (chunkID+offset) have been assembled for each file
-		// Key: filePath, Value: map of "chunkID:offset" -> bool
-		fileAssembledChunks := make(map[string]map[string]bool)
-		// Cache expected chunk count per file to avoid recomputing
+		// Track which chunk instances (chunkID:offset) have been assembled for each file in inst.assembled
+		// Cache expected chunk instance count per file to avoid recomputing
 		fileExpectedChunks := make(map[string]int)
 
 		for assemblerOutput := range inst.Assembler.GetOutputChannel() {
+			if inst.ctx.Err() != nil {
+				continue
+			}
 			cm := assemblerOutput.Payload.(*ChunkMetaData)
 			filePath := assemblerOutput.FilePath
 
 			if !assemblerOutput.Succeeded {
-				logging.GlobalLogger.Warn(fmt.Sprintf("Assembly failed for chunk %s, re-enqueueing", cm.ChunkID))
-				utils.NonBlockingEnqueue(inst.InputQueue, ChunksInput{Metadata: cm})
+				inst.log.Warn("Assembly failed, re-enqueueing", logging.KeyChunkID, cm.ChunkID, logging.KeyFile, filePath)
+				// Only this destination failed, the others may already be complete and moved
+				again := *cm
+				again.Destinations = nil
+				for _, dest := range cm.Destinations {
+					if dest.File.FilePath == filePath && dest.Offset == assemblerOutput.Offset {
+						again.Destinations = append(again.Destinations, dest)
+					}
+				}
+				inst.requeue(&again)
 
 				// Adjust downloaded bytes since we are re-enqueueing
 				inst.Progress.IncrementTotalBytes(int64(cm.CompressedSize))
@@ -179,168 +304,102 @@ func (inst *Installer) VerifyFiles() {
 			}
 			inst.Progress.IncrementAssembledChunks()
 
-			if fileAssembledChunks[filePath] == nil {
-				fileAssembledChunks[filePath] = make(map[string]bool)
-			}
-
-			// Find the offset for this specific file to create a unique key
-			var offset uint64
-			var fileMeta *FileMetaData
-			for _, dest := range cm.Destinations {
-				if dest.File.FilePath == filePath {
-					fileMeta = dest.File
-					offset = dest.Offset
-					break
-				}
-			}
-			if fileMeta == nil {
-				logging.GlobalLogger.Fatal(fmt.Sprintf("File metadata not found for assembled file: %s", filePath))
-				return
+			fileMeta, ok := inst.FileMap[filePath]
+			if !ok {
+				inst.fail(fmt.Errorf("file metadata not found for assembled file: %s", filePath))
+				continue
 			}
 
-			// Compute expected chunk count only once per file
+			// Compute expected chunk instance count only once per file
 			if _, exists := fileExpectedChunks[filePath]; !exists {
-				chunkSet := make(map[string]bool)
-				for _, chunkID := range fileMeta.Chunks {
-					chunkSet[chunkID] = true
-				}
-				fileExpectedChunks[filePath] = len(chunkSet)
+				fileExpectedChunks[filePath] = len(fileMeta.chunkInstances())
 			}
 
 			// Create a unique key for this chunk instance (chunkID:offset)
-			chunkInstanceKey := fmt.Sprintf("%s:%d", cm.ChunkID, offset)
-			fileAssembledChunks[filePath][chunkInstanceKey] = true
+			chunkInstanceKey := chunkInstanceKey(cm.ChunkID, assemblerOutput.Offset)
+			if inst.assembled[filePath] == nil {
+				inst.assembled[filePath] = make(map[string]bool)
+			}
+			inst.assembled[filePath][chunkInstanceKey] = true
+			inst.journal.recordChunk(filePath, chunkInstanceKey)
 
 			expectedChunkInstances := fileExpectedChunks[filePath]
-			logging.GlobalLogger.Debug(fmt.Sprintf("File %s: Assembled Chunks: %d, Expected Chunk Instances: %d", filePath, len(fileAssembledChunks[filePath]), expectedChunkInstances))
-			if len(fileAssembledChunks[filePath]) == expectedChunkInstances {
+			inst.log.Debug("Chunk assembled", logging.KeyFile, filePath, "assembled", len(inst.assembled[filePath]), "expected", expectedChunkInstances)
+			if len(inst.assembled[filePath]) == expectedChunkInstances {
 				stagingPath := filepath.Join(inst.StagingDir, filePath)
-				logging.GlobalLogger.Info(fmt.Sprintf("File complete, verifying: %s", filePath))
+				inst.log.Info("File complete, verifying", logging.KeyFile, filePath)
 
-				f, err := os.Open(stagingPath)
-				if err != nil {
-					logging.GlobalLogger.Error(fmt.Sprintf("Failed to open completed file %s: %v - re-enqueueing all chunks for this file", stagingPath, err))
+				delete(inst.assembled, filePath)
+				delete(fileExpectedChunks, filePath)
 
-					delete(fileAssembledChunks, filePath)
-					delete(fileExpectedChunks, filePath)
+				// Once per file instead of per chunk, before it is verified and moved into the game
+				err := inst.syncFile(stagingPath)
+				var f utils.File
+				if err == nil {
+					f, err = inst.FS.Open(stagingPath)
+				}
+				if err != nil {
+					inst.log.Error("Failed to open completed file, re-enqueueing all chunks for this file", logging.KeyFile, filePath, "error", err)
 
-					if removeErr := os.Remove(stagingPath); removeErr != nil && !os.IsNotExist(removeErr) {
-						logging.GlobalLogger.Warn(fmt.Sprintf("Failed to remove corrupted staging file %s: %v", stagingPath, removeErr))
+					if removeErr := inst.FS.Remove(stagingPath); removeErr != nil && !os.IsNotExist(removeErr) {
+						inst.log.Warn("Failed to remove corrupted staging file", logging.KeyFile, stagingPath, "error", removeErr)
 					}
 
-					for _, chunkID := range fileMeta.Chunks {
-						chunkMeta := inst.ChunkMap[chunkID]
-
-						var offset uint64
-						var found bool
-						for _, d := range chunkMeta.Destinations {
-							if d.File == fileMeta {
-								offset = d.Offset
-								found = true
-								break
-							}
-						}
-						if !found {
-							logging.GlobalLogger.Fatal(fmt.Sprintf("Offset not found for file %s in chunk %s", fileMeta.FilePath, chunkID))
-							return
-						}
-
-						// Create new ChunkMetaData for re-enqueueing (only for this file)
-						cm_new := &ChunkMetaData{
-							ChunkID:          chunkMeta.ChunkID,
-							URL:              chunkMeta.URL,
-							MD5:              chunkMeta.MD5,
-							CompressedSize:   chunkMeta.CompressedSize,
-							UncompressedSize: chunkMeta.UncompressedSize,
-							IsCompressed:     chunkMeta.IsCompressed,
-							Destinations: []ChunkDestination{
-								{File: fileMeta, Offset: offset},
-							},
-						}
-
-						utils.NonBlockingEnqueue(inst.InputQueue, ChunksInput{Metadata: cm_new})
-
-						inst.Progress.IncrementTotalBytes(int64(chunkMeta.CompressedSize))
+					if err := inst.requeueFile(fileMeta); err != nil {
+						inst.fail(err)
 					}
 					continue
 				}
 
 				inst.Verifier2.EnqueueVerification(filePath, f, fileMeta.MD5, fileMeta)
-
-				delete(fileAssembledChunks, filePath)
-				delete(fileExpectedChunks, filePath)
 			}
 		}
-		logging.GlobalLogger.Info("Assembler output closed, stopping File Verifier")
+		inst.log.Info("Assembler output closed, stopping File Verifier")
 		inst.Verifier2.Stop()
 	}()
 }
 
 func (inst *Installer) MoveFiles() {
-	logging.GlobalLogger.Info("Starting file move to game directory")
+	inst.log.Info("Starting file move to game directory")
 
 	inst.wg.Add(1)
 	go func() {
 		defer inst.wg.Done()
 		for verifyOutput := range inst.Verifier2.GetOutputChannel() {
+			if inst.ctx.Err() != nil {
+				verifyOutput.Discard()
+				continue
+			}
 			fm := verifyOutput.Payload.(*FileMetaData)
 			stagingPath := filepath.Join(inst.StagingDir, fm.FilePath)
 			finalPath := filepath.Join(inst.GameDir, fm.FilePath)
 
 			if !verifyOutput.Suceeded {
-				logging.GlobalLogger.Error(fmt.Sprintf("File verification failed: %s - re-enqueueing all chunks", fm.FilePath))
+				inst.log.Error("File verification failed, re-enqueueing all chunks", logging.KeyFile, fm.FilePath)
 
-				if removeErr := os.Remove(stagingPath); removeErr != nil && !os.IsNotExist(removeErr) {
-					logging.GlobalLogger.Warn(fmt.Sprintf("Failed to remove corrupted staging file %s: %v", stagingPath, removeErr))
+				if removeErr := inst.FS.Remove(stagingPath); removeErr != nil && !os.IsNotExist(removeErr) {
+					inst.log.Warn("Failed to remove corrupted staging file", logging.KeyFile, stagingPath, "error", removeErr)
 				}
 
-				for _, chunkID := range fm.Chunks {
-					cm := inst.ChunkMap[chunkID]
-
-					var offset uint64
-					var offsetFound bool
-					for _, dest := range cm.Destinations {
-						if dest.File == fm {
-							offset = dest.Offset
-							offsetFound = true
-							break
-						}
-					}
-					if !offsetFound {
-						logging.GlobalLogger.Fatal(fmt.Sprintf("Offset not found for file %s in chunk %s", fm.FilePath, chunkID))
-					}
-
-					new_cm := &ChunkMetaData{
-						ChunkID:          cm.ChunkID,
-						URL:              cm.URL,
-						MD5:              cm.MD5,
-						CompressedSize:   cm.CompressedSize,
-						UncompressedSize: cm.UncompressedSize,
-						IsCompressed:     cm.IsCompressed,
-						Destinations: []ChunkDestination{
-							{File: fm, Offset: offset},
-						},
-					}
-
-					utils.NonBlockingEnqueue(inst.InputQueue, ChunksInput{Metadata: new_cm})
-
-					inst.Progress.IncrementTotalBytes(int64(cm.CompressedSize))
+				if err := inst.requeueFile(fm); err != nil {
+					inst.fail(err)
 				}
 				continue
 			}
-			logging.GlobalLogger.Info(fmt.Sprintf("File verified successfully: %s", fm.FilePath))
+			inst.log.Info("File verified successfully", logging.KeyFile, fm.FilePath)
 
 			finalDir := filepath.Dir(finalPath)
-			if err := os.MkdirAll(finalDir, 0o755); err != nil {
-				logging.GlobalLogger.Fatal(fmt.Sprintf("Failed to create directory for final file location: %s : %v", finalDir, err))
-				return
+			if err := inst.FS.MkdirAll(finalDir, 0o755); err != nil {
+				inst.fail(fmt.Errorf("creating directory for final file location %s: %w", finalDir, err))
+				continue
 			}
 
-			err := os.Rename(stagingPath, finalPath)
+			err := inst.FS.Rename(stagingPath, finalPath)
 			if err != nil {
-				logging.GlobalLogger.Fatal(fmt.Sprintf("Failed to move file from staging to final location: %s -> %s : %v", stagingPath, finalPath, err))
-				return
+				inst.fail(fmt.Errorf("moving file from staging to final location %s -> %s: %w", stagingPath, finalPath, err))
+				continue
 			}
+			inst.journal.resetFile(fm.FilePath)
 
 			inst.Progress.IncrementVerifiedFiles()
 			inst.Progress.mu.Lock()
@@ -349,10 +408,10 @@ func (inst *Installer) MoveFiles() {
 			inst.Progress.mu.Unlock()
 
 			if verifiedFiles >= totalFiles {
-				logging.GlobalLogger.Info("All files verified and moved, closing InputQueue to shut down pipeline")
-				close(inst.InputQueue)
+				inst.log.Info("All files verified and moved, shutting down pipeline")
+				inst.finishInput()
 			}
 		}
-		logging.GlobalLogger.Info("File Verifier output closed, file move complete")
+		inst.log.Info("File Verifier output closed, file move complete")
 	}()
 }
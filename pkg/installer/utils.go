@@ -1,16 +1,18 @@
 package installer
 
 import (
-	"SophonClientv2/internal/logging"
 	"SophonClientv2/internal/models"
-	"fmt"
+	"SophonClientv2/pkg/downloader"
 	"sort"
+	"time"
 )
 
 func (inst *Installer) ParseManifest(mani *models.Manifest, chunkDownload models.SophonChunkDownloadInfo) error {
-	logging.GlobalLogger.Debug("Resetting installer state before parsing manifest")
+	inst.log.Debug("Resetting installer state before parsing manifest")
 	inst.ChunkMap = make(map[string]*ChunkMetaData)
 	inst.FileMap = make(map[string]*FileMetaData)
+	inst.allChunks = make(map[string]*ChunkMetaData)
+	inst.assembled = make(map[string]map[string]bool)
 	inst.Progress = InstallProgress{}
 
 	for _, fi := range mani.GetFiles() {
@@ -21,12 +23,14 @@ func (inst *Installer) ParseManifest(mani *models.Manifest, chunkDownload models
 			Size:     fi.GetSize(),
 			MD5:      fi.GetMd5(),
 			Chunks:   make([]string, len(fi.GetChunks())),
+			Offsets:  make([]uint64, len(fi.GetChunks())),
 			IsFolder: isFolder,
 		}
 
 		for i, ci := range fi.GetChunks() {
 			chunkID := ci.GetChunkId()
 			fm.Chunks[i] = chunkID
+			fm.Offsets[i] = ci.GetOffset()
 
 			if _, ok := inst.ChunkMap[chunkID]; !ok {
 				url := chunkDownload.UrlPrefix + "/" + chunkID
@@ -52,22 +56,35 @@ func (inst *Installer) ParseManifest(mani *models.Manifest, chunkDownload models
 		}
 		inst.FileMap[filePath] = fm
 	}
+	inst.Downloader.SetMirrors(downloader.NewMirrors(downloader.MirrorPrefixes(chunkDownload.UrlPrefix, inst.Options.Downloader.Mirrors)...))
+	for chunkID, cm := range inst.ChunkMap {
+		inst.allChunks[chunkID] = cm
+	}
 	inst.Progress.mu.Lock()
 	inst.Progress.TotalChunks = len(inst.ChunkMap)
 	inst.Progress.mu.Unlock()
 	inst.ComputeTotalBytes()
-	logging.GlobalLogger.Info(fmt.Sprintf("Parsed manifest: %d chunks for %d files, total %d bytes", inst.Progress.TotalChunks, len(inst.FileMap), inst.Progress.TotalBytes))
+	inst.log.Info("Parsed manifest", "chunks", inst.Progress.TotalChunks, "files", len(inst.FileMap), "total_bytes", inst.Progress.TotalBytes)
 
 	var totalChunksInManifest int
 	for _, f := range mani.GetFiles() {
 		totalChunksInManifest += len(f.GetChunks())
 	}
-	logging.GlobalLogger.Debug(fmt.Sprintf("Total chunks in manifest before deduplication: %d", totalChunksInManifest))
+	inst.log.Debug("Counted chunks in manifest before deduplication", "chunks", totalChunksInManifest)
 	return nil
 }
 
+// chunkInstances returns the distinct chunk instances of the file keyed by chunkInstanceKey.
+func (fm *FileMetaData) chunkInstances() map[string]chunkInstance {
+	instances := make(map[string]chunkInstance, len(fm.Chunks))
+	for i, chunkID := range fm.Chunks {
+		instances[chunkInstanceKey(chunkID, fm.Offsets[i])] = chunkInstance{ChunkID: chunkID, Offset: fm.Offsets[i]}
+	}
+	return instances
+}
+
 func (inst *Installer) ComputeTotalBytes() {
-	logging.GlobalLogger.Debug("Recomputing total bytes from ChunkMap")
+	inst.log.Debug("Recomputing total bytes from ChunkMap")
 	var total int64
 	for _, chunk := range inst.ChunkMap {
 		// Download size is compressed size
@@ -76,7 +93,7 @@ func (inst *Installer) ComputeTotalBytes() {
 	inst.Progress.mu.Lock()
 	inst.Progress.TotalBytes = total
 	inst.Progress.mu.Unlock()
-	logging.GlobalLogger.Debug(fmt.Sprintf("Total bytes to download: %d", total))
+	inst.log.Debug("Computed bytes to download", "total_bytes", total)
 }
 
 func (inst *Installer) EnumerateChunksWithFileOrder() []*ChunkMetaData {
@@ -134,7 +151,7 @@ func (inst *Installer) EnumerateChunksWithFileOrder() []*ChunkMetaData {
 		}
 	}
 
-	logging.GlobalLogger.Info(fmt.Sprintf("Enumerated %d chunks in priority order from %d files", len(chunkList), len(fileList)))
+	inst.log.Info("Enumerated chunks in priority order", "chunks", len(chunkList), "files", len(fileList))
 	return chunkList
 }
 
@@ -174,6 +191,12 @@ func (p *InstallProgress) IncrementTotalBytes(n int64) {
 	p.mu.Unlock()
 }
 
+func (p *InstallProgress) IncrementTotalFiles(n int) {
+	p.mu.Lock()
+	p.TotalFiles += n
+	p.mu.Unlock()
+}
+
 func (p *InstallProgress) IncrementDecompressedChunks() {
 	p.mu.Lock()
 	p.DecompressedChunks++
@@ -197,3 +220,67 @@ func (p *InstallProgress) IncrementVerifiedFiles() {
 	p.VerifiedFiles++
 	p.mu.Unlock()
 }
+
+func (p *InstallProgress) setPaused(paused bool) {
+	p.mu.Lock()
+	p.paused = paused
+	p.mu.Unlock()
+}
+
+func (p *InstallProgress) MarkStarted() {
+	p.mu.Lock()
+	if p.startedAt.IsZero() {
+		p.startedAt = time.Now()
+		p.sampleAt = p.startedAt
+		p.sampleBytes = p.DownloadedBytes
+	}
+	p.mu.Unlock()
+}
+
+// Snapshot returns a copy of the counters with speed and ETA derived from download bytes.
+// The speed estimate is refreshed at most once per second regardless of how often it is called.
+func (p *InstallProgress) Snapshot() models.TaskProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if !p.startedAt.IsZero() {
+		if elapsed := now.Sub(p.sampleAt).Seconds(); elapsed >= 1 {
+			current := float64(p.DownloadedBytes-p.sampleBytes) / elapsed
+			if p.speed == 0 {
+				p.speed = current
+			} else {
+				p.speed = 0.7*p.speed + 0.3*current
+			}
+			p.sampleAt = now
+			p.sampleBytes = p.DownloadedBytes
+		}
+	}
+
+	snap := models.TaskProgress{
+		TotalChunks:        p.TotalChunks,
+		TotalFiles:         p.TotalFiles,
+		DownloadedChunks:   p.DownloadedChunks,
+		DecompressedChunks: p.DecompressedChunks,
+		VerifiedChunks:     p.VerifiedChunks,
+		AssembledChunks:    p.AssembledChunks,
+		VerifiedFiles:      p.VerifiedFiles,
+		TotalBytes:         p.TotalBytes,
+		DownloadedBytes:    p.DownloadedBytes,
+		SpeedBytesPerSec:   p.speed,
+		Paused:             p.paused,
+	}
+	if p.TotalBytes > 0 {
+		snap.Percent = min(100, float64(p.DownloadedBytes)/float64(p.TotalBytes)*100)
+	} else if p.TotalFiles > 0 {
+		snap.Percent = min(100, float64(p.VerifiedFiles)/float64(p.TotalFiles)*100)
+	}
+	if !p.startedAt.IsZero() {
+		snap.ElapsedSeconds = now.Sub(p.startedAt).Seconds()
+	}
+	if p.speed > 0 && !p.paused {
+		eta := float64(max(0, p.TotalBytes-p.DownloadedBytes)) / p.speed
+		snap.ETASeconds = &eta
+	}
+	return snap
+}
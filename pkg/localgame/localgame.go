@@ -0,0 +1,135 @@
+// Package localgame inspects an installed game directory.
+package localgame
+
+import (
+	"SophonClientv2/internal/logging"
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ConfigFileName is the launcher config in the game directory, its [general] section carries game_version.
+const ConfigFileName = "config.ini"
+
+var (
+	ErrNotInstalled   = errors.New("no installed game found")
+	ErrVersionUnknown = errors.New("game files found but the installed version is unknown")
+)
+
+var versionPattern = regexp.MustCompile(`\d+\.\d+\.\d+`)
+
+// Version files the games ship themselves, used when config.ini is missing (e.g. installs copied
+// from another launcher). Paths are globbed relative to the game directory.
+var versionFiles = map[string][]string{
+	"hk4e":  {"*_Data/Persistent/ScriptVersion"},
+	"hkrpg": {"StarRail_Data/StreamingAssets/BinaryVersion.bytes"},
+	"nap":   {"ZenlessZoneZero_Data/StreamingAssets/BinaryVersion.bytes"},
+	"bh3":   {"BH3_Data/StreamingAssets/BinaryVersion.bytes"},
+}
+
+// DetectVersion returns the installed version of the game in gameDir and the file it was read from.
+func DetectVersion(gameDir, gameType string) (version string, source string, err error) {
+	configPath := filepath.Join(gameDir, ConfigFileName)
+	version, err = readConfigVersion(configPath)
+	if err == nil && version != "" {
+		return version, configPath, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logging.GlobalLogger.Warn(fmt.Sprintf("Failed to read %s: %v", configPath, err))
+	}
+
+	for _, pattern := range versionFiles[strings.ToLower(gameType)] {
+		matches, _ := filepath.Glob(filepath.Join(gameDir, pattern))
+		for _, path := range matches {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			if v := versionPattern.Find(data); v != nil {
+				return string(v), path, nil
+			}
+		}
+	}
+	// pkg_version lists the game files but carries no version
+	if _, err := os.Stat(filepath.Join(gameDir, "pkg_version")); err == nil {
+		return "", "", ErrVersionUnknown
+	}
+	return "", "", ErrNotInstalled
+}
+
+func readConfigVersion(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if ok && section == "general" && strings.TrimSpace(key) == "game_version" {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// WriteVersion records version as game_version in config.ini, keeping every other entry.
+func WriteVersion(gameDir, version string) error {
+	path := filepath.Join(gameDir, ConfigFileName)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	newline := "\n"
+	if strings.Contains(string(data), "\r\n") {
+		newline = "\r\n" // Keep the line endings the launcher wrote
+	}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n"), "\n")
+	}
+
+	section, generalAt, written := "", -1, false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.ToLower(strings.TrimSpace(trimmed[1 : len(trimmed)-1]))
+			if section == "general" {
+				generalAt = i
+			}
+			continue
+		}
+		if key, _, ok := strings.Cut(trimmed, "="); ok && section == "general" && strings.TrimSpace(key) == "game_version" {
+			lines[i] = "game_version=" + version
+			written = true
+		}
+	}
+	if !written {
+		if generalAt < 0 {
+			lines = append([]string{"[general]", "game_version=" + version}, lines...)
+		} else {
+			lines = append(lines[:generalAt+1], append([]string{"game_version=" + version}, lines[generalAt+1:]...)...)
+		}
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(lines, newline)+newline), 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("replacing %s: %w", path, err)
+	}
+	return nil
+}
@@ -4,30 +4,74 @@ import (
 	"SophonClientv2/internal/config"
 	"SophonClientv2/internal/logging"
 	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/hypAPI"
+	"SophonClientv2/pkg/retry"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"hash"
 	"io"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
 	"google.golang.org/protobuf/proto"
 )
 
-func GetManifest(sophonBuildAPIManifest models.SophonManifest) *models.Manifest {
+var ErrEncryptedManifest = errors.New("encrypted manifests are not supported")
+
+// GetManifest downloads the manifest of a getBuild entry. A nil client uses hypAPI.DefaultClient.
+func GetManifest(ctx context.Context, client *hypAPI.Client, sophonBuildAPIManifest models.SophonManifest) (*models.Manifest, error) {
+	data, err := fetchManifestData(ctx, client, sophonBuildAPIManifest.ManifestDownload, sophonBuildAPIManifest.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest models.Manifest
+	if err := proto.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+	data = nil
+
+	logging.GlobalLogger.Info("Manifest decoded successfully")
+	return &manifest, nil
+}
+
+// GetDiffManifest fetches the ldiff manifest of a getPatchBuild entry. It is served like a regular manifest.
+func GetDiffManifest(ctx context.Context, client *hypAPI.Client, sophonPatchAPIManifest models.SophonPatchManifest) (*models.DiffManifest, error) {
+	data, err := fetchManifestData(ctx, client, sophonPatchAPIManifest.ManifestDownload, sophonPatchAPIManifest.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest models.DiffManifest
+	if err := proto.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("decoding diff manifest: %w", err)
+	}
+	data = nil
+
+	logging.GlobalLogger.Info("Diff manifest decoded successfully")
+	return &manifest, nil
+}
+
+// fetchManifestData downloads, decompresses and checks a manifest, returning the raw protobuf bytes.
+func fetchManifestData(ctx context.Context, client *hypAPI.Client, download models.SophonManifestDownloadInfo, info models.SophonManifestInfo) ([]byte, error) {
+	if client == nil {
+		client = hypAPI.DefaultClient
+	}
 	var url string
-	urlPrefix := sophonBuildAPIManifest.ManifestDownload.UrlPrefix
-	urlSuffix := sophonBuildAPIManifest.ManifestDownload.UrlSuffix
-	manifestID := sophonBuildAPIManifest.Manifest.ID
-	manifestChecksum := sophonBuildAPIManifest.Manifest.Checksum
+	urlPrefix := download.UrlPrefix
+	urlSuffix := download.UrlSuffix
+	manifestID := info.ID
+	manifestChecksum := info.Checksum
 
-	isCompressed := sophonBuildAPIManifest.ManifestDownload.Compression != 0
-	isEncrypted := sophonBuildAPIManifest.ManifestDownload.Encryption != 0
+	isCompressed := download.Compression != 0
+	isEncrypted := download.Encryption != 0
 
 	if isEncrypted {
-		logging.GlobalLogger.Fatal("Encrypted manifests are not supported")
+		return nil, ErrEncryptedManifest
 	}
 
 	if urlSuffix != "" {
@@ -36,70 +80,70 @@ func GetManifest(sophonBuildAPIManifest models.SophonManifest) *models.Manifest
 		url = urlPrefix + "/" + manifestID
 	}
 
-	// Retry only on MD5 hash mismatch or network errors
-	maxRetries := config.Config.MaxManifestDownloadRetries
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		// HTTP GET
-		resp, err := http.Get(url)
-		if err != nil {
-			if attempt < maxRetries {
-				logging.GlobalLogger.Warn("Failed to fetch manifest, retrying... (attempt " + strconv.Itoa(attempt) + ")")
-				time.Sleep(time.Duration(attempt) * time.Second)
-				continue
-			}
-			logging.GlobalLogger.Fatal("Failed to fetch manifest: " + err.Error())
-		}
-		defer resp.Body.Close()
-		logging.GlobalLogger.Info("Fetched manifest successfully with status: " + resp.Status)
-
-		// Setup reader chain: optional decompression
-		var reader io.Reader = resp.Body
-		if isCompressed {
-			dec, err := zstd.NewReader(resp.Body)
-			if err != nil {
-				logging.GlobalLogger.Fatal("Failed to create zstd streaming reader: " + err.Error())
-			}
-			defer dec.Close()
-			reader = dec
-		}
+	// Retry only on MD5 hash mismatch, network errors and temporary statuses
+	policy := retry.FromConfig(config.Config.MaxManifestDownloadRetries)
+	var data []byte
+	err := policy.Do(ctx, func(int) error {
+		var err error
+		data, err = fetchManifestOnce(ctx, client, url, isCompressed, manifestChecksum)
+		return err
+	}, func(attempt int, err error, delay time.Duration) {
+		logging.GlobalLogger.Warn(fmt.Sprintf("%v, retrying in %s (attempt %d/%d)", err, delay.Round(time.Millisecond), attempt, policy.MaxAttempts))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching manifest %s: %w", manifestID, err)
+	}
+	return data, nil
+}
 
-		// Stream through MD5 hash computation if checksum validation is needed
-		var hashWriter hash.Hash
-		if manifestChecksum != "" {
-			hashWriter = md5.New()
-			reader = io.TeeReader(reader, hashWriter)
-		}
+// fetchManifestOnce makes a single download attempt. Failures retrying cannot fix are marked permanent.
+func fetchManifestOnce(ctx context.Context, client *hypAPI.Client, url string, isCompressed bool, manifestChecksum string) ([]byte, error) {
+	// HTTP GET
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, retry.MarkPermanent(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, retry.NewStatusError(resp)
+	}
+	logging.GlobalLogger.Info("Fetched manifest successfully with status: " + resp.Status)
 
-		// Read data once (streaming through decompression and hash)
-		data, err := io.ReadAll(reader)
+	// Setup reader chain: optional decompression
+	var reader io.Reader = resp.Body
+	if isCompressed {
+		dec, err := zstd.NewReader(resp.Body)
 		if err != nil {
-			logging.GlobalLogger.Fatal("Failed to read manifest: " + err.Error())
+			return nil, retry.MarkPermanent(fmt.Errorf("creating zstd streaming reader: %w", err))
 		}
+		defer dec.Close()
+		reader = dec
+	}
 
-		// Validate MD5 hash if required
-		if manifestChecksum != "" {
-			computedHash := hex.EncodeToString(hashWriter.Sum(nil))
-			if computedHash != manifestChecksum {
-				if attempt < maxRetries {
-					logging.GlobalLogger.Warn("Manifest hash mismatch, retrying... (attempt " + strconv.Itoa(attempt) + ")")
-					time.Sleep(time.Duration(attempt) * time.Second)
-					continue
-				}
-				logging.GlobalLogger.Fatal("Manifest hash mismatch after retries")
-			}
-		}
+	// Stream through MD5 hash computation if checksum validation is needed
+	var hashWriter hash.Hash
+	if manifestChecksum != "" {
+		hashWriter = md5.New()
+		reader = io.TeeReader(reader, hashWriter)
+	}
 
-		var manifest models.Manifest
-		err = proto.Unmarshal(data, &manifest)
-		if err != nil {
-			logging.GlobalLogger.Fatal("Failed to decode manifest: " + err.Error())
-		}
-		data = nil
+	// Read data once (streaming through decompression and hash)
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
 
-		logging.GlobalLogger.Info("Manifest decoded successfully")
-		return &manifest
+	// Validate MD5 hash if required
+	if manifestChecksum != "" {
+		computedHash := hex.EncodeToString(hashWriter.Sum(nil))
+		if computedHash != manifestChecksum {
+			return nil, errors.New("manifest hash mismatch")
+		}
 	}
 
-	logging.GlobalLogger.Fatal("Failed to fetch manifest after retries")
-	return nil
+	return data, nil
 }
@@ -0,0 +1,78 @@
+package operations
+
+import (
+	"SophonClientv2/internal/models"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Task lifecycle events published to subscribers
+const (
+	EventCreated   = "created"
+	EventStarted   = "started"
+	EventPaused    = "paused"
+	EventResumed   = "resumed"
+	EventFailed    = "failed"
+	EventCompleted = "completed"
+	EventCancelled = "cancelled"
+)
+
+type EventSubscription struct {
+	C       chan models.TaskEvent // Closed by Close, or by the bus once an event did not fit
+	dropped atomic.Int64
+}
+
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[*EventSubscription]struct{}
+}
+
+var events = &eventBus{subs: make(map[*EventSubscription]struct{})}
+
+// SubscribeEvents registers a listener for all task lifecycle events.
+// Publishing never blocks: a subscriber whose buffer is full loses the event and is unsubscribed,
+// C is then closed with Dropped above 0, so lifecycle events are never lost unnoticed.
+func SubscribeEvents(buffSize int) *EventSubscription {
+	sub := &EventSubscription{C: make(chan models.TaskEvent, buffSize)}
+	events.mu.Lock()
+	events.subs[sub] = struct{}{}
+	events.mu.Unlock()
+	return sub
+}
+
+func (s *EventSubscription) Close() {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	s.closeLocked()
+}
+
+func (s *EventSubscription) closeLocked() {
+	if _, ok := events.subs[s]; !ok {
+		return
+	}
+	delete(events.subs, s)
+	close(s.C)
+}
+
+// Dropped returns how many events could not be delivered because the subscriber was too slow.
+// It is at most 1, the subscription is closed after the first lost event.
+func (s *EventSubscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+func publishEvent(ev models.TaskEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	for sub := range events.subs {
+		select {
+		case sub.C <- ev:
+		default:
+			sub.dropped.Add(1)
+			sub.closeLocked()
+		}
+	}
+}
@@ -1,8 +1,115 @@
 package operations
 
-import "SophonClientv2/internal/models"
+import (
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/hypAPI"
+	"SophonClientv2/pkg/localgame"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
 
-func GetOnlineGameInfo(request models.GameOperationRequest) models.OnlineGameInfo {
-	// TODO: Implement GetOnlineGameInfo
-	return models.OnlineGameInfo{}
+// GetOnlineGameInfo reports the latest version of a game, its install size and the versions that
+// can be updated with a diff. Failures are reported in the Error field.
+func GetOnlineGameInfo(ctx context.Context, gameType string, relType string) models.OnlineGameInfo {
+	info := models.OnlineGameInfo{GameType: gameType, ReleaseType: relType}
+	fail := func(err error) models.OnlineGameInfo {
+		msg := err.Error()
+		info.Error = &msg
+		return info
+	}
+
+	game, err := findGame(ctx, gameType, relType)
+	if err != nil {
+		return fail(err)
+	}
+	info.Version = game.Main.Tag
+	info.UpdatableVersions = append([]string{}, game.Main.DiffTags...)
+	if game.PreDownload != nil && game.PreDownload.Tag != "" {
+		info.PreDownload = true
+		tag := game.PreDownload.Tag
+		info.PreDownloadVersion = &tag
+	}
+
+	build, err := hypAPI.DefaultClient.GetSophonBuildByBranch(ctx, relType, game.Main)
+	if err != nil {
+		return fail(fmt.Errorf("fetching Sophon build: %w", err))
+	}
+
+	for _, mani := range build.Data.Manifests {
+		if mani.MatchingField != "game" {
+			continue
+		}
+		info.InstallSize = mani.Stats.UncompressedSize
+		// Chunks shared between files are only downloaded once
+		info.DownloadSize = mani.DeduplicatedStats.CompressedSize
+		if info.DownloadSize == 0 {
+			info.DownloadSize = mani.Stats.CompressedSize
+		}
+		return info
+	}
+	return fail(fmt.Errorf("build %s has no game manifest", build.Data.Tag))
+}
+
+// Actions suggested by GetLocalGameInfo
+const (
+	ActionUpToDate  = "up_to_date"
+	ActionUpdate    = "update"    // Diff update from the installed version
+	ActionReinstall = "reinstall" // No diff available, download everything that changed
+	ActionInstall   = "install"   // Nothing installed yet
+)
+
+// GetLocalGameInfo detects the version installed in gameDir and decides how it can be brought up to date.
+func GetLocalGameInfo(ctx context.Context, gameDir string, gameType string, relType string) models.LocalGameInfo {
+	info := models.LocalGameInfo{GameType: gameType, GameDir: gameDir, ReleaseType: relType}
+	fail := func(err error) models.LocalGameInfo {
+		msg := err.Error()
+		info.Error = &msg
+		return info
+	}
+
+	game, err := findGame(ctx, gameType, relType)
+	if err != nil {
+		return fail(err)
+	}
+	info.LatestVersion = game.Main.Tag
+
+	version, source, err := localgame.DetectVersion(gameDir, gameType)
+	switch {
+	case errors.Is(err, localgame.ErrNotInstalled):
+		info.Action = ActionInstall
+		return info
+	case errors.Is(err, localgame.ErrVersionUnknown):
+		info.Installed = true
+		info.Action = ActionReinstall
+		return info
+	case err != nil:
+		return fail(err)
+	}
+	info.Installed = true
+	info.InstalledVersion = version
+	info.VersionSource = source
+	info.Action = updateAction(version, game.Main)
+
+	// A predownload patches from the current main version (or the versions it lists as diff sources)
+	if pre := game.PreDownload; pre != nil && pre.Tag != "" && pre.Tag != version {
+		if version == game.Main.Tag || slices.Contains(pre.DiffTags, version) {
+			info.PreDownload = true
+			tag := pre.Tag
+			info.PreDownloadVersion = &tag
+		}
+	}
+	return info
+}
+
+func updateAction(installed string, main models.HYPGameBranch) string {
+	switch {
+	case installed == main.Tag:
+		return ActionUpToDate
+	case slices.Contains(main.DiffTags, installed):
+		return ActionUpdate
+	default:
+		return ActionReinstall
+	}
 }
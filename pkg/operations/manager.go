@@ -0,0 +1,292 @@
+package operations
+
+import (
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/installer"
+	"SophonClientv2/pkg/localgame"
+	"SophonClientv2/pkg/updater"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+)
+
+// startTask runs a registered task in the background and records the outcome in the registry.
+func startTask(rec *taskRecord) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	registry.mu.Lock()
+	rec.cancel = cancel
+	done := make(chan struct{})
+	rec.done = done
+	taskID, taskType, request := rec.TaskID, rec.TaskType, rec.Request
+	registry.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		defer cancel()
+		log := taskLogger(taskID).With("task_type", taskType)
+		if path := logging.DefaultTaskLogPath(taskID); path != "" {
+			if err := logging.OpenTaskLog(taskID, path); err != nil {
+				log.Warn("Failed to open task log", "error", err)
+			} else {
+				defer logging.CloseTaskLog(taskID)
+			}
+		}
+		registry.setStatus(taskID, StatusRunning, EventStarted, nil)
+		log.Info("Task started")
+
+		err := executeTask(ctx, taskID, taskType, request)
+		switch {
+		case ctx.Err() != nil:
+			log.Info("Task cancelled")
+			registry.setStatus(taskID, StatusCancelled, EventCancelled, nil)
+		case err != nil:
+			log.Error("Task failed", "error", err)
+			registry.setStatus(taskID, StatusFailed, EventFailed, err)
+		default:
+			log.Info("Task completed")
+			registry.setStatus(taskID, StatusCompleted, EventCompleted, nil)
+		}
+	}()
+}
+
+// taskLogger tags records with the task ID, which also routes them to the task's log file and subscribers.
+func taskLogger(taskID string) *logging.Logger {
+	return logging.GlobalLogger.With(logging.KeyTaskID, taskID)
+}
+
+func executeTask(ctx context.Context, taskID, taskType string, request json.RawMessage) error {
+	switch taskType {
+	case "install":
+		var req models.InstallRequest
+		if err := json.Unmarshal(request, &req); err != nil {
+			return fmt.Errorf("decoding install request: %w", err)
+		}
+		return runInstallPipeline(ctx, taskID, req.GameOperationRequest, req.InstallRelType, false)
+	case "repair":
+		var req models.RepairRequest
+		if err := json.Unmarshal(request, &req); err != nil {
+			return fmt.Errorf("decoding repair request: %w", err)
+		}
+		return runInstallPipeline(ctx, taskID, req.GameOperationRequest, req.RepairRelType, req.RepairMode == "quick")
+	case "update":
+		var req models.UpdateRequest
+		if err := json.Unmarshal(request, &req); err != nil {
+			return fmt.Errorf("decoding update request: %w", err)
+		}
+		return runUpdatePipeline(ctx, taskID, req)
+	default:
+		return fmt.Errorf("unknown task type: %s", taskType)
+	}
+}
+
+// installerOptions applies the per-task limits of req to the configured installer settings.
+func installerOptions(req models.GameOperationRequest, log *logging.Logger) installer.Options {
+	opts := installer.DefaultOptions()
+	opts.Logger = log
+	if req.Downloads > 0 {
+		opts.Downloader.Workers = req.Downloads
+	}
+	if req.Decompressions > 0 {
+		opts.Decompressor.Workers = req.Decompressions
+	}
+	if req.Hashchecks > 0 {
+		opts.Verifier.Workers = req.Hashchecks
+	}
+	opts.Downloader.RateLimit = int64(req.RateLimit) << 10
+	opts.Downloader.Mirrors = append(opts.Downloader.Mirrors, req.Mirrors...)
+	return opts
+}
+
+func updaterOptions(req models.GameOperationRequest, log *logging.Logger) updater.Options {
+	opts := updater.DefaultOptions()
+	opts.Logger = log
+	if req.Downloads > 0 {
+		opts.Downloads = req.Downloads
+	}
+	if req.Hashchecks > 0 {
+		opts.Hashchecks = req.Hashchecks
+	}
+	opts.RateLimit = int64(req.RateLimit) << 10
+	return opts
+}
+
+func stagingDirFor(req models.GameOperationRequest) string {
+	if req.TempDir != "" {
+		return req.TempDir
+	}
+	return filepath.Join(req.GameDir, ".sophon_staging")
+}
+
+// runInstallPipeline downloads every file of the main game manifest that is missing or broken in GameDir.
+// Install and repair share it, repair differs only in how existing files are checked.
+func runInstallPipeline(ctx context.Context, taskID string, req models.GameOperationRequest, relType string, quickVerify bool) error {
+	targetBranch, err := selectGameBranch(ctx, req.GameType, relType, "main")
+	if err != nil {
+		return err
+	}
+	mani, info, err := GetManifest(ctx, req.GameType, relType, "game", "main")
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := installManifest(ctx, taskID, req, mani, info, quickVerify); err != nil {
+		return err
+	}
+	recordInstalledVersion(req.GameDir, targetBranch.Tag)
+	return nil
+}
+
+// recordInstalledVersion updates config.ini so later updates know what is installed.
+func recordInstalledVersion(gameDir string, version string) {
+	if version == "" {
+		return
+	}
+	if err := localgame.WriteVersion(gameDir, version); err != nil {
+		logging.GlobalLogger.Warn("Failed to record installed version: " + err.Error())
+	}
+}
+
+func installManifest(ctx context.Context, taskID string, req models.GameOperationRequest, mani *models.Manifest, info *models.SophonManifest, quickVerify bool) error {
+	inst := installer.NewInstaller(req.GameDir, stagingDirFor(req), installerOptions(req, taskLogger(taskID)))
+	// Keep the autotuner and adaptive downloads away from stages the request sized explicitly
+	inst.SetLimits(installer.Limits{Downloads: req.Downloads, Decompressions: req.Decompressions, Hashchecks: req.Hashchecks})
+	inst.QuickVerify = quickVerify
+	if err := inst.ParseManifest(mani, info.ChunkDownload); err != nil {
+		return fmt.Errorf("parsing manifest: %w", err)
+	}
+	registry.attachInstaller(taskID, inst)
+
+	if err := inst.Prepare(ctx); err != nil {
+		return fmt.Errorf("preparing installation: %w", err)
+	}
+
+	inst.Start(ctx)
+	defer inst.Stop()
+	return inst.Wait()
+}
+
+// runUpdatePipeline patches the game from req.FromVersion (detected from GameDir when empty) to the latest
+// version. Files that cannot be patched are downloaded in full with the installer afterwards.
+// A predownload only fetches the patches.
+func runUpdatePipeline(ctx context.Context, taskID string, req models.UpdateRequest) error {
+	log := taskLogger(taskID)
+	branch := "main"
+	if req.Predownload {
+		branch = "predownload"
+	}
+	if req.FromVersion == "" {
+		version, source, err := localgame.DetectVersion(req.GameDir, req.GameType)
+		if err != nil {
+			return fmt.Errorf("detecting installed version (set from_version to override): %w", err)
+		}
+		log.Info("Detected installed version", "version", version, "source", source)
+		req.FromVersion = version
+	}
+	targetBranch, err := selectGameBranch(ctx, req.GameType, req.UpdateRelType, branch)
+	if err != nil {
+		return err
+	}
+	targetVersion := targetBranch.Tag
+	if req.FromVersion == targetVersion {
+		log.Info("Game is already at the latest version, nothing to update", "version", targetVersion)
+		return nil
+	}
+
+	diff, patchInfo, err := GetPatchManifest(ctx, req.GameType, req.UpdateRelType, "game", branch)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	upd := updater.NewUpdater(req.GameDir, stagingDirFor(req.GameOperationRequest), req.FromVersion, updaterOptions(req.GameOperationRequest, log))
+	if err := upd.ParseDiffManifest(diff, patchInfo.DiffDownload); err != nil {
+		return fmt.Errorf("parsing diff manifest: %w", err)
+	}
+	registry.attachProgress(taskID, &upd.Progress)
+
+	if req.Predownload {
+		return upd.Predownload(ctx)
+	}
+
+	if err := upd.Prepare(ctx); err != nil {
+		return fmt.Errorf("preparing update: %w", err)
+	}
+	if err := upd.Run(ctx); err != nil {
+		return fmt.Errorf("applying patches: %w", err)
+	}
+
+	fallback := upd.FallbackFiles()
+	if len(fallback) == 0 {
+		recordInstalledVersion(req.GameDir, targetVersion)
+		return nil
+	}
+	log.Info("Downloading files that could not be patched", "files", len(fallback))
+	mani, info, err := GetManifest(ctx, req.GameType, req.UpdateRelType, "game", branch)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := installManifest(ctx, taskID, req.GameOperationRequest, filterManifest(mani, fallback), info, false); err != nil {
+		return err
+	}
+	recordInstalledVersion(req.GameDir, targetVersion)
+	return nil
+}
+
+// filterManifest returns a manifest containing only the given files.
+func filterManifest(mani *models.Manifest, files []string) *models.Manifest {
+	wanted := make(map[string]bool, len(files))
+	for _, file := range files {
+		wanted[file] = true
+	}
+	filtered := &models.Manifest{}
+	for _, fi := range mani.GetFiles() {
+		if wanted[fi.GetFilename()] {
+			filtered.Files = append(filtered.Files, fi)
+		}
+	}
+	return filtered
+}
+
+// ResumeTask continues a paused task in place, or starts an interrupted or failed task again
+// from its stored request. Files already present in the game directory are verified and kept,
+// chunks recorded in the staging journal are not downloaded again.
+func ResumeTask(taskID string) (models.TaskStatus, error) {
+	registry.mu.Lock()
+	rec, ok := registry.tasks[taskID]
+	if !ok {
+		registry.mu.Unlock()
+		return models.TaskStatus{}, ErrTaskNotFound
+	}
+	if rec.Status == StatusPaused && rec.inst != nil {
+		inst := rec.inst
+		registry.mu.Unlock()
+		if inst.Resume() {
+			registry.setStatus(taskID, StatusRunning, EventResumed, nil)
+		}
+		status, _ := GetTaskStatus(taskID)
+		return status, nil
+	}
+	if rec.Status != StatusInterrupted && rec.Status != StatusFailed {
+		status := rec.TaskStatus
+		registry.mu.Unlock()
+		return status, ErrTaskNotResumable
+	}
+	rec.Status = StatusPending
+	rec.Error = nil
+	registry.persistOrWarn()
+	registry.mu.Unlock()
+
+	startTask(rec)
+	status, _ := GetTaskStatus(taskID)
+	return status, nil
+}
@@ -0,0 +1,39 @@
+package operations
+
+import (
+	"SophonClientv2/internal/config"
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/downloader"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidRateLimit = errors.New("invalid rate limit")
+
+// GetRateLimit returns the bandwidth limit shared by all tasks.
+func GetRateLimit() models.RateLimitStatus {
+	limit, schedule, effective := downloader.GlobalRate()
+	return models.RateLimitStatus{Limit: limit, Schedule: schedule.String(), Effective: int(effective >> 10)}
+}
+
+// SetRateLimit changes the shared bandwidth limit and schedule until the process exits.
+func SetRateLimit(req models.RateLimitRequest) (models.RateLimitStatus, error) {
+	limit, schedule, _ := downloader.GlobalRate()
+	if req.Limit != nil {
+		if *req.Limit < 0 {
+			return GetRateLimit(), fmt.Errorf("%w: limit must be at least 0, got %d", ErrInvalidRateLimit, *req.Limit)
+		}
+		limit = *req.Limit
+	}
+	if req.Schedule != nil {
+		var err error
+		if schedule, err = config.ParseRateSchedule(*req.Schedule); err != nil {
+			return GetRateLimit(), fmt.Errorf("%w: %w", ErrInvalidRateLimit, err)
+		}
+	}
+	downloader.SetGlobalRate(limit, schedule)
+	status := GetRateLimit()
+	logging.GlobalLogger.Info("Rate limit changed", "limit", status.Limit, "schedule", status.Schedule, "effective", status.Effective)
+	return status, nil
+}
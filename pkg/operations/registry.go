@@ -0,0 +1,413 @@
+package operations
+
+import (
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/installer"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	StatusPending     = "pending"
+	StatusRunning     = "running"
+	StatusPaused      = "paused"
+	StatusCompleted   = "completed"
+	StatusFailed      = "failed"
+	StatusCancelled   = "cancelled"
+	StatusInterrupted = "interrupted" // Was running when the previous server process exited
+)
+
+var (
+	ErrTaskNotFound     = errors.New("task not found")
+	ErrTaskFinished     = errors.New("task already finished")
+	ErrTaskNotResumable = errors.New("task cannot be resumed")
+	ErrTaskNotPausable  = errors.New("task cannot be paused")
+	ErrTaskNotResizable = errors.New("task limits cannot be changed")
+)
+
+// taskRecord is the persisted form of a task. The original request is kept
+// so interrupted tasks can be started again after a restart.
+type taskRecord struct {
+	models.TaskStatus
+	Request   json.RawMessage `json:"request"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+
+	cancel   context.CancelFunc
+	done     chan struct{} // Closed when the current run has finished cleaning up
+	inst     *installer.Installer
+	progress *installer.InstallProgress
+}
+
+type taskStoreFile struct {
+	Tasks []*taskRecord `json:"tasks"`
+}
+
+type taskRegistry struct {
+	mu        sync.RWMutex
+	tasks     map[string]*taskRecord
+	order     []string // Insertion order for stable listing
+	storePath string   // Empty means in-memory only
+}
+
+var registry = &taskRegistry{tasks: make(map[string]*taskRecord)}
+
+func newTaskID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func isFinished(status string) bool {
+	switch status {
+	case StatusCompleted, StatusFailed, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// InitTaskStore loads tasks persisted at path and keeps persisting changes there.
+// Tasks that were still pending, running or paused are marked as interrupted.
+func InitTaskStore(path string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.storePath = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logging.GlobalLogger.Info("No task registry found at " + path + ", starting empty")
+			return nil
+		}
+		return fmt.Errorf("reading task registry %s: %w", path, err)
+	}
+
+	var store taskStoreFile
+	if err := json.Unmarshal(data, &store); err != nil {
+		return fmt.Errorf("decoding task registry %s: %w", path, err)
+	}
+
+	interrupted := 0
+	for _, rec := range store.Tasks {
+		if rec == nil || rec.TaskID == "" {
+			continue
+		}
+		if rec.Status == StatusPending || rec.Status == StatusRunning || rec.Status == StatusPaused {
+			rec.Status = StatusInterrupted
+			rec.UpdatedAt = time.Now()
+			interrupted++
+		}
+		if _, exists := registry.tasks[rec.TaskID]; !exists {
+			registry.order = append(registry.order, rec.TaskID)
+		}
+		registry.tasks[rec.TaskID] = rec
+	}
+	logging.GlobalLogger.Info(fmt.Sprintf("Loaded %d tasks from %s (%d interrupted)", len(store.Tasks), path, interrupted))
+	return registry.persistLocked()
+}
+
+// persistLocked writes the registry atomically. Caller must hold r.mu.
+func (r *taskRegistry) persistLocked() error {
+	if r.storePath == "" {
+		return nil
+	}
+	store := taskStoreFile{Tasks: make([]*taskRecord, 0, len(r.order))}
+	for _, id := range r.order {
+		store.Tasks = append(store.Tasks, r.tasks[id])
+	}
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding task registry: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.storePath), 0o755); err != nil {
+		return fmt.Errorf("creating task registry dir: %w", err)
+	}
+	tmpPath := r.storePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("writing task registry: %w", err)
+	}
+	if err := os.Rename(tmpPath, r.storePath); err != nil {
+		return fmt.Errorf("replacing task registry: %w", err)
+	}
+	return nil
+}
+
+func (r *taskRegistry) persistOrWarn() {
+	if err := r.persistLocked(); err != nil {
+		logging.GlobalLogger.Warn("Failed to persist task registry: " + err.Error())
+	}
+}
+
+func (r *taskRegistry) register(taskType string, request any) (*taskRecord, error) {
+	raw, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s request: %w", taskType, err)
+	}
+
+	now := time.Now()
+	rec := &taskRecord{
+		TaskStatus: models.TaskStatus{
+			TaskID:   newTaskID(),
+			TaskType: taskType,
+			Status:   StatusPending,
+		},
+		Request:   raw,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	r.mu.Lock()
+	r.tasks[rec.TaskID] = rec
+	r.order = append(r.order, rec.TaskID)
+	r.persistOrWarn()
+	r.mu.Unlock()
+
+	publishEvent(models.TaskEvent{TaskID: rec.TaskID, Event: EventCreated, Status: rec.Status, Message: taskType + " task created"})
+	return rec, nil
+}
+
+// setStatus records a status transition, persists it and publishes the matching event.
+// Finished tasks are never changed again so a cancelled task stays cancelled.
+func (r *taskRegistry) setStatus(taskID, status, event string, taskErr error) {
+	r.mu.Lock()
+	rec, ok := r.tasks[taskID]
+	if !ok || isFinished(rec.Status) {
+		r.mu.Unlock()
+		return
+	}
+	rec.Status = status
+	rec.Error = nil
+	if taskErr != nil {
+		msg := taskErr.Error()
+		rec.Error = &msg
+	}
+	if rec.progress != nil {
+		percent := rec.progress.Snapshot().Percent
+		rec.Progress = &percent
+	}
+	rec.UpdatedAt = time.Now()
+	r.persistOrWarn()
+	ev := models.TaskEvent{TaskID: taskID, Event: event, Status: status, Error: rec.Error}
+	r.mu.Unlock()
+
+	publishEvent(ev)
+}
+
+// attachInstaller exposes a running installer for progress snapshots and pause/resume.
+func (r *taskRegistry) attachInstaller(taskID string, inst *installer.Installer) {
+	r.mu.Lock()
+	if rec, ok := r.tasks[taskID]; ok {
+		rec.inst = inst
+		rec.progress = &inst.Progress
+	}
+	r.mu.Unlock()
+}
+
+// attachProgress exposes progress counters of a task step that cannot be paused.
+func (r *taskRegistry) attachProgress(taskID string, progress *installer.InstallProgress) {
+	r.mu.Lock()
+	if rec, ok := r.tasks[taskID]; ok {
+		rec.inst = nil
+		rec.progress = progress
+	}
+	r.mu.Unlock()
+}
+
+// statusLocked returns the public status with live progress filled in. Caller must hold r.mu.
+func (r *taskRegistry) statusLocked(rec *taskRecord) models.TaskStatus {
+	status := rec.TaskStatus
+	if rec.progress != nil && (rec.Status == StatusRunning || rec.Status == StatusPaused) {
+		percent := rec.progress.Snapshot().Percent
+		status.Progress = &percent
+	}
+	return status
+}
+
+// GetTaskProgress returns a progress snapshot if the task has a pipeline attached.
+func GetTaskProgress(taskID string) (models.TaskProgress, bool) {
+	registry.mu.RLock()
+	rec, ok := registry.tasks[taskID]
+	var progress *installer.InstallProgress
+	var inst *installer.Installer
+	if ok {
+		progress, inst = rec.progress, rec.inst
+	}
+	registry.mu.RUnlock()
+	if progress == nil {
+		return models.TaskProgress{}, false
+	}
+	snap := progress.Snapshot()
+	if inst != nil {
+		snap.DownloadConcurrency = inst.Downloader.WorkerCount()
+	}
+	return snap, true
+}
+
+func GetTaskStatus(taskID string) (models.TaskStatus, bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	rec, ok := registry.tasks[taskID]
+	if !ok {
+		return models.TaskStatus{}, false
+	}
+	return registry.statusLocked(rec), true
+}
+
+func ListTasks() []models.TaskStatus {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	list := make([]models.TaskStatus, 0, len(registry.order))
+	for _, id := range registry.order {
+		list = append(list, registry.statusLocked(registry.tasks[id]))
+	}
+	return list
+}
+
+func CancelTask(taskID string) (models.TaskStatus, error) {
+	registry.mu.Lock()
+	rec, ok := registry.tasks[taskID]
+	if !ok {
+		registry.mu.Unlock()
+		return models.TaskStatus{}, ErrTaskNotFound
+	}
+	if isFinished(rec.Status) {
+		registry.mu.Unlock()
+		return rec.TaskStatus, ErrTaskFinished
+	}
+	cancel := rec.cancel
+	registry.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	registry.setStatus(taskID, StatusCancelled, EventCancelled, nil)
+
+	status, _ := GetTaskStatus(taskID)
+	return status, nil
+}
+
+// WaitTask blocks until the current run of a task has returned, including cleanup after a
+// cancellation, and returns its final status. Tasks not started by this process return at once.
+func WaitTask(ctx context.Context, taskID string) (models.TaskStatus, error) {
+	registry.mu.RLock()
+	rec, ok := registry.tasks[taskID]
+	var done chan struct{}
+	if ok {
+		done = rec.done
+	}
+	registry.mu.RUnlock()
+	if !ok {
+		return models.TaskStatus{}, ErrTaskNotFound
+	}
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			status, _ := GetTaskStatus(taskID)
+			return status, ctx.Err()
+		}
+	}
+	status, _ := GetTaskStatus(taskID)
+	return status, nil
+}
+
+// PauseTask suspends chunk dispatch of a running task. Chunks already in flight are finished.
+func PauseTask(taskID string) (models.TaskStatus, error) {
+	registry.mu.Lock()
+	rec, ok := registry.tasks[taskID]
+	if !ok {
+		registry.mu.Unlock()
+		return models.TaskStatus{}, ErrTaskNotFound
+	}
+	if rec.Status != StatusRunning || rec.inst == nil {
+		status := rec.TaskStatus
+		registry.mu.Unlock()
+		return status, ErrTaskNotPausable
+	}
+	inst := rec.inst
+	registry.mu.Unlock()
+
+	if inst.Pause() {
+		registry.setStatus(taskID, StatusPaused, EventPaused, nil)
+	}
+	status, _ := GetTaskStatus(taskID)
+	return status, nil
+}
+
+// SetTaskLimits resizes the pipeline stages of a running or paused task and returns the resulting limits.
+func SetTaskLimits(taskID string, limits models.TaskLimits) (models.TaskLimits, error) {
+	registry.mu.RLock()
+	rec, ok := registry.tasks[taskID]
+	var inst *installer.Installer
+	if ok && (rec.Status == StatusRunning || rec.Status == StatusPaused) {
+		inst = rec.inst
+	}
+	registry.mu.RUnlock()
+	if !ok {
+		return models.TaskLimits{}, ErrTaskNotFound
+	}
+	if inst == nil {
+		return models.TaskLimits{}, ErrTaskNotResizable
+	}
+
+	l := inst.SetLimits(installer.Limits{
+		Downloads:      limits.Downloads,
+		Decompressions: limits.Decompressions,
+		Hashchecks:     limits.Hashchecks,
+		Writers:        limits.Writers,
+		QueueSize:      limits.QueueSize,
+		RateLimit:      int64(limits.RateLimit) << 10,
+	})
+	taskLogger(taskID).Info("Task limits changed", "downloads", l.Downloads, "decompressions", l.Decompressions, "hashchecks", l.Hashchecks, "writers", l.Writers, "queue_size", l.QueueSize, "rate_limit", l.RateLimit)
+	return models.TaskLimits{
+		Downloads:      l.Downloads,
+		Decompressions: l.Decompressions,
+		Hashchecks:     l.Hashchecks,
+		Writers:        l.Writers,
+		QueueSize:      l.QueueSize,
+		RateLimit:      int(l.RateLimit >> 10),
+	}, nil
+}
+
+// GetTaskMirrors returns the chunk mirrors of a task with a running pipeline, empty otherwise.
+func GetTaskMirrors(taskID string) ([]models.MirrorStatus, error) {
+	registry.mu.RLock()
+	rec, ok := registry.tasks[taskID]
+	var inst *installer.Installer
+	if ok {
+		inst = rec.inst
+	}
+	registry.mu.RUnlock()
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	mirrors := []models.MirrorStatus{}
+	if inst == nil || inst.Downloader.Mirrors() == nil {
+		return mirrors, nil
+	}
+	for _, m := range inst.Downloader.Mirrors().Stats() {
+		mirrors = append(mirrors, models.MirrorStatus{
+			Prefix:           m.Prefix,
+			SpeedBytesPerSec: m.Throughput,
+			LatencyMs:        float64(m.Latency) / float64(time.Millisecond),
+			ErrorRate:        m.ErrorRate,
+			Requests:         m.Requests,
+			Errors:           m.Errors,
+			Bytes:            m.Bytes,
+			Down:             m.Down,
+		})
+	}
+	return mirrors, nil
+}
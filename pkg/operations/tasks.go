@@ -4,18 +4,25 @@ import "SophonClientv2/internal/models"
 import "SophonClientv2/internal/logging"
 
 func PerformInstall(request models.InstallRequest) models.TaskResponse {
-	// TODO: Implement install
-	return models.TaskResponse{}
+	return submitTask("install", request)
 }
 
 func PerformRepair(request models.RepairRequest) models.TaskResponse {
-	// TODO: Implement repair
-	return models.TaskResponse{}
+	return submitTask("repair", request)
 }
 
 func PerformUpdate(request models.UpdateRequest) models.TaskResponse {
-	// TODO: Implement update
-	return models.TaskResponse{}
+	return submitTask("update", request)
+}
+
+func submitTask(taskType string, request any) models.TaskResponse {
+	rec, err := registry.register(taskType, request)
+	if err != nil {
+		logging.GlobalLogger.Error("Failed to register " + taskType + " task: " + err.Error())
+		return models.TaskResponse{Status: StatusFailed, Message: err.Error()}
+	}
+	startTask(rec)
+	return models.TaskResponse{TaskID: rec.TaskID, Status: StatusPending, Message: taskType + " task started"}
 }
 
 func RunTask(taskType string, request interface{}) models.TaskResponse {
@@ -33,7 +40,9 @@ func RunTask(taskType string, request interface{}) models.TaskResponse {
 			return PerformUpdate(req)
 		}
 	default:
-		logging.GlobalLogger.Fatal("Unknown task type: " + taskType)
+		logging.GlobalLogger.Error("Unknown task type: " + taskType)
+		return models.TaskResponse{Status: "failed", Message: "Unknown task type: " + taskType}
 	}
-	return models.TaskResponse{} // Should not reach here
+	logging.GlobalLogger.Error("Request does not match task type: " + taskType)
+	return models.TaskResponse{Status: "failed", Message: "Request does not match task type: " + taskType}
 }
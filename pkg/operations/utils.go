@@ -5,61 +5,101 @@ import (
 	"SophonClientv2/internal/models"
 	"SophonClientv2/pkg/hypAPI"
 	"SophonClientv2/pkg/manifest"
+	"context"
+	"fmt"
 	"strings"
 )
 
-func GetManifest(gameType string, relType string, matchingField string, branch string) (*models.Manifest, *models.SophonManifest) {
+func GetManifest(ctx context.Context, gameType string, relType string, matchingField string, branch string) (*models.Manifest, *models.SophonManifest, error) {
+	targetBranch, err := selectGameBranch(ctx, gameType, relType, branch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sophonBuild, err := hypAPI.DefaultClient.GetSophonBuildByBranch(ctx, relType, targetBranch)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching Sophon build for branch %s: %w", targetBranch.Branch, err)
+	}
+
+	for _, manifestInfo := range sophonBuild.Data.Manifests {
+		if manifestInfo.MatchingField == matchingField {
+			mani, err := manifest.GetManifest(ctx, hypAPI.DefaultClient, manifestInfo)
+			if err != nil {
+				return nil, nil, fmt.Errorf("fetching manifest for matching field %s: %w", matchingField, err)
+			}
+			return mani, &manifestInfo, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("no manifest with matching field %s", matchingField)
+}
+
+// GetPatchManifest returns the diff manifest that patches older versions to the given branch.
+func GetPatchManifest(ctx context.Context, gameType string, relType string, matchingField string, branch string) (*models.DiffManifest, *models.SophonPatchManifest, error) {
+	targetBranch, err := selectGameBranch(ctx, gameType, relType, branch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	patchBuild, err := hypAPI.DefaultClient.GetSophonPatchBuildByBranch(ctx, relType, targetBranch)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching Sophon patch build for branch %s: %w", targetBranch.Branch, err)
+	}
+
+	for _, manifestInfo := range patchBuild.Data.Manifests {
+		if manifestInfo.MatchingField == matchingField {
+			mani, err := manifest.GetDiffManifest(ctx, hypAPI.DefaultClient, manifestInfo)
+			if err != nil {
+				return nil, nil, fmt.Errorf("fetching diff manifest for matching field %s: %w", matchingField, err)
+			}
+			return mani, &manifestInfo, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("no diff manifest with matching field %s", matchingField)
+}
+
+// findGame looks up the game in the cached getGameBranches response of the release type.
+func findGame(ctx context.Context, gameType string, relType string) (*models.HYPGame, error) {
 	var biz string
-	var hypGames []models.HYPGame
 	switch strings.ToLower(relType) {
 	case "cn":
 		biz = strings.ToLower(gameType) + "_cn"
-		hypGames = hypAPI.CNGameBranches.Data.GameBranches
 	case "os":
 		biz = strings.ToLower(gameType) + "_global"
-		hypGames = hypAPI.OSGameBranches.Data.GameBranches
 	default:
-		logging.GlobalLogger.Warn("Unknown release type in function GetAndParseManifest, defaulting to OS")
-		biz = strings.ToLower(gameType) + "_global"
+		return nil, fmt.Errorf("unknown release type: %s", relType)
 	}
 
-	var selectedGame models.HYPGame
+	branches, err := hypAPI.Metadata.GameBranches(ctx, relType)
+	if err != nil {
+		return nil, fmt.Errorf("fetching game branches: %w", err)
+	}
+	hypGames := branches.Data.GameBranches
 	for i, hypGame := range hypGames {
 		if strings.ToLower(hypGame.Game.Biz) == biz {
-			selectedGame = hypGames[i]
+			return &hypGames[i], nil
 		}
 	}
+	return nil, fmt.Errorf("game %s not found in %s game branches", gameType, relType)
+}
+
+func selectGameBranch(ctx context.Context, gameType string, relType string, branch string) (models.HYPGameBranch, error) {
+	selectedGame, err := findGame(ctx, gameType, relType)
+	if err != nil {
+		return models.HYPGameBranch{}, err
+	}
 
-	var targetBranch models.HYPGameBranch
 	switch strings.ToLower(branch) {
 	case "main":
-		targetBranch = selectedGame.Main
+		return selectedGame.Main, nil
 	case "predownload":
-		if selectedGame.PreDownload != nil {
-			targetBranch = *selectedGame.PreDownload
-		} else {
-			logging.GlobalLogger.Fatal("PreDownload branch not available for game: " + gameType + "_" + relType)
+		if selectedGame.PreDownload == nil {
+			return models.HYPGameBranch{}, fmt.Errorf("predownload branch not available for game %s_%s", gameType, relType)
 		}
+		return *selectedGame.PreDownload, nil
 	default:
-		logging.GlobalLogger.Warn("Unknown branch type in function GetAndParseManifest, defaulting to Main")
-		targetBranch = selectedGame.Main
+		logging.GlobalLogger.Warn("Unknown branch type in function selectGameBranch, defaulting to Main")
+		return selectedGame.Main, nil
 	}
-
-	sophonBuild := hypAPI.GetSophonBuildByBranch(relType, targetBranch)
-	if sophonBuild.Retcode != 0 {
-		logging.GlobalLogger.Fatal("Failed to fetch Sophon build for branch " + selectedGame.Main.Branch + ": " + sophonBuild.Message)
-	}
-
-	for _, manifestInfo := range sophonBuild.Data.Manifests {
-		if manifestInfo.MatchingField == matchingField {
-			mani := manifest.GetManifest(manifestInfo)
-			if mani == nil {
-				logging.GlobalLogger.Fatal("Failed to fetch manifest for matching field: " + matchingField)
-			}
-			return mani, &manifestInfo
-		}
-	}
-
-	logging.GlobalLogger.Fatal("Failed to find matching manifest with field: " + matchingField)
-	return nil, nil
 }
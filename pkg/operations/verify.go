@@ -0,0 +1,29 @@
+package operations
+
+import (
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/installer"
+	"context"
+	"fmt"
+)
+
+// VerifyGame checks the files in GameDir against the latest game manifest without repairing anything.
+// onStart, if not nil, receives the progress counters before checking begins.
+func VerifyGame(ctx context.Context, req models.RepairRequest, onStart func(*installer.InstallProgress)) (installer.CheckResult, error) {
+	mani, info, err := GetManifest(ctx, req.GameType, req.RepairRelType, "game", "main")
+	if err != nil {
+		return installer.CheckResult{}, err
+	}
+	opts := installerOptions(req.GameOperationRequest, logging.GlobalLogger)
+	opts.QueueSize = 1
+	inst := installer.NewInstaller(req.GameDir, stagingDirFor(req.GameOperationRequest), opts)
+	inst.QuickVerify = req.RepairMode == "quick"
+	if err := inst.ParseManifest(mani, info.ChunkDownload); err != nil {
+		return installer.CheckResult{}, fmt.Errorf("parsing manifest: %w", err)
+	}
+	if onStart != nil {
+		onStart(&inst.Progress)
+	}
+	return inst.Check(ctx)
+}
@@ -0,0 +1,184 @@
+package retry
+
+import (
+	"SophonClientv2/internal/config"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Class tells whether a failed attempt is worth repeating.
+type Class int
+
+const (
+	Retryable Class = iota // Network errors, 5xx, 429, truncated or corrupt data
+	Permanent              // Retrying cannot help, e.g. 404 or an invalid request
+)
+
+func (c Class) String() string {
+	if c == Permanent {
+		return "permanent"
+	}
+	return "retryable"
+}
+
+// Policy decides whether and when a failed attempt is repeated. Zero delays retry immediately.
+type Policy struct {
+	MaxAttempts int           // Attempts including the first, at least 1
+	BaseDelay   time.Duration // Wait before the second attempt, doubled for every further one
+	MaxDelay    time.Duration // Upper bound of every wait, including Retry-After
+	Jitter      float64       // Fraction of each wait that is randomized, 0 to 1
+	// Classify overrides the default classification, see Classify
+	Classify func(err error) Class
+}
+
+// FromConfig returns a policy with maxAttempts and the configured delays.
+func FromConfig(maxAttempts int) Policy {
+	return Policy{
+		MaxAttempts: max(1, maxAttempts),
+		BaseDelay:   config.Config.RetryBaseDelay,
+		MaxDelay:    config.Config.RetryMaxDelay,
+		Jitter:      float64(config.Config.RetryJitter) / 100,
+	}
+}
+
+// StatusError is an unexpected HTTP response. RetryAfter is the wait the server asked for, 0 if none.
+type StatusError struct {
+	Code       int
+	Status     string
+	RetryAfter time.Duration
+}
+
+// NewStatusError describes resp, including its Retry-After header given in seconds or as a date.
+func NewStatusError(resp *http.Response) *StatusError {
+	e := &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		} else if at, err := http.ParseTime(value); err == nil {
+			e.RetryAfter = max(0, time.Until(at))
+		}
+	}
+	return e
+}
+
+func (e *StatusError) Error() string {
+	if e.Status == "" {
+		return fmt.Sprintf("unexpected status %d %s", e.Code, http.StatusText(e.Code))
+	}
+	return "unexpected status " + e.Status
+}
+
+// ClassifyStatus treats request timeouts, 429 and server errors other than 501 and 505 as retryable.
+func ClassifyStatus(code int) Class {
+	switch {
+	case code == http.StatusRequestTimeout, code == http.StatusTooEarly, code == http.StatusTooManyRequests:
+		return Retryable
+	case code == http.StatusNotImplemented, code == http.StatusHTTPVersionNotSupported:
+		return Permanent
+	case code >= 500:
+		return Retryable
+	}
+	return Permanent
+}
+
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// MarkPermanent wraps err so Classify never retries it.
+func MarkPermanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// Classify is the default classification: errors marked permanent, cancellation, and statuses
+// ClassifyStatus rejects are permanent, anything else (network errors, truncated bodies, checksum
+// mismatches) is retryable.
+func Classify(err error) Class {
+	var perm *permanentError
+	var status *StatusError
+	switch {
+	case errors.As(err, &perm), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return Permanent
+	case errors.As(err, &status):
+		return ClassifyStatus(status.Code)
+	}
+	return Retryable
+}
+
+func (p Policy) classify(err error) Class {
+	if p.Classify != nil {
+		return p.Classify(err)
+	}
+	return Classify(err)
+}
+
+// Retry reports whether attempt, counted from 1, is followed by another after failing with err.
+func (p Policy) Retry(attempt int, err error) bool {
+	return attempt < max(1, p.MaxAttempts) && p.classify(err) == Retryable
+}
+
+// Delay returns the wait after attempt failed with err: the Retry-After of the server if it sent one,
+// otherwise BaseDelay doubled per attempt with Jitter of it randomized. Both are capped at MaxDelay.
+func (p Policy) Delay(attempt int, err error) time.Duration {
+	var status *StatusError
+	if errors.As(err, &status) && status.RetryAfter > 0 {
+		return p.capped(status.RetryAfter)
+	}
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	delay := p.capped(p.BaseDelay << min(max(0, attempt-1), 30))
+	if jitter := min(1, max(0, p.Jitter)); jitter > 0 {
+		delay -= time.Duration(jitter * rand.Float64() * float64(delay))
+	}
+	return delay
+}
+
+func (p Policy) capped(d time.Duration) time.Duration {
+	if p.MaxDelay > 0 && (d > p.MaxDelay || d < 0) {
+		return p.MaxDelay
+	}
+	return d
+}
+
+// Do runs fn until it succeeds, fails permanently, runs out of attempts or ctx is done, and returns
+// the last error. onRetry, if set, is called before every wait.
+func (p Policy) Do(ctx context.Context, fn func(attempt int) error, onRetry func(attempt int, err error, delay time.Duration)) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || !p.Retry(attempt, err) {
+			return err
+		}
+		delay := p.Delay(attempt, err)
+		if onRetry != nil {
+			onRetry(attempt, err, delay)
+		}
+		if serr := Sleep(ctx, delay); serr != nil {
+			return err
+		}
+	}
+}
+
+// Sleep waits for d or until ctx is done, whichever comes first, and returns ctx.Err() in the latter case.
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,55 @@
+package updater
+
+import (
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/installer"
+	"net/http"
+	"sync"
+)
+
+type PatchMethod int
+
+const (
+	PatchApply    PatchMethod = iota // Apply an hdiff patch to the original file
+	PatchCopyOver                    // Patch data is the new file itself (no original file)
+)
+
+type PatchJob struct {
+	FilePath string // Target path relative to GameDir
+	Size     int64
+	MD5      string // Hash after patching
+	Method   PatchMethod
+	URL      string // Patch blob, only [Info.PatchOffset, Info.PatchOffset+Info.PatchLength) belongs to this file
+	Info     *models.PatchInfo
+}
+
+// Options are the settings of one updater. Zero fields are taken from DefaultOptions.
+type Options struct {
+	Downloads  int   // Parallel patch downloads
+	Hashchecks int   // Parallel MD5 checks of existing files
+	MaxRetries int   // Attempts per patch download, waiting between them like retry.FromConfig
+	RateLimit  int64 // Bytes per second of this updater, within the global limit. 0 is unlimited
+	Logger     *logging.Logger
+}
+
+type Updater struct {
+	GameDir     string
+	StagingDir  string
+	FromVersion string
+	Options     Options
+
+	Patches []*PatchJob
+	Deletes []*models.DeleteFileInfo
+
+	Patcher  Patcher
+	Progress installer.InstallProgress
+
+	HttpClient *http.Client
+	rate       *downloader.RateLimiter
+
+	mu       sync.Mutex
+	fallback map[string]bool // Files that have to be downloaded in full
+	staged   []*PatchJob     // Patched files waiting in staging to be moved
+}
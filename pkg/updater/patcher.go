@@ -0,0 +1,22 @@
+package updater
+
+import (
+	"SophonClientv2/pkg/hpatch"
+	"context"
+)
+
+// Patcher applies a single hdiff patch. oldPath may be empty for patches that create a file.
+type Patcher interface {
+	Apply(ctx context.Context, oldPath, diffPath, outPath string) error
+}
+
+// NativePatcher applies patches with the built-in HDiffPatch implementation.
+type NativePatcher struct{}
+
+func (NativePatcher) Apply(ctx context.Context, oldPath, diffPath, outPath string) error {
+	return hpatch.PatchFile(ctx, oldPath, diffPath, outPath)
+}
+
+func DefaultPatcher() Patcher {
+	return NativePatcher{}
+}
@@ -0,0 +1,437 @@
+package updater
+
+import (
+	"SophonClientv2/internal/config"
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/downloader"
+	"SophonClientv2/pkg/retry"
+	"SophonClientv2/pkg/utils"
+	"SophonClientv2/pkg/verifier"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PatchDirName is the directory inside the installer staging dir holding patch data.
+// The installer leaves dot-directories in staging alone.
+const PatchDirName = ".patches"
+
+// DefaultOptions returns the updater settings of the global configuration.
+func DefaultOptions() Options {
+	return Options{
+		Downloads:  config.Config.CocurrentDownloads,
+		Hashchecks: verifier.DefaultOptions().Workers,
+		MaxRetries: config.Config.MaxChunkDownloadRetries,
+	}
+}
+
+func (o Options) withDefaults() Options {
+	def := DefaultOptions()
+	if o.Downloads <= 0 {
+		o.Downloads = def.Downloads
+	}
+	if o.Hashchecks <= 0 {
+		o.Hashchecks = def.Hashchecks
+	}
+	if o.MaxRetries <= 0 {
+		o.MaxRetries = def.MaxRetries
+	}
+	if o.Logger == nil {
+		o.Logger = logging.GlobalLogger
+	}
+	return o
+}
+
+func NewUpdater(gameDir, stagingDir, fromVersion string, opts Options) *Updater {
+	opts = opts.withDefaults()
+	return &Updater{
+		GameDir:     gameDir,
+		StagingDir:  filepath.Join(stagingDir, PatchDirName),
+		FromVersion: fromVersion,
+		Options:     opts,
+		Patcher:     DefaultPatcher(),
+		HttpClient:  &http.Client{Timeout: 30 * time.Minute},
+		rate:        downloader.NewRateLimiter(opts.RateLimit),
+		fallback:    make(map[string]bool),
+	}
+}
+
+// ParseDiffManifest selects the patches that apply to FromVersion. Changed files without
+// such a patch are marked for a full download.
+func (u *Updater) ParseDiffManifest(diff *models.DiffManifest, diffDownload models.SophonChunkDownloadInfo) error {
+	u.Patches = nil
+	u.Deletes = nil
+
+	for _, fi := range diff.GetFiles() {
+		var info *models.PatchInfo
+		for _, patch := range fi.GetPatches() {
+			if patch.GetKey() == u.FromVersion {
+				info = patch.GetInfo()
+				break
+			}
+		}
+		if info == nil {
+			u.Options.Logger.Debug("No patch for this version, will download", logging.KeyFile, fi.GetFilename(), "from_version", u.FromVersion)
+			u.markFallback(fi.GetFilename())
+			continue
+		}
+
+		url := diffDownload.UrlPrefix + "/" + info.GetPatchId()
+		if diffDownload.UrlSuffix != "" {
+			url += "/" + diffDownload.UrlSuffix
+		}
+		job := &PatchJob{
+			FilePath: fi.GetFilename(),
+			Size:     int64(fi.GetSize()),
+			MD5:      fi.GetHash(),
+			Method:   PatchApply,
+			URL:      url,
+			Info:     info,
+		}
+		if info.GetOriginalName() == "" {
+			job.Method = PatchCopyOver
+		}
+		u.Patches = append(u.Patches, job)
+	}
+
+	for _, del := range diff.GetFilesDelete() {
+		if del.GetKey() == u.FromVersion {
+			u.Deletes = append(u.Deletes, del.GetInfo().GetList()...)
+		}
+	}
+
+	if len(u.Patches) == 0 && len(u.fallback) == 0 && len(u.Deletes) == 0 {
+		return fmt.Errorf("diff manifest has no changes from version %s", u.FromVersion)
+	}
+	u.Options.Logger.Info("Parsed diff manifest", "patches", len(u.Patches), "full_downloads", len(u.fallback), "deletions", len(u.Deletes), "from_version", u.FromVersion)
+	return nil
+}
+
+// Prepare checks the files on disk. Files already at the new version are dropped, patches whose
+// original file does not match original_hash are replaced by a full download.
+func (u *Updater) Prepare(ctx context.Context) error {
+	if err := os.MkdirAll(u.StagingDir, 0o755); err != nil {
+		return fmt.Errorf("creating patch staging dir: %w", err)
+	}
+
+	keep := make([]bool, len(u.Patches))
+	err := u.forEach(ctx, u.Options.Hashchecks, func(i int, job *PatchJob) error {
+		targetHash, err := fileMD5(filepath.Join(u.GameDir, job.FilePath))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && strings.EqualFold(targetHash, job.MD5) {
+			u.Options.Logger.Debug("Already up to date", logging.KeyFile, job.FilePath)
+			return nil
+		}
+		if job.Method == PatchCopyOver {
+			keep[i] = true
+			return nil
+		}
+
+		originalHash := targetHash
+		if job.Info.GetOriginalName() != job.FilePath {
+			originalHash, err = fileMD5(filepath.Join(u.GameDir, job.Info.GetOriginalName()))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err != nil || !strings.EqualFold(originalHash, job.Info.GetOriginalHash()) {
+			u.Options.Logger.Debug("Original missing or modified, will download", logging.KeyFile, job.FilePath)
+			u.markFallback(job.FilePath)
+			return nil
+		}
+		keep[i] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	patches := u.Patches[:0]
+	var totalBytes int64
+	for i, job := range u.Patches {
+		if keep[i] {
+			patches = append(patches, job)
+			totalBytes += job.Info.GetPatchLength()
+		}
+	}
+	u.Patches = patches
+	u.Progress.IncrementTotalFiles(len(patches))
+	u.Progress.IncrementTotalBytes(totalBytes)
+	u.Options.Logger.Info("Update prepared", "patches", len(patches), "patch_bytes", totalBytes, "full_downloads", len(u.fallback))
+	return nil
+}
+
+// Predownload only fetches the patch data so a later update can run without downloading it.
+func (u *Updater) Predownload(ctx context.Context) error {
+	if err := os.MkdirAll(u.StagingDir, 0o755); err != nil {
+		return fmt.Errorf("creating patch staging dir: %w", err)
+	}
+	var totalBytes int64
+	for _, job := range u.Patches {
+		totalBytes += job.Info.GetPatchLength()
+	}
+	u.Progress.IncrementTotalFiles(len(u.Patches))
+	u.Progress.IncrementTotalBytes(totalBytes)
+	u.Progress.MarkStarted()
+
+	return u.forEach(ctx, u.Options.Downloads, func(_ int, job *PatchJob) error {
+		if err := u.downloadPatch(ctx, job); err != nil {
+			return fmt.Errorf("predownloading patch for %s: %w", job.FilePath, err)
+		}
+		u.Progress.IncrementVerifiedFiles()
+		return nil
+	})
+}
+
+// Run downloads and applies every patch, then moves the results into GameDir and removes deleted files.
+// Patches that fail are added to FallbackFiles instead of failing the update.
+func (u *Updater) Run(ctx context.Context) error {
+	u.Progress.MarkStarted()
+	u.staged = nil
+
+	err := u.forEach(ctx, u.Options.Downloads, func(_ int, job *PatchJob) error {
+		if err := u.downloadPatch(ctx, job); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			u.Options.Logger.Warn("Downloading patch failed, will download file", logging.KeyFile, job.FilePath, "error", err)
+			u.markFallback(job.FilePath)
+			return nil
+		}
+		if err := u.applyPatch(ctx, job); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			u.Options.Logger.Warn("Patching failed, will download file", logging.KeyFile, job.FilePath, "error", err)
+			u.markFallback(job.FilePath)
+			return nil
+		}
+		u.mu.Lock()
+		u.staged = append(u.staged, job)
+		u.mu.Unlock()
+		u.Progress.IncrementVerifiedFiles()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Originals may be shared between patches, so nothing in GameDir is replaced before all patches are applied
+	for _, job := range u.staged {
+		finalPath := filepath.Join(u.GameDir, job.FilePath)
+		if err := os.MkdirAll(filepath.Dir(finalPath), 0o755); err != nil {
+			return fmt.Errorf("creating directory for %s: %w", finalPath, err)
+		}
+		if err := os.Rename(u.stagedPath(job), finalPath); err != nil {
+			return fmt.Errorf("moving patched file %s: %w", job.FilePath, err)
+		}
+	}
+	u.Options.Logger.Info("Patched files", "files", len(u.staged))
+
+	for _, del := range u.Deletes {
+		if u.isFallback(del.GetFilename()) {
+			continue
+		}
+		path := filepath.Join(u.GameDir, del.GetFilename())
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("deleting %s: %w", path, err)
+		}
+		u.Options.Logger.Debug("Deleted obsolete file", logging.KeyFile, del.GetFilename())
+	}
+	return nil
+}
+
+// FallbackFiles returns the files that could not be patched and need a full chunk download.
+func (u *Updater) FallbackFiles() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	files := make([]string, 0, len(u.fallback))
+	for file := range u.fallback {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (u *Updater) markFallback(filePath string) {
+	u.mu.Lock()
+	u.fallback[filePath] = true
+	u.mu.Unlock()
+}
+
+func (u *Updater) isFallback(filePath string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.fallback[filePath]
+}
+
+func (u *Updater) patchPath(job *PatchJob) string {
+	return filepath.Join(u.StagingDir, job.FilePath+".hdiff")
+}
+
+func (u *Updater) stagedPath(job *PatchJob) string {
+	return filepath.Join(u.StagingDir, job.FilePath)
+}
+
+// forEach runs fn for every patch job on up to workers goroutines and returns the first error.
+func (u *Updater) forEach(ctx context.Context, workers int, fn func(i int, job *PatchJob) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < max(1, workers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fn(i, u.Patches[i]); err != nil {
+					cancel(err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range u.Patches {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- i:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return context.Cause(ctx)
+}
+
+// downloadPatch fetches the byte range of the patch blob belonging to job. Data already
+// downloaded (e.g. by a predownload) is reused.
+func (u *Updater) downloadPatch(ctx context.Context, job *PatchJob) error {
+	path := u.patchPath(job)
+	offset, length := job.Info.GetPatchOffset(), job.Info.GetPatchLength()
+	if info, err := os.Stat(path); err == nil && info.Size() == length {
+		u.Options.Logger.Debug("Using cached patch", logging.KeyFile, job.FilePath)
+		u.Progress.IncrementDownloadedBytes(length)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	err := retry.FromConfig(u.Options.MaxRetries).Do(ctx, func(int) error {
+		return u.downloadRange(ctx, job.URL, offset, length, path)
+	}, func(attempt int, err error, delay time.Duration) {
+		u.Options.Logger.Warn("Failed to download patch, retrying...", logging.KeyFile, job.FilePath, "attempt", attempt, "delay", delay, "error", err)
+	})
+	if err != nil {
+		return err
+	}
+	u.Progress.IncrementDownloadedBytes(length)
+	return nil
+}
+
+func (u *Updater) downloadRange(ctx context.Context, url string, offset, length int64, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return retry.MarkPermanent(err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := u.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer utils.CloseStreamSafe(resp.Body)
+
+	body := downloader.NewLimitedReader(ctx, resp.Body, downloader.GlobalRateLimiter, u.rate)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Writing whatever range was sent would store the wrong part of the blob as the patch
+		start, end, _, err := downloader.ParseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if start != offset || end-start+1 != length {
+			return fmt.Errorf("content range %q does not match the requested bytes %d-%d", resp.Header.Get("Content-Range"), offset, offset+length-1)
+		}
+	case http.StatusOK:
+		// Server ignored the range, skip to the part we need
+		if _, err := io.CopyN(io.Discard, body, offset); err != nil {
+			return fmt.Errorf("skipping to patch offset: %w", err)
+		}
+	default:
+		return retry.NewStatusError(resp)
+	}
+
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return retry.MarkPermanent(err)
+	}
+	n, err := io.CopyN(f, body, length)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("writing patch data (%d of %d bytes): %w", n, length, err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// applyPatch produces the new file in staging and verifies its hash. The patch data is removed on success.
+func (u *Updater) applyPatch(ctx context.Context, job *PatchJob) error {
+	patchPath := u.patchPath(job)
+	outPath := u.stagedPath(job)
+
+	switch job.Method {
+	case PatchCopyOver:
+		if err := os.Rename(patchPath, outPath); err != nil {
+			return err
+		}
+	case PatchApply:
+		oldPath := filepath.Join(u.GameDir, job.Info.GetOriginalName())
+		if err := u.Patcher.Apply(ctx, oldPath, patchPath, outPath); err != nil {
+			return err
+		}
+	}
+
+	hash, err := fileMD5(outPath)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(hash, job.MD5) {
+		os.Remove(outPath)
+		os.Remove(patchPath)
+		return fmt.Errorf("hash mismatch after patching: got %s, want %s", hash, job.MD5)
+	}
+	if err := os.Remove(patchPath); err != nil && !os.IsNotExist(err) {
+		u.Options.Logger.Warn("Failed to remove patch data", "path", patchPath, "error", err)
+	}
+	return nil
+}
+
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+// WorkerGroup tracks the workers of a stage whose worker count can change while it runs.
+// Once the last worker has exited the group is finished: Done is closed and Add refuses new workers,
+// so the stage can close its output safely.
+type WorkerGroup struct {
+	mu       sync.Mutex
+	active   int
+	finished bool
+	done     chan struct{}
+}
+
+func NewWorkerGroup() *WorkerGroup {
+	return &WorkerGroup{done: make(chan struct{})}
+}
+
+// Add registers a worker about to start. It returns false if the group has already finished.
+func (g *WorkerGroup) Add() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.finished {
+		return false
+	}
+	g.active++
+	return true
+}
+
+// Exit unregisters a worker. The group finishes when no worker is left.
+func (g *WorkerGroup) Exit() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	if g.active == 0 && !g.finished {
+		g.finished = true
+		close(g.done)
+	}
+}
+
+// Finish ends a group that never had a worker.
+func (g *WorkerGroup) Finish() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.active == 0 && !g.finished {
+		g.finished = true
+		close(g.done)
+	}
+}
+
+func (g *WorkerGroup) Done() <-chan struct{} {
+	return g.done
+}
+
+// Limiter is a counting semaphore whose limit can be changed while it is in use.
+// Lowering the limit below the current use only takes effect as slots are released.
+type Limiter struct {
+	mu      sync.Mutex
+	limit   int
+	used    int
+	changed chan struct{} // Closed and replaced whenever a slot may have become free
+}
+
+func NewLimiter(limit int) *Limiter {
+	return &Limiter{limit: max(1, limit), changed: make(chan struct{})}
+}
+
+func (l *Limiter) TryAcquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.used < l.limit {
+		l.used++
+		return true
+	}
+	return false
+}
+
+// Acquire blocks until a slot is free or ctx is done.
+func (l *Limiter) Acquire(ctx context.Context) bool {
+	for {
+		l.mu.Lock()
+		if l.used < l.limit {
+			l.used++
+			l.mu.Unlock()
+			return true
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+func (l *Limiter) Release() {
+	l.mu.Lock()
+	l.used--
+	l.notifyLocked()
+	l.mu.Unlock()
+}
+
+func (l *Limiter) SetLimit(limit int) {
+	l.mu.Lock()
+	l.limit = max(1, limit)
+	l.notifyLocked()
+	l.mu.Unlock()
+}
+
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func (l *Limiter) notifyLocked() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// EnqueueLimited is EnqueueContext for a queue whose length is bounded by slots instead of the
+// channel capacity. The consumer releases a slot for every item it takes from ch.
+func EnqueueLimited[T any](ctx context.Context, ch chan<- T, slots *Limiter, item T) {
+	if slots.TryAcquire() {
+		select {
+		case ch <- item:
+			return
+		default:
+			slots.Release()
+		}
+	}
+	go func() {
+		if !slots.Acquire(ctx) {
+			discard(item)
+			return
+		}
+		if !SendContext(ctx, ch, item) {
+			slots.Release()
+		}
+	}()
+}
+
+// SendLimited is SendContext for a queue bounded by slots: it blocks until a slot is free and
+// item is sent, so a producer cannot run ahead of the consumer. The item is discarded if ctx ends first.
+func SendLimited[T any](ctx context.Context, ch chan<- T, slots *Limiter, item T) bool {
+	if !slots.Acquire(ctx) {
+		discard(item)
+		return false
+	}
+	if !SendContext(ctx, ch, item) {
+		slots.Release()
+		return false
+	}
+	return true
+}
@@ -2,18 +2,81 @@ package utils
 
 import (
 	"SophonClientv2/internal/logging"
+	"context"
 	"fmt"
 	"io"
 )
 
-func NonBlockingEnqueue[T any](ch chan<- T, item T) {
+// Discardable is implemented by queue items owning resources (streams, files)
+// that must be released when the item is dropped from a cancelled pipeline.
+type Discardable interface {
+	Discard()
+}
+
+func discard[T any](item T) {
+	if d, ok := any(item).(Discardable); ok {
+		d.Discard()
+	}
+}
+
+// EnqueueContext sends item without blocking the caller. If ch is full the send is handed to a goroutine
+// which gives up (and discards the item) once ctx is done.
+func EnqueueContext[T any](ctx context.Context, ch chan<- T, item T) {
 	select {
 	case ch <- item:
+		return
 	default:
-		go func() {
-			ch <- item
-		}()
 	}
+	go func() {
+		select {
+		case ch <- item:
+		case <-ctx.Done():
+			discard(item)
+		}
+	}()
+}
+
+// SendContext blocks until item is sent or ctx is done. The item is discarded if it could not be sent.
+func SendContext[T any](ctx context.Context, ch chan<- T, item T) bool {
+	select {
+	case ch <- item:
+		return true
+	case <-ctx.Done():
+		discard(item)
+		return false
+	}
+}
+
+// DrainDiscard empties whatever is currently buffered in ch without blocking.
+func DrainDiscard[T any](ch <-chan T) {
+	for {
+		select {
+		case item, ok := <-ch:
+			if !ok {
+				return
+			}
+			discard(item)
+		default:
+			return
+		}
+	}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// NewContextReader aborts reads with the context error once ctx is done.
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
 }
 
 func CloseStreamSafe(stream interface{ Close() error }) {
@@ -1,8 +1,12 @@
 package verifier
 
 import (
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/pkg/utils"
+	"context"
 	"io"
 	"sync"
+	"sync/atomic"
 )
 
 type VerifierInput struct {
@@ -12,25 +16,65 @@ type VerifierInput struct {
 	Payload     any
 }
 
+func (i VerifierInput) Discard() {
+	if i.Content != nil {
+		i.Content.Close()
+	}
+}
+
 type VerifierOutput struct {
 	Content  io.ReadCloser
 	Suceeded bool
 	Payload  any
 }
 
+func (o VerifierOutput) Discard() {
+	if o.Content != nil {
+		o.Content.Close()
+	}
+}
+
+// Options configures a Verifier. Zero fields are taken from DefaultOptions.
+type Options struct {
+	Workers        int
+	QueueSize      int
+	MaxQueueSize   int             // Capacity of the input queue, the most SetQueueSize allows. At least QueueSize
+	StatusInterval int             // Seconds between queue length debug messages
+	Logger         *logging.Logger // Records are tagged with the stage and worker
+	// Pass the verified content on in VerifierOutput instead of only checking it
+	ReturnContent bool
+}
+
 type VerifierWorker struct {
 	Id            int
 	ReturnContent bool
 	InputQueue    chan VerifierInput
 	OutputQueue   chan VerifierOutput
-	wg            *sync.WaitGroup
+
+	log       *logging.Logger
+	group     *utils.WorkerGroup
+	slots     *utils.Limiter
+	processed *atomic.Int64
+	quit      chan struct{} // Closed to remove the worker after its current item
 }
 
 type Verifier struct {
+	Options       Options
 	ReturnContent bool
 	ThreadCount   int
 	InputQueue    chan VerifierInput
 	OutputQueue   chan VerifierOutput
 	Workers       []*VerifierWorker
-	wg            *sync.WaitGroup
+
+	log       *logging.Logger
+	mu        sync.Mutex // Guards Workers and ThreadCount once started
+	nextID    int
+	group     *utils.WorkerGroup
+	slots     *utils.Limiter
+	processed atomic.Int64
+
+	ctx      context.Context
+	started  bool
+	done     chan struct{} // Closed together with OutputQueue
+	stopOnce sync.Once
 }
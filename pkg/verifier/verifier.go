@@ -5,142 +5,294 @@ import (
 	"SophonClientv2/internal/logging"
 	"SophonClientv2/pkg/utils"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"io"
-	"strconv"
-	"sync"
+	"runtime"
 	"time"
 )
 
-func NewWorker(id int, inputQueue chan VerifierInput, outputQueue chan VerifierOutput, wg *sync.WaitGroup, returnContent bool) *VerifierWorker {
+func (v *Verifier) newWorker() *VerifierWorker {
+	v.nextID++
 	return &VerifierWorker{
-		Id:            id,
-		ReturnContent: returnContent,
-		InputQueue:    inputQueue,
-		OutputQueue:   outputQueue,
-		wg:            wg,
+		Id:            v.nextID - 1,
+		ReturnContent: v.ReturnContent,
+		InputQueue:    v.InputQueue,
+		OutputQueue:   v.OutputQueue,
+		log:           v.log.With(logging.KeyWorker, v.nextID-1),
+		group:         v.group,
+		slots:         v.slots,
+		processed:     &v.processed,
+		quit:          make(chan struct{}),
 	}
 }
 
-func (worker *VerifierWorker) Start() {
-	logging.GlobalLogger.Debug("Started verifier worker " + strconv.Itoa(worker.Id))
+// Start runs the worker until the input is closed, ctx is done or the worker is removed.
+// It returns false if the verifier has already finished.
+func (worker *VerifierWorker) Start(ctx context.Context) bool {
+	if !worker.group.Add() {
+		return false
+	}
+	worker.log.Debug("Started verifier worker")
 
-	worker.wg.Add(1)
 	go func() {
-		defer worker.wg.Done()
-		for input := range worker.InputQueue {
+		defer worker.group.Exit()
+		for {
+			var input VerifierInput
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case <-worker.quit:
+				worker.log.Debug("Removed verifier worker")
+				return
+			case input, ok = <-worker.InputQueue:
+				if !ok {
+					return
+				}
+			}
+			worker.slots.Release()
+			worker.processed.Add(1)
+			content := utils.NewContextReader(ctx, input.Content)
+
 			// Streaming MD5 computation
 			hash := md5.New()
 			if worker.ReturnContent {
 				var buf bytes.Buffer
-				teeReader := io.TeeReader(input.Content, &buf) // for passing content (no consume content)
+				teeReader := io.TeeReader(content, &buf) // for passing content (no consume content)
 				if _, err := io.Copy(hash, teeReader); err != nil {
 					if cerr := input.Content.Close(); cerr != nil {
-						logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Error closing content after read failure: " + cerr.Error())
+						worker.log.Error("Error closing content after read failure", "name", input.Name, "error", cerr)
+					}
+					worker.log.Error("Failed to read content, marking verification as failed", "name", input.Name, "error", err)
+					if !utils.SendContext(ctx, worker.OutputQueue, VerifierOutput{Content: nil, Suceeded: false, Payload: input.Payload}) {
+						return
 					}
-					logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Failed to read content: " + err.Error() + " for " + input.Name)
-					logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Marking verification as failed for " + input.Name)
-					worker.OutputQueue <- VerifierOutput{Content: nil, Suceeded: false, Payload: input.Payload}
 					continue
 				}
 				if cerr := input.Content.Close(); cerr != nil {
-					logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Error closing content after successful read: " + cerr.Error())
+					worker.log.Error("Error closing content after successful read", "name", input.Name, "error", cerr)
 				}
 
 				computedHex := hex.EncodeToString(hash.Sum(nil))
 
 				if computedHex != input.ExpectedMD5 {
-					logging.GlobalLogger.Warn("Worker " + strconv.Itoa(worker.Id) + ": MD5 mismatch - expected " + input.ExpectedMD5 + ", got " + computedHex + " for " + input.Name)
-					worker.OutputQueue <- VerifierOutput{Content: nil, Suceeded: false, Payload: input.Payload}
+					worker.log.Warn("MD5 mismatch", "name", input.Name, "expected", input.ExpectedMD5, "got", computedHex)
+					if !utils.SendContext(ctx, worker.OutputQueue, VerifierOutput{Content: nil, Suceeded: false, Payload: input.Payload}) {
+						return
+					}
 					continue
 				}
 
-				logging.GlobalLogger.Debug("Worker " + strconv.Itoa(worker.Id) + ": MD5 verified successfully for " + input.Name)
-				worker.OutputQueue <- VerifierOutput{Content: io.NopCloser(bytes.NewReader(buf.Bytes())), Suceeded: true, Payload: input.Payload}
+				worker.log.Debug("MD5 verified successfully", "name", input.Name)
+				if !utils.SendContext(ctx, worker.OutputQueue, VerifierOutput{Content: io.NopCloser(bytes.NewReader(buf.Bytes())), Suceeded: true, Payload: input.Payload}) {
+					return
+				}
 			} else {
 				// No copying content to memory (stream to hash)
-				if _, err := io.Copy(hash, input.Content); err != nil {
+				if _, err := io.Copy(hash, content); err != nil {
 					if cerr := input.Content.Close(); cerr != nil {
-						logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Error closing content after read failure: " + cerr.Error())
+						worker.log.Error("Error closing content after read failure", "name", input.Name, "error", cerr)
+					}
+					worker.log.Error("Failed to read content, marking verification as failed", "name", input.Name, "error", err)
+					if !utils.SendContext(ctx, worker.OutputQueue, VerifierOutput{Content: nil, Suceeded: false, Payload: input.Payload}) {
+						return
 					}
-					logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Failed to read content: " + err.Error() + " for " + input.Name)
-					logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Marking verification as failed for " + input.Name)
-					worker.OutputQueue <- VerifierOutput{Content: nil, Suceeded: false, Payload: input.Payload}
 					continue
 				}
 				if cerr := input.Content.Close(); cerr != nil {
-					logging.GlobalLogger.Error("Worker " + strconv.Itoa(worker.Id) + ": Error closing content after successful read: " + cerr.Error())
+					worker.log.Error("Error closing content after successful read", "name", input.Name, "error", cerr)
 				}
 
 				computedHex := hex.EncodeToString(hash.Sum(nil))
 
 				if computedHex != input.ExpectedMD5 {
-					logging.GlobalLogger.Warn("Worker " + strconv.Itoa(worker.Id) + ": MD5 mismatch - expected " + input.ExpectedMD5 + ", got " + computedHex + " for " + input.Name)
-					worker.OutputQueue <- VerifierOutput{Content: nil, Suceeded: false, Payload: input.Payload}
+					worker.log.Warn("MD5 mismatch", "name", input.Name, "expected", input.ExpectedMD5, "got", computedHex)
+					if !utils.SendContext(ctx, worker.OutputQueue, VerifierOutput{Content: nil, Suceeded: false, Payload: input.Payload}) {
+						return
+					}
 					continue
 				}
 
-				logging.GlobalLogger.Debug("Worker " + strconv.Itoa(worker.Id) + ": MD5 verified successfully for " + input.Name)
-				worker.OutputQueue <- VerifierOutput{Content: nil, Suceeded: true, Payload: input.Payload}
+				worker.log.Debug("MD5 verified successfully", "name", input.Name)
+				if !utils.SendContext(ctx, worker.OutputQueue, VerifierOutput{Content: nil, Suceeded: true, Payload: input.Payload}) {
+					return
+				}
 			}
 		}
 	}()
+	return true
 }
 
-func NewVerifier(buffSize int, returnContent bool) *Verifier {
-	logging.GlobalLogger.Info("Initializing Verifier with " + strconv.Itoa(config.Config.CocurrentDownloads) + " workers")
+// DefaultOptions returns the verifier settings of the global configuration.
+// A worker count of 0 means one worker per CPU.
+func DefaultOptions() Options {
+	workers := config.Config.CocurrentHashchecks
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return Options{
+		Workers:        workers,
+		QueueSize:      config.Config.VerifyChanSize,
+		StatusInterval: config.Config.QueueLengthPrintInterval,
+	}
+}
+
+func (o Options) withDefaults() Options {
+	def := DefaultOptions()
+	if o.Workers <= 0 {
+		o.Workers = def.Workers
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = def.QueueSize
+	}
+	if o.MaxQueueSize < o.QueueSize {
+		o.MaxQueueSize = 4 * o.QueueSize // Room for SetQueueSize, unused capacity costs next to nothing
+	}
+	if o.StatusInterval <= 0 {
+		o.StatusInterval = def.StatusInterval
+	}
+	if o.Logger == nil {
+		o.Logger = logging.GlobalLogger
+	}
+	return o
+}
+
+func NewVerifier(opts Options) *Verifier {
+	opts = opts.withDefaults()
+	opts.Logger.Info("Initializing Verifier", "workers", opts.Workers)
 
-	threadCount := config.Config.CocurrentDownloads
-	inputQueue := make(chan VerifierInput, buffSize)
-	outputQueue := make(chan VerifierOutput, buffSize)
-	workers := make([]*VerifierWorker, threadCount)
-	wg := &sync.WaitGroup{}
+	v := &Verifier{
+		Options:       opts,
+		ReturnContent: opts.ReturnContent,
+		InputQueue:    make(chan VerifierInput, max(opts.QueueSize, opts.MaxQueueSize)),
+		OutputQueue:   make(chan VerifierOutput, opts.QueueSize),
+		log:           opts.Logger.With(logging.KeyStage, "verifier"),
+		group:         utils.NewWorkerGroup(),
+		slots:         utils.NewLimiter(opts.QueueSize),
+		ctx:           context.Background(),
+		done:          make(chan struct{}),
+	}
+	v.SetWorkers(opts.Workers)
+	return v
+}
 
-	for i := 0; i < threadCount; i++ {
-		workers[i] = NewWorker(i, inputQueue, outputQueue, wg, returnContent)
-		workers[i].Start()
+// Start launches the workers. OutputQueue is closed once every worker has exited,
+// either because the input was closed or because ctx was cancelled.
+func (v *Verifier) Start(ctx context.Context) {
+	v.mu.Lock()
+	v.ctx = ctx
+	v.started = true
+	for _, worker := range v.Workers {
+		worker.Start(ctx)
 	}
+	v.mu.Unlock()
+	go func() {
+		<-v.group.Done()
+		close(v.OutputQueue)
+		close(v.done)
+	}()
+	v.StartPrintChannelStatus(ctx, v.Options.StatusInterval)
+}
 
-	verifier := &Verifier{
-		ThreadCount:   threadCount,
-		ReturnContent: returnContent,
-		InputQueue:    inputQueue,
-		OutputQueue:   outputQueue,
-		Workers:       workers,
-		wg:            wg,
+// SetWorkers changes the number of workers, also while running. Removed workers finish their
+// current item first. Returns the new worker count.
+func (v *Verifier) SetWorkers(n int) int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for len(v.Workers) < max(1, n) {
+		worker := v.newWorker()
+		if v.started && !worker.Start(v.ctx) {
+			break
+		}
+		v.Workers = append(v.Workers, worker)
+	}
+	for len(v.Workers) > max(1, n) {
+		close(v.Workers[len(v.Workers)-1].quit)
+		v.Workers = v.Workers[:len(v.Workers)-1]
 	}
-	verifier.StartPrintChannelStatus(config.Config.QueueLengthPrintInterval)
-	return verifier
+	v.ThreadCount = len(v.Workers)
+	return v.ThreadCount
 }
 
-func (v *Verifier) StartPrintChannelStatus(intervalSeconds int) {
+func (v *Verifier) WorkerCount() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.ThreadCount
+}
+
+// SetQueueSize changes how many items may wait in the input queue, at most MaxQueueSize.
+// Returns the new queue size.
+func (v *Verifier) SetQueueSize(n int) int {
+	n = min(max(1, n), cap(v.InputQueue))
+	v.slots.SetLimit(n)
+	return n
+}
+
+func (v *Verifier) QueueSize() int {
+	return v.slots.Limit()
+}
+
+func (v *Verifier) QueueLength() int {
+	return len(v.InputQueue)
+}
+
+// Processed returns how many items the workers have taken from the input queue so far.
+func (v *Verifier) Processed() int64 {
+	return v.processed.Load()
+}
+
+func (v *Verifier) StartPrintChannelStatus(ctx context.Context, intervalSeconds int) {
 	go func() {
+		ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
+		defer ticker.Stop()
 		for {
-			if v.wg == nil {
+			v.PrintChannelStatus()
+			select {
+			case <-ctx.Done():
+				return
+			case <-v.done:
 				return
+			case <-ticker.C:
 			}
-			v.PrintChannelStatus()
-			<-time.After(time.Duration(intervalSeconds) * time.Second)
 		}
 	}()
 }
 
 func (v *Verifier) PrintChannelStatus() {
-	logging.GlobalLogger.Debug("Verifier Input Queue Length: " + strconv.Itoa(len(v.InputQueue)) + "/" + strconv.Itoa(cap(v.InputQueue)))
-	logging.GlobalLogger.Debug("Verifier Output Queue Length: " + strconv.Itoa(len(v.OutputQueue)) + "/" + strconv.Itoa(cap(v.OutputQueue)))
+	v.log.Debug("Queue lengths", "input", len(v.InputQueue), "input_size", v.QueueSize(), "output", len(v.OutputQueue), "output_size", cap(v.OutputQueue))
 }
 
+// Stop closes the input for a graceful shutdown and waits until the workers have drained it.
+// After cancellation the input is left open since abandoned enqueues may still reference it.
 func (v *Verifier) Stop() {
-	close(v.InputQueue)
-	v.wg.Wait()
-	v.wg = nil
-	close(v.OutputQueue)
-	logging.GlobalLogger.Info("Verifier stopped")
+	v.stopOnce.Do(func() {
+		if v.ctx.Err() == nil {
+			close(v.InputQueue)
+		}
+		if !v.started {
+			close(v.OutputQueue)
+			close(v.done)
+		}
+	})
+	v.Wait()
+	v.log.Info("Verifier stopped")
+}
+
+// Wait blocks until all workers have exited and OutputQueue is closed.
+func (v *Verifier) Wait() {
+	<-v.done
+}
+
+// Discard releases everything still buffered in the queues of a cancelled verifier, closing open files.
+func (v *Verifier) Discard() {
+	utils.DrainDiscard(v.InputQueue)
+	utils.DrainDiscard(v.OutputQueue)
 }
 
 func (v *Verifier) EnqueueVerification(name string, content io.ReadCloser, expectedMD5 string, payload any) {
-	utils.NonBlockingEnqueue(v.InputQueue, VerifierInput{Name: name, Content: content, ExpectedMD5: expectedMD5, Payload: payload})
+	utils.EnqueueLimited(v.ctx, v.InputQueue, v.slots, VerifierInput{Name: name, Content: content, ExpectedMD5: expectedMD5, Payload: payload})
 }
 
 func (v *Verifier) GetOutputChannel() chan VerifierOutput {
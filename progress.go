@@ -0,0 +1,101 @@
+package main
+
+import (
+	"SophonClientv2/internal/models"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	progressBarWidth = 30
+	// Without a terminal a plain line is printed at this interval instead of redrawing the bar
+	progressLogInterval = 5 * time.Second
+)
+
+// progressBar draws a TaskProgress snapshot on a single, redrawn terminal line.
+type progressBar struct {
+	w        io.Writer
+	tty      bool
+	drawn    bool
+	lastLine time.Time
+	pending  string // Latest line not printed yet because of progressLogInterval
+}
+
+func newProgressBar(f *os.File) *progressBar {
+	bar := &progressBar{w: f}
+	if info, err := f.Stat(); err == nil {
+		bar.tty = info.Mode()&os.ModeCharDevice != 0
+	}
+	return bar
+}
+
+func (b *progressBar) Render(p models.TaskProgress) {
+	line := formatProgress(p)
+	if b.tty {
+		// Pad to overwrite leftovers of a longer previous line
+		fmt.Fprintf(b.w, "\r%-100s", line)
+		b.drawn = true
+		return
+	}
+	b.pending = line
+	if time.Since(b.lastLine) >= progressLogInterval {
+		fmt.Fprintln(b.w, line)
+		b.lastLine = time.Now()
+		b.pending = ""
+	}
+}
+
+// Finish ends the bar line so following output starts on a fresh line.
+func (b *progressBar) Finish() {
+	if b.drawn {
+		fmt.Fprintln(b.w)
+		b.drawn = false
+	}
+	if b.pending != "" {
+		fmt.Fprintln(b.w, b.pending)
+		b.pending = ""
+	}
+}
+
+func formatProgress(p models.TaskProgress) string {
+	filled := int(p.Percent / 100 * progressBarWidth)
+	filled = max(0, min(progressBarWidth, filled))
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+
+	line := fmt.Sprintf("[%s] %5.1f%%", bar, p.Percent)
+	if p.TotalBytes > 0 {
+		line += fmt.Sprintf("  %s/%s  %s/s", formatBytes(p.DownloadedBytes), formatBytes(p.TotalBytes), formatBytes(int64(p.SpeedBytesPerSec)))
+		if p.ETASeconds != nil {
+			line += "  ETA " + formatDuration(*p.ETASeconds)
+		}
+	} else if p.TotalFiles > 0 {
+		line += fmt.Sprintf("  %d/%d files", p.VerifiedFiles, p.TotalFiles)
+	}
+	if p.Paused {
+		line += "  (paused)"
+	}
+	return line
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatDuration(seconds float64) string {
+	return (time.Duration(seconds) * time.Second).Round(time.Second).String()
+}
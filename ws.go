@@ -0,0 +1,354 @@
+package main
+
+import (
+	"SophonClientv2/internal/logging"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/operations"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsSnapshotInterval = 1 * time.Second
+	wsWriteTimeout     = 10 * time.Second
+	wsPongTimeout      = 60 * time.Second
+	wsPingInterval     = wsPongTimeout * 9 / 10
+	wsSendBuffer       = 64
+	wsBulkBuffer       = 64
+	wsEventBuffer      = 256
+	wsLogBuffer        = 1024
+	wsMaxMessageSize   = 64 * 1024
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// wsClient is one connection. Only the write loop touches the socket for writing,
+// everything else hands messages over through the bounded send channels.
+type wsClient struct {
+	conn *websocket.Conn
+	send chan models.WSServerMessage // Events and replies, the client is disconnected when it is full
+	bulk chan models.WSServerMessage // Snapshots and logs, dropped when it is full
+	done chan struct{}
+	once sync.Once
+
+	mu               sync.Mutex
+	subscriptions    map[string]bool
+	logSubscriptions map[string]bool
+	logs             *logging.Subscription // Created by the first subscribe_logs
+}
+
+func newWSMessage(msgType, taskID string, data any) models.WSServerMessage {
+	msg := models.WSServerMessage{
+		Version: models.WSProtocolVersion,
+		Type:    msgType,
+		TaskID:  taskID,
+		Time:    time.Now(),
+	}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			log.Println("Failed to encode websocket payload:", err)
+		} else {
+			msg.Data = raw
+		}
+	}
+	return msg
+}
+
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	client := &wsClient{
+		conn:             conn,
+		send:             make(chan models.WSServerMessage, wsSendBuffer),
+		bulk:             make(chan models.WSServerMessage, wsBulkBuffer),
+		done:             make(chan struct{}),
+		subscriptions:    make(map[string]bool),
+		logSubscriptions: make(map[string]bool),
+	}
+	sub := operations.SubscribeEvents(wsEventBuffer)
+
+	go client.writeLoop()
+	go client.pumpLoop(sub)
+
+	client.trySend(newWSMessage(models.WSHello, "", models.WSHelloData{
+		ProtocolVersion:    models.WSProtocolVersion,
+		SnapshotIntervalMs: wsSnapshotInterval.Milliseconds(),
+	}))
+	client.readLoop()
+
+	client.close()
+	sub.Close()
+	client.mu.Lock()
+	if client.logs != nil {
+		client.logs.Close()
+	}
+	client.mu.Unlock()
+}
+
+func (c *wsClient) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// trySend queues a message without blocking. It returns false if the client is not keeping up.
+func (c *wsClient) trySend(msg models.WSServerMessage) bool {
+	return c.queue(c.send, msg)
+}
+
+// tryBulk queues a snapshot or log record, which cannot take the room events need.
+func (c *wsClient) tryBulk(msg models.WSServerMessage) bool {
+	return c.queue(c.bulk, msg)
+}
+
+func (c *wsClient) queue(ch chan models.WSServerMessage, msg models.WSServerMessage) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case ch <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *wsClient) isSubscribed(taskID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscriptions[models.WSAllTasks] || c.subscriptions[taskID]
+}
+
+// subscribedTasks resolves the wildcard subscription into the currently known task IDs.
+func (c *wsClient) subscribedTasks() []string {
+	c.mu.Lock()
+	all := c.subscriptions[models.WSAllTasks]
+	ids := make([]string, 0, len(c.subscriptions))
+	for id := range c.subscriptions {
+		if id != models.WSAllTasks {
+			ids = append(ids, id)
+		}
+	}
+	c.mu.Unlock()
+
+	if !all {
+		return ids
+	}
+	tasks := operations.ListTasks()
+	ids = ids[:0]
+	for _, t := range tasks {
+		ids = append(ids, t.TaskID)
+	}
+	return ids
+}
+
+func (c *wsClient) readLoop() {
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		var msg models.WSClientMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("Websocket read error:", err)
+			}
+			return
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+
+		switch msg.Type {
+		case models.WSSubscribe:
+			c.mu.Lock()
+			for _, id := range msg.TaskIDs {
+				c.subscriptions[id] = true
+			}
+			c.mu.Unlock()
+			c.trySend(newWSMessage(models.WSSubscribed, "", models.WSSubscriptionData{TaskIDs: msg.TaskIDs}))
+			// Send an immediate snapshot so clients do not wait a full interval
+			for _, id := range msg.TaskIDs {
+				if id == models.WSAllTasks {
+					c.sendSnapshots()
+					break
+				}
+				c.sendSnapshot(id)
+			}
+		case models.WSUnsubscribe:
+			c.mu.Lock()
+			for _, id := range msg.TaskIDs {
+				delete(c.subscriptions, id)
+			}
+			c.mu.Unlock()
+			c.trySend(newWSMessage(models.WSUnsubscribed, "", models.WSSubscriptionData{TaskIDs: msg.TaskIDs}))
+		case models.WSSubscribeLogs:
+			c.mu.Lock()
+			for _, id := range msg.TaskIDs {
+				c.logSubscriptions[id] = true
+			}
+			logs := c.logs
+			if logs == nil {
+				logs = logging.Subscribe("", wsLogBuffer)
+				c.logs = logs
+				go c.logLoop(logs)
+			}
+			c.mu.Unlock()
+			c.trySend(newWSMessage(models.WSLogsSubscribed, "", models.WSSubscriptionData{TaskIDs: msg.TaskIDs}))
+		case models.WSUnsubscribeLogs:
+			c.mu.Lock()
+			for _, id := range msg.TaskIDs {
+				delete(c.logSubscriptions, id)
+			}
+			c.mu.Unlock()
+			c.trySend(newWSMessage(models.WSLogsUnsubscribed, "", models.WSSubscriptionData{TaskIDs: msg.TaskIDs}))
+		case models.WSPing:
+			c.trySend(newWSMessage(models.WSPong, "", nil))
+		case models.WSPause, models.WSResume:
+			// Success is reported through the paused/resumed lifecycle events
+			for _, id := range msg.TaskIDs {
+				var err error
+				if msg.Type == models.WSPause {
+					_, err = operations.PauseTask(id)
+				} else {
+					_, err = operations.ResumeTask(id)
+				}
+				if err != nil {
+					c.trySend(newWSMessage(models.WSError, id, models.WSErrorData{Error: err.Error()}))
+				}
+			}
+		default:
+			c.trySend(newWSMessage(models.WSError, "", models.WSErrorData{Error: "unknown message type: " + msg.Type}))
+		}
+	}
+}
+
+func (c *wsClient) sendSnapshot(taskID string) {
+	progress, ok := operations.GetTaskProgress(taskID)
+	if !ok {
+		return
+	}
+	// Dropping a snapshot is fine, the next tick carries fresher data anyway
+	c.tryBulk(newWSMessage(models.WSProgress, taskID, progress))
+}
+
+func (c *wsClient) sendSnapshots() {
+	for _, id := range c.subscribedTasks() {
+		c.sendSnapshot(id)
+	}
+}
+
+func (c *wsClient) isLogSubscribed(taskID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.logSubscriptions[models.WSAllTasks] || c.logSubscriptions[taskID]
+}
+
+// logLoop forwards log records of subscribed tasks. Unlike events they are dropped when the client
+// falls behind, a busy pipeline logs far more than a slow connection can take.
+func (c *wsClient) logLoop(logs *logging.Subscription) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case entry, ok := <-logs.C:
+			if !ok {
+				return
+			}
+			if c.isLogSubscribed(entry.TaskID) {
+				c.tryBulk(newWSMessage(models.WSLog, entry.TaskID, entry))
+			}
+		}
+	}
+}
+
+// pumpLoop forwards lifecycle events and periodic progress snapshots for subscribed tasks.
+func (c *wsClient) pumpLoop(sub *operations.EventSubscription) {
+	ticker := time.NewTicker(wsSnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case ev, ok := <-sub.C:
+			if !ok {
+				// The bus closes subscriptions that could not take an event
+				if sub.Dropped() > 0 {
+					log.Println("Websocket client too slow for lifecycle events, dropping connection")
+					c.close()
+				}
+				return
+			}
+			if !c.isSubscribed(ev.TaskID) {
+				continue
+			}
+			// Events must not be lost silently, disconnect consumers that cannot keep up
+			if !c.trySend(newWSMessage(models.WSEvent, ev.TaskID, ev)) {
+				log.Println("Websocket client too slow, dropping connection")
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			c.sendSnapshots()
+		}
+	}
+}
+
+func (c *wsClient) write(msg models.WSServerMessage) bool {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := c.conn.WriteJSON(msg); err != nil {
+		log.Println("Websocket write error:", err)
+		return false
+	}
+	return true
+}
+
+func (c *wsClient) writeLoop() {
+	pingTicker := time.NewTicker(wsPingInterval)
+	defer pingTicker.Stop()
+	defer c.close()
+
+	for {
+		select {
+		case <-c.done:
+			_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteTimeout))
+			return
+		case msg := <-c.send:
+			if !c.write(msg) {
+				return
+			}
+		case msg := <-c.bulk:
+			// Events go first, a steady stream of logs must not hold them back
+			for len(c.send) > 0 {
+				if !c.write(<-c.send) {
+					return
+				}
+			}
+			if !c.write(msg) {
+				return
+			}
+		case <-pingTicker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
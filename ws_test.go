@@ -0,0 +1,134 @@
+package main
+
+import (
+	"SophonClientv2/internal/fakesophon"
+	"SophonClientv2/internal/models"
+	"SophonClientv2/pkg/operations"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startFakeGame serves a small game of many chunks from a fake Sophon server for the duration of the test.
+func startFakeGame(t *testing.T) {
+	t.Helper()
+	srv := fakesophon.NewServer()
+	restore := srv.UseAsDefault()
+	t.Cleanup(func() {
+		restore()
+		srv.Close()
+	})
+	srv.ChunkSize = 1024 // Plenty of log records per install
+	r := rand.New(rand.NewSource(1))
+	files := make(map[string][]byte)
+	for _, name := range []string{"GenshinImpact.exe", "GenshinImpact_Data/data.unity3d", "GenshinImpact_Data/StreamingAssets/a.blk"} {
+		data := make([]byte, 128<<10+r.Intn(4096))
+		r.Read(data)
+		files[name] = data
+	}
+	if err := srv.SetGame("hk4e", "os", "5.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWSLogsDoNotCrowdOutEvents subscribes to the logs and events of an install through a client
+// that reads nothing until the task is done, over small socket buffers. Logs are dropped, but
+// the connection stays up and the completed event arrives.
+func TestWSLogsDoNotCrowdOutEvents(t *testing.T) {
+	startFakeGame(t)
+	// Small socket buffers on both ends, so the server cannot hide the slow client in the kernel
+	var client *net.TCPConn
+	servers := make(chan *net.TCPConn, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(wsHandler))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conn.(*net.TCPConn).SetWriteBuffer(4096)
+			servers <- conn.(*net.TCPConn)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	dialer := *websocket.DefaultDialer
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err == nil {
+			client = conn.(*net.TCPConn)
+			err = client.SetReadBuffer(4096)
+		}
+		return conn, err
+	}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, msgType := range []string{models.WSSubscribe, models.WSSubscribeLogs} {
+		if err := conn.WriteJSON(models.WSClientMessage{Type: msgType, TaskIDs: []string{models.WSAllTasks}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Subscriptions are confirmed before the task starts, so its first records are not missed
+	for confirmed := 0; confirmed < 2; {
+		var msg models.WSServerMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == models.WSSubscribed || msg.Type == models.WSLogsSubscribed {
+			confirmed++
+		}
+	}
+
+	resp := operations.PerformInstall(models.InstallRequest{
+		GameOperationRequest: models.GameOperationRequest{GameDir: t.TempDir(), GameType: "hk4e"},
+		InstallRelType:       "os",
+	})
+	if resp.TaskID == "" {
+		t.Fatalf("task was not started: %+v", resp)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if _, err := operations.WaitTask(ctx, resp.TaskID); err != nil {
+		t.Fatal(err)
+	}
+	(<-servers).SetWriteBuffer(1 << 20)
+	client.SetReadBuffer(1 << 20)
+
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	logs := 0
+	for {
+		var msg models.WSServerMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("connection lost after %d log records: %v", logs, err)
+		}
+		if msg.TaskID != resp.TaskID {
+			continue
+		}
+		switch msg.Type {
+		case models.WSLog:
+			logs++
+		case models.WSEvent:
+			var ev models.TaskEvent
+			if err := json.Unmarshal(msg.Data, &ev); err != nil {
+				t.Fatal(err)
+			}
+			switch ev.Event {
+			case operations.EventCompleted:
+				if logs == 0 {
+					t.Error("no log records received")
+				}
+				return
+			case operations.EventFailed, operations.EventCancelled:
+				t.Fatalf("task ended %s", ev.Event)
+			}
+		}
+	}
+}